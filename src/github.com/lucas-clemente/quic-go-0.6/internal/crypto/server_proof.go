@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -35,6 +36,8 @@ func signServerProof(cert *tls.Certificate, chlo []byte, serverConfigData []byte
 
 	if _, ok = key.(*rsa.PrivateKey); ok {
 		opts = &rsa.PSSOptions{SaltLength: 32, Hash: crypto.SHA256}
+	} else if _, ok = key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0) // Ed25519 signs the hash itself as message
 	}
 
 	return key.Sign(rand.Reader, hash.Sum(nil), opts)
@@ -56,6 +59,11 @@ func verifyServerProof(proof []byte, cert *x509.Certificate, chlo []byte, server
 		return err == nil
 	}
 
+	// Ed25519
+	if cert.PublicKeyAlgorithm == x509.Ed25519 {
+		return ed25519.Verify(cert.PublicKey.(ed25519.PublicKey), hash.Sum(nil), proof)
+	}
+
 	// ECDSA
 	signature := &ecdsaSignature{}
 	rest, err := asn1.Unmarshal(proof, signature)
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"github.com/alexflint/go-arg"
+	"io/ioutil"
+	"os"
+	"quic_utils"
+	"strings"
+)
+
+// ================== configuration, parsing from command line ==================
+
+type cli_config struct {
+	Type        string  `arg:"-t" help:"type of the generated key: rsa, ecdsa or ed25519 (default=ed25519)"`
+	Bits        int     `arg:"-b" help:"size of the generated RSA key in bits (default=2048)"`
+	File        string  `arg:"-f" help:"key file (default=id_TYPE for a generated key, whose public key is written in FILE.pub)"`
+	Passphrase  *string `arg:"-N" help:"passphrase of the written private key, empty for no encryption (default=asked on the terminal)"`
+	Format      string  `arg:"-m" help:"format of the written key: pem, pkcs8 or openssh for private keys, pem, pkix, openssh or line for public keys (default=pem)"`
+	Fingerprint bool    `arg:"-l" help:"show the SHA-256 fingerprint of the key in FILE (public or private key)"`
+	Visual      bool    `arg:"-v" help:"also show the randomart of the fingerprint"`
+	Export      bool    `arg:"-e" help:"print the public key of the key in FILE (public or private key) in the format -m"`
+	Host        string  `arg:"-H" help:"with -e -m line, print the line of HOST (hostnames and/or IP addresses, comma separated) for the known hosts file"`
+	Convert     bool    `arg:"-p" help:"rewrite the private key in FILE in the format -m, with the passphrase -N"`
+	Force       bool    `help:"overwrite existing key files"`
+}
+
+func main() {
+	conf := cli_config{}
+	p := arg.MustParse(&conf)
+	if conf.Type == "" {
+		conf.Type = "ed25519"
+	}
+	if conf.Format == "" {
+		conf.Format = "pem"
+	}
+
+	var err error
+	switch {
+	case conf.Fingerprint:
+		err = showFingerprint(&conf)
+	case conf.Export:
+		err = exportPublicKey(&conf)
+	case conf.Convert:
+		err = convertPrivateKey(&conf)
+	default:
+		err = generateKeyPair(&conf)
+	}
+	if err != nil {
+		p.Fail(err.Error())
+	}
+}
+
+/////// generation ///////
+
+/*
+ * generate a key pair: the private key is written in FILE (in the format -m, encrypted if a
+ * passphrase is given) and the public key in FILE.pub (in the format read by quic_utils).
+ */
+func generateKeyPair(conf *cli_config) error {
+	if conf.File == "" {
+		conf.File = "id_" + conf.Type
+	}
+	if !conf.Force {
+		for _, file := range []string{conf.File, conf.File + ".pub"} {
+			if _, err := os.Stat(file); err == nil {
+				return fmt.Errorf("'%s' already exists (use --force to overwrite)", file)
+			}
+		}
+	}
+
+	fmt.Printf("Generating %s key pair.\n", conf.Type)
+	key, err := quic_utils.GenerateKey(conf.Type, conf.Bits)
+	if err != nil {
+		return err
+	}
+	passphrase, err := newPassphrase(conf)
+	if err != nil {
+		return err
+	}
+	if err := writePrivateKey(conf.File, key, conf.Format, passphrase); err != nil {
+		return err
+	}
+	publicKey, err := quic_utils.FormatPublicKey(key.Public(), "pem")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.File+".pub", publicKey, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key saved in '%s'.\nPublic key saved in '%s'.\n", conf.File, conf.File+".pub")
+	fmt.Println("The key fingerprint is:")
+	conf.Visual = true
+	return printFingerprint(key.Public(), conf.File+".pub", conf)
+}
+
+/////// inspection ///////
+
+// print the fingerprint of the key in FILE (and its randomart with -v)
+func showFingerprint(conf *cli_config) error {
+	key, err := readPublicKey(conf.File)
+	if err != nil {
+		return err
+	}
+	return printFingerprint(key, conf.File, conf)
+}
+
+// "BITS SHA256:... FILE (TYPE)", as ssh-keygen -l
+func printFingerprint(key crypto.PublicKey, file string, conf *cli_config) error {
+	fingerprint, err := quic_utils.Fingerprint(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d %s %s (%s)\n", quic_utils.KeyBits(key), fingerprint, file, strings.ToUpper(quic_utils.KeyType(key)))
+	if conf.Visual {
+		art, err := quic_utils.Randomart(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(art)
+	}
+	return nil
+}
+
+/////// conversion ///////
+
+// print the public key of the key in FILE in the format -m (prefixed by -H for a known hosts line)
+func exportPublicKey(conf *cli_config) error {
+	key, err := readPublicKey(conf.File)
+	if err != nil {
+		return err
+	}
+	data, err := quic_utils.FormatPublicKey(key, conf.Format)
+	if err != nil {
+		return err
+	}
+	if conf.Host != "" {
+		if conf.Format != "line" {
+			return fmt.Errorf("-H is only used with the format 'line'")
+		}
+		data = append([]byte(conf.Host+" "), data...)
+	}
+	os.Stdout.Write(data)
+	return nil
+}
+
+// rewrite the private key in FILE in the format -m with a new passphrase
+func convertPrivateKey(conf *cli_config) error {
+	if conf.File == "" {
+		return fmt.Errorf("the key file must be given with -f")
+	}
+	key, err := quic_utils.ExtractPrivateKeyWithPassphrase(conf.File, func(keyFile string) ([]byte, error) {
+		return quic_utils.PromptPassphrase(fmt.Sprintf("Enter old passphrase for key '%s': ", keyFile))
+	})
+	if err != nil {
+		return err
+	}
+	passphrase, err := newPassphrase(conf)
+	if err != nil {
+		return err
+	}
+	if err := writePrivateKey(conf.File, key, conf.Format, passphrase); err != nil {
+		return err
+	}
+	fmt.Printf("Private key saved in '%s'.\n", conf.File)
+	return nil
+}
+
+/////// files ///////
+
+// public key of a public or private key file (the passphrase of an encrypted private key is asked)
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	if file == "" {
+		return nil, fmt.Errorf("the key file must be given with -f")
+	}
+	if key, err := quic_utils.ExtractPublicKey(file); err == nil {
+		return key, nil
+	}
+	key, err := quic_utils.ExtractPrivateKey(file)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a valid public or private key file: %s", file, err)
+	}
+	return key.Public(), nil
+}
+
+func writePrivateKey(file string, key crypto.Signer, format string, passphrase []byte) error {
+	block, err := quic_utils.FormatPrivateKey(key, format, passphrase)
+	if err != nil {
+		return err
+	}
+	return quic_utils.WritePrivateKeyBlock(file, block)
+}
+
+// passphrase of the written private key: -N if given, otherwise asked twice on the terminal
+func newPassphrase(conf *cli_config) ([]byte, error) {
+	if conf.Passphrase != nil {
+		return []byte(*conf.Passphrase), nil
+	}
+	passphrase, err := quic_utils.PromptPassphrase("Enter passphrase (empty for no passphrase): ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := quic_utils.PromptPassphrase("Enter same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
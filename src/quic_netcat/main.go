@@ -10,9 +10,7 @@ import (
 	"quic_utils"
 	"errors"
 	"crypto/tls"
-	"crypto/rsa"
 	"github.com/alexflint/go-arg"
-	"time"
 )
 
 // ================== configuration, parsing from command line ==================
@@ -23,7 +21,7 @@ type cli_config struct {
 	Host    string `arg:"positional" help:"host to contact"`
 	Port    int    `arg:"positional, required" help:"port to connect or listen"`
 	PubKey  string `arg:"--pub" help:"server public key"`
-	PrivKey string `arg:"--priv" help:"server private key"`
+	PrivKey string `arg:"--priv" help:"server private key (client: uses the agent of QUIC_SSH_AUTH_SOCK if empty)"`
 	ReqKey  string `arg:"--req" help:"remote host public key"`
 	BufSize int    `arg:"-b" help:"internal buffer size (default=200000)"`
 }
@@ -71,7 +69,7 @@ func runServer(conf *cli_config) error {
 	debug(conf, "stream accepted")
 
 	if conf.ReqKey != "" {
-		receivedKey, _ := quic_utils.AskClientPublicKey(stream)
+		receivedKey, _ := quic_utils.AskClientPublicKey(session, stream)
 		debug(conf, "key received")
 
 		requiredClientKey, _ := quic_utils.ExtractPublicKey(conf.ReqKey)
@@ -104,7 +102,7 @@ func runClient(conf *cli_config) error {
 		quic_utils.Check(err)
 		debug(conf, "server key received")
 
-		if !quic_utils.ComparePublicKeys(cert.PublicKey.(*rsa.PublicKey), requiredServerKey) {
+		if !quic_utils.ComparePublicKeys(cert.PublicKey, requiredServerKey) {
 			session.Close(errors.New("server public key refused"))
 			return errors.New("server public key refused")
 		} else {
@@ -119,10 +117,20 @@ func runClient(conf *cli_config) error {
 	if conf.ReqKey != "" {
 		publicKey, err := quic_utils.ExtractPublicKey(conf.PubKey)
 		quic_utils.Check(err)
-		privateKey, err := quic_utils.ExtractPrivateKey(conf.PrivKey)
-		quic_utils.Check(err)
+		var signer quic_utils.Signer
+		if conf.PrivKey != "" {
+			privateKey, err := quic_utils.ExtractPrivateKey(conf.PrivKey)
+			quic_utils.Check(err)
+			signer = quic_utils.PrivateKeySigner{Key: privateKey}
+		} else {
+			agent, err := quic_utils.DialAgent(os.Getenv(quic_utils.AgentSocketEnv))
+			quic_utils.Check(err)
+			defer agent.Close()
+			signer = agent
+			debug(conf, "agent contacted")
+		}
 
-		quic_utils.ServeClientPublicKey(stream, privateKey, publicKey)
+		quic_utils.Check(quic_utils.ServeClientPublicKeyWithSigner(session, stream, signer, publicKey))
 		debug(conf, "client key served")
 	}
 
@@ -0,0 +1,46 @@
+package quicssh
+
+import (
+	"quic_utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("16")
+}
+
+func TestAdmission(t *testing.T) {
+	port := 41136
+	authorizedKeys := directory + "authorized_hosts_server_admission"
+	writeFile(authorizedKeys, `from="10.0.0.1" `+dummyClientPublicKeyInline+"\n")
+	confServer := SSHConfig{authorizedPublicKeysFile: authorizedKeys, maxAuthFailures: 2, loginGraceTime: time.Second}
+	go launchServerWithResult(port, &confServer)
+
+	// a session not authenticated in time is closed, and counted as a failure
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client"}
+	sshClient := newTestClient(conf)
+	select {
+	case <-sshClient.session.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not closed after LoginGraceTime")
+	}
+
+	// the second failure bans the address
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "refused"}}
+	sshClient = newTestClient(conf)
+	quic_utils.ServeClientPublicKeyWithSigner(sshClient.session, sshClient.firstStream, sshClient.signer, sshClient.publicKey)
+	err := sshClient.setServerMode()
+	checkValueBoolean("'key refused'", true, err != nil && strings.Contains(err.Error(), "public key not allowed"), t)
+
+	// the sessions of a banned address are refused before their authentication
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "banned"}}
+	sshClient = newTestClient(conf)
+	quic_utils.ServeClientPublicKeyWithSigner(sshClient.session, sshClient.firstStream, sshClient.signer, sshClient.publicKey)
+	err = sshClient.setServerMode()
+	checkValueBoolean("'address banned'", true, err != nil && strings.Contains(err.Error(), quic_utils.ErrSourceBanned.Error()), t)
+}
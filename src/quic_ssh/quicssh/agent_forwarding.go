@@ -0,0 +1,136 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"quic_utils"
+	"sync"
+)
+
+// first byte of the streams opened by the server for the connections to the forwarded agent (see port_forwarding_control.go)
+const AGENT_STREAM = 0x06
+
+/////////////////
+// server part //
+/////////////////
+
+// Unix socket given to the session of a client launched with -A. Its connections are forwarded to the client.
+type agentForwarding struct {
+	dir      string // private directory of the socket
+	path     string
+	listener net.Listener
+	mutex    sync.Mutex
+	session  quic.Session // session of the client (replaced when a persistent session is reattached, nil if detached)
+}
+
+/*
+ * listen on a new Unix socket (in a directory only reachable by the user) and forward each connection
+ * accepted on it to the client, on a new stream.
+ */
+func startAgentForwarding(session quic.Session, account *userAccount) (*agentForwarding, error) {
+	dir, err := ioutil.TempDir("", "quic_ssh-agent-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if os.Getuid() == 0 {
+		os.Chown(dir, int(account.uid), int(account.gid))
+		os.Chown(path, int(account.uid), int(account.gid))
+	}
+	forwarding := &agentForwarding{dir: dir, path: path, listener: listener, session: session}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				session := forwarding.currentSession()
+				if session == nil {
+					conn.Close()
+					return
+				}
+				stream, err := session.OpenStreamSync()
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if _, err = stream.Write([]byte{AGENT_STREAM}); err != nil {
+					conn.Close()
+					stream.Close()
+					return
+				}
+				pipeAgentConnection(conn, stream)
+			}()
+		}
+	}()
+	return forwarding, nil
+}
+
+// forward the next connections to another client (nil to refuse them)
+func (forwarding *agentForwarding) setSession(session quic.Session) {
+	forwarding.mutex.Lock()
+	defer forwarding.mutex.Unlock()
+	forwarding.session = session
+}
+
+func (forwarding *agentForwarding) currentSession() quic.Session {
+	forwarding.mutex.Lock()
+	defer forwarding.mutex.Unlock()
+	return forwarding.session
+}
+
+// environment variable given to the shell (or the command) of the user
+func (forwarding *agentForwarding) env() string {
+	return quic_utils.AgentSocketEnv + "=" + forwarding.path
+}
+
+// stop listening and remove the socket
+func (forwarding *agentForwarding) stop() {
+	forwarding.listener.Close()
+	os.RemoveAll(forwarding.dir)
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// forward a stream opened by the server to our agent (only if agent forwarding was requested with -A)
+func serveForwardedAgent(conf *SSHConfig, stream quic.Stream) {
+	if conf.listen || !conf.forwardAgent || conf.agentSocket == "" {
+		stream.Close()
+		return
+	}
+	conn, err := net.Dial("unix", conf.agentSocket)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	pipeAgentConnection(conn, stream)
+}
+
+// send and receive data from agent connection/QUIC stream to QUIC stream/agent connection
+func pipeAgentConnection(conn net.Conn, stream quic.Stream) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(stream, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, stream)
+		done <- true
+	}()
+	<-done
+	conn.Close()
+	stream.Close()
+}
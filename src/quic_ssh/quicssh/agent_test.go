@@ -0,0 +1,77 @@
+package quicssh
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"quic_utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("9")
+}
+
+// start an agent holding the private key of the client
+func launchAgent(t *testing.T) string {
+	privateKey, err := quic_utils.ExtractPrivateKey(directory + "pr_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := directory + "agent.sock"
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go quic_utils.NewAgent([]crypto.Signer{privateKey}).Serve(listener)
+	return socket
+}
+
+func TestAgent(t *testing.T) {
+	port := 41122
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+	socket := launchAgent(t)
+
+	// the authentication is signed by the agent (no private key given)
+	conf := SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, agentSocket: socket, remoteCommand: []string{"echo", "ok"}}
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "ok\n", conf.testOutput(), t)
+	checkValueInt("exit status", 0, sshClient.exitStatus, t)
+
+	// with -A, the command reaches our agent through the socket given in QUIC_SSH_AUTH_SOCK
+	conf = SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, agentSocket: socket, forwardAgent: true,
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "$QUIC_SSH_AUTH_SOCK;", "sleep", "3"}}
+	sshClient = newTestClient(&conf)
+	done := make(chan bool)
+	go func() {
+		sshClient.Run(context.Background())
+		close(done)
+	}()
+	remoteSocket := ""
+	for i := 0; i < 20 && remoteSocket == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+		remoteSocket = strings.TrimSpace(conf.testOutput())
+	}
+	checkValueBoolean("'forwarded socket given'", true, remoteSocket != "" && remoteSocket != socket, t)
+	agent, err := quic_utils.DialAgent(remoteSocket)
+	checkValueBoolean("'forwarded agent reached'", true, err == nil, t)
+	if err == nil {
+		keys, err := agent.ListKeys()
+		checkValueBoolean("'keys listed'", true, err == nil && len(keys) == 1, t)
+		publicKey, _ := quic_utils.ExtractPublicKey(directory + "pk_client")
+		signature, err := agent.SignChallenge(publicKey, []byte("challenge"))
+		checkValueBoolean("'challenge signed'", true, err == nil && quic_utils.VerifySignature(publicKey, []byte("challenge"), signature) == nil, t)
+
+		// keys not held by the agent are refused
+		serverKey, _ := quic_utils.ExtractPublicKey(directory + "pk_server")
+		_, err = agent.SignChallenge(serverKey, []byte("challenge"))
+		checkValueBoolean("'unknown key refused'", true, err != nil, t)
+		agent.Close()
+	}
+	<-done
+	checkValueInt("exit status", 0, sshClient.exitStatus, t)
+}
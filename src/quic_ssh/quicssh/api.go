@@ -0,0 +1,299 @@
+/*
+ * Package quicssh is the client and the server of quic_ssh (remote logins, remote commands, port
+ * forwardings and file copies over QUIC). The quic_ssh command only calls Main: another program
+ * creates a Client or a Server, configured by options, and runs it until its context is done.
+ *
+ *	server, err := quicssh.NewServer(quicssh.WithKeys("pr_server", ""), quicssh.WithListenAddresses("127.0.0.1:4242"))
+ *	go server.Run(ctx)
+ *
+ *	client, err := quicssh.NewClient(ctx, "127.0.0.1", 4242, quicssh.WithKeys("pr_client", "pub_client"),
+ *		quicssh.WithCommand("uname", "-a"), quicssh.WithTerminal(nil, &output, nil))
+ *	err = client.Run(ctx) // client.ExitStatus() is the exit status of uname
+ *
+ * The terminal of the client (and the messages of the client or the server) are the standard input,
+ * output and error of the process unless WithTerminal is given. Signals are only handled by Main.
+ */
+package quicssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Option configures a Client (see NewClient) or a Server (see NewServer)
+type Option func(conf *SSHConfig) error
+
+// private key file, and public key file (the public key of a server is derived from its private key if "").
+// Without this option, a client signs with the agent of QUIC_SSH_AUTH_SOCK.
+func WithKeys(privateKeyFile string, publicKeyFile string) Option {
+	return func(conf *SSHConfig) error {
+		conf.privKeyFile = privateKeyFile
+		conf.pubKeyFile = publicKeyFile
+		return nil
+	}
+}
+
+// known hosts file of a client (the key of the server is not checked without it)
+func WithKnownHosts(file string) Option {
+	return func(conf *SSHConfig) error {
+		conf.authorizedPublicKeysFile = file
+		return nil
+	}
+}
+
+// authorized keys file of a server (any client is accepted without it)
+func WithAuthorizedKeys(file string) Option {
+	return func(conf *SSHConfig) error {
+		conf.authorizedPublicKeysFile = file
+		return nil
+	}
+}
+
+// terminal of a client, and output of the messages of a client or a server. A nil reader or writer keeps
+// the standard input, output or error of the process. The input is only put in raw mode if it is a terminal.
+func WithTerminal(in io.Reader, out io.Writer, errOut io.Writer) Option {
+	return func(conf *SSHConfig) error {
+		conf.stdin, conf.stdout, conf.stderr = in, out, errOut
+		return nil
+	}
+}
+
+// messages printed: "quiet" (only the errors), "info" or "debug" (by default, as the command line)
+func WithLogLevel(level string) Option {
+	return func(conf *SSHConfig) error {
+		printLevel, found := printLevelNames[strings.ToLower(level)]
+		if !found {
+			return errors.New(fmt.Sprintf("unknown log level '%s' (quiet, info or debug)", level))
+		}
+		conf.printLevel = printLevel
+		return nil
+	}
+}
+
+// internal buffer size (-b)
+func WithBufferSize(size int) Option {
+	return func(conf *SSHConfig) error {
+		if size <= 0 {
+			return errors.New("Buffer size not correct. Should be a positive integer.")
+		}
+		conf.bufSize = size
+		return nil
+	}
+}
+
+////////////////////
+// client options //
+////////////////////
+
+// remote user to log in as (--user, the local user by default)
+func WithUser(username string) Option {
+	return func(conf *SSHConfig) error {
+		conf.username = username
+		return nil
+	}
+}
+
+// command executed on the server instead of the remote login (after "--" on the command line)
+func WithCommand(args ...string) Option {
+	return func(conf *SSHConfig) error {
+		if len(args) == 0 {
+			return errors.New("No command given")
+		}
+		conf.remoteCommand = append([]string{}, args...)
+		return nil
+	}
+}
+
+// local port forwarding (-L [bindAddress:]localPort:hostname:remotePort[/udp])
+func WithLocalForward(spec string) Option {
+	return func(conf *SSHConfig) error {
+		conf.localPortForwarding = true
+		return conf.addForwardingOption(parseForwardingArgument(spec, true))
+	}
+}
+
+// remote port forwarding (-R [bindAddress:]remotePort:hostname:localPort[/udp])
+func WithRemoteForward(spec string) Option {
+	return func(conf *SSHConfig) error {
+		conf.remotePortForwarding = true
+		return conf.addForwardingOption(parseForwardingArgument(spec, false))
+	}
+}
+
+// dynamic port forwarding (-D [bindAddress:]port)
+func WithDynamicForward(spec string) Option {
+	return func(conf *SSHConfig) error {
+		conf.localPortForwarding = true
+		return conf.addForwardingOption(parseDynamicForwardingArgument(spec))
+	}
+}
+
+func (conf *SSHConfig) addForwardingOption(err error, request portForwardingRequest) error {
+	if err != nil {
+		return err
+	}
+	conf.forwards = append(conf.forwards, request)
+	return nil
+}
+
+// only forward ports (-N): the session lasts until the context of Run is done
+func WithOnlyForwarding() Option {
+	return func(conf *SSHConfig) error {
+		conf.onlyForwardPort = true
+		return nil
+	}
+}
+
+// contact the server through jump hosts (-J [user@]host:port[,[user@]host:port...]), in the order given
+func WithJumpHosts(spec string) Option {
+	return func(conf *SSHConfig) error {
+		err, hosts := parseJumpHosts(spec)
+		if err != nil {
+			return err
+		}
+		conf.jumpHosts = append(conf.jumpHosts, hosts...)
+		return nil
+	}
+}
+
+// forward the agent of QUIC_SSH_AUTH_SOCK to the remote login or the remote command (-A)
+func WithAgentForwarding() Option {
+	return func(conf *SSHConfig) error {
+		conf.forwardAgent = true
+		return nil
+	}
+}
+
+// environment variables sent to the server, with '*' wildcards (--send-env, LANG and LC_* by default)
+func WithSendEnv(patterns ...string) Option {
+	return func(conf *SSHConfig) error {
+		conf.sendEnv = append(conf.sendEnv, patterns...)
+		return nil
+	}
+}
+
+////////////////////
+// server options //
+////////////////////
+
+// configuration file of the server (-f, see config_server), read before the other options
+func WithConfigFile(file string) Option {
+	return func(conf *SSHConfig) error {
+		conf.configFile = file
+		return nil
+	}
+}
+
+// addresses "host:port" listened by the server (ListenAddress)
+func WithListenAddresses(addresses ...string) Option {
+	return func(conf *SSHConfig) error {
+		conf.addresses = append(conf.addresses, addresses...)
+		return nil
+	}
+}
+
+// any keyword of the configuration file of the server, as WithServerOption("AllowModes", "login", "exec")
+func WithServerOption(keyword string, args ...string) Option {
+	return func(conf *SSHConfig) error {
+		if len(args) == 0 {
+			return errors.New(fmt.Sprintf("missing argument for '%s'", keyword))
+		}
+		return conf.parseServerConfigLine(strings.ToLower(keyword), args)
+	}
+}
+
+func (conf *SSHConfig) applyOptions(options []Option) error {
+	for _, option := range options {
+		if err := option(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file of WithConfigFile, "" if none (as configFileArgument, the file is read before the other options)
+func configFileOption(options []Option) string {
+	conf := &SSHConfig{}
+	for _, option := range options {
+		option(conf) // the invalid options are reported once the file is read
+	}
+	return conf.configFile
+}
+
+////////////
+// client //
+////////////
+
+/*
+ * open a session with the server hostname:port and check its key (known hosts). The client is not
+ * authenticated yet: this is done by Run. Returns ctx.Err() if ctx is done before the handshake ends.
+ */
+func NewClient(ctx context.Context, hostname string, port int, options ...Option) (*Client, error) {
+	conf := &SSHConfig{hostname: hostname, port: port, options: options}
+	conf.setDefaults()
+	if err := conf.applyOptions(options); err != nil {
+		return nil, err
+	}
+	if conf.onlyForwardPort && len(conf.forwards) == 0 {
+		return nil, errors.New("Only forwarding ports needs a port forwarding")
+	}
+	if conf.remoteCommand != nil && (conf.onlyForwardPort || len(conf.forwards) > 0) {
+		return nil, errors.New("A remote command cannot be combined with port forwardings")
+	}
+
+	type result struct {
+		err    error
+		client *Client
+	}
+	opened := make(chan result, 1)
+	go func() {
+		err, client := newClient(conf)
+		opened <- result{err, client}
+	}()
+	select {
+	case r := <-opened:
+		return r.client, r.err
+	case <-ctx.Done():
+		go func() { // the session is closed as soon as it is opened
+			if r := <-opened; r.client != nil {
+				r.client.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// close the session at once (Run returns)
+func (c *Client) Close() error {
+	return c.session.Close(nil)
+}
+
+////////////
+// server //
+////////////
+
+/*
+ * check the configuration of the server (WithConfigFile first, then the other options) and listen on its
+ * addresses. The server needs a host key (WithKeys or HostKey). It serves the clients once Run is called.
+ */
+func NewServer(options ...Option) (*Server, error) {
+	conf := &SSHConfig{listen: true, options: options}
+	conf.setDefaults()
+	conf.configFile = configFileOption(options)
+	if conf.configFile != "" {
+		if err := conf.readServerConfigFile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.applyOptions(options); err != nil {
+		return nil, err
+	}
+	if conf.privKeyFile == "" {
+		return nil, errors.New("must specify keys for server")
+	}
+	err, server := newServer(conf)
+	return server, err
+}
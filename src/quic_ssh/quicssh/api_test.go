@@ -0,0 +1,77 @@
+package quicssh
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("18")
+}
+
+func TestLibrary(t *testing.T) {
+	// invalid options are reported
+	_, err := NewServer(WithKeys(directory+"pr_server", ""), WithServerOption("AllowModes", "shell"))
+	checkValueBoolean("'invalid server option'", true, err != nil, t)
+	_, err = NewServer(WithListenAddresses("127.0.0.1:41139"))
+	checkValueBoolean("'server without host key'", true, err != nil, t)
+	_, err = NewClient(context.Background(), "127.0.0.1", 41139, WithLocalForward("41140:bad"))
+	checkValueBoolean("'invalid client option'", true, err != nil, t)
+
+	// a server configured by options runs until its context is done
+	serverOutput := &testBuffer{}
+	server, err := NewServer(WithKeys(directory+"pr_server", directory+"pk_server"), WithListenAddresses("127.0.0.1:41139"),
+		WithAuthorizedKeys(directory+"authorized_hosts_server"), WithServerOption("AllowModes", "exec"),
+		WithTerminal(nil, serverOutput, serverOutput), WithLogLevel("quiet"))
+	if err != nil {
+		t.Fatalf("cannot create the server: %s", err)
+	}
+	ctx, stopServer := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Run(ctx)
+	}()
+
+	// the terminal of the client is given by the program
+	writeFile(directory+"known_hosts_library", "127.0.0.1:41139 "+dummyServerPublicKeyInline+"\n")
+	output, errOutput := &testBuffer{}, &testBuffer{}
+	client, err := NewClient(context.Background(), "127.0.0.1", 41139, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithKnownHosts(directory+"known_hosts_library"), WithCommand("tr", "a-z", "A-Z"),
+		WithTerminal(strings.NewReader("library\n"), output, errOutput), WithLogLevel("quiet"))
+	if err != nil {
+		t.Fatalf("cannot create the client: %s", err)
+	}
+	checkValueBoolean("'command run'", true, client.Run(context.Background()) == nil, t)
+	checkValueString("standard output", "LIBRARY\n", output.String(), t)
+	checkValueInt("exit status", 0, client.ExitStatus(), t)
+
+	// a server whose key changed is refused by NewClient
+	writeFile(directory+"known_hosts_library_changed", "127.0.0.1:41139 "+dummyClientPublicKeyInline+"\n")
+	_, err = NewClient(context.Background(), "127.0.0.1", 41139, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithKnownHosts(directory+"known_hosts_library_changed"), WithTerminal(strings.NewReader(""), output, errOutput))
+	checkValueBoolean("'changed server refused'", true, err != nil, t)
+	checkValueBoolean("'change reported'", true, strings.Contains(errOutput.String(), "HAS CHANGED"), t)
+
+	// a command is interrupted when the context of the client is done
+	client, err = NewClient(context.Background(), "127.0.0.1", 41139, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithCommand("sleep", "3"), WithTerminal(strings.NewReader(""), output, errOutput), WithLogLevel("quiet"))
+	if err != nil {
+		t.Fatalf("cannot create the client: %s", err)
+	}
+	clientCtx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	checkValueBoolean("'client cancelled'", true, client.Run(clientCtx) == context.DeadlineExceeded, t)
+	checkValueBoolean("'client stopped at once'", true, time.Since(start) < 5*time.Second, t)
+
+	stopServer()
+	select {
+	case err := <-result:
+		checkValueBoolean("'server stopped'", true, err == nil, t)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the server did not stop")
+	}
+	checkValueString("messages of the server", "", serverOutput.String(), t)
+}
@@ -0,0 +1,593 @@
+package quicssh
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+	"net"
+	"errors"
+	"strings"
+	"quic_utils"
+)
+
+//parse all the command line arguments
+func (conf *SSHConfig) parseArguments() {
+	conf.setDefaults()
+
+	if len(os.Args) > 1 && os.Args[1] == "scp" {
+		conf.parseCopyArguments()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sftp" {
+		conf.parseSFTPArguments()
+		return
+	}
+
+	// the configuration file of the server is read first: the command line takes precedence
+	conf.configFile = configFileArgument()
+	if conf.configFile != "" {
+		if err := conf.readServerConfigFile(); err != nil {
+			usage(err.Error(), conf)
+			return
+		}
+	}
+	conf.parseCommandLine()
+}
+
+func (conf *SSHConfig) setDefaults() {
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_DEBUG
+	conf.escapeChar = defaultEscapeChar
+	conf.sendEnv = []string{"LANG", "LC_*"}
+	conf.agentSocket = os.Getenv(quic_utils.AgentSocketEnv)
+}
+
+// parse the options and operands of the command line (without subcommand)
+func (conf *SSHConfig) parseCommandLine() {
+	unparsed := make([]string, 0)
+	for index := 1; index < len(os.Args); index++ {
+		unparsed, index = parseOneArgument(conf, index, unparsed)
+	}
+
+	if conf.onlyForwardPort && !conf.remotePortForwarding && !conf.localPortForwarding && !conf.controlMaster {
+		usage("Argument -N cannot be used if no port forwarding is requested", conf)
+	}
+
+	if conf.controlMaster && conf.controlPath == "" {
+		usage("The master of a shared session (-M) needs a control socket (-S)", conf)
+	}
+
+	if conf.listen && conf.controlPath != "" {
+		usage("Sessions can only be shared by the client (-M and -S)", conf)
+	}
+
+	if conf.listen && len(conf.forwards) > 0 {
+		usage("Port forwarding can only be requested by the client", conf)
+	}
+
+	if conf.listen && len(conf.jumpHosts) > 0 {
+		usage("Jump hosts (-J) can only be used by the client", conf)
+	}
+
+	if conf.persistent && (conf.listen || conf.onlyForwardPort || conf.localPortForwarding || conf.remotePortForwarding ||
+		conf.remoteCommand != nil || conf.controlPath != "") {
+		usage("A persistent session (--persist or --attach) is a remote login only, without -l, -N, -L, -R, -D, -S or command", conf)
+	}
+
+	if conf.forwardAgent && (conf.listen || conf.onlyForwardPort) {
+		usage("Agent forwarding (-A) needs a remote login or a remote command", conf)
+	}
+
+	if conf.remoteCommand != nil {
+		if len(conf.remoteCommand) == 0 {
+			usage("No command given after '--'", conf)
+		} else if conf.listen || conf.onlyForwardPort || conf.localPortForwarding || conf.remotePortForwarding {
+			usage("A remote command cannot be combined with -l, -N, -L, -R or -D", conf)
+		}
+	}
+
+	if len(unparsed) == 2 {
+		conf.hostname = unparsed[0]
+	}
+	if len(unparsed) >= 1 {
+		port, err := strconv.Atoi(unparsed[len(unparsed)-1])
+		if err != nil {
+			usage("invalid port value'" + unparsed[len(unparsed)-1] + "' ", conf)
+		} else {
+			conf.port = port
+		}
+	}
+	if len(unparsed) > 2{
+		usage("invalid command'" + unparsed[len(unparsed)-1] + "' ", conf)
+	}
+
+	if !conf.listen {
+		if conf.hostname == "" || conf.port == 0 {
+			usage("In non listen mode you should define an address to connect", conf)
+		}
+	}
+
+	if conf.listen && conf.privKeyFile == "" {
+		usage("must specify keys for server", conf)
+	}
+}
+
+// file given with -f (before "--"), "" if none
+func configFileArgument() string {
+	for i := 1; i < len(os.Args)-1 && os.Args[i] != "--"; i++ {
+		if os.Args[i] == "-f" {
+			return os.Args[i+1]
+		}
+	}
+	return ""
+}
+
+//handle one command line argument, update config and add not parsed arguments to 'unparsed'
+func parseOneArgument(conf *SSHConfig, i int, unparsed []string) ([]string, int) {
+	var err error
+	switch os.Args[i] {
+	case "--":
+		// everything after "--" is the command to execute on the server
+		conf.remoteCommand = append([]string{}, os.Args[i+1:]...)
+		i = len(os.Args)
+	case "-b":
+		conf.bufSize, err = strconv.Atoi(os.Args[i+1])
+		i++
+		if err != nil{
+			usage("Buffer size not correct. Should be integer.", conf)
+		}
+	case "-e":
+		if os.Args[i+1] == "none" {
+			conf.escapeChar = 0
+		} else if len(os.Args[i+1]) == 1 {
+			conf.escapeChar = os.Args[i+1][0]
+		} else {
+			usage("Escape character not correct. Should be a single character or 'none'.", conf)
+		}
+		i++
+	case "-f":
+		conf.listen = true // the file itself is read before the other arguments
+		i++
+	case "-h":
+		usage("", conf)
+	case "-A":
+		conf.forwardAgent = true
+	case "-l":
+		conf.listen = true
+	case "-D":
+		conf.localPortForwarding = true // a dynamic port forwarding is a local port forwarding with a destination chosen at runtime
+		conf.addForwarding(parseDynamicForwardingArgument(os.Args[i+1]))
+		i++
+	case "-L":
+		conf.localPortForwarding = true
+		conf.addForwarding(parseForwardingArgument(os.Args[i+1], true))
+		i++
+	case "-J":
+		err, hosts := parseJumpHosts(os.Args[i+1])
+		if err != nil {
+			usage(err.Error(), conf)
+		}
+		conf.jumpHosts = append(conf.jumpHosts, hosts...)
+		i++
+	case "-M":
+		conf.controlMaster = true
+	case "-N":
+		conf.onlyForwardPort = true
+	case "-S":
+		conf.controlPath = os.Args[i+1]
+		i++
+	case "-t":
+		conf.listen = true
+		conf.checkConfig = true
+	case "-R":
+		conf.remotePortForwarding = true
+		conf.addForwarding(parseForwardingArgument(os.Args[i+1], false))
+		i++
+	case "--priv":
+		conf.privKeyFile = os.Args[i+1]
+		i++
+	case "--pub":
+		conf.pubKeyFile = os.Args[i+1]
+		i++
+	case "--req":
+		conf.authorizedPublicKeysFile = os.Args[i+1]
+		i++
+	case "--hash-known-hosts":
+		conf.hashKnownHosts = true
+	case "--persist":
+		conf.persistent = true
+	case "--attach":
+		conf.persistent = true
+		conf.attachToken = os.Args[i+1]
+		i++
+	case "--user":
+		conf.username = os.Args[i+1]
+		i++
+	case "--send-env":
+		conf.sendEnv = append(conf.sendEnv, os.Args[i+1])
+		i++
+	case "--pass":
+		conf.password = os.Args[i+1]
+		i++
+	default:
+		unparsed = append(unparsed, os.Args[i])
+	}
+	return unparsed, i
+}
+
+// add a port forwarding of the command line (the usage is printed when its argument is not correct)
+func (conf *SSHConfig) addForwarding(err error, request portForwardingRequest) {
+	if err != nil {
+		usage(err.Error(), conf)
+		return
+	}
+	conf.forwards = append(conf.forwards, request)
+}
+
+/*
+ * parse the argument of -L or -R: listening:destination[/udp]
+ * listening is [bindAddress:]port or the path of a Unix socket.
+ * destination is hostname:hostport or the path of a Unix socket.
+ * IPv6 addresses must be enclosed in square brackets.
+ */
+func parseForwardingArgument(arg string, local bool) (err error, request portForwardingRequest) {
+	request = portForwardingRequest{local: local, protocol: PROTOCOL_TCP}
+	spec := arg
+	for suffix, protocol := range map[string]byte{"/udp": PROTOCOL_UDP, "/tcp": PROTOCOL_TCP} {
+		// the suffix is a protocol only if it follows a port (and not inside the path of a Unix socket)
+		fields := splitForwardingArgument(strings.TrimSuffix(spec, suffix))
+		if strings.HasSuffix(spec, suffix) && !isUnixSocketPath(fields[len(fields)-1]) {
+			request.protocol = protocol
+			spec = strings.TrimSuffix(spec, suffix)
+			break
+		}
+	}
+	fields := splitForwardingArgument(spec)
+	if len(fields) < 2 || len(fields) > 4 {
+		return errors.New("Bad argument for port forwarding '" + arg + "'"), request
+	}
+
+	// listening side
+	if isUnixSocketPath(fields[0]) {
+		request.localSocket = fields[0]
+		fields = fields[1:]
+	} else {
+		if len(fields) == 4 || (len(fields) == 3 && isUnixSocketPath(fields[2])) {
+			err, bindIP := parseBindAddress(fields[0])
+			if err != nil {
+				return errors.New("Bind address not correct. Should be an IP address, 'localhost' or '*'."), request
+			}
+			request.bindIP = bindIP
+			fields = fields[1:]
+		}
+		val, err := strconv.Atoi(fields[0])
+		if err != nil || val <= 0 || val > 65535 {
+			return errors.New("Local port not correct. Should be integer."), request
+		}
+		request.localPort = uint16(val)
+		fields = fields[1:]
+	}
+
+	// destination side
+	if len(fields) == 1 && isUnixSocketPath(fields[0]) {
+		request.remoteSocket = fields[0]
+	} else if len(fields) == 2 {
+		val, err := strconv.Atoi(fields[1])
+		if err != nil || val <= 0 || val > 65535 {
+			return errors.New("Remote port not correct. Should be integer."), request
+		}
+		request.remotePort = uint16(val)
+		err, remoteIP := resolveHostname(fields[0])
+		if err != nil{
+			return errors.New("Remote hostname cannot be resolved."), request
+		}
+		request.remoteIP = remoteIP
+	} else {
+		return errors.New("Bad argument for port forwarding '" + arg + "'"), request
+	}
+
+	if request.usesUnixSocket() && request.protocol == PROTOCOL_UDP {
+		return errors.New("UDP cannot be forwarded from or to a Unix socket"), request
+	} else if len(request.localSocket) > maxUnixSocketPath || len(request.remoteSocket) > maxUnixSocketPath {
+		return errors.New("Path of Unix socket too long"), request
+	}
+	return nil, request
+}
+
+// the path of a Unix socket is recognized by its '/' (use ./name for a socket in the current directory)
+func isUnixSocketPath(field string) bool {
+	return strings.Contains(field, "/")
+}
+
+/*
+ * parse the argument of -D: [bindAddress:]port
+ */
+func parseDynamicForwardingArgument(arg string) (err error, request portForwardingRequest) {
+	request = portForwardingRequest{local: true, dynamic: true}
+	fields := splitForwardingArgument(arg)
+	if len(fields) != 1 && len(fields) != 2 {
+		return errors.New("Bad argument for dynamic port forwarding '" + arg + "'"), request
+	}
+	if len(fields) == 2 {
+		err, bindIP := parseBindAddress(fields[0])
+		if err != nil {
+			return errors.New("Bind address not correct. Should be an IP address, 'localhost' or '*'."), request
+		}
+		request.bindIP = bindIP
+		fields = fields[1:]
+	}
+	val, err := strconv.Atoi(fields[0])
+	if err != nil || val <= 0 || val > 65535 {
+		return errors.New("Local port not correct. Should be integer."), request
+	}
+	request.localPort = uint16(val)
+	return nil, request
+}
+
+// split a port forwarding argument on ':' (except inside square brackets, which are removed)
+func splitForwardingArgument(arg string) []string {
+	fields := make([]string, 0)
+	current := ""
+	inBrackets := false
+	for _, c := range arg {
+		switch {
+		case c == '[' && !inBrackets:
+			inBrackets = true
+		case c == ']' && inBrackets:
+			inBrackets = false
+		case c == ':' && !inBrackets:
+			fields = append(fields, current)
+			current = ""
+		default:
+			current += string(c)
+		}
+	}
+	return append(fields, current)
+}
+
+// bind address of a port forwarding: empty or '*' for all interfaces, 'localhost' or an IP address
+func parseBindAddress(address string) (err error, ip net.IP) {
+	switch address {
+	case "", "*":
+		return nil, nil
+	case "localhost":
+		return nil, net.ParseIP("127.0.0.1").To4()
+	}
+	ip = net.ParseIP(address)
+	if ip == nil {
+		return errors.New("invalid bind address"), nil
+	}
+	if ip.To4() != nil {
+		return nil, ip.To4()
+	}
+	return nil, ip
+}
+
+/*
+ * parse the arguments of "quic_ssh scp [options] source... target".
+ * A remote file is written [user@]hostname:path (IPv6 addresses enclosed in square brackets).
+ */
+func (conf *SSHConfig) parseCopyArguments() {
+	conf.copyMode = true
+	err, operands := conf.parseSubcommandOptions()
+	if err != nil {
+		usage(err.Error(), conf)
+		return
+	}
+	if len(operands) < 2 {
+		usage("A copy needs at least one source and a target", conf)
+		return
+	}
+
+	// exactly one side of the copy is on the server
+	remoteHost := ""
+	remoteCount := 0
+	for index, operand := range operands {
+		isRemote, user, host, path := splitRemotePath(operand)
+		target := index == len(operands)-1
+		if !isRemote {
+			if target {
+				conf.copyTarget = path
+			} else {
+				conf.copySources = append(conf.copySources, path)
+			}
+			continue
+		}
+		if remoteHost != "" && remoteHost != host {
+			usage("All remote files must be on the same server", conf)
+			return
+		}
+		remoteHost = host
+		remoteCount++
+		if user != "" {
+			conf.username = user
+		}
+		if target {
+			conf.copyUpload = true
+			conf.copyTarget = path
+		} else {
+			conf.copySources = append(conf.copySources, path)
+		}
+	}
+	if remoteHost == "" {
+		usage("Either the sources or the target must be on the server ([user@]hostname:path)", conf)
+		return
+	}
+	if (conf.copyUpload && remoteCount != 1) || (!conf.copyUpload && remoteCount != len(operands)-1) {
+		usage("Sources and target cannot be both on the server (or both local)", conf)
+		return
+	}
+	conf.hostname = remoteHost
+}
+
+/*
+ * parse the arguments of "quic_ssh sftp [options] -P port [user@]hostname".
+ */
+func (conf *SSHConfig) parseSFTPArguments() {
+	conf.subsystem = "sftp"
+	err, operands := conf.parseSubcommandOptions()
+	if err != nil {
+		usage(err.Error(), conf)
+		return
+	}
+	if len(operands) != 1 {
+		usage("sftp needs the server to contact ([user@]hostname)", conf)
+		return
+	}
+	conf.hostname = operands[0]
+	if at := strings.LastIndex(operands[0], "@"); at >= 0 {
+		conf.username, conf.hostname = operands[0][:at], operands[0][at+1:]
+	}
+	conf.hostname = strings.TrimSuffix(strings.TrimPrefix(conf.hostname, "["), "]")
+	if conf.hostname == "" {
+		usage("sftp needs the server to contact ([user@]hostname)", conf)
+	}
+}
+
+/*
+ * parse the options of the subcommands (scp and sftp): the port of the server is given with -P.
+ * Returns the other arguments.
+ */
+func (conf *SSHConfig) parseSubcommandOptions() (err error, operands []string) {
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "-r":
+			if !conf.copyMode {
+				return errors.New("-r can only be used with scp"), nil
+			}
+			conf.copyRecursive = true
+		case "-P", "-b", "-J", "-S", "--priv", "--pub", "--req", "--user", "--pass":
+			if i+1 >= len(os.Args) {
+				return errors.New("Missing value after " + os.Args[i]), nil
+			}
+			if os.Args[i] == "-P" {
+				port, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || port <= 0 || port > 65535 {
+					return errors.New("invalid port value'" + os.Args[i+1] + "' "), nil
+				}
+				conf.port = port
+				i++
+			} else {
+				_, i = parseOneArgument(conf, i, nil)
+			}
+		case "-h":
+			return errors.New(""), nil
+		case "--hash-known-hosts":
+			conf.hashKnownHosts = true
+		default:
+			operands = append(operands, os.Args[i])
+		}
+	}
+	if conf.port == 0 {
+		return errors.New("The port of the server must be given with -P"), nil
+	}
+	return nil, operands
+}
+
+/*
+ * split a copy operand: [user@]hostname:path is a remote path, anything else is a local path.
+ * A colon after a '/' belongs to a local path (e.g. ./a:b).
+ */
+func splitRemotePath(operand string) (isRemote bool, user string, host string, path string) {
+	rest := operand
+	if at := strings.Index(rest, "@"); at >= 0 && at < strings.IndexAny(rest+":", ":/") {
+		user, rest = rest[:at], rest[at+1:]
+	}
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return false, "", "", operand
+		}
+		host, path = rest[1:end], rest[end+2:]
+	} else {
+		colon := strings.Index(rest, ":")
+		slash := strings.Index(rest, "/")
+		if colon <= 0 || (slash >= 0 && slash < colon) {
+			return false, "", "", operand
+		}
+		host, path = rest[:colon], rest[colon+1:]
+	}
+	if path == "" {
+		path = "."
+	}
+	return true, user, host, path
+}
+
+func usage(message string, conf *SSHConfig) {
+	buf := ""
+	if message != "" {
+		buf += "[Error] " + message + "\n\n"
+	}
+	buf += "QuicSSH\n"
+	buf += "Usage: quic_ssh [options] [hostname] [port] [-- command [args...]]\n"
+	buf += "       quic_ssh scp [options] [-r] -P port source... target\n"
+	buf += "       quic_ssh sftp [options] -P port [user@]hostname\n"
+	buf += "\n"
+	buf += "-A       forward the agent (QUIC_SSH_AUTH_SOCK) to the remote login or the remote command\n"
+	buf += "-b       internal buffer size (default=100000)\n"
+	buf += "-D       dynamic port forwarding (SOCKS5, SOCKS4a and HTTP CONNECT proxy) by using syntax: [bindAddress:]port\n"
+	buf += "-e       escape character of the remote login (default='~', 'none' to disable), type '~?' for the escape sequences\n"
+	buf += "-f       configuration file of the server (implies -l, see config_server), read again on SIGHUP\n"
+	buf += "-J       contact the server through jump hosts: [user@]host:port[,[user@]host:port...]\n"
+	buf += "-l       Bind and listen for incoming connections\n"
+	buf += "-L       makes port forwarding by using syntax: [bindAddress:]localPort:hostname:remotePort[/udp]\n"
+	buf += "         (localPort and hostname:remotePort can be replaced by the path of a Unix socket)\n"
+	buf += "-M       share the session with the next invocations given the control socket -S (with -N, only share it)\n"
+	buf += "-N       only forward ports, do not open interactive ssh session\n"
+	buf += "-S       control socket of a shared session: used if a master (-M) listens on it, else a new session is opened\n"
+	buf += "-t       check the configuration of the server (file, keys and addresses) and exit\n"
+	buf += "-R       makes port forwarding by using syntax: [bindAddress:]remotePort:hostname:localPort[/udp]\n"
+	buf += "         (remotePort and hostname:localPort can be replaced by the path of a Unix socket)\n"
+	buf += "--priv   Private key location (required if -l set, else the agent of QUIC_SSH_AUTH_SOCK is used if no key given)\n"
+	buf += "--pub    Public key location (derived from the private key of the server if not given)\n"
+	buf += "--req    authorized_keys file for server / known_hosts file for client (if check required)\n"
+	buf += "--hash-known-hosts  hash the hostnames added to the known_hosts file\n"
+	buf += "--persist  keep the remote shell running when the connection is lost, and reconnect to it\n"
+	buf += "--attach   reattach the persistent session of the given token (implies --persist)\n"
+	buf += "--user   remote user to log in as (default: local user)\n"
+	buf += "--send-env  environment variable sent to the server, with '*' wildcards (LANG and LC_* by default, can be repeated)\n"
+	buf += "\n-L, -R and -D can be repeated (and mixed) to forward several ports on the same connection.\n"
+	buf += "IPv6 addresses must be enclosed in square brackets. By default, forwarded ports listen on all interfaces.\n"
+	buf += "With the '/udp' suffix, UDP datagrams are forwarded instead of TCP connections.\n"
+	buf += "\nIf a command is given after '--', it is executed on the server instead of the interactive\n"
+	buf += "session. Its outputs are forwarded and quic_ssh exits with the exit status of the command.\n"
+	buf += "\nDuring a remote login, '~C' opens a command line to add (-L, -R, -D) or cancel (-KL, -KR, -KD)\n"
+	buf += "port forwardings, '~#' lists them with the bytes forwarded and '~.' disconnects.\n"
+	buf += "\nWith -M -S path, the session is shared: the next invocations with -S path (shells, commands,\n"
+	buf += "forwardings and copies) open their streams on it, without new handshake nor authentication.\n"
+	buf += "The master closes the session once it and the invocations using it are finished.\n"
+	buf += "\nWith --persist, the server keeps the shell running when the client disconnects (DetachTimeout)\n"
+	buf += "and keeps its last output. The client reconnects by itself when the connection is lost, and the\n"
+	buf += "screen is redrawn. The token of the session is printed (and given to the shell in QUIC_SSH_SESSION):\n"
+	buf += "another client with the same key can reattach the session with --attach token.\n"
+	buf += "\nWith -J, the session is relayed by each jump host in turn (which must allow the port forwardings):\n"
+	buf += "the handshake and the key check of each next host are end-to-end, a jump host only relays encrypted\n"
+	buf += "packets. The keys of the hosts behind a jump host are checked under the name given ('host:port').\n"
+	buf += "\nWith 'scp', files are copied from or to the server: remote files are written [user@]hostname:path\n"
+	buf += "(relative to the home directory of the user). -r copies directories recursively. Modes and\n"
+	buf += "modification times are preserved and each file is checked with its SHA-256.\n"
+	buf += "\nWith 'sftp', remote files are browsed and transferred with interactive commands (type 'help').\n"
+	buf += "Interrupted transfers are resumed with 'get -a' and 'put -a'.\n"
+	buf += "\nEach key of the authorized_keys file can be preceded by options restricting its use, as with OpenSSH:\n"
+	buf += "command=\"cmd\", from=\"patterns\", expiry-time=\"YYYYMMDD\", no-pty, no-port-forwarding,\n"
+	buf += "no-agent-forwarding, restrict, permitopen=\"host:port\", permitlisten=\"[host:]port\" and user=\"names\".\n"
+	buf += "A key without user=\"names\" only opens sessions for the account running the server.\n"
+	buf += "\nThe configuration file of the server has one 'Keyword arguments' per line, as sshd_config:\n"
+	buf += "ListenAddress, Port, HostKey, AuthorizedKeysFile, AllowModes, AllowTcpForwarding,\n"
+	buf += "AllowStreamLocalForwarding, AllowAgentForwarding, PermitOpen, PermitListen, AcceptEnv, AuditLog,\n"
+	buf += "RecordSessions, MaxStartups, MaxAuthFailures, BanTime, MaxBanTime, LoginGraceTime, IdleTimeout, DetachTimeout,\n"
+	buf += "ShutdownGraceTime, LogLevel and BufferSize. On SIGHUP, the established sessions are kept with their configuration.\n"
+	buf += "On SIGTERM or SIGINT, the server stops accepting sessions and closes the established ones after ShutdownGraceTime.\n"
+	buf += "\nThe known_hosts file lists the keys of the servers by hostname and/or IP address (whatever the\n"
+	buf += "port), with '*' and '?' wildcards, '!' negations and hashed hostnames. The connection is refused\n"
+	buf += "if a known server sends another key. Fingerprints are shown as by 'quic_keygen -l'.\n"
+	buf += "\nKeys can be RSA, ECDSA P-256 or Ed25519 keys. Private keys can be PKCS #1, SEC 1, PKCS #8 or\n"
+	buf += "OpenSSH keys. The passphrase of an encrypted key is asked on the terminal, or given by\n"
+	buf += "QUIC_SSH_PASSPHRASE. Public keys can also be OpenSSH '.pub' files.\n"
+	buf += "\nOther options on the client for measurements/debugging only:\n"
+	buf += "--pass   set the password directly in the arguments\n"
+	buf += ""
+
+	fmt.Fprintln(conf.output(), buf)
+	conf.invalidArguments = true
+}
\ No newline at end of file
@@ -0,0 +1,261 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Audit log:
+	----------
+
+	If the configuration of the server has an AuditLog file, the server appends to it one JSON object per line
+	for each session, once the session is closed (the sessions refused at the authentication too):
+
+	{"start":"2019-05-02T10:00:00.1+02:00","end":"2019-05-02T10:05:12.3+02:00","remote_address":"10.0.0.2:50123",
+	 "connection_id":"5c1f9a0b7d3e2a11","key_fingerprint":"SHA256:...","user":"alice","mode":"login forward",
+	 "forwards":[{"forward":"-L 127.0.0.1:80","requests":3},{"forward":"-R 8080:127.0.0.1:80","requests":1,
+	 "refused":"remote forwarding not allowed by the server"}],"bytes_sent":18032,"bytes_received":2291,
+	 "recording":"/var/log/quic_ssh/20190502-100000-5c1f9a0b7d3e2a11.cast","close_reason":"session ended"}
+
+	> mode       : service of the session (login, forward, exec, copy, subsystem or sharing). The services of the
+	               channels of a shared session are listed in "channels".
+	> forwards   : port forwardings requested to the server, as seen by the server: the destination of each
+	               connection of a local (-L) or dynamic (-D) forwarding, the listening side of a remote one (-R).
+	               The same forwarding requested several times is counted in "requests".
+	> bytes_sent / bytes_received: bytes sent to / received from the client on all the streams of the session.
+	> recording  : terminal I/O of the remote login, if recorded (RecordSessions, see session_recording.go).
+*/
+
+// audit record of one session
+type sessionAudit struct {
+	mutex    sync.Mutex
+	record   auditRecord
+	sent     uint64 // bytes written on the streams of the session
+	received uint64 // bytes read on the streams of the session
+}
+
+type auditRecord struct {
+	Start         time.Time      `json:"start"`
+	End           time.Time      `json:"end"`
+	RemoteAddress string         `json:"remote_address"`
+	ConnectionID  string         `json:"connection_id"`
+	Fingerprint   string         `json:"key_fingerprint,omitempty"`
+	User          string         `json:"user,omitempty"`
+	Mode          string         `json:"mode,omitempty"`
+	Channels      []string       `json:"channels,omitempty"`
+	Command       string         `json:"command,omitempty"`
+	Forwards      []auditForward `json:"forwards,omitempty"`
+	BytesSent     uint64         `json:"bytes_sent"`
+	BytesReceived uint64         `json:"bytes_received"`
+	Recording     string         `json:"recording,omitempty"`
+	CloseReason   string         `json:"close_reason"`
+}
+
+type auditForward struct {
+	Forward  string `json:"forward"`
+	Requests int    `json:"requests"`
+	Refused  string `json:"refused,omitempty"`
+}
+
+// the audit log is shared by all the sessions
+var auditLogMutex sync.Mutex
+
+// audit of a new session (nil if the server has no audit log): the bytes of its streams are counted from now on
+func (s *Server) newSessionAudit(client *clientServed) *sessionAudit {
+	if s.conf.auditLog == "" {
+		return nil
+	}
+	audit := &sessionAudit{record: auditRecord{
+		Start:         time.Now(),
+		RemoteAddress: client.session.RemoteAddr().String(),
+		ConnectionID:  fmt.Sprintf("%016x", client.session.AddedForThesis_getConnectionId()),
+	}}
+	client.session = &auditedSession{Session: client.session, audit: audit}
+	return audit
+}
+
+// service asked by the client (by a channel if the session is shared)
+func (audit *sessionAudit) requestedMode(mode int) {
+	if audit == nil {
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.record.Mode == "" {
+		audit.record.Mode = modeName(mode)
+	} else {
+		audit.record.Channels = append(audit.record.Channels, modeName(mode))
+	}
+}
+
+// user of the remote login or of the remote command (and the command)
+func (audit *sessionAudit) requestedUser(username string, command string) {
+	if audit == nil {
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	audit.record.User = username
+	if command != "" {
+		audit.record.Command = command
+	}
+}
+
+// port forwarding requested by the client (err if refused by the server)
+func (audit *sessionAudit) requestedForward(request portForwardingRequest, err error) {
+	if audit == nil || request.agent {
+		return
+	}
+	description := auditedForward(request)
+	refused := ""
+	if err != nil {
+		refused = err.Error()
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	for i, forward := range audit.record.Forwards {
+		if forward.Forward == description && forward.Refused == refused {
+			audit.record.Forwards[i].Requests++
+			return
+		}
+	}
+	audit.record.Forwards = append(audit.record.Forwards, auditForward{Forward: description, Requests: 1, Refused: refused})
+}
+
+func (audit *sessionAudit) recordedIn(path string) {
+	if audit == nil {
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	audit.record.Recording = path
+}
+
+// why the session is closed (the first reason given is kept)
+func (audit *sessionAudit) closed(reason string) {
+	if audit == nil {
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.record.CloseReason == "" {
+		audit.record.CloseReason = reason
+	}
+}
+
+// append the record of a closed session to the audit log
+func (s *Server) writeAudit(client *clientServed) {
+	audit := client.audit
+	if audit == nil {
+		return
+	}
+	audit.mutex.Lock()
+	record := audit.record
+	audit.mutex.Unlock()
+	record.End = time.Now()
+	record.BytesSent, record.BytesReceived = atomic.LoadUint64(&audit.sent), atomic.LoadUint64(&audit.received)
+	if client.publicKey != nil {
+		record.Fingerprint = keyFingerprint(client.publicKey)
+	}
+	if record.CloseReason == "" {
+		record.CloseReason = "session ended"
+	}
+	line, err := json.Marshal(record)
+	if err == nil {
+		auditLogMutex.Lock()
+		defer auditLogMutex.Unlock()
+		var file *os.File
+		if file, err = os.OpenFile(s.conf.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+			_, err = file.Write(append(line, '\n'))
+			file.Close()
+		}
+	}
+	if err != nil {
+		s.conf.printErr("Cannot write the audit log: " + err.Error())
+	}
+}
+
+// port forwarding as seen by the server: destination of a local or dynamic forwarding (or of the relay of a jump host), whole remote forwarding
+func auditedForward(request portForwardingRequest) string {
+	if !request.local {
+		return "-R " + request.String()
+	} else if request.dynamic && request.getProtocol() == PROTOCOL_UDP { // relay of a jump host
+		return fmt.Sprintf("-J %s:%d", request.hostname, request.remotePort)
+	} else if request.dynamic {
+		return "-D " + request.String()
+	}
+	destination := fmt.Sprintf("%s:%d", ipToString(request.remoteIP), request.remotePort)
+	if request.remoteSocket != "" {
+		destination = request.remoteSocket
+	}
+	if request.getProtocol() == PROTOCOL_UDP {
+		destination += "/udp"
+	}
+	return "-L " + destination
+}
+
+// name of a mode in the audit log (as in AllowModes)
+func modeName(mode int) string {
+	switch mode {
+	case MODE_BOTH:
+		return "login forward"
+	case MODE_MUX:
+		return "sharing"
+	}
+	for name, value := range modeNames {
+		if value == mode {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+/////// byte counters ///////
+
+// session whose streams count the bytes of the audit
+type auditedSession struct {
+	quic.Session
+	audit *sessionAudit
+}
+
+type auditedStream struct {
+	quic.Stream
+	audit *sessionAudit
+}
+
+func (session *auditedSession) AcceptStream() (quic.Stream, error) {
+	return session.audited(session.Session.AcceptStream())
+}
+
+func (session *auditedSession) OpenStream() (quic.Stream, error) {
+	return session.audited(session.Session.OpenStream())
+}
+
+func (session *auditedSession) OpenStreamSync() (quic.Stream, error) {
+	return session.audited(session.Session.OpenStreamSync())
+}
+
+func (session *auditedSession) audited(stream quic.Stream, err error) (quic.Stream, error) {
+	if err != nil {
+		return stream, err
+	}
+	return &auditedStream{Stream: stream, audit: session.audit}, nil
+}
+
+func (stream *auditedStream) Read(b []byte) (int, error) {
+	n, err := stream.Stream.Read(b)
+	atomic.AddUint64(&stream.audit.received, uint64(n))
+	return n, err
+}
+
+func (stream *auditedStream) Write(b []byte) (int, error) {
+	n, err := stream.Stream.Write(b)
+	atomic.AddUint64(&stream.audit.sent, uint64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+package quicssh
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("15")
+}
+
+// wait until the audit log has count records and return them
+func readAuditRecords(file string, count int) []auditRecord {
+	records := []auditRecord{}
+	for i := 0; i < 50 && len(records) < count; i++ {
+		time.Sleep(100 * time.Millisecond)
+		records = []auditRecord{}
+		data, _ := ioutil.ReadFile(file)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record auditRecord
+			if json.Unmarshal([]byte(line), &record) == nil {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	port := 41134
+	auditLog, recordings := directory+"audit.log", directory+"recordings"
+	os.Remove(auditLog)
+	os.RemoveAll(recordings)
+	os.Mkdir(recordings, 0700)
+	confServer := SSHConfig{auditLog: auditLog, recordSessions: recordings}
+	go launchServerWithResult(port, &confServer)
+
+	// a remote command
+	conf, _ := launchRemoteExecClient(port, []string{"echo", "audited"}, "")
+	checkValueString("standard output", "audited\n", conf.testOutput(), t)
+	records := readAuditRecords(auditLog, 1)
+	if len(records) != 1 {
+		t.Fatalf("no audit record of the remote command")
+	}
+	record := records[0]
+	checkValueString("mode", "exec", record.Mode, t)
+	checkValueString("command", "echo audited", record.Command, t)
+	checkValueString("close reason", "session ended", record.CloseReason, t)
+	checkValueBoolean("'fingerprint'", true, strings.HasPrefix(record.Fingerprint, "SHA256:"), t)
+	checkValueBoolean("'remote address'", true, strings.HasPrefix(record.RemoteAddress, "127.0.0.1:"), t)
+	checkValueInt("connection id length", 16, len(record.ConnectionID), t)
+	checkValueBoolean("'bytes counted'", true, record.BytesSent >= uint64(len("audited\n")) && record.BytesReceived > 0, t)
+	checkValueBoolean("'start before end'", true, !record.End.Before(record.Start), t)
+
+	// a recorded remote login with a port forwarding
+	_, remoteIP := resolveHostname("127.0.0.1")
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", stdin: typed("echo recorded_$((40+2))\nexit\n"), remotePortForwarding: true,
+		forwards: []portForwardingRequest{{localPort: 41135, remotePort: 5432, remoteIP: remoteIP}}}
+	newTestClient(conf).Run(context.Background())
+	records = readAuditRecords(auditLog, 2)
+	if len(records) != 2 {
+		t.Fatalf("no audit record of the remote login")
+	}
+	record = records[1]
+	checkValueString("mode", "login forward", record.Mode, t)
+	if len(record.Forwards) != 1 {
+		t.Fatalf("port forwarding not audited: %v", record.Forwards)
+	}
+	checkValueString("forward", "-R 41135:127.0.0.1:5432", record.Forwards[0].Forward, t)
+	checkValueInt("forward requests", 1, record.Forwards[0].Requests, t)
+	data, err := ioutil.ReadFile(record.Recording)
+	if err != nil {
+		t.Fatalf("no recording of the remote login: %s", err)
+	}
+	lines := strings.Split(string(data), "\n")
+	var header asciicastHeader
+	checkValueBoolean("'header'", true, json.Unmarshal([]byte(lines[0]), &header) == nil, t)
+	checkValueInt("version", 2, header.Version, t)
+	checkValueInt("width", 80, int(header.Width), t)
+	checkValueBoolean("'input recorded'", true, strings.Contains(string(data), `"i","echo recorded_$((40+2))`), t)
+	checkValueBoolean("'output recorded'", true, strings.Contains(string(data), "recorded_42\\r\\n"), t)
+}
+
+func TestRecordingSplitCharacters(t *testing.T) {
+	file := directory + "split.cast"
+	f, _ := os.Create(file)
+	recording := &sessionRecording{file: f, start: time.Now(), pending: make(map[string][]byte)}
+	euro := []byte("€")
+	recording.event("o", append([]byte("a"), euro[:2]...))
+	recording.event("o", euro[2:])
+	recording.close()
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	checkValueInt("events", 2, len(lines), t)
+	checkValueBoolean("'character kept whole'", true, strings.HasSuffix(lines[1], `"o","€"]`), t)
+}
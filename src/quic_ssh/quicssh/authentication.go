@@ -0,0 +1,126 @@
+package quicssh
+
+import (
+	"quic_utils"
+	"crypto"
+	"io/ioutil"
+	"bytes"
+	"strings"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// line of the authorized keys file: [options] key
+type authorizedKey struct {
+	publicKey crypto.PublicKey
+	options   keyOptions
+	line      int
+}
+
+/*
+ * check if remote public key is in list of authorized keys, and if the options of its line allow
+ * the client (address, expiry time). Returns the options to apply to the client.
+ */
+func checkClientPublicKey(s *Server, receivedKey crypto.PublicKey, remoteAddr net.Addr) (bool, keyOptions) {
+	if s.conf.authorizedPublicKeysFile == "" {
+		return true, keyOptions{}
+	}
+	err, authorizedKeys := getAuthorizedKeys(s.conf.authorizedPublicKeysFile)
+	if err != nil {
+		s.conf.printErr(fmt.Sprintf("Cannot read the authorized keys: %s", err))
+		return false, keyOptions{}
+	}
+	for _, authorized := range authorizedKeys {
+		if !quic_utils.ComparePublicKeys(receivedKey, authorized.publicKey) {
+			continue
+		}
+		if err := authorized.options.allowsClient(remoteAddr); err != nil {
+			s.conf.printDebug(fmt.Sprintf("Key of line %d refused: %s", authorized.line, err))
+			continue // another line can have the same key with other options
+		}
+		return true, authorized.options
+	}
+	return false, keyOptions{}
+}
+
+// get list of public keys allowed (with their options), given a file listing them
+func getAuthorizedKeys(file_path string) (error, []authorizedKey) {
+	var result []authorizedKey = nil
+	data, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		return err, nil
+	}
+	parts := bytes.Split(data, []byte("\n"))
+	for i, line := range parts {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "--") || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		err, authorized := parseAuthorizedKeyLine(string(line))
+		if err != nil {
+			quic_utils.Logf("authorized keys file '%s', line %d ignored: %s", file_path, i+1, err)
+			continue
+		}
+		authorized.line = i + 1
+		result = append(result, authorized)
+	}
+	return nil, result
+}
+
+// parse "[options] key [comment]" (the options cannot contain spaces outside double quotes)
+func parseAuthorizedKeyLine(line string) (err error, authorized authorizedKey) {
+	line = strings.TrimSpace(line)
+	if authorized.publicKey, err = decodeInlineKey(strings.Fields(line)[0]); err == nil {
+		return nil, authorized
+	}
+	fields := splitOutsideQuotes(line, ' ')
+	if len(fields) < 2 {
+		return errors.New("invalid key"), authorized
+	}
+	if authorized.publicKey, err = decodeInlineKey(strings.Fields(strings.Join(fields[1:], " "))[0]); err != nil {
+		return errors.New("invalid key"), authorized
+	}
+	err, authorized.options = parseKeyOptions(fields[0])
+	return err, authorized
+}
+
+// decode a key written on a single line (see addPemMarkers)
+func decodeInlineKey(key string) (crypto.PublicKey, error) {
+	pemData, _ := pem.Decode(addPemMarkers([]byte(key)))
+	if pemData == nil {
+		return nil, errors.New("invalid key")
+	}
+	return quic_utils.DecodePublicKey(pemData.Bytes)
+}
+
+// add necessary fields before giving the key to Decode function.
+// (the markers are those of RSA keys, but the single-line form of any key type is decoded by DecodePublicKey)
+func addPemMarkers(key []byte) []byte {
+	nbr_line, i := (len(key)/64)+1, 0
+	result := []byte("-----BEGIN RSA PUBLIC KEY-----\n")
+	for i < nbr_line {
+		if i == nbr_line-1 {
+			result = append(append(result, key[i*64:]...), []byte("\n")...)
+		} else {
+			result = append(append(result, key[i*64:(i+1)*64]...), []byte("\n")...)
+		}
+		i = i + 1
+	}
+	result = append(result, []byte("-----END RSA PUBLIC KEY-----\n")...)
+	return result
+}
+
+// undo the addPemMarkers result: get single-line string key
+func removePemMarkers(key [] byte) string {
+	input := string(key)
+	parts := strings.Split(input, "\n")
+	result := ""
+	for _, part := range parts {
+		if len(part) > 0 && !strings.Contains(part, "-----") {
+			result = result + part
+		}
+	}
+	return result
+}
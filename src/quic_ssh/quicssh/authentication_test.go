@@ -0,0 +1,296 @@
+package quicssh
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"quic_utils"
+	"testing"
+	"strings"
+)
+
+func init() {
+	logTmp("2")
+}
+
+func TestCheckRemotePublicKey(t *testing.T) {
+	// construct config and other args
+	conf := SSHConfig{printLevel: PRINT_LEVEL_QUIET}
+	conf.useTestTerminal()
+	conf.authorizedPublicKeysFile = directory + "known_hosts_client_with_invalid_key"
+	remoteAddr := "127.0.0.1:5050"
+	serverPk, err := quic_utils.ExtractPublicKey(directory + "pk_server")
+	if err == nil {
+		result, _, _ := checkRemotePublicKey(&conf, remoteAddr, serverPk)
+		if result != hostKnown {
+			t.Errorf("check return %d when it should return hostKnown", result)
+		}
+		remoteAddr2 := "123.456.789.0:5050"
+		result, _, _ = checkRemotePublicKey(&conf, remoteAddr2, serverPk)
+		if result != hostUnknown {
+			t.Errorf("check return %d when it should return hostUnknown", result)
+		}
+		serverPk2, _ := quic_utils.ExtractPublicKey(directory + "pk_client")
+		result, _, matching := checkRemotePublicKey(&conf, remoteAddr, serverPk2)
+		if result != hostChanged || len(matching) != 1 || matching[0].line != 2 {
+			t.Errorf("check return %d when it should return hostChanged (line 2)", result)
+		}
+	} else {
+		t.Errorf("cannot extract properly server public key from file")
+	}
+}
+
+func TestKnownHostsPatterns(t *testing.T) {
+	serverPk, _ := quic_utils.ExtractPublicKey(directory + "pk_server")
+	otherPk, _ := quic_utils.ExtractPublicKey(directory + "pk_client")
+	conf := SSHConfig{printLevel: PRINT_LEVEL_QUIET, authorizedPublicKeysFile: directory + "known_hosts_client_patterns"}
+	_, hiddenHost := hashHostname("hidden.example.com")
+	writeFile(conf.authorizedPublicKeysFile, "# comment\n"+
+		"server.example.com,192.0.2.10 "+dummyServerPublicKeyInline+"\n"+
+		"*.example.org,!gw.example.org "+dummyServerPublicKeyInline+"\n"+
+		"gw.example.org "+dummyClientPublicKeyInline+"\n"+
+		hiddenHost+" "+dummyServerPublicKeyInline+"\n"+
+		"[198.51.100.1]:5050 "+dummyServerPublicKeyInline+"\n"+
+		"moved.example.com "+dummyClientPublicKeyInline+"\n"+
+		"192.0.2.20,192.0.2.30 "+dummyServerPublicKeyInline+"\n"+
+		"192.0.2.40 "+dummyClientPublicKeyInline+"\n")
+
+	testData := []struct {
+		hostname   string
+		remoteAddr string
+		key        crypto.PublicKey
+		expected   knownHostStatus
+	}{
+		{"server.example.com", "203.0.113.1:41000", serverPk, hostKnown}, // by hostname, whatever the port
+		{"SERVER.example.com", "203.0.113.1:41000", serverPk, hostKnown},
+		{"", "192.0.2.10:5050", serverPk, hostKnown}, // by IP
+		{"other.example.com", "192.0.2.10:6060", otherPk, hostChanged},
+		{"server.example.com", "203.0.113.1:41000", otherPk, hostChanged},
+		{"www.example.org", "203.0.113.2:5050", serverPk, hostKnown}, // wildcard
+		{"a.b.example.org", "203.0.113.2:5050", otherPk, hostChanged},
+		{"gw.example.org", "203.0.113.2:5050", otherPk, hostKnown}, // excluded from the wildcard line
+		{"gw.example.org", "203.0.113.2:5050", serverPk, hostChanged},
+		{"example.org", "203.0.113.2:5050", serverPk, hostUnknown},
+		{"hidden.example.com", "203.0.113.3:5050", serverPk, hostKnown}, // hashed
+		{"hidden2.example.com", "203.0.113.3:5050", serverPk, hostUnknown},
+		{"", "198.51.100.1:5050", serverPk, hostKnown}, // with a port
+		{"", "198.51.100.1:6060", serverPk, hostUnknown},
+		{"moved.example.com", "192.0.2.20:5050", serverPk, hostChanged}, // the hostname has another key, whatever its IP address
+		{"moved.example.com", "192.0.2.40:5050", otherPk, hostKnown},
+		{"unlisted.example.com", "192.0.2.30:5050", serverPk, hostKnown}, // hostname without line: by IP
+		{"server.example.com", "192.0.2.40:5050", serverPk, hostKnown},   // IP address with another key: only reported
+	}
+	for _, data := range testData {
+		conf.hostname = data.hostname
+		status, _, _ := checkRemotePublicKey(&conf, data.remoteAddr, data.key)
+		checkValueInt("status of "+data.hostname+" ("+data.remoteAddr+")", int(data.expected), int(status), t)
+	}
+
+	// an accepted host is written by hostname and IP (hashed if requested), then known on any port
+	conf = SSHConfig{printLevel: PRINT_LEVEL_QUIET, hostname: "new.example.com", authorizedPublicKeysFile: directory + "known_hosts_client_new", hashKnownHosts: true, stdin: strings.NewReader("yes")}
+	conf.useTestTerminal()
+	status, remoteServer, _ := checkRemotePublicKey(&conf, "203.0.113.4:5050", serverPk)
+	checkValueInt("status of an unknown host", int(hostUnknown), int(status), t)
+	checkValueString("names of the host", "new.example.com,203.0.113.4", remoteServer.hosts, t)
+	checkValueBoolean("host accepted", true, askForUnknownRemotePublicKey(remoteServer, &conf), t)
+	data, _ := ioutil.ReadFile(conf.authorizedPublicKeysFile)
+	checkValueBoolean("hostnames hashed", true, strings.HasPrefix(string(data), "|1|") && !strings.Contains(string(data), "example.com"), t)
+	status, _, _ = checkRemotePublicKey(&conf, "203.0.113.4:6060", serverPk)
+	checkValueInt("status of an added host", int(hostKnown), int(status), t)
+
+	// a changed key is refused without asking, showing the fingerprints
+	status, remoteServer, matching := checkRemotePublicKey(&conf, "203.0.113.4:5050", otherPk)
+	checkValueInt("status of a changed host", int(hostChanged), int(status), t)
+	reportChangedRemotePublicKey(remoteServer, matching, &conf)
+	fingerprint, _ := quic_utils.Fingerprint(otherPk)
+	checkValueBoolean("fingerprint shown", true, strings.Contains(conf.testErrOutput(), "HAS CHANGED") && strings.Contains(conf.testErrOutput(), fingerprint), t)
+}
+
+func TestAddPemMarkers(t *testing.T) {
+	// write dummy key inline and check if it is correctly splitted and surrounded with pem markers
+	key := dummyClientPublicKeyInline
+	result := string(addPemMarkers([]byte(key)))
+	parts := strings.Split(result, "\n")
+	if len(parts) < 5 {
+		t.Errorf("%d line expected (got %d)", 5, len(parts))
+	} else if parts[0] != "-----BEGIN RSA PUBLIC KEY-----" {
+		t.Errorf("result should contain start line")
+	} else if parts[1] != "MIGJAoGBAMlBdZvARrLyVK5B8yyojAKB0f70RSauEqxVvZ9mGbI+J/dWFQZmjILr" ||
+		parts[2] != "Wtvw8mcfsLYLIq6XD1WUjJP+CfulY/C2WOZxCUeL0rTophtcNx3lgPX4G4rRza8z" ||
+		parts[3] != "hMKPjDBCjoWbxCEfoPwQG4eeJh2w18cSspx1NmSIpv/dsSo5ViVhAgMBAAE=" {
+		t.Errorf("bad content")
+	} else if parts[4] != "-----END RSA PUBLIC KEY-----" {
+		t.Errorf("result should contain end line")
+	} else if len(parts) == 6 && parts[5] != "" {
+		t.Errorf("result should not contain data after end line")
+	}
+}
+
+func TestRemovePemMarkers(t *testing.T) {
+	// use dummy key with pem markers and extract inline key
+	key1, key2 := dummyServerPublicKey, dummyClientPublicKey
+	result1, result2 := string(removePemMarkers([]byte(key1))), string(removePemMarkers([]byte(key2)))
+	parts1, parts2 := strings.Split(result1, "\n"), strings.Split(result2, "\n")
+	if len(parts1) != 1 || len(parts2) != 1 {
+		t.Errorf("result should contain only one line")
+	}
+
+	if result1 != dummyServerPublicKeyInline || result2 != dummyClientPublicKeyInline {
+		t.Errorf("result not correctly constructed")
+	}
+
+}
+
+// single-line form of a public key, as written in the authorized keys and known hosts files
+func inlinePublicKey(file string, t *testing.T) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return removePemMarkers(data)
+}
+
+func TestKeyTypesAuthentication(t *testing.T) {
+	// ed25519 key for the server, ecdsa key for the client
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	quic_utils.WritePrivateKey(directory+"pr_server_ed25519", serverKey, nil)
+	quic_utils.WritePublicKey(directory+"pk_server_ed25519", serverKey.Public())
+	quic_utils.WritePrivateKey(directory+"pr_client_ecdsa", clientKey, nil)
+	quic_utils.WritePublicKey(directory+"pk_client_ecdsa", clientKey.Public())
+
+	port := 41123
+	writeFile(directory+"authorized_hosts_server_ecdsa", inlinePublicKey(directory+"pk_client_ecdsa", t)+"\n")
+	writeFile(directory+"known_hosts_client_ed25519", fmt.Sprintf("127.0.0.1:%d ", port)+inlinePublicKey(directory+"pk_server_ed25519", t)+"\n")
+	confServer := SSHConfig{bufSize: 100000, port: port, printLevel: PRINT_LEVEL_QUIET, privKeyFile: directory + "pr_server_ed25519",
+		pubKeyFile: directory + "pk_server_ed25519", authorizedPublicKeysFile: directory + "authorized_hosts_server_ecdsa"}
+	go newTestServer(&confServer).Run(context.Background())
+
+	conf := SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client_ecdsa",
+		pubKeyFile: directory + "pk_client_ecdsa", authorizedPublicKeysFile: directory + "known_hosts_client_ed25519", remoteCommand: []string{"echo", "ok"}}
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "ok\n", conf.testOutput(), t)
+	checkValueInt("exit status", 0, sshClient.exitStatus, t)
+}
+
+func TestKeyOptions(t *testing.T) {
+	// parsing of the lines of the authorized keys file
+	err, authorized := parseAuthorizedKeyLine(`restrict,port-forwarding,permitopen="db.example.com:5432",permitopen="192.0.2.1:*",command="echo \"a,b\"" ` + dummyClientPublicKeyInline + " ci key")
+	checkValueBoolean("'line with options parsed'", true, err == nil, t)
+	checkValueString("forced command", `echo "a,b"`, authorized.options.command, t)
+	checkValueBoolean("'restrictions'", true, authorized.options.noPty && !authorized.options.noPortForwarding && authorized.options.noAgentForwarding, t)
+	checkValueInt("permitopen", 2, len(authorized.options.permitOpen), t)
+	err, authorized = parseAuthorizedKeyLine(dummyClientPublicKeyInline)
+	checkValueBoolean("'line without options parsed'", true, err == nil && authorized.publicKey != nil && authorized.options.command == "", t)
+	for _, invalid := range []string{`unknown-option ` + dummyClientPublicKeyInline, `command=echo ` + dummyClientPublicKeyInline,
+		`no-pty="x" ` + dummyClientPublicKeyInline, `expiry-time="2020" ` + dummyClientPublicKeyInline, `no-pty`} {
+		err, _ = parseAuthorizedKeyLine(invalid)
+		checkValueBoolean("'invalid line refused' ("+strings.Fields(invalid)[0]+")", true, err != nil, t)
+	}
+
+	// address of the client and expiry time
+	_, options := parseKeyOptions(`from="192.0.2.*,10.0.0.0/8,!10.1.2.3",expiry-time="20991231"`)
+	for addr, expected := range map[string]bool{"192.0.2.7:5050": true, "10.20.30.40:5050": true, "10.1.2.3:5050": false, "198.51.100.1:5050": false} {
+		udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+		checkValueBoolean("'client "+addr+" allowed'", expected, options.allowsClient(udpAddr) == nil, t)
+	}
+	_, options = parseKeyOptions(`expiry-time="200001010000"`)
+	checkValueBoolean("'expired key refused'", true, options.allowsClient(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}) != nil, t)
+
+	// port forwardings
+	_, options = parseKeyOptions(`permitopen="127.0.0.1:5432",permitopen="localhost:8080",permitlisten="localhost:9000",permitlisten="9001"`)
+	forwards := []struct {
+		request  portForwardingRequest
+		expected bool
+	}{
+		{portForwardingRequest{local: true, remoteIP: net.ParseIP("127.0.0.1"), remotePort: 5432}, true},
+		{portForwardingRequest{local: true, remoteIP: net.ParseIP("127.0.0.1"), remotePort: 5433}, false},
+		{portForwardingRequest{local: true, remoteIP: net.ParseIP("127.0.0.1"), remotePort: 8080}, true}, // resolved
+		{portForwardingRequest{local: true, dynamic: true, hostname: "localhost", remotePort: 8080}, true},
+		{portForwardingRequest{local: true, dynamic: true, hostname: "example.com", remotePort: 5432}, false},
+		{portForwardingRequest{local: true, remoteSocket: "/tmp/socket"}, false},
+		{portForwardingRequest{localPort: 9000, bindIP: net.ParseIP("127.0.0.1")}, true},
+		{portForwardingRequest{localPort: 9000}, false}, // all interfaces
+		{portForwardingRequest{localPort: 9001}, true},
+		{portForwardingRequest{agent: true}, true},
+	}
+	for _, forward := range forwards {
+		checkValueBoolean("'forwarding "+forward.request.String()+" allowed'", forward.expected, options.allowsForwarding(forward.request) == nil, t)
+	}
+	_, options = parseKeyOptions("restrict")
+	checkValueBoolean("'port forwarding refused'", true, options.allowsForwarding(forwards[0].request) != nil, t)
+	checkValueBoolean("'agent forwarding refused'", true, options.allowsForwarding(portForwardingRequest{agent: true}) != nil, t)
+
+	// accounts of the sessions: the account running the server if the key is not bound to users
+	server := &userAccount{name: "server", uid: uint32(os.Getuid())}
+	other := &userAccount{name: "other", uid: uint32(os.Getuid()) + 1}
+	_, options = parseKeyOptions("no-pty")
+	checkValueBoolean("'account of the server allowed'", true, options.allowsAccount(server) == nil, t)
+	checkValueBoolean("'other account refused'", true, options.allowsAccount(other) != nil, t)
+	err, options = parseKeyOptions(`user="other, third"`)
+	checkValueBoolean("'user option parsed'", true, err == nil && len(options.users) == 2, t)
+	checkValueBoolean("'bound account allowed'", true, options.allowsAccount(other) == nil, t)
+	checkValueBoolean("'account of the server refused'", true, options.allowsAccount(server) != nil, t)
+	err, _ = parseKeyOptions(`user=""`)
+	checkValueBoolean("'empty user option refused'", true, err != nil, t)
+}
+
+func TestAccountOfKey(t *testing.T) {
+	port := 41144
+	authorizedKeys := directory + "authorized_hosts_server_users"
+	writeFile(authorizedKeys, dummyClientPublicKeyInline+"\n")
+	go launchServerWithResult(port, &SSHConfig{authorizedPublicKeysFile: authorizedKeys})
+
+	// a key which is not bound to the account cannot open a session for it
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", username: "nobody", remoteCommand: []string{"id", "-un"}, stdin: strings.NewReader("")}
+	sshClient := newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "", conf.testOutput(), t)
+	checkValueBoolean("'account refused'", true, strings.Contains(conf.testErrOutput(), "cannot open a session for user 'nobody'"), t)
+	checkValueInt("exit status", 255, sshClient.exitStatus, t)
+
+	// once bound, the session is opened for the account (whose shell refuses the command)
+	writeFile(authorizedKeys, `user="nobody" `+dummyClientPublicKeyInline+"\n")
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", username: "nobody", remoteCommand: []string{"id", "-un"}, stdin: strings.NewReader("")}
+	sshClient = newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueBoolean("'account allowed'", false, strings.Contains(conf.testErrOutput(), "user option"), t)
+
+	// the account running the server is not allowed anymore for this key
+	conf, status := launchRemoteExecClient(port, []string{"id", "-un"}, "")
+	checkValueBoolean("'account of the server refused'", true, status == 255 && strings.Contains(conf.testErrOutput(), "user option"), t)
+}
+
+func TestForcedCommand(t *testing.T) {
+	port := 41124
+	authorizedKeys := directory + "authorized_hosts_server_options"
+	writeFile(authorizedKeys, `command="echo forced: $QUIC_SSH_ORIGINAL_COMMAND",no-pty `+dummyClientPublicKeyInline+"\n")
+	confServer := SSHConfig{authorizedPublicKeysFile: authorizedKeys}
+	go launchServerWithResult(port, &confServer)
+
+	// the forced command is run instead of the requested one
+	conf, status := launchRemoteExecClient(port, []string{"echo", "requested"}, "")
+	checkValueString("standard output", "forced: echo requested\n", conf.testOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+
+	// no file copy with a forced command
+	writeFile(directory+"forced_copy_src", "data")
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client", pubKeyFile: directory + "pk_client",
+		copyMode: true, copyUpload: true, copySources: []string{directory + "forced_copy_src"}, copyTarget: directory + "forced_copy_dst"}
+	sshClient := newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueString("error", "Copy refused by the server. file copy is not allowed for this key\n", conf.testErrOutput(), t)
+	checkValueInt("exit status", 1, sshClient.exitStatus, t)
+	_, err := os.Stat(directory + "forced_copy_dst")
+	checkValueBoolean("'file not copied'", true, os.IsNotExist(err), t)
+}
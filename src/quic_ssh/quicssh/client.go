@@ -0,0 +1,408 @@
+package quicssh
+
+import (
+	"context"
+	"quic_utils"
+	"github.com/lucas-clemente/quic-go"
+	"crypto"
+	"fmt"
+	"os"
+	"errors"
+	"io"
+	"os/signal"
+	"sync"
+)
+
+type Client struct {
+	conf        *SSHConfig
+	session     quic.Session
+	firstStream quic.Stream
+	controlStream quic.Stream // terminal control stream (only if remote login)
+	publicKey   crypto.PublicKey
+	signer      quic_utils.Signer // signs the authentication with our private key (or through the agent)
+	stopChannel chan bool
+	exitStatus  int  // exit status of the remote command (if any)
+	shared      bool // channel of a shared session (already authenticated, see connection_sharing.go)
+	legacy      bool // the server does not negotiate the features: the mode is written as a single byte (see feature_negotiation.go)
+	login       *persistentLogin // remote login kept by the server after a disconnection (only with --persist or --attach)
+	forwarding      *portForwardingSession // port forwardings of the session (created by the first one, see forward_management.go)
+	forwardingMutex sync.Mutex
+}
+
+// returned by newClient when the key of the server is not trusted (refused by the user, or changed)
+var errServerNotAllowed = errors.New("server not allowed")
+
+// open the session of the client (steps 0 to 3): the server is authenticated, but not the client yet (see Run)
+func newClient(config *SSHConfig) (error, *Client) {
+	// Step 0) [optional] use the session of the master listening on the control socket (-S)
+	if config.controlPath != "" && !config.controlMaster {
+		if session, err := dialControlSocket(config.controlPath); err == nil {
+			return newSharedClient(config, session)
+		}
+		config.printDebug("No master on the control socket, opening a new session")
+	}
+
+	// Step 1) contacting distant server (directly or through the jump hosts of -J) to open session and opening the first stream
+	session, err := config.dialServer()
+	if err != nil {
+		return err, nil
+	}
+	cert := config.getServerCert(session)
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		session.Close(nil)
+		return err, nil
+	}
+
+	// Step 2) authenticate and then allow or reject this server given it's public key
+	if !config.allowServer(session, cert.PublicKey) {
+		session.Close(nil)
+		return errServerNotAllowed, nil
+	}
+
+	// Step 3) extracting our public and private keys from files (or asking the agent)
+	publicKey, signer, err := config.getClientKeys()
+	if err != nil {
+		session.Close(nil)
+		return err, nil
+	}
+
+	// return an object regrouping all variables needed for running the client
+	return nil, &Client{
+		conf:        config,
+		session:     session,
+		firstStream: stream,
+		publicKey:   publicKey,
+		signer:      signer,
+		stopChannel: make(chan bool, 2),
+	}
+}
+
+/*
+ * Run the session of the client (steps 4 to 10) until it ends, or until ctx is done: the session is then closed
+ * (the port forwardings of -N tell the server the session ends first). The exit status of the remote command is
+ * given by ExitStatus, and is not 0 if an error is returned.
+ */
+func (c *Client) Run(ctx context.Context) error {
+	if c.conf.controlMaster && !c.shared {
+		return c.runMaster(ctx)
+	}
+
+	// Step 4) give our public key (application level) + sign with our private key (already done for a shared session)
+	if !c.shared {
+		quic_utils.ServeClientPublicKeyWithSigner(c.session, c.firstStream, c.signer, c.publicKey)
+	}
+
+	// Step 5) tell to server the mode to use (port forwarding and/or remote login), by negotiating the features of the session
+	if err := c.setServerMode(); err != nil {
+		c.exitStatus = 1
+		c.session.Close(nil)
+		return err
+	}
+
+	// Step 5b) [optional] open the terminal control stream, before any port forwarding stream
+	if len(c.conf.remoteCommand) == 0 && !c.conf.onlyForwardPort && !c.conf.copyMode && c.conf.subsystem == "" {
+		stream, err := c.session.OpenStreamSync()
+		if err != nil {
+			c.exitStatus = 1
+			c.session.Close(nil)
+			return err
+		}
+		c.controlStream = stream
+	}
+
+	// Step 6) [optional] launch local port forwardings
+	if c.conf.localPortForwarding {
+		if err := c.launchPortForwarding(true); err != nil {
+			return err
+		}
+	}
+
+	// Step 7) [optional] launch remote port forwardings (and accept the agent streams of a remote login with -A,
+	// see runAsClientDestination: the server cannot open other streams)
+	if c.conf.remotePortForwarding || (c.conf.forwardAgent && c.controlStream != nil) {
+		if err := c.launchPortForwarding(false); err != nil {
+			return err
+		}
+	}
+
+	// Step 8) [optional] launch remote command execution or remote login
+	if c.conf.subsystem != "" {
+		c.launchSubsystem()
+	} else if c.conf.copyMode {
+		c.launchRemoteCopy()
+	} else if len(c.conf.remoteCommand) > 0 {
+		c.launchRemoteExec()
+	} else if !c.conf.onlyForwardPort {
+		c.launchRemoteLogin()
+	}
+
+	// Step 9) [optional] wait for "exit" msg from user to stop port forwarding
+	if c.conf.onlyForwardPort {
+		c.waitForExitRequest(ctx)
+		<-c.stopChannel
+		c.session.Close(nil)
+		return nil
+	}
+
+	// Step 10) wait for message received on stopChannel then close the session
+	// such stop message can come from step 6 or 7 from inside goroutines.
+	select {
+	case <-c.stopChannel:
+	case <-ctx.Done():
+		c.session.Close(nil)
+		return ctx.Err()
+	}
+	c.session.Close(nil)
+	return nil
+}
+
+// exit status of the remote command (0 for a remote login, 1 if the session could not be served, 255 if it was lost)
+func (c *Client) ExitStatus() int {
+	return c.exitStatus
+}
+
+/*
+ * public key of the client and signer of the authentication: the private key file if given,
+ * otherwise the agent (with the public key file if given, or the first key of the agent).
+ */
+func (conf *SSHConfig) getClientKeys() (crypto.PublicKey, quic_utils.Signer, error) {
+	if conf.privKeyFile != "" || conf.agentSocket == "" {
+		publicKey, err := quic_utils.ExtractPublicKey(conf.pubKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKey, err := quic_utils.ExtractPrivateKey(conf.privKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return publicKey, quic_utils.PrivateKeySigner{Key: privateKey}, nil
+	}
+	agent, err := quic_utils.DialAgent(conf.agentSocket)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.pubKeyFile != "" {
+		publicKey, err := quic_utils.ExtractPublicKey(conf.pubKeyFile)
+		return publicKey, agent, err
+	}
+	keys, err := agent.ListKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("the agent has no key")
+	}
+	return keys[0], agent, nil
+}
+
+func (conf *SSHConfig) allowServer(session quic.Session, serverPK crypto.PublicKey) (result bool) {
+	if conf.authorizedPublicKeysFile == "" {
+		return true; // if it was not requested to verify server's public key
+	}
+	status, remoteServer, matching := checkRemotePublicKey(conf, session.RemoteAddr().String(), serverPK)
+	switch status {
+	case hostUnknown:
+		return askForUnknownRemotePublicKey(remoteServer, conf) // ask client if he trusts the server
+	case hostChanged:
+		reportChangedRemotePublicKey(remoteServer, matching, conf) // never trusted
+		return false
+	}
+	return true
+}
+
+/*
+ * negotiate the features of the session with the server (see feature_negotiation.go). An older server closes
+ * the session without answering: a new session is then opened, and the mode written as a single byte. The
+ * older servers are remembered, their next sessions directly write the mode.
+ */
+func (c *Client) setServerMode() error {
+	if c.legacy || c.isLegacyServer() {
+		c.legacy = true
+		return c.setLegacyServerMode()
+	}
+	err := c.negotiateFeatures(c.firstStream)
+	if err != errNoNegotiation {
+		return err
+	}
+	c.conf.printDebug("The server does not negotiate the features, asking the mode of the older protocol")
+	if err := c.reopen(); err != nil {
+		return err
+	}
+	c.legacy = true
+	c.setLegacyServer()
+	return c.setLegacyServerMode()
+}
+
+/*
+ * older protocol: after getting allowed, first message of the client sent is:
+ * > "1" if the client wants remote login only
+ * > "2" if the client wants port forwarding only
+ * > "3" if the client wants both remote login and port forwarding
+ * > "4" if the client wants remote command execution
+ * > "5" if the client wants to copy files
+ * > "6" followed by the name of the subsystem if the client wants a subsystem (see askServerMode)
+ * > "7" if the session is shared (-M)
+ * This method write on the stream this number
+ */
+func (c *Client) setLegacyServerMode() (error) {
+	var n int
+	var err error
+	if c.conf.controlMaster && !c.shared {
+		n, err = c.firstStream.Write([]byte("7"))
+	} else if c.conf.subsystem != "" {
+		return c.requestSubsystem()
+	} else if c.conf.copyMode {
+		n, err = c.firstStream.Write([]byte("5"))
+	} else if len(c.conf.remoteCommand) > 0 {
+		n, err = c.firstStream.Write([]byte("4"))
+	} else if c.conf.onlyForwardPort {
+		n, err = c.firstStream.Write([]byte("2"))
+	} else if c.conf.localPortForwarding || c.conf.remotePortForwarding {
+		n, err = c.firstStream.Write([]byte("3"))
+	} else {
+		n, err = c.firstStream.Write([]byte("1"))
+	}
+	if err != nil || n != 1 {
+		return errors.New("a problem appeared when writing server mode on stream")
+	}
+	return nil
+}
+
+// ask the server to launch a subsystem
+func (c *Client) requestSubsystem() error {
+	msg := append([]byte{'6', byte(len(c.conf.subsystem))}, []byte(c.conf.subsystem)...)
+	if n, err := c.firstStream.Write(msg); err != nil || n != len(msg) {
+		return errors.New("a problem appeared when writing server mode on stream")
+	}
+	answer := make([]byte, 1, 1)
+	if _, err := io.ReadFull(c.firstStream, answer); err != nil || answer[0] != SUBSYSTEM_ACCEPTED {
+		return errors.New(fmt.Sprintf("subsystem '%s' refused by the server", c.conf.subsystem))
+	}
+	return nil
+}
+
+// replace the session by a new one (a new channel for a shared session), authenticated with the same key
+func (c *Client) reopen() error {
+	var session quic.Session
+	var stream quic.Stream
+	var err error
+	if c.shared {
+		if session, err = dialControlSocket(c.conf.controlPath); err == nil {
+			if stream, err = session.OpenStreamSync(); err != nil {
+				session.Close(nil)
+			}
+		}
+	} else {
+		err, session, stream = c.openAuthenticatedSession()
+	}
+	if err != nil {
+		return err
+	}
+	previous := c.session
+	c.session, c.firstStream = session, stream
+	previous.Close(nil)
+	return nil
+}
+
+// open a new session with the server, check its key and authenticate (steps 1, 2 and 4)
+func (c *Client) openAuthenticatedSession() (err error, session quic.Session, stream quic.Stream) {
+	if session, err = c.conf.dialServer(); err != nil {
+		return err, nil, nil
+	}
+	if stream, err = session.OpenStreamSync(); err != nil {
+		session.Close(nil)
+		return err, nil, nil
+	}
+	if !c.conf.allowServer(session, c.conf.getServerCert(session).PublicKey) {
+		session.Close(nil)
+		return errors.New("server not allowed"), nil, nil
+	}
+	if err = quic_utils.ServeClientPublicKeyWithSigner(session, stream, c.signer, c.publicKey); err != nil {
+		session.Close(nil)
+		return err, nil, nil
+	}
+	return nil, session, stream
+}
+
+// launch all the local (or all the remote) port forwardings requested on the command line
+func (c *Client) launchPortForwarding(local bool) error {
+	if !local {
+		// a single destination accepts the streams opened by the server for all remote port forwardings
+		c.forwardingSession().startDestination()
+	}
+	for _, request := range c.conf.forwards {
+		if request.local != local {
+			continue
+		}
+		if err := c.startForwarding(request); err != nil {
+			c.exitStatus = 255
+			c.session.Close(nil)
+			return errors.New(fmt.Sprintf("A problem appeared when trying to established port forwarding %s: %s", request.String(), err))
+		}
+	}
+	return nil
+}
+
+func (c *Client) launchRemoteLogin() {
+	if c.conf.persistent {
+		go persistentLoginClientLoops(c, c.stopChannel)
+		return
+	}
+	go remoteLoginClientLoops(c.firstStream, c.controlStream, c, c.stopChannel)
+}
+
+func (c *Client) launchRemoteExec() {
+	go remoteExecClientLoops(c, c.stopChannel)
+}
+
+func (c *Client) launchRemoteCopy() {
+	go remoteCopyClientLoops(c, c.stopChannel)
+}
+
+func (c *Client) launchSubsystem() {
+	go sftpClientLoops(c, c.stopChannel)
+}
+
+// this method simply waits that user enter "exit" on command line when port forwarding is active to stop it.
+// It also reads the stream to show eventual error message coming from server.
+func (c *Client) waitForExitRequest(ctx context.Context) {
+	c.conf.printMsg("Port forwarding active. Press Ctrl-C to stop it.")
+	go func() {
+		for {
+			readBuffer := make([]byte, c.conf.bufSize, c.conf.bufSize)
+			n, err := c.firstStream.Read(readBuffer)
+			if n > 0 {
+				c.conf.printMsg(fmt.Sprintf("%s", readBuffer[:n]))
+			}
+			if err != nil {
+				c.stopChannel <- true
+				return
+			}
+		}
+	}()
+	go func() {
+		if c.conf.waitForStop(ctx, os.Interrupt) { // stop when Ctrl-C
+			c.conf.printMsg("\n	Bye")
+		}
+		if !c.legacy { // tell the server the session ends (see feature_negotiation.go)
+			c.firstStream.Write([]byte{SESSION_END})
+		}
+		c.stopChannel <- true
+	}()
+}
+
+// wait until ctx is done, or until one of signals is received if launched from the command line (returns true)
+func (conf *SSHConfig) waitForStop(ctx context.Context, signals ...os.Signal) bool {
+	sigchan := make(chan os.Signal, 1)
+	if conf.handleSignals {
+		signal.Notify(sigchan, signals...)
+		defer signal.Stop(sigchan)
+	}
+	select {
+	case <-sigchan:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package quicssh
 
 import (
 	"quic_utils"
@@ -15,8 +15,8 @@ func init() {
 
 func TestAskForUnknownRemotePublicKey(t *testing.T) {
 	pk, err := quic_utils.ExtractPublicKey(directory + "pk_server")
-	conf := SSHConfig{}
-	conf.testMode = true
+	conf := SSHConfig{printLevel: PRINT_LEVEL_QUIET}
+	conf.useTestTerminal()
 	conf.authorizedPublicKeysFile = directory + "known_hosts_client_void"
 	if err != nil {
 		t.Errorf("cannot extract a public key from file. Stop the test")
@@ -24,7 +24,7 @@ func TestAskForUnknownRemotePublicKey(t *testing.T) {
 
 	// test1: accept server key
 	si := serverInfo{"111.222.3.4", pk}
-	conf.testInput = "y"
+	conf.stdin = strings.NewReader("y")
 	result := askForUnknownRemotePublicKey(si, &conf)
 	if !result {
 		t.Errorf("should return true. False received")
@@ -51,14 +51,14 @@ func TestAskForUnknownRemotePublicKey(t *testing.T) {
 
 	// test2: refuse server key
 	writeFile(directory+"known_hosts_client_void", "")
-	conf.testInput = "n"
+	conf.stdin = strings.NewReader("n")
 	result = askForUnknownRemotePublicKey(si, &conf)
 	if result {
 		t.Errorf("should return false but true was received")
 	}
 
 	// test3: write something crazy in place of 'y' or 'n'
-	conf.testInput = "something wrong"
+	conf.stdin = strings.NewReader("something wrong")
 	result = askForUnknownRemotePublicKey(si, &conf)
 	dat, err = ioutil.ReadFile(directory + "known_hosts_client_void")
 	if err != nil {
@@ -92,16 +92,16 @@ func TestInitServerAndClient(t *testing.T) {
 	port := 41111
 	conf := SSHConfig{}
 	conf.bufSize = 100000
-	conf.testInput = "n"
+	conf.stdin = strings.NewReader("n")
 	conf.hostname = "127.0.0.1"
 	conf.authorizedPublicKeysFile = directory + "known_hosts_client_with_invalid_key"
 	conf.port = port
-	conf.testMode = true
+	conf.printLevel = PRINT_LEVEL_QUIET
 	conf.privKeyFile = directory + "pr_client"
 	conf.pubKeyFile = directory + "pk_client"
-	sshClient := NewQuicSSHClient(&conf)
+	sshClient := newTestClient(&conf)
 
 	if sshClient != nil{
-		t.Errorf("SSHClient should be nil when user rejects server's key")
+		t.Errorf("Client should be nil when user rejects server's key")
 	}
 }
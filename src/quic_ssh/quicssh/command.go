@@ -0,0 +1,58 @@
+package quicssh
+
+import (
+	"context"
+)
+
+/*
+ * the quic_ssh command: run the client or the server given the command line (os.Args), with the standard
+ * input, output and error of the process and its signals. Returns the exit status of the process:
+ * > 1 if the arguments or the configuration are not valid, or if the server fails,
+ * > 255 if the client cannot be set up or connected, or if its session fails (as ssh),
+ * > the exit status of the remote command for a client.
+ */
+func Main() int {
+	conf := &SSHConfig{handleSignals: true}
+	conf.parseArguments()
+	if conf.invalidArguments {
+		return 1
+	}
+	ctx := context.Background()
+
+	if conf.checkConfig {
+		// only check the configuration of the server (-t)
+		if err, _ := conf.checkServerConfig(); err != nil {
+			conf.printErr(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	if conf.listen {
+		// the server runs until SIGTERM or SIGINT, and fails if sessions had to be closed (see shutdown.go)
+		err, server := newServer(conf)
+		if err == nil {
+			err = server.Run(ctx)
+		}
+		if err != nil {
+			conf.printErr(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	err, client := newClient(conf)
+	if err == errServerNotAllowed {
+		return 255 // already explained to the user
+	}
+	if err == nil {
+		err = client.Run(ctx)
+	}
+	if err != nil {
+		conf.printErr(err.Error())
+		if client == nil || client.exitStatus == 0 {
+			return 255
+		}
+	}
+	return client.exitStatus
+}
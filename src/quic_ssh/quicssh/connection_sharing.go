@@ -0,0 +1,436 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"quic_utils"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ * Connection sharing: the master (-M) shares its session (see multiplexing.go) and listens on the
+ * control socket (-S path). The other invocations given the same path use this session instead of
+ * opening a new one (no handshake and no authentication). Each invocation is a channel of the
+ * shared session, and each of its streams is a connection to the control socket relayed by the master:
+ * > |CONTROL_NEW_CHANNEL|: open a channel, answered by |status|channel id (4 bytes)|. The master then
+ *   writes on this connection the id (4 bytes) of each stream opened by the server on the channel.
+ *   The channel is closed when this connection is closed (by either side).
+ * > |CONTROL_OPEN_STREAM|channel id (4 bytes)|: open a stream on the channel,
+ * > |CONTROL_ACCEPT_STREAM|stream id (4 bytes)|: take a stream announced on the connection of the channel.
+ *   Both are answered by |status|stream id (4 bytes)|, then the connection carries the data of the stream.
+ */
+
+const CONTROL_NEW_CHANNEL = 0x01
+const CONTROL_OPEN_STREAM = 0x02
+const CONTROL_ACCEPT_STREAM = 0x03
+
+const CONTROL_OK = 0x00
+const CONTROL_FAILURE = 0x01
+
+/////////////////
+// master part //
+/////////////////
+
+type controlMaster struct {
+	mux      *sessionMux
+	listener net.Listener
+	path     string
+	mutex    sync.Mutex
+	pending  map[quic.StreamID]quic.Stream // streams announced to an invocation, not taken yet
+}
+
+// Run as master of a shared session (-M). The invocation of the master is the first channel of the session.
+func (c *Client) runMaster(ctx context.Context) error {
+	// Step 4) give our public key (application level) + sign with our private key, then share the session
+	quic_utils.ServeClientPublicKeyWithSigner(c.session, c.firstStream, c.signer, c.publicKey)
+	if err := c.setServerMode(); err != nil {
+		c.exitStatus = 1
+		c.session.Close(nil)
+		return err
+	}
+	mux := newSessionMux(c.session, c.firstStream, false)
+	master, err := listenControlSocket(c.conf.controlPath, mux)
+	if err != nil {
+		c.exitStatus = 1
+		c.session.Close(nil)
+		return errors.New(fmt.Sprintf("Cannot listen on the control socket: %s", err))
+	}
+	go master.serve()
+	c.conf.printDebug("Session shared on " + c.conf.controlPath)
+
+	// Step 5 to 10) in a channel, unless the master only shares the session (-N without forwarding)
+	var runErr error
+	if !c.conf.onlyForwardPort || len(c.conf.forwards) > 0 {
+		channel, err := mux.openChannel()
+		if err == nil {
+			var client *Client
+			if err, client = newSharedClient(c.conf, channel); err == nil {
+				client.legacy = c.legacy // the channels ask their mode as the session was asked
+				runErr = client.Run(ctx)
+				c.exitStatus = client.exitStatus
+			}
+		}
+		if err != nil {
+			runErr = errors.New("A problem appeared when opening a channel of the shared session")
+			c.exitStatus = 1
+		}
+	} else {
+		c.waitForStopSignal(ctx)
+	}
+
+	// stop sharing, the session is closed once the other invocations are finished
+	master.close()
+	for mux.activeChannels() > 0 {
+		select {
+		case <-mux.closed:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	c.session.Close(nil)
+	return runErr
+}
+
+// the master which does not run anything stops on Ctrl-C or SIGTERM (or when ctx is done)
+func (c *Client) waitForStopSignal(ctx context.Context) {
+	c.conf.printMsg("Session shared. Press Ctrl-C to stop sharing it.")
+	c.conf.waitForStop(ctx, os.Interrupt, syscall.SIGTERM)
+}
+
+// listen on the control socket, only reachable by its owner (a socket left by a stopped master is replaced)
+func listenControlSocket(path string, mux *sessionMux) (*controlMaster, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("a master is already listening on " + path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &controlMaster{
+		mux:      mux,
+		listener: listener,
+		path:     path,
+		pending:  make(map[quic.StreamID]quic.Stream),
+	}, nil
+}
+
+func (master *controlMaster) serve() {
+	for {
+		conn, err := master.listener.Accept()
+		if err != nil {
+			return
+		}
+		go master.serveConnection(conn.(*net.UnixConn))
+	}
+}
+
+// stop accepting new invocations (the channels already opened are kept)
+func (master *controlMaster) close() {
+	master.listener.Close()
+	os.Remove(master.path)
+}
+
+func (master *controlMaster) serveConnection(conn *net.UnixConn) {
+	request := make([]byte, 5, 5)
+	if _, err := io.ReadFull(conn, request[:1]); err != nil {
+		conn.Close()
+		return
+	}
+	if request[0] == CONTROL_NEW_CHANNEL {
+		master.serveChannel(conn)
+		return
+	}
+	if _, err := io.ReadFull(conn, request[1:]); err != nil {
+		conn.Close()
+		return
+	}
+	var stream quic.Stream
+	err := errors.New("unknown request")
+	if request[0] == CONTROL_OPEN_STREAM {
+		stream, err = master.openStream(uint32(decodeInt(request[1:])))
+	} else if request[0] == CONTROL_ACCEPT_STREAM {
+		stream, err = master.takeStream(quic.StreamID(decodeInt(request[1:])))
+	}
+	if err != nil {
+		conn.Write([]byte{CONTROL_FAILURE})
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(append([]byte{CONTROL_OK}, encodeInt(int(stream.StreamID()))...)); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		conn.Close()
+		return
+	}
+	relayStream(conn, stream)
+}
+
+// open a channel for an invocation and announce the streams opened by the server on it
+func (master *controlMaster) serveChannel(conn *net.UnixConn) {
+	channel, err := master.mux.openChannel()
+	if err != nil {
+		conn.Write([]byte{CONTROL_FAILURE})
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(ioutil.Discard, conn) // until closed by the invocation
+		channel.Close(nil)
+	}()
+	if _, err := conn.Write(append([]byte{CONTROL_OK}, encodeInt(int(channel.id))...)); err == nil {
+		for {
+			stream, err := channel.AcceptStream()
+			if err != nil {
+				break
+			}
+			master.mutex.Lock()
+			master.pending[stream.StreamID()] = stream
+			master.mutex.Unlock()
+			if _, err := conn.Write(encodeInt(int(stream.StreamID()))); err != nil {
+				break
+			}
+		}
+	}
+	channel.Close(nil)
+	conn.Close()
+}
+
+func (master *controlMaster) openStream(id uint32) (quic.Stream, error) {
+	channel := master.mux.channel(id)
+	if channel == nil {
+		return nil, errors.New("unknown channel")
+	}
+	return channel.OpenStreamSync()
+}
+
+func (master *controlMaster) takeStream(id quic.StreamID) (quic.Stream, error) {
+	master.mutex.Lock()
+	defer master.mutex.Unlock()
+	stream, found := master.pending[id]
+	if !found {
+		return nil, errors.New("unknown stream")
+	}
+	delete(master.pending, id)
+	return stream, nil
+}
+
+// relay the data between a stream and a connection to the control socket until both directions are closed
+func relayStream(conn *net.UnixConn, stream quic.Stream) {
+	done := make(chan bool, 2)
+	go func() {
+		if _, err := io.Copy(stream, conn); err != nil {
+			stream.CancelWrite(0)
+		} else {
+			stream.Close()
+		}
+		done <- true
+	}()
+	go func() {
+		if _, err := io.Copy(conn, stream); err != nil {
+			conn.Close() // the stream was reset
+		} else {
+			conn.CloseWrite()
+		}
+		done <- true
+	}()
+	<-done
+	<-done
+	conn.Close()
+}
+
+/////////////////////
+// invocation part //
+/////////////////////
+
+// client of a channel of a shared session (already authenticated): only its first stream is opened
+func newSharedClient(config *SSHConfig, session quic.Session) (error, *Client) {
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		return err, nil
+	}
+	return nil, &Client{
+		conf:        config,
+		session:     session,
+		firstStream: stream,
+		shared:      true,
+		stopChannel: make(chan bool),
+	}
+}
+
+// session of an invocation using the session of a master through the control socket
+type controlSession struct {
+	path         string
+	channel      []byte        // id of the channel (4 bytes)
+	conn         *net.UnixConn // connection of the channel: announces the streams opened by the server
+	acceptMutex  sync.Mutex
+	streamsMutex sync.Mutex
+	streams      []*controlStream
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closeOnce    sync.Once
+}
+
+// stream of a controlSession: a connection to the control socket relayed by the master
+type controlStream struct {
+	*net.UnixConn
+	id     quic.StreamID
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// open a channel on the session of the master listening on the control socket
+func dialControlSocket(path string) (*controlSession, error) {
+	conn, channel, err := controlRequest(path, []byte{CONTROL_NEW_CHANNEL})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &controlSession{
+		path:    path,
+		channel: channel,
+		conn:    conn,
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// send a request to the master on a new connection, returns the connection and the id of the answer
+func controlRequest(path string, request []byte) (*net.UnixConn, []byte, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	answer := make([]byte, 5, 5)
+	if _, err = conn.Write(request); err == nil {
+		_, err = io.ReadFull(conn, answer)
+	}
+	if err != nil || answer[0] != CONTROL_OK {
+		conn.Close()
+		return nil, nil, errors.New("request refused by the master")
+	}
+	return conn, answer[1:], nil
+}
+
+func (s *controlSession) AcceptStream() (quic.Stream, error) {
+	s.acceptMutex.Lock()
+	defer s.acceptMutex.Unlock()
+	id := make([]byte, 4, 4)
+	if _, err := io.ReadFull(s.conn, id); err != nil {
+		s.Close(nil)
+		return nil, errors.New("shared session closed")
+	}
+	return s.openControlStream(append([]byte{CONTROL_ACCEPT_STREAM}, id...))
+}
+
+func (s *controlSession) OpenStream() (quic.Stream, error) {
+	return s.OpenStreamSync()
+}
+
+func (s *controlSession) OpenStreamSync() (quic.Stream, error) {
+	return s.openControlStream(append([]byte{CONTROL_OPEN_STREAM}, s.channel...))
+}
+
+func (s *controlSession) openControlStream(request []byte) (quic.Stream, error) {
+	if s.ctx.Err() != nil {
+		return nil, errors.New("shared session closed")
+	}
+	conn, id, err := controlRequest(s.path, request)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	stream := &controlStream{UnixConn: conn, id: quic.StreamID(decodeInt(id)), ctx: ctx, cancel: cancel}
+	s.streamsMutex.Lock()
+	s.streams = append(s.streams, stream)
+	s.streamsMutex.Unlock()
+	return stream, nil
+}
+
+func (s *controlSession) AcceptUniStream() (quic.ReceiveStream, error) {
+	return nil, errors.New("unidirectional streams are not shared")
+}
+
+func (s *controlSession) OpenUniStream() (quic.SendStream, error) {
+	return nil, errors.New("unidirectional streams are not shared")
+}
+
+func (s *controlSession) OpenUniStreamSync() (quic.SendStream, error) {
+	return nil, errors.New("unidirectional streams are not shared")
+}
+
+func (s *controlSession) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: s.path, Net: "unix"}
+}
+
+func (s *controlSession) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: s.path, Net: "unix"}
+}
+
+// close the channel (the master keeps the session)
+func (s *controlSession) Close(error) error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.conn.Close()
+		s.streamsMutex.Lock()
+		for _, stream := range s.streams {
+			stream.UnixConn.Close()
+		}
+		s.streamsMutex.Unlock()
+	})
+	return nil
+}
+
+func (s *controlSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *controlSession) ConnectionState() quic.ConnectionState {
+	return quic.ConnectionState{}
+}
+
+func (s *controlSession) AddedForThesis_getConnectionId() uint64 {
+	return 0
+}
+
+func (s *controlSession) AddedForThesis_getRtt() time.Duration {
+	return 0
+}
+
+func (stream *controlStream) StreamID() quic.StreamID {
+	return stream.id
+}
+
+// close the write direction, as the Close of a QUIC stream
+func (stream *controlStream) Close() error {
+	stream.cancel()
+	return stream.UnixConn.CloseWrite()
+}
+
+// the connection cannot be reset in one direction only: both are closed
+func (stream *controlStream) CancelWrite(quic.ErrorCode) error {
+	stream.cancel()
+	return stream.UnixConn.Close()
+}
+
+func (stream *controlStream) CancelRead(quic.ErrorCode) error {
+	return stream.UnixConn.CloseRead()
+}
+
+func (stream *controlStream) Context() context.Context {
+	return stream.ctx
+}
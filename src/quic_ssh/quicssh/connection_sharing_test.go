@@ -0,0 +1,99 @@
+package quicssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("11")
+}
+
+// config of a client using the control socket (its keys are missing: only a shared session can be used)
+func sharedClientConfig(port int, controlPath string) *SSHConfig {
+	return &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, controlPath: controlPath,
+		privKeyFile: directory + "missing_key", pubKeyFile: directory + "missing_key.pub"}
+}
+
+func TestConnectionSharing(t *testing.T) {
+	port := 41127
+	controlPath := directory + "control_socket"
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+
+	// the master only shares its session (-M -N), until its context is done
+	ctx, stopMaster := context.WithCancel(context.Background())
+	confMaster := SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", controlMaster: true, controlPath: controlPath, onlyForwardPort: true}
+	masterDone := make(chan bool)
+	go func() {
+		newTestClient(&confMaster).Run(ctx)
+		masterDone <- true
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(controlPath); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// commands run concurrently in channels of the shared session
+	results := make(chan *Client, 2)
+	for _, word := range []string{"first", "second"} {
+		conf := sharedClientConfig(port, controlPath)
+		conf.remoteCommand = []string{"sleep", "0.2;", "echo", word, ";", "echo", "to_stderr", ">&2;", "exit", "4"}
+		go func() {
+			sshClient := newTestClient(conf)
+			sshClient.Run(context.Background())
+			results <- sshClient
+		}()
+	}
+	outputs := []string{}
+	for i := 0; i < 2; i++ {
+		sshClient := <-results
+		checkValueBoolean("'shared session used'", true, sshClient.shared, t)
+		checkValueString("standard error", "to_stderr\n", sshClient.conf.testErrOutput(), t)
+		checkValueInt("exit status", 4, sshClient.exitStatus, t)
+		outputs = append(outputs, strings.TrimSpace(sshClient.conf.testOutput()))
+	}
+	checkValueBoolean("'outputs of both commands'", true, strings.Contains(strings.Join(outputs, " "), "first") && strings.Contains(strings.Join(outputs, " "), "second"), t)
+
+	// standard input and file copies
+	conf := sharedClientConfig(port, controlPath)
+	conf.remoteCommand = []string{"tr", "a-z", "A-Z"}
+	conf.stdin = strings.NewReader("shared session\n")
+	sshClient := newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "SHARED SESSION\n", conf.testOutput(), t)
+
+	writeFile(directory+"shared_copy_src", strings.Repeat("shared copy\n", 10000))
+	conf = sharedClientConfig(port, controlPath)
+	conf.copyMode, conf.copyUpload = true, true
+	conf.copySources, conf.copyTarget = []string{directory + "shared_copy_src"}, directory+"shared_copy_dst"
+	sshClient = newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueInt("copy exit status", 0, sshClient.exitStatus, t)
+	copied, _ := ioutil.ReadFile(directory + "shared_copy_dst")
+	checkValueString("copied file", strings.Repeat("shared copy\n", 10000), string(copied), t)
+
+	// the master stops sharing and removes the socket, the next invocations open their own session
+	stopMaster()
+	select {
+	case <-masterDone:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the master did not stop")
+	}
+	_, err := os.Stat(controlPath)
+	checkValueBoolean("'control socket removed'", true, os.IsNotExist(err), t)
+	conf = sharedClientConfig(port, controlPath)
+	conf.privKeyFile, conf.pubKeyFile = directory+"pr_client", directory+"pk_client"
+	conf.remoteCommand = []string{"echo", "own session"}
+	sshClient = newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueBoolean("'own session used'", false, sshClient.shared, t)
+	checkValueString("standard output", "own session\n", conf.testOutput(), t)
+}
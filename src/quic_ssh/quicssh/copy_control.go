@@ -0,0 +1,325 @@
+package quicssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+/*
+    Format for file copy messages:
+    ------------------------------
+
+	As paths can be longer than 255 bytes, file copy messages use a TLV encoding with a length on 2 bytes:
+
+	0       8               24
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |    length     | value
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Possible types are:
+    > 0x01 for "copy request",
+    > 0x02 for "file header",
+    > 0x03 for "copy end",
+    > 0x04 for "copy status".
+
+	The copy request, the copy end and the final copy status are sent on the first stream. Each file (or directory)
+	is sent on its own stream: a file header, the content of the file and its SHA-256 (32 bytes), then the receiver
+	answers with a copy status on the same stream. Thus, files are transferred in parallel.
+
+	1) copy request:
+
+	Sent by the client just after the server mode.
+
+    0       8               24             40
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x01 |    length     | flags |user l.|
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .           username (user l.)          .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    | sources count |   path l.     |       |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+       +
+    .            path (path l.)             .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .        other paths (same format)      .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	flags         : 0x01 if files are sent by the client (upload), 0x02 for a recursive copy.
+	sources count : Number of files or directories to copy.
+	path          : For an upload, a single path: the target on the server. For a download, the paths of the sources.
+	                Relative paths are relative to the home directory of the user.
+
+	The server answers with a copy status (0x00 if the copy can start).
+
+
+	2) file header:
+
+	First message of the stream of a file (or directory). The content of a file follows its header.
+
+    0       8               24      32             48
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x02 |    length     | kind  |     mode      .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .(4 b.) |       modification time (8 bytes)     .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .       |            size (8 bytes)             .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .       |            relative path              .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	kind              : 0x01 for a regular file, 0x02 for a directory.
+	mode              : Permission bits of the file.
+	modification time : In nanoseconds since January 1, 1970 UTC.
+	size              : Size of the content of a file (0 for a directory).
+	relative path     : Path of the file, beginning with the name of the source it belongs to ('/' as separator).
+
+
+	3) copy end:
+
+	Sent by the sender once all the files were sent.
+
+    0       8               24
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x03 |    length     |   count       .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .(4 b.) |     errors (length-4 bytes)   .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	count  : Number of streams opened for the files and directories.
+	errors : Errors of the sender (one per line), such as sources that cannot be read.
+
+
+	4) copy status:
+
+    0       8               24      32
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x04 |    length     |status |       .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+       .
+    .      message (length-1 bytes)         .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	status  : 0x00 for success, 0x01 for an error.
+	message : Description of the errors (one per line).
+*/
+
+const COPY_REQUEST = 0x01
+const FILE_HEADER = 0x02
+const COPY_END = 0x03
+const COPY_STATUS = 0x04
+
+const COPY_FLAG_UPLOAD = 0x01
+const COPY_FLAG_RECURSIVE = 0x02
+
+const FILE_KIND_REGULAR = 0x01
+const FILE_KIND_DIRECTORY = 0x02
+
+const COPY_SUCCESS = 0x00
+const COPY_ERROR = 0x01
+
+type copyRequest struct {
+	upload       bool
+	recursive    bool
+	username     string
+	sourcesCount int
+	paths        []string
+}
+
+type fileHeader struct {
+	kind    byte
+	mode    uint32
+	modTime time.Time
+	size    int64
+	path    string
+}
+
+/*
+ * read one file copy message on stream and return its type and value.
+ */
+func readCopyMessage(stream readable) (err error, msgType byte, value []byte) {
+	headerBuffer := make([]byte, 3, 3)
+	n, err := io.ReadFull(stream, headerBuffer)
+	if err != nil || n != 3 {
+		return errors.New("error when reading stream"), 0, nil
+	}
+	value = make([]byte, binary.BigEndian.Uint16(headerBuffer[1:3]))
+	n, err = io.ReadFull(stream, value)
+	if err != nil || n != len(value) {
+		return errors.New("error when reading stream"), 0, nil
+	}
+	return nil, headerBuffer[0], value
+}
+
+/*
+ * write one file copy message on stream.
+ */
+func writeCopyMessage(stream writable, msgType byte, value []byte) error {
+	if len(value) > 65535 {
+		return errors.New("error with the values passed in argument (value too long)")
+	}
+	buf := []byte{msgType, 0, 0}
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(value)))
+	buf = append(buf, value...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+/*
+ * read copy request on stream following schema depicted above.
+ */
+func readCopyRequest(stream readable) (err error, request copyRequest) {
+	err, msgType, value := readCopyMessage(stream)
+	if err != nil {
+		return
+	}
+	if msgType != COPY_REQUEST || len(value) < 2 || len(value) < 2+int(value[1])+2 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	request.upload = value[0]&COPY_FLAG_UPLOAD != 0
+	request.recursive = value[0]&COPY_FLAG_RECURSIVE != 0
+	userLength := int(value[1])
+	request.username = string(value[2 : 2+userLength])
+	value = value[2+userLength:]
+	request.sourcesCount = int(binary.BigEndian.Uint16(value[0:2]))
+	value = value[2:]
+	for len(value) > 0 {
+		if len(value) < 2 || len(value) < 2+int(binary.BigEndian.Uint16(value[0:2])) {
+			err = errors.New("error with the values read on the stream")
+			return
+		}
+		pathLength := int(binary.BigEndian.Uint16(value[0:2]))
+		request.paths = append(request.paths, string(value[2:2+pathLength]))
+		value = value[2+pathLength:]
+	}
+	if len(request.paths) == 0 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	return nil, request
+}
+
+/*
+ * write copy request on stream following schema depicted above.
+ */
+func writeCopyRequest(stream writable, request copyRequest) error {
+	if len(request.username) > 100 {
+		return errors.New("error with the values passed in argument (username too long)")
+	}
+	flags := byte(0)
+	if request.upload {
+		flags |= COPY_FLAG_UPLOAD
+	}
+	if request.recursive {
+		flags |= COPY_FLAG_RECURSIVE
+	}
+	value := append([]byte{flags, byte(len(request.username))}, []byte(request.username)...)
+	value = append(value, 0, 0)
+	binary.BigEndian.PutUint16(value[len(value)-2:], uint16(request.sourcesCount))
+	for _, path := range request.paths {
+		value = append(value, 0, 0)
+		binary.BigEndian.PutUint16(value[len(value)-2:], uint16(len(path)))
+		value = append(value, []byte(path)...)
+	}
+	return writeCopyMessage(stream, COPY_REQUEST, value)
+}
+
+/*
+ * read file header on stream following schema depicted above.
+ */
+func readFileHeader(stream readable) (err error, header fileHeader) {
+	err, msgType, value := readCopyMessage(stream)
+	if err != nil {
+		return
+	}
+	if msgType != FILE_HEADER || len(value) < 22 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	header.kind = value[0]
+	header.mode = binary.BigEndian.Uint32(value[1:5])
+	header.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(value[5:13])))
+	header.size = int64(binary.BigEndian.Uint64(value[13:21]))
+	header.path = string(value[21:])
+	if (header.kind != FILE_KIND_REGULAR && header.kind != FILE_KIND_DIRECTORY) || header.size < 0 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	return nil, header
+}
+
+/*
+ * write file header on stream following schema depicted above.
+ */
+func writeFileHeader(stream writable, header fileHeader) error {
+	value := make([]byte, 21, 21+len(header.path))
+	value[0] = header.kind
+	binary.BigEndian.PutUint32(value[1:5], header.mode)
+	binary.BigEndian.PutUint64(value[5:13], uint64(header.modTime.UnixNano()))
+	binary.BigEndian.PutUint64(value[13:21], uint64(header.size))
+	value = append(value, []byte(header.path)...)
+	return writeCopyMessage(stream, FILE_HEADER, value)
+}
+
+/*
+ * read copy end on stream following schema depicted above.
+ */
+func readCopyEnd(stream readable) (err error, count int, errorsMsg string) {
+	err, msgType, value := readCopyMessage(stream)
+	if err != nil {
+		return
+	}
+	if msgType != COPY_END || len(value) < 4 {
+		return errors.New("error with the values read on the stream"), 0, ""
+	}
+	return nil, int(binary.BigEndian.Uint32(value[0:4])), string(value[4:])
+}
+
+/*
+ * write copy end on stream following schema depicted above.
+ */
+func writeCopyEnd(stream writable, count int, errorsMsg string) error {
+	value := make([]byte, 4, 4+len(errorsMsg))
+	binary.BigEndian.PutUint32(value, uint32(count))
+	return writeCopyMessage(stream, COPY_END, append(value, []byte(truncateCopyMessage(errorsMsg, 65531))...))
+}
+
+/*
+ * read copy status on stream following schema depicted above.
+ */
+func readCopyStatus(stream readable) (err error, status byte, msg string) {
+	err, msgType, value := readCopyMessage(stream)
+	if err != nil {
+		return
+	}
+	if msgType != COPY_STATUS || len(value) < 1 {
+		return errors.New("error with the values read on the stream"), COPY_ERROR, ""
+	}
+	return nil, value[0], string(value[1:])
+}
+
+/*
+ * write copy status on stream following schema depicted above.
+ */
+func writeCopyStatus(stream writable, status byte, msg string) error {
+	return writeCopyMessage(stream, COPY_STATUS, append([]byte{status}, []byte(truncateCopyMessage(msg, 65534))...))
+}
+
+// keep the beginning of a message that would not fit in a file copy message
+func truncateCopyMessage(msg string, maxLength int) string {
+	if len(msg) > maxLength {
+		return msg[:maxLength]
+	}
+	return msg
+}
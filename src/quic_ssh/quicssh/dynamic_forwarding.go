@@ -0,0 +1,327 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	Dynamic port forwarding (-D):
+	-----------------------------
+
+	The client runs a local proxy. For each accepted connection, the proxy protocol is detected from the first byte:
+	> 0x05 for SOCKS5 (only the CONNECT command without authentication),
+	> 0x04 for SOCKS4 and SOCKS4a (only the CONNECT command),
+	> anything else for an HTTP CONNECT request.
+
+	Once the destination is known, a new stream is opened with a dynamic port forwarding request
+	(see port_forwarding_control.go). The answer of the server is translated into a reply of the proxy protocol,
+	then payloads are forwarded as for a local port forwarding.
+*/
+
+const SOCKS5_VERSION = 0x05
+const SOCKS4_VERSION = 0x04
+const PROXY_HTTP = 0x00 // not a version number, only used to identify HTTP CONNECT requests
+
+// maximum time given to the application to tell which destination it wants
+const proxyHandshakeTimeout = 30 * time.Second
+
+// maximum time given to the server to connect to the destination of a dynamic port forwarding
+const dynamicDialTimeout = 10 * time.Second
+
+// destination requested to the local proxy
+type proxyRequest struct {
+	protocol byte // SOCKS5_VERSION, SOCKS4_VERSION or PROXY_HTTP
+	hostname string
+	port     uint16
+}
+
+/////////////////
+// server part //
+/////////////////
+
+// connect to the destination of a dynamic port forwarding (or of a relay, with UDP) and give the result to the source
+func dialDynamicDestination(stream quic.Stream, request portForwardingRequest) (net.Conn, error) {
+	address := net.JoinHostPort(request.hostname, strconv.Itoa(int(request.remotePort)))
+	network := "tcp"
+	if request.getProtocol() == PROTOCOL_UDP {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, address, dynamicDialTimeout)
+	status := byte(DYNAMIC_SUCCESS)
+	if err != nil {
+		status = getDynamicStatus(err)
+	}
+	if _, errWrite := stream.Write([]byte{status}); errWrite != nil && err == nil {
+		conn.Close()
+		return nil, errWrite
+	}
+	return conn, err
+}
+
+// status to send back to the source when the destination cannot be contacted
+func getDynamicStatus(err error) byte {
+	if opErr, ok := err.(*net.OpError); ok {
+		if _, isDNSError := opErr.Err.(*net.DNSError); isDNSError {
+			return DYNAMIC_HOST_UNREACHABLE
+		}
+		if strings.Contains(opErr.Err.Error(), syscall.ECONNREFUSED.Error()) {
+			return DYNAMIC_CONNECTION_REFUSED
+		}
+	}
+	return DYNAMIC_FAILURE
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// runAsDynamicSource launches the local proxy of a dynamic port forwarding.
+// (As runAsSource, except that the destination is read on each connection)
+func (pFSession *portForwardingSession) runAsDynamicSource(request portForwardingRequest) {
+
+	// step 1) open local TCPListener (socket TCPListener)
+	forward := pFSession.forwards.add(request)
+	defer pFSession.forwards.remove(forward)
+	TCPListener := pFSession.acceptLocalConnection(request, forward)
+	if TCPListener == nil {
+		writeError(pFSession, &request, nil, "Maybe chosen port is already used")
+		return
+	}
+
+	for {
+		// step 2) accept connections on the TCPListener
+		TCPConnection, err := TCPListener.Accept()
+		if err != nil {
+			// if err != nil , stop listening. This can be because QUICSession was closed (or the port forwarding cancelled) and thus we closed the TCPListener.
+			return
+		}
+		go pFSession.serveProxyConnection(TCPConnection, request, forward)
+	}
+}
+
+// read the destination requested on a proxy connection, then forward it through a new stream
+func (pFSession *portForwardingSession) serveProxyConnection(TCPConnection net.Conn, request portForwardingRequest, forward *activeForward) {
+
+	// step 3) read the proxy request (the application must tell its destination quickly)
+	TCPConnection.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	reader := bufio.NewReader(TCPConnection)
+	err, destination := readProxyRequest(reader, TCPConnection)
+	if err != nil {
+		TCPConnection.Close()
+		return
+	}
+
+	// step 4) open a new QUICStream and ask the destination to contact the requested hostname
+	stream, err := pFSession.QUICSession.OpenStreamSync()
+	if err != nil {
+		writeProxyReply(TCPConnection, destination.protocol, DYNAMIC_FAILURE)
+		TCPConnection.Close()
+		return
+	}
+	err = writeDynamicControlMessage(stream, destination.hostname, destination.port, PROTOCOL_TCP)
+	status := byte(DYNAMIC_FAILURE)
+	if err == nil {
+		err, status = readDynamicStatus(stream)
+	}
+
+	// step 5) give the answer of the destination to the application
+	writeProxyReply(TCPConnection, destination.protocol, status)
+	if err != nil || status != DYNAMIC_SUCCESS {
+		stream.Close()
+		TCPConnection.Close()
+		return
+	}
+	TCPConnection.SetDeadline(time.Time{})
+
+	// step 6) bytes already read after the proxy request belong to the payload
+	if reader.Buffered() > 0 {
+		buffered, _ := reader.Peek(reader.Buffered())
+		stream.Write(buffered)
+	}
+
+	// step 7) send and receive data from TCPConnection/QUICStream to QUICStream/TCPConnection
+	request.hostname = destination.hostname
+	request.remotePort = destination.port
+	forwardingConfig := pFSession.newPortForwardingFlow(TCPConnection, stream, request, forward)
+	forwardingConfig.transfer()
+}
+
+/*
+ * read a SOCKS5, SOCKS4(a) or HTTP CONNECT request (depending on the first byte received).
+ */
+func readProxyRequest(reader *bufio.Reader, conn writable) (err error, destination proxyRequest) {
+	version, err := reader.Peek(1)
+	if err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	switch version[0] {
+	case SOCKS5_VERSION:
+		return readSocks5Request(reader, conn)
+	case SOCKS4_VERSION:
+		return readSocks4Request(reader, conn)
+	default:
+		return readHTTPConnectRequest(reader, conn)
+	}
+}
+
+/*
+ * SOCKS5 (RFC 1928): method negotiation (only "no authentication" is accepted), then the CONNECT request.
+ */
+func readSocks5Request(reader *bufio.Reader, conn writable) (err error, destination proxyRequest) {
+	destination.protocol = SOCKS5_VERSION
+
+	// method negotiation
+	header := make([]byte, 2, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	methods := make([]byte, header[1], header[1])
+	if _, err = io.ReadFull(reader, methods); err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	noAuthentication := false
+	for _, method := range methods {
+		noAuthentication = noAuthentication || method == 0x00
+	}
+	if !noAuthentication {
+		conn.Write([]byte{SOCKS5_VERSION, 0xFF})
+		return errors.New("no acceptable authentication method"), destination
+	}
+	conn.Write([]byte{SOCKS5_VERSION, 0x00})
+
+	// request: version, command, reserved, address type, address, port
+	request := make([]byte, 4, 4)
+	if _, err = io.ReadFull(reader, request); err != nil || request[0] != SOCKS5_VERSION {
+		return errors.New("error when reading connection"), destination
+	}
+	switch request[3] {
+	case 0x01: // IPv4
+		address := make([]byte, net.IPv4len, net.IPv4len)
+		_, err = io.ReadFull(reader, address)
+		destination.hostname = net.IP(address).String()
+	case 0x03: // domain name
+		var length byte
+		if length, err = reader.ReadByte(); err == nil {
+			address := make([]byte, length, length)
+			_, err = io.ReadFull(reader, address)
+			destination.hostname = string(address)
+		}
+	case 0x04: // IPv6
+		address := make([]byte, net.IPv6len, net.IPv6len)
+		_, err = io.ReadFull(reader, address)
+		destination.hostname = net.IP(address).String()
+	default:
+		writeProxyReply(conn, SOCKS5_VERSION, 0x08) // address type not supported
+		return errors.New("address type not supported"), destination
+	}
+	port := make([]byte, 2, 2)
+	if err != nil || destination.hostname == "" {
+		return errors.New("error when reading connection"), destination
+	}
+	if _, err = io.ReadFull(reader, port); err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	destination.port = uint16(port[0])<<8 | uint16(port[1])
+	if request[1] != 0x01 {
+		writeProxyReply(conn, SOCKS5_VERSION, 0x07) // command not supported
+		return errors.New("command not supported"), destination
+	}
+	return nil, destination
+}
+
+/*
+ * SOCKS4: version, command, port, IPv4 address, user id (null terminated).
+ * SOCKS4a: the IPv4 address is 0.0.0.x (x != 0) and the hostname follows the user id (null terminated).
+ */
+func readSocks4Request(reader *bufio.Reader, conn writable) (err error, destination proxyRequest) {
+	destination.protocol = SOCKS4_VERSION
+	request := make([]byte, 8, 8)
+	if _, err = io.ReadFull(reader, request); err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	if _, err = reader.ReadString(0); err != nil { // user id (ignored)
+		return errors.New("error when reading connection"), destination
+	}
+	destination.port = uint16(request[2])<<8 | uint16(request[3])
+	address := net.IP(request[4:8])
+	if address[0] == 0 && address[1] == 0 && address[2] == 0 && address[3] != 0 {
+		hostname, err := reader.ReadString(0)
+		if err != nil || len(hostname) < 2 {
+			return errors.New("error when reading connection"), destination
+		}
+		destination.hostname = hostname[:len(hostname)-1]
+	} else {
+		destination.hostname = address.String()
+	}
+	if request[1] != 0x01 {
+		writeProxyReply(conn, SOCKS4_VERSION, DYNAMIC_FAILURE)
+		return errors.New("command not supported"), destination
+	}
+	return nil, destination
+}
+
+/*
+ * HTTP CONNECT: "CONNECT hostname:port HTTP/1.1" followed by headers (ignored) and an empty line.
+ */
+func readHTTPConnectRequest(reader *bufio.Reader, conn writable) (err error, destination proxyRequest) {
+	destination.protocol = PROXY_HTTP
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("error when reading connection"), destination
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "CONNECT" {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return errors.New("only CONNECT requests are supported"), destination
+	}
+	hostname, portStr, err := net.SplitHostPort(fields[1])
+	port, errPort := strconv.Atoi(portStr)
+	if err != nil || errPort != nil || port <= 0 || port > 65535 {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return errors.New("invalid destination"), destination
+	}
+	destination.hostname = hostname
+	destination.port = uint16(port)
+
+	// skip headers until the empty line
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return errors.New("error when reading connection"), destination
+		}
+		if strings.TrimSpace(line) == "" {
+			return nil, destination
+		}
+	}
+}
+
+/*
+ * answer a proxy request with the status of the dynamic port forwarding request.
+ */
+func writeProxyReply(conn writable, protocol byte, status byte) {
+	switch protocol {
+	case SOCKS5_VERSION:
+		// bound address and port are not meaningful here (the connection is made by the server)
+		conn.Write([]byte{SOCKS5_VERSION, status, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	case SOCKS4_VERSION:
+		if status == DYNAMIC_SUCCESS {
+			conn.Write([]byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0})
+		} else {
+			conn.Write([]byte{0x00, 0x5B, 0, 0, 0, 0, 0, 0})
+		}
+	default:
+		if status == DYNAMIC_SUCCESS {
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		} else {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		}
+	}
+}
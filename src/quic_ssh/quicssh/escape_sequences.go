@@ -0,0 +1,235 @@
+package quicssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	Escape sequences:
+	-----------------
+
+	During a remote login, the escape character (~ by default, changed or disabled with -e) typed at the beginning
+	of a line is not sent to the server: with the next character, it is a command for the client.
+	> ~.  disconnect (a persistent session is only detached),
+	> ~C  open a command line to add or cancel a port forwarding during the session:
+	      -L, -R and -D followed by the same argument as on the command line add a port forwarding,
+	      -KL, -KR and -KD followed by [bindAddress:]port (or the path of a Unix socket) cancel it,
+	> ~#  list the port forwardings with their connections in progress and the bytes forwarded,
+	> ~?  list the escape sequences,
+	> ~~  send the escape character itself.
+	Any other character after the escape character is sent with it.
+
+	A remote port forwarding added during the session is requested as on the command line. It is cancelled with
+	a dedicated message (see message 7 in port_forwarding_control.go). The port forwardings are bound to the
+	session: they are stopped when a persistent session reconnects.
+*/
+
+const defaultEscapeChar = '~'
+
+// read by remoteLoginClientLoops when the user disconnects (~.)
+var errEscapeDisconnect = errors.New("disconnected by the escape sequence")
+
+// state of the escape sequences on the input of a remote login
+type escapeHandler struct {
+	client       *Client
+	char         byte   // escape character (0 if the escape sequences are disabled)
+	lineStart    bool   // the next character typed begins a line ?
+	escaped      bool   // the escape character was just typed ?
+	command      []byte // command line being typed after ~C (nil if none)
+	disconnected bool   // ~. was typed
+}
+
+func newEscapeHandler(c *Client) *escapeHandler {
+	return &escapeHandler{client: c, char: c.conf.escapeChar, lineStart: true}
+}
+
+// filter the input typed by the user: run the escape sequences, and return what must be sent to the server
+func (e *escapeHandler) filter(input []byte) []byte {
+	if e.char == 0 {
+		return input
+	}
+	output := make([]byte, 0, len(input))
+	for _, b := range input {
+		if e.disconnected {
+			break
+		}
+		if e.command != nil {
+			e.editCommand(b)
+			continue
+		}
+		if e.escaped {
+			e.escaped = false
+			if e.runEscape(b) {
+				continue
+			}
+			if b != e.char { // not an escape sequence: the escape character is sent too
+				output = append(output, e.char)
+			}
+		} else if b == e.char && e.lineStart {
+			e.escaped = true
+			continue
+		}
+		output = append(output, b)
+		e.lineStart = b == '\r' || b == '\n'
+	}
+	return output
+}
+
+// run the escape sequence of b (false if b does not make one)
+func (e *escapeHandler) runEscape(b byte) bool {
+	switch b {
+	case '.':
+		e.disconnected = true
+		e.print(fmt.Sprintf("Connection to %s closed.", e.client.conf.formatAddress()))
+	case 'C':
+		e.command = []byte{}
+		e.echo("\r\nquic_ssh> ")
+	case '#':
+		e.listForwards()
+	case '?':
+		c := string(e.char)
+		e.print("Supported escape sequences:",
+			" "+c+".   - disconnect (detach a persistent session)",
+			" "+c+"C   - open a command line to add or cancel a port forwarding",
+			" "+c+"#   - list the port forwardings",
+			" "+c+"?   - this message",
+			" "+c+c+"   - send the escape character",
+			"(Note that escapes are only recognized immediately after newline.)")
+	default:
+		return false
+	}
+	return true
+}
+
+// a character typed on the command line of ~C (run on Enter, cancelled by Ctrl-C)
+func (e *escapeHandler) editCommand(b byte) {
+	switch b {
+	case '\r', '\n':
+		line := string(e.command)
+		e.command = nil
+		e.echo("\r\n")
+		e.runCommand(line)
+		e.lineStart = true
+	case 0x7f, 0x08: // erase the last character
+		if len(e.command) > 0 {
+			e.command = e.command[:len(e.command)-1]
+			e.echo("\b \b")
+		}
+	case 0x03:
+		e.command = nil
+		e.echo("\r\n")
+		e.lineStart = true
+	default:
+		if b >= 0x20 {
+			e.command = append(e.command, b)
+			e.echo(string(b))
+		}
+	}
+}
+
+// add or cancel a port forwarding given the command line of ~C
+func (e *escapeHandler) runCommand(line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	option, arg := fields[0], ""
+	if len(fields) == 2 {
+		arg = fields[1]
+	} else if len(fields) == 1 {
+		for _, prefix := range []string{"-KL", "-KR", "-KD", "-L", "-R", "-D"} { // argument stuck to the option
+			if strings.HasPrefix(option, prefix) {
+				option, arg = prefix, option[len(prefix):]
+				break
+			}
+		}
+	}
+
+	var err error
+	var request portForwardingRequest
+	switch option {
+	case "-L", "-R":
+		err, request = parseForwardingArgument(arg, option == "-L")
+	case "-D":
+		err, request = parseDynamicForwardingArgument(arg)
+	case "-KL", "-KR", "-KD":
+		err, request = parseListeningArgument(arg)
+		request.local, request.dynamic = option != "-KR", option == "-KD"
+	default:
+		e.print("Commands:",
+			"      -L[bindAddress:]port:hostname:hostport[/udp]  Request local forward",
+			"      -R[bindAddress:]port:hostname:hostport[/udp]  Request remote forward",
+			"      -D[bindAddress:]port                          Request dynamic forward",
+			"      -KL[bindAddress:]port[/udp]                   Cancel local forward",
+			"      -KR[bindAddress:]port[/udp]                   Cancel remote forward",
+			"      -KD[bindAddress:]port                         Cancel dynamic forward",
+			"(ports can be replaced by the path of a Unix socket)")
+		return
+	}
+	if err != nil {
+		e.print(err.Error())
+		return
+	}
+	if strings.HasPrefix(option, "-K") {
+		err = e.client.cancelForwarding(request)
+	} else {
+		err = e.client.startForwarding(request)
+	}
+	if err != nil {
+		e.print("Port forwarding failed: " + err.Error())
+	} else if strings.HasPrefix(option, "-K") {
+		e.print(fmt.Sprintf("Port forwarding cancelled: -%s %s", option[2:], arg))
+	} else {
+		e.print(fmt.Sprintf("Port forwarding added: %s %s", option, request.String()))
+	}
+}
+
+// print the port forwardings of the session with their counters
+func (e *escapeHandler) listForwards() {
+	forwards := e.client.forwardingSession().forwards.list()
+	if len(forwards) == 0 {
+		e.print("No port forwarding.")
+		return
+	}
+	lines := []string{"The following port forwardings are active:"}
+	for _, forward := range forwards {
+		lines = append(lines, "  "+forward.String())
+	}
+	e.print(lines...)
+}
+
+// print messages of the escape sequences on the standard error (the terminal is in raw mode)
+func (e *escapeHandler) print(lines ...string) {
+	if e.client.conf.terminal() == nil {
+		e.client.conf.printErr(strings.Join(lines, "\n"))
+		return
+	}
+	fmt.Fprintf(e.client.conf.errOutput(), "\r\n%s\r\n", strings.Join(lines, "\r\n"))
+}
+
+// echo the command line (only on a terminal)
+func (e *escapeHandler) echo(str string) {
+	if e.client.conf.terminal() != nil {
+		fmt.Fprint(e.client.conf.errOutput(), str)
+	}
+}
+
+/*
+ * parse the listening side of a port forwarding to cancel: [bindAddress:]port[/udp] or the path of a Unix socket.
+ */
+func parseListeningArgument(arg string) (err error, request portForwardingRequest) {
+	request.protocol = PROTOCOL_TCP
+	if strings.HasSuffix(arg, "/udp") && !isUnixSocketPath(strings.TrimSuffix(arg, "/udp")) {
+		request.protocol = PROTOCOL_UDP
+		arg = strings.TrimSuffix(arg, "/udp")
+	}
+	if isUnixSocketPath(arg) {
+		request.localSocket = arg
+		return nil, request
+	}
+	err, listening := parseDynamicForwardingArgument(arg)
+	request.bindIP, request.localPort = listening.bindIP, listening.localPort
+	return err, request
+}
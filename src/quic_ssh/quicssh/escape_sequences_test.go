@@ -0,0 +1,130 @@
+package quicssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("13")
+}
+
+// TCP server sending back everything it receives
+func launchEchoServer(address string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// send msg through the port forwarding listening on address and read the answer
+func echoThrough(address string, msg string) string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg))
+	answer := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _ := io.ReadFull(conn, answer)
+	return string(answer[:n])
+}
+
+// wait until the messages of the escape sequences contain expected
+func waitForEscapeOutput(conf *SSHConfig, expected string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(conf.testErrOutput(), expected) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestEscapeFilter(t *testing.T) {
+	conf := &SSHConfig{printLevel: PRINT_LEVEL_QUIET, escapeChar: '~', hostname: "127.0.0.1", port: 22}
+	conf.useTestTerminal()
+	escape := newEscapeHandler(&Client{conf: conf})
+	checkValueString("filtered input", "ls ~x\n~\n~x\r", string(escape.filter([]byte("ls ~x\n~~\n~x\r"))), t)
+	checkValueString("input of help", "", string(escape.filter([]byte("~?"))), t)
+	checkValueBoolean("'help printed'", true, strings.Contains(conf.testErrOutput(), "~C   - open a command line"), t)
+	checkValueString("input of command line", "", string(escape.filter([]byte("~C-Q\n"))), t)
+	checkValueBoolean("'commands printed'", true, strings.Contains(conf.testErrOutput(), "-KR[bindAddress:]port"), t)
+	escape.filter([]byte("~C-L 41131:bad\n"))
+	checkValueBoolean("'bad argument'", true, strings.Contains(conf.testErrOutput(), "Bad argument for port forwarding '41131:bad'"), t)
+	checkValueString("input after disconnection", "echo\n", string(escape.filter([]byte("echo\n~.more"))), t)
+	checkValueBoolean("'disconnected'", true, escape.disconnected, t)
+
+	conf = &SSHConfig{printLevel: PRINT_LEVEL_QUIET}
+	conf.useTestTerminal()
+	escape = newEscapeHandler(&Client{conf: conf})
+	checkValueString("input without escape character", "~.\n", string(escape.filter([]byte("~.\n"))), t)
+}
+
+func TestEscapeSequencesForwarding(t *testing.T) {
+	port := 41129
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+	echo := launchEchoServer("127.0.0.1:41130")
+	if echo == nil {
+		t.Fatalf("cannot launch the echo server")
+	}
+	defer echo.Close()
+
+	// the port forwardings are added, listed, cancelled during the remote login, then the client disconnects
+	input := "~C-L 41131:127.0.0.1:41130\n~C -R 127.0.0.1:41132:127.0.0.1:41130\n" + strings.Repeat("\n", 15) +
+		"~#\n~C-KL 41131\n~C-KR 41132\n~#\n" + strings.Repeat("\n", 15) + "~.\n"
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", escapeChar: '~', stdin: typed(input)}
+	conf.useTestTerminal()
+	done := make(chan bool)
+	go func() {
+		newTestClient(conf).Run(context.Background())
+		close(done)
+	}()
+
+	if !waitForEscapeOutput(conf, "Port forwarding added: -R 127.0.0.1:41132:127.0.0.1:41130") {
+		t.Fatalf("the port forwardings were not added: %s", conf.testErrOutput())
+	}
+	time.Sleep(500 * time.Millisecond) // the server listens
+	checkValueString("local forwarding", "local", echoThrough("127.0.0.1:41131", "local"), t)
+	checkValueString("remote forwarding", "remote!", echoThrough("127.0.0.1:41132", "remote!"), t)
+
+	waitForEscapeOutput(conf, "No port forwarding.")
+	checkValueBoolean("'local forwarding listed'", true,
+		strings.Contains(conf.testErrOutput(), "#1 -L 41131:127.0.0.1:41130: 0 connections, 5 B sent, 5 B received"), t)
+	checkValueBoolean("'remote forwarding listed'", true,
+		strings.Contains(conf.testErrOutput(), "#2 -R 127.0.0.1:41132:127.0.0.1:41130: 0 connections, 7 B sent, 7 B received"), t)
+	checkValueBoolean("'local forwarding cancelled'", true, strings.Contains(conf.testErrOutput(), "Port forwarding cancelled: -L 41131"), t)
+	checkValueBoolean("'remote forwarding cancelled'", true, strings.Contains(conf.testErrOutput(), "Port forwarding cancelled: -R 41132"), t)
+	time.Sleep(200 * time.Millisecond)
+	for _, address := range []string{"127.0.0.1:41131", "127.0.0.1:41132"} {
+		_, err := net.Dial("tcp", address)
+		checkValueBoolean("'"+address+" closed'", true, err != nil, t)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the client did not disconnect")
+	}
+	checkValueBoolean("'disconnected'", true, strings.Contains(conf.testErrOutput(), "Connection to 127.0.0.1:41129 closed."), t)
+}
@@ -0,0 +1,435 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+	Feature negotiation:
+	--------------------
+
+	After the authentication, the client sends a hello on the first stream with the version of its protocol and
+	the features it requests. The server answers with its own version and tells, for each requested feature,
+	whether it is granted and why not. Both sides then use the lowest version.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+    |m=0x56 |version|    length     | features
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	fields:
+	-------
+	m          : 'V', which cannot be the mode of the older clients ("1" to "7", see askServerMode).
+	version    : Version of the protocol of the sender (PROTOCOL_VERSION).
+	length     : Length of the features. Encoded on 2 bytes.
+	features   : One TLV per feature, the length being encoded on 2 bytes. The value of a requested feature
+	             depends on its type. The value of an answered feature is its status followed by a reason.
+
+	feature requested by the client:           feature answered by the server:
+
+    0       8       16      24                 0       8       16      24      32
+    +-+-+-+-+-+-+-+-+-+-+-+-+---               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |    length     | value            | type  |    length     |status | reason
+    +-+-+-+-+-+-+-+-+-+-+-+-+---               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Possible types are:
+    > 0x01 for "remote login",
+    > 0x02 for "remote command",
+    > 0x03 for "port forwarding" (alone, or with a remote login),
+    > 0x04 for "file transfer",
+    > 0x05 for "subsystem", whose value is the name of the subsystem,
+    > 0x06 for "session sharing" (see multiplexing.go),
+    > 0x07 for "environment", whose value is a list of "NAME=value" separated by null bytes. The variables
+      accepted by the server (AcceptEnv) are given to the remote login or the remote command.
+	A session has a single service: remote login, remote command, file transfer, subsystem or session sharing,
+	unless it only forwards ports.
+
+	status     : 0x00 if the feature is granted (the reason can then detail what is granted, as the names of the
+	             accepted environment variables), 0x01 if it is refused (the reason tells why), 0x02 if the
+	             feature is unknown to the server. New features can so be requested from older servers.
+
+	If the service of the session is refused, the server closes the session after its answer. An older server
+	closes the session without answer: the client then opens a new session and writes the mode of the older
+	protocol instead. This fallback costs a second handshake and authentication: the client remembers the older
+	servers (per hostname and port, or control socket) for the life of the process, so the next sessions to
+	them (reconnections, jump hosts, shared sessions) write the mode of the older protocol directly.
+
+	Once the port forwardings of a session without other service (-N) are finished, the client writes on the
+	first stream a single byte 0x01 ("end of session") instead of the "stop" of the older protocol.
+*/
+
+const PROTOCOL_VERSION = 1
+const HELLO_MAGIC = 'V'
+
+const FEATURE_LOGIN = 0x01
+const FEATURE_EXEC = 0x02
+const FEATURE_FORWARDING = 0x03
+const FEATURE_FILE_TRANSFER = 0x04
+const FEATURE_SUBSYSTEM = 0x05
+const FEATURE_SHARING = 0x06
+const FEATURE_ENV = 0x07
+
+const FEATURE_GRANTED = 0x00
+const FEATURE_REFUSED = 0x01
+const FEATURE_UNKNOWN = 0x02
+
+const SESSION_END = 0x01
+
+// features shown in the messages, given their type
+var featureNames = map[byte]string{
+	FEATURE_LOGIN:         "Remote login",
+	FEATURE_EXEC:          "Remote command",
+	FEATURE_FORWARDING:    "Port forwarding",
+	FEATURE_FILE_TRANSFER: "File transfer",
+	FEATURE_SUBSYSTEM:     "Subsystem",
+	FEATURE_SHARING:       "Session sharing",
+	FEATURE_ENV:           "Environment",
+}
+
+// returned when the server closes the session without reason nor answer to the hello (older server)
+var errNoNegotiation = errors.New("the server does not negotiate the features")
+
+// servers known to not negotiate the features (see legacyServerKey), not asked again by this process
+var legacyServers = map[string]bool{}
+var legacyServersMutex sync.Mutex
+
+// feature requested by the client, and its answer
+type feature struct {
+	kind   byte
+	value  []byte // value of the request
+	status byte   // FEATURE_GRANTED, FEATURE_REFUSED or FEATURE_UNKNOWN (answer only)
+	reason string // (answer only)
+}
+
+// hello of the client, or answer of the server
+type hello struct {
+	version  byte
+	features []feature
+}
+
+/*
+ * read the hello (or its answer) on stream following schema depicted above, once its magic byte is read
+ * (the server tells it from the mode of the older clients, the client from the closing of an older server).
+ */
+func readHello(stream readable, answer bool) (err error, h hello) {
+	header := make([]byte, 3, 3)
+	if _, err = io.ReadFull(stream, header); err != nil {
+		return errors.New("error when reading stream"), h
+	}
+	h.version = header[0]
+	value := make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if _, err = io.ReadFull(stream, value); err != nil {
+		return errors.New("error when reading stream"), h
+	}
+	for len(value) > 0 {
+		if len(value) < 3 || len(value) < 3+int(binary.BigEndian.Uint16(value[1:3])) {
+			return errors.New("error with the values read on the stream"), h
+		}
+		f := feature{kind: value[0], value: value[3 : 3+int(binary.BigEndian.Uint16(value[1:3]))]}
+		value = value[3+len(f.value):]
+		if answer {
+			if len(f.value) < 1 {
+				return errors.New("error with the values read on the stream"), h
+			}
+			f.status, f.reason, f.value = f.value[0], string(f.value[1:]), nil
+		}
+		h.features = append(h.features, f)
+	}
+	return nil, h
+}
+
+/*
+ * write the hello (or its answer) on stream following schema depicted above.
+ */
+func writeHello(stream writable, h hello, answer bool) error {
+	value := []byte{}
+	for _, f := range h.features {
+		featureValue := f.value
+		if answer {
+			featureValue = append([]byte{f.status}, []byte(f.reason)...)
+		}
+		if len(featureValue) > 0xFFFF {
+			return errors.New("error with the values passed in argument (feature too long)")
+		}
+		length := make([]byte, 2, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(featureValue)))
+		value = append(append(append(value, f.kind), length...), featureValue...)
+	}
+	if len(value) > 0xFFFF {
+		return errors.New("error with the values passed in argument (too many features)")
+	}
+	buf := []byte{HELLO_MAGIC, h.version, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(value)))
+	buf = append(buf, value...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+// environment variables "NAME=value" of a feature (separated by null bytes)
+func parseEnvironment(value []byte) []string {
+	env := []string{}
+	for _, variable := range strings.Split(string(value), "\x00") {
+		if equal := strings.Index(variable, "="); equal > 0 {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+/////////////////
+// server part //
+/////////////////
+
+/*
+ * answer the hello of the client (magic byte already read) and return the mode of the session given the
+ * features granted. A session whose service is refused is an error (the client was told why).
+ */
+func (s *Server) negotiateFeatures(client *clientServed) (err error, mode int) {
+	err, request := readHello(client.firstStream, false)
+	if err != nil {
+		return err, 0
+	}
+	answer := hello{version: PROTOCOL_VERSION}
+	if request.version < answer.version {
+		answer.version = request.version
+	}
+	service, forwarding := byte(0), -1
+	for _, f := range request.features {
+		f.status, f.reason = FEATURE_GRANTED, ""
+		switch f.kind {
+		case FEATURE_LOGIN, FEATURE_EXEC, FEATURE_FILE_TRANSFER, FEATURE_SUBSYSTEM, FEATURE_SHARING:
+			if service != 0 {
+				f.status, f.reason = FEATURE_REFUSED, "a session has a single service"
+			} else if err := s.allowsService(client, f); err != nil {
+				f.status, f.reason = FEATURE_REFUSED, err.Error()
+			} else {
+				service = f.kind
+			}
+		case FEATURE_FORWARDING:
+			forwarding = len(answer.features)
+			if !s.conf.allowsMode(MODE_PORT_FORW) {
+				f.status, f.reason = FEATURE_REFUSED, "not allowed by the server (AllowModes)"
+			} else if client.options.noPortForwarding {
+				f.status, f.reason = FEATURE_REFUSED, "not allowed for this key (no-port-forwarding)"
+			}
+		case FEATURE_ENV:
+			client.env = s.conf.acceptedEnvironment(parseEnvironment(f.value))
+			names := []string{}
+			for _, variable := range client.env {
+				names = append(names, variable[:strings.Index(variable, "=")])
+			}
+			if len(names) == 0 {
+				f.status, f.reason = FEATURE_REFUSED, "not accepted by the server (AcceptEnv)"
+			} else {
+				f.reason = strings.Join(names, " ")
+			}
+		default:
+			f.status, f.reason = FEATURE_UNKNOWN, "unknown feature"
+		}
+		answer.features = append(answer.features, f)
+	}
+
+	// port forwarding only comes alone or with a remote login
+	forwardingGranted := forwarding >= 0 && answer.features[forwarding].status == FEATURE_GRANTED
+	if forwardingGranted && service != 0 && service != FEATURE_LOGIN {
+		answer.features[forwarding].status, answer.features[forwarding].reason = FEATURE_REFUSED, "only with a remote login"
+		forwardingGranted = false
+	}
+	switch {
+	case service == FEATURE_LOGIN && forwardingGranted:
+		mode = MODE_BOTH
+	case service == FEATURE_LOGIN:
+		mode = MODE_REM_LOGIN
+	case service == FEATURE_EXEC:
+		mode = MODE_EXEC
+	case service == FEATURE_FILE_TRANSFER:
+		mode = MODE_COPY
+	case service == FEATURE_SUBSYSTEM:
+		mode = MODE_SUBSYSTEM
+	case service == FEATURE_SHARING:
+		mode = MODE_MUX
+	case forwardingGranted && !requestsService(request): // a refused service is not replaced by the port forwarding
+		mode = MODE_PORT_FORW
+	}
+	if err := writeHello(client.firstStream, answer, true); err != nil {
+		return err, 0
+	}
+	if mode == 0 {
+		return errors.New("no service granted"), 0
+	}
+	client.version = answer.version
+	return nil, mode
+}
+
+// does the client request a service (other than port forwarding) ?
+func requestsService(request hello) bool {
+	for _, f := range request.features {
+		switch f.kind {
+		case FEATURE_LOGIN, FEATURE_EXEC, FEATURE_FILE_TRANSFER, FEATURE_SUBSYSTEM, FEATURE_SHARING:
+			return true
+		}
+	}
+	return false
+}
+
+// can the client have this service ? (the subsystem is remembered)
+func (s *Server) allowsService(client *clientServed, f feature) error {
+	mode := map[byte]int{FEATURE_LOGIN: MODE_REM_LOGIN, FEATURE_EXEC: MODE_EXEC, FEATURE_FILE_TRANSFER: MODE_COPY,
+		FEATURE_SUBSYSTEM: MODE_SUBSYSTEM, FEATURE_SHARING: MODE_MUX}[f.kind]
+	if f.kind == FEATURE_SUBSYSTEM {
+		if subsystems[string(f.value)] == nil {
+			return errors.New(fmt.Sprintf("unknown subsystem '%s'", f.value))
+		}
+		if client.options.command != "" { // only the forced command can be run
+			return errors.New("not allowed for this key (forced command)")
+		}
+	}
+	if !s.conf.allowsMode(mode) {
+		return errors.New("not allowed by the server (AllowModes)")
+	}
+	if f.kind == FEATURE_SUBSYSTEM {
+		client.subsystem = string(f.value)
+	}
+	return nil
+}
+
+// environment variables whose name matches a pattern of AcceptEnv
+func (conf *SSHConfig) acceptedEnvironment(env []string) []string {
+	accepted := []string{}
+	for _, variable := range env {
+		name := variable[:strings.Index(variable, "=")]
+		for _, pattern := range conf.acceptEnv {
+			if matchWildcard(pattern, name) {
+				accepted = append(accepted, variable)
+				break
+			}
+		}
+	}
+	return accepted
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// features to request to the server, given the command line
+func (c *Client) requestedFeatures() []feature {
+	features := []feature{}
+	service := byte(0)
+	switch {
+	case c.conf.controlMaster && !c.shared:
+		service = FEATURE_SHARING
+	case c.conf.subsystem != "":
+		features = append(features, feature{kind: FEATURE_SUBSYSTEM, value: []byte(c.conf.subsystem)})
+	case c.conf.copyMode:
+		service = FEATURE_FILE_TRANSFER
+	case len(c.conf.remoteCommand) > 0:
+		service = FEATURE_EXEC
+	case !c.conf.onlyForwardPort:
+		service = FEATURE_LOGIN
+	}
+	if service != 0 {
+		features = append(features, feature{kind: service})
+	}
+	if service == FEATURE_SHARING {
+		return features
+	}
+	if c.conf.localPortForwarding || c.conf.remotePortForwarding {
+		features = append(features, feature{kind: FEATURE_FORWARDING})
+	}
+	if env := c.conf.environment(); len(env) > 0 && (service == FEATURE_LOGIN || service == FEATURE_EXEC) {
+		features = append(features, feature{kind: FEATURE_ENV, value: []byte(strings.Join(env, "\x00"))})
+	}
+	return features
+}
+
+// environment variables sent to the server (whose name matches a pattern of --send-env)
+func (conf *SSHConfig) environment() []string {
+	env := []string{}
+	for _, variable := range os.Environ() {
+		equal := strings.Index(variable, "=")
+		if equal <= 0 {
+			continue
+		}
+		for _, pattern := range conf.sendEnv {
+			if matchWildcard(pattern, variable[:equal]) {
+				env = append(env, variable)
+				break
+			}
+		}
+	}
+	return env
+}
+
+/*
+ * send the hello on stream and apply the answer of the server: an error if the service is refused. A refused
+ * port forwarding is only reported if the session has another service.
+ */
+func (c *Client) negotiateFeatures(stream quic.Stream) error {
+	writeErr := writeHello(stream, hello{version: PROTOCOL_VERSION, features: c.requestedFeatures()}, false)
+	magic := make([]byte, 1, 1)
+	if _, err := io.ReadFull(stream, magic); err != nil {
+		if quicErr, ok := err.(*qerr.QuicError); ok && quicErr.ErrorCode != qerr.PeerGoingAway { // closed with a reason (key refused, ...)
+			return errors.New("Connection closed by the server: " + quicErr.ErrorMessage)
+		} else if writeErr != nil {
+			return writeErr
+		}
+		return errNoNegotiation
+	}
+	err, answer := readHello(stream, true)
+	if err != nil || magic[0] != HELLO_MAGIC {
+		return errors.New("a problem appeared when reading the features granted by the server")
+	}
+	for _, f := range answer.features {
+		if f.status == FEATURE_GRANTED {
+			continue
+		}
+		if f.status == FEATURE_UNKNOWN {
+			f.reason = "not supported by the server"
+		}
+		description := fmt.Sprintf("%s refused by the server: %s", featureNames[f.kind], f.reason)
+		switch {
+		case f.kind == FEATURE_ENV:
+			c.conf.printDebug(description)
+		case f.kind == FEATURE_FORWARDING && !c.conf.onlyForwardPort:
+			c.conf.printErr(description)
+			c.conf.localPortForwarding, c.conf.remotePortForwarding = false, false
+		default:
+			return errors.New(description)
+		}
+	}
+	return nil
+}
+
+// server whose negotiation is remembered: the control socket of a shared session, else the hostname and port
+func (c *Client) legacyServerKey() string {
+	if c.shared {
+		return c.conf.controlPath
+	}
+	return fmt.Sprintf("%s:%d", c.conf.hostname, c.conf.port)
+}
+
+// is the server known to not negotiate the features ?
+func (c *Client) isLegacyServer() bool {
+	legacyServersMutex.Lock()
+	defer legacyServersMutex.Unlock()
+	return legacyServers[c.legacyServerKey()]
+}
+
+// remember the server does not negotiate the features (the next sessions skip the hello)
+func (c *Client) setLegacyServer() {
+	legacyServersMutex.Lock()
+	defer legacyServersMutex.Unlock()
+	legacyServers[c.legacyServerKey()] = true
+}
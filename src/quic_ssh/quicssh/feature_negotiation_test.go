@@ -0,0 +1,103 @@
+package quicssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"quic_utils"
+	"strings"
+	"testing"
+)
+
+func init() {
+	logTmp("14")
+}
+
+func TestHelloEncoding(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	request := hello{version: 3, features: []feature{{kind: FEATURE_EXEC}, {kind: FEATURE_ENV, value: []byte("LANG=C\x00LC_ALL=C")}}}
+	checkValueBoolean("'hello written'", true, writeHello(buffer, request, false) == nil, t)
+	magic, _ := buffer.ReadByte()
+	checkValueInt("magic", HELLO_MAGIC, int(magic), t)
+	err, read := readHello(buffer, false)
+	checkValueBoolean("'hello read'", true, err == nil, t)
+	checkValueInt("version", 3, int(read.version), t)
+	checkValueInt("features", 2, len(read.features), t)
+	checkValueString("environment", "LANG=C LC_ALL=C", strings.Join(parseEnvironment(read.features[1].value), " "), t)
+
+	answer := hello{version: 1, features: []feature{{kind: FEATURE_EXEC, status: FEATURE_REFUSED, reason: "not allowed"}}}
+	writeHello(buffer, answer, true)
+	buffer.ReadByte()
+	err, read = readHello(buffer, true)
+	checkValueBoolean("'answer read'", true, err == nil, t)
+	checkValueInt("status", FEATURE_REFUSED, int(read.features[0].status), t)
+	checkValueString("reason", "not allowed", read.features[0].reason, t)
+
+	// truncated feature
+	err, _ = readHello(bytes.NewReader([]byte{1, 0, 4, FEATURE_ENV, 0, 9, 'A'}), false)
+	checkValueBoolean("'truncated feature refused'", true, err != nil, t)
+}
+
+func TestFeatureNegotiation(t *testing.T) {
+	port := 41133
+	confServer := SSHConfig{acceptEnv: []string{"QUIC_SSH_TEST_*"}, allowedModes: []int{MODE_REM_LOGIN, MODE_EXEC}}
+	go launchServerWithResult(port, &confServer)
+
+	// the server answers each feature, the unknown ones too
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client"}
+	sshClient := newTestClient(conf)
+	quic_utils.ServeClientPublicKeyWithSigner(sshClient.session, sshClient.firstStream, sshClient.signer, sshClient.publicKey)
+	request := hello{version: PROTOCOL_VERSION + 1, features: []feature{{kind: FEATURE_EXEC}, {kind: FEATURE_FORWARDING},
+		{kind: FEATURE_ENV, value: []byte("QUIC_SSH_TEST_A=1\x00PATH=/tmp")}, {kind: 0x7F}, {kind: FEATURE_LOGIN}}}
+	writeHello(sshClient.firstStream, request, false)
+	magic := make([]byte, 1, 1)
+	io.ReadFull(sshClient.firstStream, magic)
+	err, answer := readHello(sshClient.firstStream, true)
+	sshClient.session.Close(nil)
+	if err != nil || len(answer.features) != 5 {
+		t.Fatalf("no answer to the hello: %v", err)
+	}
+	checkValueInt("negotiated version", PROTOCOL_VERSION, int(answer.version), t)
+	checkValueInt("exec status", FEATURE_GRANTED, int(answer.features[0].status), t)
+	checkValueString("forwarding refused", "not allowed by the server (AllowModes)", answer.features[1].reason, t)
+	checkValueString("environment accepted", "QUIC_SSH_TEST_A", answer.features[2].reason, t)
+	checkValueInt("unknown feature status", FEATURE_UNKNOWN, int(answer.features[3].status), t)
+	checkValueString("second service refused", "a session has a single service", answer.features[4].reason, t)
+
+	// the environment variables accepted are given to the command
+	os.Setenv("QUIC_SSH_TEST_VAR", "negotiated")
+	defer os.Unsetenv("QUIC_SSH_TEST_VAR")
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "$QUIC_SSH_TEST_VAR"}, sendEnv: []string{"QUIC_SSH_TEST_*"}}
+	sshClient = newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "negotiated\n", conf.testOutput(), t)
+	checkValueBoolean("'older protocol not used'", false, sshClient.legacy, t)
+
+	// a refused service is reported
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", copyMode: true, copySources: []string{"/etc/hostname"}, copyTarget: directory}
+	sshClient = newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueInt("exit status", 1, sshClient.exitStatus, t)
+
+	// the mode of the older clients is still accepted (without environment)
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "older$QUIC_SSH_TEST_VAR"}, sendEnv: []string{"QUIC_SSH_TEST_*"}}
+	sshClient = newTestClient(conf)
+	sshClient.legacy = true
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "older\n", conf.testOutput(), t)
+
+	// a server known to not negotiate is directly asked the mode of the older protocol
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", remoteCommand: []string{"echo", "remembered$QUIC_SSH_TEST_VAR"}, sendEnv: []string{"QUIC_SSH_TEST_*"}}
+	sshClient = newTestClient(conf)
+	sshClient.setLegacyServer()
+	defer delete(legacyServers, sshClient.legacyServerKey())
+	sshClient.Run(context.Background())
+	checkValueString("standard output", "remembered\n", conf.testOutput(), t)
+	checkValueBoolean("'older protocol used'", true, sshClient.legacy, t)
+}
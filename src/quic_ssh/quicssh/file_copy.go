@@ -0,0 +1,607 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// number of files sent at the same time (one stream per file)
+const copyParallelStreams = 8
+
+// one file (or directory) to send
+type copyEntry struct {
+	localPath string
+	header    fileHeader
+}
+
+// receiver of a file copy: writes the files received on the streams below the target
+type copyReceiver struct {
+	target       string
+	targetIsDir  bool
+	sourcesCount int
+	account      *userAccount // owner of the files received (nil on client side)
+	mutex        sync.Mutex
+	directories  map[string]fileHeader // attributes of the directories, applied once all files are received
+}
+
+/////////////////
+// server part //
+/////////////////
+
+func remoteCopyServerLoops(client *clientServed, serverConfig *Server, stopChanel chan bool) {
+	stream := client.firstStream
+
+	// step 1) read the copy request and check the user
+	err, request := readCopyRequest(stream)
+	if err != nil {
+		stream.Close()
+		stopChanel <- true
+		return
+	}
+	account, err := client.lookupAccount(request.username)
+	if err == nil && client.options.command != "" { // only the forced command can be run
+		err = errors.New("file copy is not allowed for this key")
+	}
+	if err != nil {
+		writeCopyStatus(stream, COPY_ERROR, err.Error())
+		endRemoteCopy(client, stopChanel)
+		return
+	}
+
+	// step 2) receive or send the files (relative paths are relative to the home directory of the user)
+	if request.upload {
+		serverConfig.conf.printDebug(fmt.Sprintf("New upload for user '%s' to %s", account.name, request.paths[0]))
+		receiver, err := newCopyReceiver(resolveCopyPath(account, request.paths[0]), request.sourcesCount, account)
+		if err != nil {
+			writeCopyStatus(stream, COPY_ERROR, err.Error())
+		} else {
+			writeCopyStatus(stream, COPY_SUCCESS, "")
+			errs := receiver.receiveFiles(client.session, stream)
+			writeCopyStatus(stream, getCopyStatus(errs), errs)
+		}
+	} else {
+		serverConfig.conf.printDebug(fmt.Sprintf("New download for user '%s' of %s", account.name, strings.Join(request.paths, " ")))
+		writeCopyStatus(stream, COPY_SUCCESS, "")
+		sources := make([]string, len(request.paths))
+		for i, source := range request.paths {
+			sources[i] = resolveCopyPath(account, source)
+		}
+		count, errs := sendFiles(client.session, sources, request.recursive, account)
+		writeCopyEnd(stream, count, errs)
+		readCopyStatus(stream) // the client tells when all files are received
+	}
+
+	// step 3) let the client close the session
+	endRemoteCopy(client, stopChanel)
+}
+
+// close the first stream, then let the client close the session (so that it reads the last status)
+func endRemoteCopy(client *clientServed, stopChanel chan bool) {
+	client.firstStream.Close()
+	select {
+	case <-client.session.Context().Done():
+	case <-time.After(shellExitTimeout):
+	}
+	stopChanel <- true
+}
+
+// relative paths (and paths beginning with "~/") are relative to the home directory of the user
+func resolveCopyPath(account *userAccount, p string) string {
+	if p == "~" {
+		return account.home
+	} else if strings.HasPrefix(p, "~/") {
+		p = p[2:]
+	}
+	if !filepath.IsAbs(p) {
+		return filepath.Join(account.home, p)
+	}
+	return p
+}
+
+/////////////////
+// client part //
+/////////////////
+
+func remoteCopyClientLoops(c *Client, stopChanel chan bool) {
+	request := copyRequest{
+		upload:       c.conf.copyUpload,
+		recursive:    c.conf.copyRecursive,
+		username:     c.getRemoteUsername(),
+		sourcesCount: len(c.conf.copySources),
+		paths:        c.conf.copySources,
+	}
+	if c.conf.copyUpload {
+		request.paths = []string{c.conf.copyTarget}
+	}
+
+	// step 1) check the local target before asking anything to the server
+	var receiver *copyReceiver
+	var err error
+	if !c.conf.copyUpload {
+		receiver, err = newCopyReceiver(c.conf.copyTarget, len(c.conf.copySources), nil)
+		if err != nil {
+			c.stopCopy(err.Error(), stopChanel)
+			return
+		}
+	}
+
+	// step 2) send the copy request and wait until the server is ready
+	if writeCopyRequest(c.firstStream, request) != nil {
+		c.stopCopy("A problem appeared when sending the copy request to the server", stopChanel)
+		return
+	}
+	err, status, msg := readCopyStatus(c.firstStream)
+	if err != nil || status != COPY_SUCCESS {
+		c.stopCopy(fmt.Sprintf("Copy refused by the server. %s", msg), stopChanel)
+		return
+	}
+
+	// step 3) send or receive the files
+	errs := ""
+	if c.conf.copyUpload {
+		count, senderErrs := sendFiles(c.session, c.conf.copySources, c.conf.copyRecursive, nil)
+		writeCopyEnd(c.firstStream, count, senderErrs)
+		err, _, receiverErrs := readCopyStatus(c.firstStream)
+		if err != nil {
+			receiverErrs = receiverErrs + "A problem appeared when reading the result of the copy\n"
+		}
+		errs = senderErrs + receiverErrs
+	} else {
+		errs = receiver.receiveFiles(c.session, c.firstStream)
+		writeCopyStatus(c.firstStream, getCopyStatus(errs), "")
+	}
+
+	// step 4) report errors (exit status is 1 if any file could not be copied)
+	if errs != "" {
+		c.stopCopy(strings.TrimSuffix(errs, "\n"), stopChanel)
+		return
+	}
+	stopChanel <- true
+}
+
+func (c *Client) stopCopy(msg string, stopChanel chan bool) {
+	c.conf.printErr(msg)
+	c.exitStatus = 1
+	stopChanel <- true
+}
+
+/////////////////
+// sender part //
+/////////////////
+
+/*
+ * send files and directories, each one on its own stream (at most copyParallelStreams at the same time).
+ * Returns the number of streams opened and the errors (one per line).
+ */
+func sendFiles(session quic.Session, sources []string, recursive bool, account *userAccount) (count int, errs string) {
+	entries, errs := collectCopyEntries(sources, recursive, account)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan copyEntry)
+	for i := 0; i < copyParallelStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				opened, err := sendFile(session, entry, account)
+				mutex.Lock()
+				if opened {
+					count++
+				}
+				if err != nil {
+					errs = errs + fmt.Sprintf("%s: %s\n", entry.localPath, err)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, entry := range entries {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	return count, errs
+}
+
+// list the files and directories to send (directories are walked if recursive)
+func collectCopyEntries(sources []string, recursive bool, account *userAccount) (entries []copyEntry, errs string) {
+	account.asUser(func() error {
+		entries, errs = walkCopySources(sources, recursive)
+		return nil
+	})
+	return entries, errs
+}
+
+// walk the sources (to be called by asUser: the files the user cannot read are reported when sent)
+func walkCopySources(sources []string, recursive bool) (entries []copyEntry, errs string) {
+	for _, source := range sources {
+		source = filepath.Clean(source)
+		info, err := os.Stat(source)
+		if os.IsPermission(err) {
+			errs = errs + fmt.Sprintf("%s: permission denied\n", source)
+			continue
+		} else if err != nil {
+			errs = errs + fmt.Sprintf("%s: no such file or directory\n", source)
+			continue
+		}
+		if info.IsDir() && !recursive {
+			errs = errs + fmt.Sprintf("%s: is a directory (use -r)\n", source)
+			continue
+		}
+		base := filepath.Base(source)
+		if !info.IsDir() {
+			entries = append(entries, newCopyEntry(source, base, info))
+			continue
+		}
+		filepath.Walk(source, func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				errs = errs + fmt.Sprintf("%s: cannot be read\n", walkPath)
+				return nil
+			}
+			rel, _ := filepath.Rel(source, walkPath)
+			rel = path.Join(base, filepath.ToSlash(rel))
+			if info.Mode()&os.ModeSymlink != 0 { // follow links to regular files only (no loop possible)
+				info, err = os.Stat(walkPath)
+				if err != nil || !info.Mode().IsRegular() {
+					return nil
+				}
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				errs = errs + fmt.Sprintf("%s: not a regular file\n", walkPath)
+				return nil
+			}
+			entries = append(entries, newCopyEntry(walkPath, rel, info))
+			return nil
+		})
+	}
+	return entries, errs
+}
+
+func newCopyEntry(localPath string, rel string, info os.FileInfo) copyEntry {
+	header := fileHeader{kind: FILE_KIND_REGULAR, mode: uint32(info.Mode().Perm()), modTime: info.ModTime(), size: info.Size(), path: rel}
+	if info.IsDir() {
+		header.kind = FILE_KIND_DIRECTORY
+		header.size = 0
+	}
+	return copyEntry{localPath: localPath, header: header}
+}
+
+/*
+ * open a new stream and send header, content and SHA-256 of the content on it, then wait for the status of the receiver.
+ * Returns whether the stream was opened.
+ */
+func sendFile(session quic.Session, entry copyEntry, account *userAccount) (bool, error) {
+	var file *os.File
+	var err error
+	if entry.header.kind == FILE_KIND_REGULAR {
+		err = account.asUser(func() (err error) {
+			file, err = os.Open(entry.localPath)
+			return err
+		})
+		if err != nil {
+			return false, errors.New("cannot be read")
+		}
+		defer file.Close()
+	}
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		return false, errors.New("cannot open stream")
+	}
+	defer stream.Close()
+
+	if writeFileHeader(stream, entry.header) != nil {
+		return true, errors.New("problem when writing on stream")
+	}
+	if file != nil {
+		hash := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(stream, hash), file, entry.header.size)
+		if err != nil || n != entry.header.size {
+			return true, errors.New("file changed while being copied")
+		}
+		if _, err = stream.Write(hash.Sum(nil)); err != nil {
+			return true, errors.New("problem when writing on stream")
+		}
+	}
+	err, status, msg := readCopyStatus(stream)
+	if err != nil {
+		return true, errors.New("no answer from the receiver")
+	} else if status != COPY_SUCCESS {
+		return true, errors.New(msg)
+	}
+	return true, nil
+}
+
+///////////////////
+// receiver part //
+///////////////////
+
+/*
+ * prepare to receive sourcesCount files or directories into target.
+ * If target is not an existing directory, there must be a single source that is copied as target.
+ */
+func newCopyReceiver(target string, sourcesCount int, account *userAccount) (*copyReceiver, error) {
+	receiver := &copyReceiver{target: filepath.Clean(target), sourcesCount: sourcesCount, account: account, directories: make(map[string]fileHeader)}
+	var info os.FileInfo
+	err := account.asUser(func() (err error) {
+		info, err = os.Stat(target)
+		return err
+	})
+	if err == nil && info.IsDir() {
+		receiver.targetIsDir = true
+	} else if sourcesCount > 1 {
+		return nil, errors.New(fmt.Sprintf("%s: not a directory", target))
+	}
+	return receiver, nil
+}
+
+/*
+ * receive the files on the streams opened by the sender until the copy end is read on endStream.
+ * Returns the errors (one per line), of both the sender and the receiver.
+ */
+func (receiver *copyReceiver) receiveFiles(session quic.Session, endStream quic.Stream) string {
+	results := make(chan string)
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				results <- receiver.receiveFile(stream)
+			}()
+		}
+	}()
+
+	err, count, errs := readCopyEnd(endStream)
+	if err != nil {
+		return "A problem appeared when reading the end of the copy\n"
+	}
+	for i := 0; i < count; i++ {
+		errs = errs + <-results
+	}
+
+	// set the attributes of the directories, deepest first (creating a file changes the modification time of its directory)
+	dirs := make([]string, 0, len(receiver.directories))
+	for dir := range receiver.directories {
+		dirs = append(dirs, dir)
+	}
+	for len(dirs) > 0 {
+		deepest := 0
+		for i, dir := range dirs {
+			if strings.Count(dir, string(filepath.Separator)) > strings.Count(dirs[deepest], string(filepath.Separator)) {
+				deepest = i
+			}
+		}
+		dir, header := dirs[deepest], receiver.directories[dirs[deepest]]
+		receiver.account.asUser(func() error {
+			os.Chmod(dir, os.FileMode(header.mode))
+			return os.Chtimes(dir, header.modTime, header.modTime)
+		})
+		dirs = append(dirs[:deepest], dirs[deepest+1:]...)
+	}
+	return errs
+}
+
+// receive one file (or directory) and answer with its status. Returns the error (empty if none).
+func (receiver *copyReceiver) receiveFile(stream quic.Stream) string {
+	defer stream.Close()
+	err, header := readFileHeader(stream)
+	if err != nil {
+		writeCopyStatus(stream, COPY_ERROR, "invalid file header")
+		return "invalid file header received\n"
+	}
+	dest, err := receiver.destination(header.path)
+	if err == nil && header.kind == FILE_KIND_DIRECTORY {
+		err = receiver.account.asUser(func() error {
+			return createDirectories(dest)
+		})
+		if err == nil {
+			receiver.mutex.Lock()
+			receiver.directories[dest] = header
+			receiver.mutex.Unlock()
+		}
+	} else if err == nil || header.kind == FILE_KIND_REGULAR {
+		err = receiver.receiveContent(stream, header, dest, err)
+	}
+	if err != nil {
+		writeCopyStatus(stream, COPY_ERROR, err.Error())
+		return fmt.Sprintf("%s: %s\n", header.path, err)
+	}
+	writeCopyStatus(stream, COPY_SUCCESS, "")
+	return ""
+}
+
+// destination of a relative path received
+func (receiver *copyReceiver) destination(rel string) (string, error) {
+	clean := path.Clean(rel)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("invalid path")
+	}
+	if receiver.targetIsDir {
+		return filepath.Join(receiver.target, filepath.FromSlash(clean)), nil
+	}
+	components := strings.Split(clean, "/")
+	return filepath.Join(append([]string{receiver.target}, components[1:]...)...), nil
+}
+
+/*
+ * write the content of a file in a temporary file, check its SHA-256 and then move it to dest.
+ * If the file cannot be written (previousErr or any error), the content is read anyway to answer the sender.
+ * The files are accessed with the credentials of the user (see asUser).
+ */
+func (receiver *copyReceiver) receiveContent(stream quic.Stream, header fileHeader, dest string, previousErr error) error {
+	err := previousErr
+	var file *os.File
+	tmpPath := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".quic_scp")
+	if err == nil {
+		err = receiver.account.asUser(func() error {
+			if err := createDirectories(filepath.Dir(dest)); err != nil {
+				return err
+			}
+			if err := checkWritable(dest); err != nil {
+				return err
+			}
+			// a temporary file left by a previous copy is replaced, a link is never followed
+			err := os.Remove(tmpPath)
+			if err == nil || os.IsNotExist(err) {
+				file, err = os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+			}
+			if os.IsPermission(err) {
+				return errors.New("permission denied")
+			} else if err != nil {
+				return errors.New("cannot be written")
+			}
+			return nil
+		})
+	}
+
+	var out io.Writer = ioutil.Discard
+	if file != nil {
+		out = file
+		defer receiver.account.asUser(func() error {
+			return os.Remove(tmpPath) // does nothing once the file was moved to dest
+		})
+	}
+	hash := sha256.New()
+	n, errCopy := io.CopyN(io.MultiWriter(out, hash), stream, header.size)
+	receivedHash := make([]byte, sha256.Size, sha256.Size)
+	if errCopy == nil && n == header.size {
+		_, errCopy = io.ReadFull(stream, receivedHash)
+	}
+	if file != nil {
+		if errClose := file.Close(); errClose != nil && err == nil {
+			err = errors.New("cannot be written")
+		}
+	}
+	if err != nil {
+		return err
+	} else if errCopy != nil || n != header.size {
+		return errors.New("transfer interrupted")
+	} else if !bytes.Equal(hash.Sum(nil), receivedHash) {
+		return errors.New("integrity check failed (SHA-256 mismatch)")
+	}
+
+	// apply mode and modification time, then move to dest (the file already belongs to the user)
+	return receiver.account.asUser(func() error {
+		os.Chmod(tmpPath, os.FileMode(header.mode))
+		os.Chtimes(tmpPath, header.modTime, header.modTime)
+		if os.Rename(tmpPath, dest) != nil {
+			return errors.New("cannot be written")
+		}
+		return nil
+	})
+}
+
+// an existing regular file is only replaced if it can be opened for writing (to be called by asUser)
+func checkWritable(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return errors.New("permission denied")
+	}
+	file.Close()
+	return nil
+}
+
+/////////////////////////////////////////////////
+// permissions (server run by root for a user) //
+/////////////////////////////////////////////////
+
+// files must be accessed on behalf of the user only if the server is run by root for another user
+func (account *userAccount) mustCheckPermissions() bool {
+	return account != nil && os.Getuid() == 0 && account.uid != 0
+}
+
+/*
+ * run f with the filesystem credentials of the user: the kernel checks the permissions of every path used by f
+ * (search permission of the parent directories and symbolic links included) and the files created belong to the user.
+ * Only the thread running f gets these credentials: f must access the files itself (no goroutine) and must not
+ * call asUser. If the credentials of the server cannot be restored, the thread ends with the goroutine.
+ */
+func (account *userAccount) asUser(f func() error) error {
+	if !account.mustCheckPermissions() {
+		return f()
+	}
+	runtime.LockOSThread()
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return errors.New("permission denied")
+	}
+	serverGroups := make([]uint32, len(groups))
+	for i, group := range groups {
+		serverGroups[i] = uint32(group)
+	}
+	if err = setThreadCredentials(account.uid, account.gid, account.groups); err == nil {
+		err = f()
+	} else {
+		err = errors.New("permission denied")
+	}
+	if setThreadCredentials(uint32(os.Getuid()), uint32(os.Getgid()), serverGroups) == nil {
+		runtime.UnlockOSThread()
+	}
+	return err
+}
+
+/*
+ * set the supplementary groups, fsgid and fsuid of the current thread. The raw system calls only change the
+ * credentials of this thread (unlike syscall.Setgroups, applied to all the threads of the process).
+ */
+func setThreadCredentials(uid uint32, gid uint32, groups []uint32) error {
+	gids := make([]uint32, len(groups)+1) // the address of the first group is given even without group
+	copy(gids, groups)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(groups)), uintptr(unsafe.Pointer(&gids[0])), 0); errno != 0 {
+		return errno
+	}
+	// setfsgid and setfsuid return the previous id: calling them twice tells whether the id was applied
+	syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	fsgid, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	fsuid, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	if uint32(fsgid) != gid || uint32(fsuid) != uid {
+		return errors.New("cannot change the credentials of the thread")
+	}
+	return nil
+}
+
+// create a directory and its missing parents on behalf of the user (to be called by asUser)
+func createDirectories(dir string) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return errors.New("not a directory")
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); os.IsPermission(err) {
+		return errors.New("permission denied")
+	} else if err != nil {
+		return errors.New("cannot create directory")
+	}
+	return nil
+}
+
+// status of a copy given its errors
+func getCopyStatus(errs string) byte {
+	if errs != "" {
+		return COPY_ERROR
+	}
+	return COPY_SUCCESS
+}
@@ -0,0 +1,183 @@
+package quicssh
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("7")
+}
+
+// copy files with the server and return the client config (with errors) and the exit status
+func launchCopyClient(port int, upload bool, recursive bool, sources []string, target string) (*SSHConfig, int) {
+	return launchCopyClientAs(port, "", upload, recursive, sources, target)
+}
+
+// same as launchCopyClient, for the given user
+func launchCopyClientAs(port int, username string, upload bool, recursive bool, sources []string, target string) (*SSHConfig, int) {
+	conf := SSHConfig{}
+	conf.username = username
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.copyMode = true
+	conf.copyUpload = upload
+	conf.copyRecursive = recursive
+	conf.copySources = sources
+	conf.copyTarget = target
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	return &conf, sshClient.exitStatus
+}
+
+func checkCopiedFile(path string, content string, mode os.FileMode, modTime time.Time, t *testing.T) {
+	read, err := ioutil.ReadFile(path)
+	checkValueBoolean("'file "+path+" copied'", true, err == nil, t)
+	checkValueString("content of "+path, content, string(read), t)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	checkValueInt("mode of "+path, int(mode), int(info.Mode().Perm()), t)
+	checkValueBoolean("'modification time of "+path+" preserved'", true, info.ModTime().Equal(modTime), t)
+}
+
+func TestFileCopy(t *testing.T) {
+	port := 41120
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+
+	modTime := time.Date(2017, 5, 4, 3, 2, 1, 0, time.UTC)
+	source := directory + "copy_source/"
+	os.MkdirAll(source+"tree/sub", 0755)
+	writeFile(source+"tree/a.txt", "first file\n")
+	writeFile(source+"tree/sub/b.sh", strings.Repeat("second file\n", 10000))
+	os.Chmod(source+"tree/sub/b.sh", 0750)
+	os.Chtimes(source+"tree/a.txt", modTime, modTime)
+	os.Chtimes(source+"tree/sub/b.sh", modTime, modTime)
+
+	// upload of a directory (absolute target on the server)
+	conf, status := launchCopyClient(port, true, true, []string{source + "tree"}, directory+"copy_uploaded")
+	checkValueString("errors", "", conf.testErrOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+	checkCopiedFile(directory+"copy_uploaded/a.txt", "first file\n", 0600, modTime, t)
+	checkCopiedFile(directory+"copy_uploaded/sub/b.sh", strings.Repeat("second file\n", 10000), 0750, modTime, t)
+
+	// directories are only copied with -r
+	conf, status = launchCopyClient(port, true, false, []string{source + "tree"}, directory+"copy_not_recursive")
+	checkValueInt("exit status", 1, status, t)
+	checkValueBoolean("'error about -r'", true, strings.Contains(conf.testErrOutput(), "-r"), t)
+
+	// download of several files into a directory
+	os.MkdirAll(directory+"copy_downloaded", 0755)
+	conf, status = launchCopyClient(port, false, false, []string{source + "tree/a.txt", source + "tree/sub/b.sh"}, directory+"copy_downloaded")
+	checkValueString("errors", "", conf.testErrOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+	checkCopiedFile(directory+"copy_downloaded/a.txt", "first file\n", 0600, modTime, t)
+	checkCopiedFile(directory+"copy_downloaded/b.sh", strings.Repeat("second file\n", 10000), 0750, modTime, t)
+
+	// download of a file to a new name, the other files are still copied if a source is missing
+	conf, status = launchCopyClient(port, false, false, []string{source + "tree/a.txt"}, directory+"copy_renamed.txt")
+	checkValueInt("exit status", 0, status, t)
+	checkCopiedFile(directory+"copy_renamed.txt", "first file\n", 0600, modTime, t)
+	conf, status = launchCopyClient(port, false, false, []string{source + "missing", source + "tree/a.txt"}, directory+"copy_downloaded")
+	checkValueInt("exit status", 1, status, t)
+	checkValueBoolean("'error about the missing file'", true, strings.Contains(conf.testErrOutput(), "missing"), t)
+
+	// relative paths are relative to the home directory of the user
+	if u, err := user.Current(); err == nil {
+		checkValueString("resolved path", u.HomeDir+"/dir/file", resolveCopyPath(&userAccount{home: u.HomeDir}, "~/dir/file"), t)
+		checkValueString("resolved path", u.HomeDir+"/file", resolveCopyPath(&userAccount{home: u.HomeDir}, "file"), t)
+		checkValueString("resolved path", "/tmp/file", resolveCopyPath(&userAccount{home: u.HomeDir}, "/tmp/file"), t)
+	}
+}
+
+func TestFileCopyAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the server must be run by root to copy files for another user")
+	}
+	port := 41145
+	authorizedKeys := directory + "authorized_hosts_server_copy"
+	writeFile(authorizedKeys, `user="nobody" `+dummyClientPublicKeyInline+"\n")
+	go launchServerWithResult(port, &SSHConfig{authorizedPublicKeysFile: authorizedKeys})
+
+	// a directory of the user, in which a link to a file of root replaces the temporary file of the copy
+	userDir, rootDir := directory+"copy_nobody/", directory+"copy_root_only/"
+	os.RemoveAll(userDir)
+	os.RemoveAll(rootDir)
+	os.MkdirAll(userDir, 0755)
+	os.Chown(userDir, 65534, 65534)
+	os.MkdirAll(rootDir, 0700)
+	writeFile(rootDir+"secret", "secret\n")
+	writeFile(directory+"copy_victim", "victim\n")
+	os.Chmod(directory+"copy_victim", 0600)
+	os.Symlink(directory+"copy_victim", userDir+".uploaded.quic_scp")
+	writeFile(directory+"copy_user_source", "uploaded\n")
+
+	// the file is written by the user: the link is replaced, not followed
+	conf, status := launchCopyClientAs(port, "nobody", true, false, []string{directory + "copy_user_source"}, userDir+"uploaded")
+	checkValueInt("exit status of the upload", 0, status, t)
+	read, _ := ioutil.ReadFile(userDir + "uploaded")
+	checkValueString("uploaded file", "uploaded\n", string(read), t)
+	read, _ = ioutil.ReadFile(directory + "copy_victim")
+	checkValueString("file of root", "victim\n", string(read), t)
+	if info, err := os.Stat(userDir + "uploaded"); err == nil {
+		checkValueInt("owner of the uploaded file", 65534, int(info.Sys().(*syscall.Stat_t).Uid), t)
+	}
+
+	// the directories and files of root cannot be used by the user
+	conf, status = launchCopyClientAs(port, "nobody", true, false, []string{directory + "copy_user_source"}, rootDir+"uploaded")
+	checkValueBoolean("'upload refused'", true, status != 0 && strings.Contains(conf.testErrOutput(), "permission denied"), t)
+	_, err := os.Stat(rootDir + "uploaded")
+	checkValueBoolean("'file not uploaded'", true, os.IsNotExist(err), t)
+	conf, status = launchCopyClientAs(port, "nobody", false, false, []string{rootDir + "secret"}, directory+"copy_secret")
+	checkValueBoolean("'download refused'", true, status != 0 && strings.Contains(conf.testErrOutput(), "permission denied"), t)
+	conf, status = launchCopyClientAs(port, "nobody", false, false, []string{directory + "copy_victim"}, directory+"copy_secret")
+	checkValueBoolean("'download of an unreadable file refused'", true, status != 0, t)
+	_, err = os.Stat(directory + "copy_secret")
+	checkValueBoolean("'file not downloaded'", true, os.IsNotExist(err), t)
+}
+
+func TestCopyMessages(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeCopyRequest(buf, copyRequest{upload: false, recursive: true, username: "user", sourcesCount: 2, paths: []string{"a", "dir/b"}})
+	err, request := readCopyRequest(buf)
+	checkValueBoolean("'copy request read'", true, err == nil, t)
+	checkValueBoolean("upload", false, request.upload, t)
+	checkValueBoolean("recursive", true, request.recursive, t)
+	checkValueString("username", "user", request.username, t)
+	checkValueInt("sources count", 2, request.sourcesCount, t)
+	checkValueString("paths", "a,dir/b", strings.Join(request.paths, ","), t)
+
+	modTime := time.Unix(1500000000, 123456789)
+	writeFileHeader(buf, fileHeader{kind: FILE_KIND_REGULAR, mode: 0644, modTime: modTime, size: 42, path: "dir/b"})
+	err, header := readFileHeader(buf)
+	checkValueBoolean("'file header read'", true, err == nil, t)
+	checkValueInt("mode", 0644, int(header.mode), t)
+	checkValueBoolean("'modification time'", true, header.modTime.Equal(modTime), t)
+	checkValueInt("size", 42, int(header.size), t)
+	checkValueString("path", "dir/b", header.path, t)
+
+	// a file header with an unknown kind is refused
+	writeFileHeader(buf, fileHeader{kind: 0x09, path: "x"})
+	err, _ = readFileHeader(buf)
+	checkValueBoolean("'invalid file header refused'", true, err != nil, t)
+
+	// paths leaving the target are refused by the receiver
+	receiver := &copyReceiver{target: directory, targetIsDir: true}
+	for _, p := range []string{"../etc/passwd", "/etc/passwd", "a/../../b", ""} {
+		_, err := receiver.destination(p)
+		checkValueBoolean("'path "+p+" refused'", true, err != nil, t)
+	}
+}
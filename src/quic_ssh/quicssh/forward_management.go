@@ -0,0 +1,293 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Port forwardings of a session:
+	------------------------------
+
+	Each side keeps the port forwardings of a session in a registry: the listening ones (-L, -D, and -R on the
+	server) and, on the client, the remote port forwardings requested to the server. Each one counts its
+	connections in progress (UDP flows for UDP) and the bytes sent and received through the session.
+
+	The registry is used by the escape sequences of the client (see escape_sequences.go) to list the port
+	forwardings (~#), and to add or cancel them during the session (~C). A local port forwarding is cancelled by
+	closing its listener. A remote one is cancelled by the server, which closes the listener it opened for this
+	client (message 7 in port_forwarding_control.go). The connections already forwarded are kept.
+*/
+
+// one port forwarding of a session
+type activeForward struct {
+	id          int
+	request     portForwardingRequest
+	listener    closable // listening socket (nil until listening, and for the remote port forwardings of the client)
+	connections int64    // connections (or UDP flows) in progress
+	sent        uint64   // bytes sent through the session
+	received    uint64   // bytes received through the session
+}
+
+type forwardRegistry struct {
+	mutex    sync.Mutex
+	forwards []*activeForward
+	lastID   int
+}
+
+func newForwardRegistry() *forwardRegistry {
+	return &forwardRegistry{}
+}
+
+// the counters of a nil port forwarding are ignored (connection of an unknown port forwarding)
+func (forward *activeForward) connectionOpened() {
+	if forward != nil {
+		atomic.AddInt64(&forward.connections, 1)
+	}
+}
+
+func (forward *activeForward) connectionClosed() {
+	if forward != nil {
+		atomic.AddInt64(&forward.connections, -1)
+	}
+}
+
+func (forward *activeForward) countSent(n int) {
+	if forward != nil && n > 0 {
+		atomic.AddUint64(&forward.sent, uint64(n))
+	}
+}
+
+func (forward *activeForward) countReceived(n int) {
+	if forward != nil && n > 0 {
+		atomic.AddUint64(&forward.received, uint64(n))
+	}
+}
+
+// describe a port forwarding as given on the command line, with its counters
+func (forward *activeForward) String() string {
+	option := "-R"
+	if forward.request.dynamic {
+		option = "-D"
+	} else if forward.request.local {
+		option = "-L"
+	}
+	connections := atomic.LoadInt64(&forward.connections)
+	plural := "s"
+	if connections == 1 {
+		plural = ""
+	}
+	return fmt.Sprintf("#%d %s %s: %d connection%s, %s sent, %s received", forward.id, option, forward.request.String(),
+		connections, plural, formatByteCount(atomic.LoadUint64(&forward.sent)), formatByteCount(atomic.LoadUint64(&forward.received)))
+}
+
+// byte count in B, KB, MB or GB
+func formatByteCount(count uint64) string {
+	if count < 1024 {
+		return fmt.Sprintf("%d B", count)
+	}
+	value, unit := float64(count)/1024, "KB"
+	for _, next := range []string{"MB", "GB"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, next
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+func (registry *forwardRegistry) add(request portForwardingRequest) *activeForward {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.lastID++
+	forward := &activeForward{id: registry.lastID, request: request}
+	registry.forwards = append(registry.forwards, forward)
+	return forward
+}
+
+// remove a port forwarding (if still present)
+func (registry *forwardRegistry) remove(forward *activeForward) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for i, element := range registry.forwards {
+		if element == forward {
+			registry.forwards = append(registry.forwards[:i], registry.forwards[i+1:]...)
+			return
+		}
+	}
+}
+
+// give its listener to a port forwarding (closed at once if the port forwarding was cancelled meanwhile)
+func (registry *forwardRegistry) setListener(forward *activeForward, listener closable) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, element := range registry.forwards {
+		if element == forward {
+			forward.listener = listener
+			return
+		}
+	}
+	listener.Close()
+}
+
+// port forwardings of the registry, in the order they were added
+func (registry *forwardRegistry) list() []*activeForward {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return append([]*activeForward{}, registry.forwards...)
+}
+
+/*
+ * first port forwarding listening as described by pattern: same kind (local, remote or dynamic), same
+ * protocol, and same port or Unix socket. The bind address of pattern is ignored if not given. Returns nil if none.
+ */
+func (registry *forwardRegistry) find(pattern portForwardingRequest) *activeForward {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, forward := range registry.forwards {
+		request := forward.request
+		if request.local == pattern.local && request.dynamic == pattern.dynamic && request.getProtocol() == pattern.getProtocol() &&
+			request.localPort == pattern.localPort && request.localSocket == pattern.localSocket &&
+			(pattern.bindIP == nil || pattern.bindIP.Equal(request.bindIP)) {
+			return forward
+		}
+	}
+	return nil
+}
+
+// remove a port forwarding and stop listening. Returns false if there is no port forwarding for pattern (see find)
+func (registry *forwardRegistry) cancel(pattern portForwardingRequest) bool {
+	forward := registry.find(pattern)
+	if forward == nil {
+		return false
+	}
+	registry.remove(forward)
+	if forward.listener != nil {
+		forward.listener.Close()
+	}
+	return true
+}
+
+// stop all the port forwardings
+func (registry *forwardRegistry) closeAll() {
+	for _, forward := range registry.list() {
+		registry.remove(forward)
+		if forward.listener != nil {
+			forward.listener.Close()
+		}
+	}
+}
+
+/////////////////
+// server part //
+/////////////////
+
+// stop listening for a remote port forwarding of the client, and tell the client whether it was known
+func (pFSession *portForwardingSession) cancelRemoteForwarding(stream quic.Stream, request portForwardingRequest) {
+	request.cancel = false
+	status := byte(FORWARD_UNKNOWN)
+	if pFSession.forwards.cancel(request) {
+		status = FORWARD_CANCELLED
+		pFSession.sshConfig.printDebug(fmt.Sprintf("Forwarding cancelled: %s", request.String()))
+	}
+	stream.Write([]byte{status})
+	stream.Close()
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// remote port forwarding of the client whose connections are sent to the destination of request (nil on server side or if none)
+func (pFSession *portForwardingSession) destinationForward(request portForwardingRequest) *activeForward {
+	if pFSession.sshConfig.listen {
+		return nil
+	}
+	for _, forward := range pFSession.forwards.list() {
+		remote := forward.request
+		if !remote.local && remote.getProtocol() == request.getProtocol() && remote.remoteSocket == request.remoteSocket &&
+			remote.remotePort == request.remotePort && remote.remoteIP.Equal(request.remoteIP) {
+			return forward
+		}
+	}
+	return nil
+}
+
+// port forwarding session of the client (the same one for all the port forwardings of the current session)
+func (c *Client) forwardingSession() *portForwardingSession {
+	c.forwardingMutex.Lock()
+	defer c.forwardingMutex.Unlock()
+	if c.forwarding == nil {
+		c.forwarding = newPortForwardingSession(c.conf, c.session, c.firstStream)
+	}
+	return c.forwarding
+}
+
+// stop the port forwardings of the session (the next ones use a new session, see persistent_session.go)
+func (c *Client) resetForwarding() {
+	c.forwardingMutex.Lock()
+	defer c.forwardingMutex.Unlock()
+	if c.forwarding != nil {
+		c.forwarding.forwards.closeAll()
+		c.forwarding = nil
+	}
+}
+
+// launch a port forwarding of the command line or of the escape sequences. A remote port forwarding is requested to the server.
+func (c *Client) startForwarding(request portForwardingRequest) error {
+	pFSession := c.forwardingSession()
+	if request.dynamic {
+		go pFSession.runAsDynamicSource(request)
+		return nil
+	} else if request.local {
+		go pFSession.runAsSource(request)
+		return nil
+	}
+	pFSession.startDestination() // accepts the streams opened by the server for the connections
+	forward := pFSession.forwards.add(request)
+	stream, err := pFSession.QUICSession.OpenStreamSync()
+	if err == nil {
+		err = writeControlMessage(stream, request)
+	}
+	if err != nil {
+		pFSession.forwards.remove(forward)
+		return err
+	}
+	return nil
+}
+
+// stop a port forwarding given its listening side (see forwardRegistry.find). A remote port forwarding is cancelled by the server.
+func (c *Client) cancelForwarding(pattern portForwardingRequest) error {
+	pFSession := c.forwardingSession()
+	if pattern.local {
+		if !pFSession.forwards.cancel(pattern) {
+			return errors.New("no such port forwarding")
+		}
+		return nil
+	}
+	forward := pFSession.forwards.find(pattern)
+	if forward == nil {
+		return errors.New("no such port forwarding")
+	}
+	stream, err := pFSession.QUICSession.OpenStreamSync()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	status := byte(FORWARD_UNKNOWN)
+	err = writeCancelControlMessage(stream, forward.request)
+	if err == nil {
+		err, status = readCancelStatus(stream)
+	}
+	if err != nil {
+		return err
+	}
+	pFSession.forwards.remove(forward) // also forgotten if the server did not listen for it (the request failed)
+	if status != FORWARD_CANCELLED {
+		return errors.New("the server did not listen for this port forwarding")
+	}
+	return nil
+}
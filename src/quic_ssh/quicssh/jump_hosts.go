@@ -0,0 +1,262 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"quic_utils"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Jump hosts (-J):
+	----------------
+
+	With -J [user@]host:port[,[user@]host2:port2...], the session with the server is relayed by each jump host
+	in turn. The client opens a session with the first jump host (its key is checked with the known hosts and the
+	client authenticates, only forwarding ports), then opens a stream with a dynamic port forwarding request
+	(see port_forwarding_control.go) whose protocol is 0x11. The jump host resolves the name of the next host,
+	answers with the status of a dynamic port forwarding, then relays the datagrams framed on the stream (see
+	udp_forwarding.go) to the next host and back.
+
+	The QUIC session with the next host uses this stream as its UDP socket: its handshake, the check of its key
+	and the authentication of the client are end-to-end, the jump host only relays encrypted packets. The next
+	hosts are contacted the same way through the previous ones, up to the server.
+
+	As the client does not resolve the names of the hosts behind a jump host, their keys are checked with the
+	known hosts under the name given by the user (and its port). Closing the session with the server closes the
+	relay, then the session with the jump host.
+*/
+
+// a jump host given with -J
+type jumpHost struct {
+	username string
+	hostname string
+	port     int
+}
+
+// returned by the relay once closed (same message as a closed socket, expected by quic-go)
+var errRelayClosed = errors.New("use of closed network connection")
+
+// "[user@]hostname:port" as given with -J
+func (host jumpHost) String() string {
+	address := net.JoinHostPort(host.hostname, strconv.Itoa(host.port))
+	if host.username != "" {
+		return host.username + "@" + address
+	}
+	return address
+}
+
+/*
+ * parse the argument of -J: [user@]hostname:port[,[user@]hostname:port...]
+ * IPv6 addresses must be enclosed in square brackets.
+ */
+func parseJumpHosts(arg string) (err error, hosts []jumpHost) {
+	for _, spec := range strings.Split(arg, ",") {
+		host := jumpHost{}
+		address := spec
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			host.username, address = address[:at], address[at+1:]
+		}
+		hostname, portStr, err := net.SplitHostPort(address)
+		port, errPort := strconv.Atoi(portStr)
+		if err != nil || hostname == "" || errPort != nil || port <= 0 || port > 65535 {
+			return errors.New("Bad jump host '" + spec + "'. Should be [user@]hostname:port."), nil
+		}
+		host.hostname, host.port = hostname, port
+		hosts = append(hosts, host)
+	}
+	return nil, hosts
+}
+
+/*
+ * open the session with the server: directly, or relayed by the last jump host (-J), itself contacted
+ * through the previous ones. The key of the server is checked by the caller, as for a direct session.
+ */
+func (conf *SSHConfig) dialServer() (quic.Session, error) {
+	if len(conf.jumpHosts) == 0 {
+		return conf.openSession()
+	}
+	last := conf.jumpHosts[len(conf.jumpHosts)-1]
+	conf.printDebug(fmt.Sprintf("Contacting %s through the jump host %s", conf.formatAddress(), last))
+
+	// Step 1) open the session with the jump host (through the previous ones) and check its key
+	err, hop := newClient(conf.jumpHostConfig(last, conf.jumpHosts[:len(conf.jumpHosts)-1]))
+	if err == errServerNotAllowed {
+		return nil, err // already explained to the user
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot contact the jump host %s: %s", last, err))
+	}
+
+	// Step 2) authenticate and ask the relay to the server
+	err, relay := hop.openRelay(conf.hostname, conf.port)
+	if err != nil {
+		hop.session.Close(nil)
+		return nil, errors.New(fmt.Sprintf("Jump host %s: %s", last, err))
+	}
+
+	// Step 3) QUIC handshake with the server through the relay
+	session, err := quic.Dial(relay, relay.RemoteAddr(), conf.formatAddress(), &tls.Config{InsecureSkipVerify: true}, &quic.Config{KeepAlive: true})
+	if err != nil {
+		relay.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// configuration of the session with a jump host: the keys, known hosts and terminal of the client, only forwarding ports
+func (conf *SSHConfig) jumpHostConfig(host jumpHost, previous []jumpHost) *SSHConfig {
+	return &SSHConfig{
+		bufSize:                  conf.bufSize,
+		pubKeyFile:               conf.pubKeyFile,
+		privKeyFile:              conf.privKeyFile,
+		agentSocket:              conf.agentSocket,
+		authorizedPublicKeysFile: conf.authorizedPublicKeysFile,
+		hashKnownHosts:           conf.hashKnownHosts,
+		username:                 host.username,
+		hostname:                 host.hostname,
+		port:                     host.port,
+		localPortForwarding:      true,
+		onlyForwardPort:          true,
+		printLevel:               conf.printLevel,
+		jumpHosts:                previous,
+		stdin:                    conf.stdin,
+		stdout:                   conf.stdout,
+		stderr:                   conf.stderr,
+	}
+}
+
+/*
+ * authenticate on the jump host (steps 4 and 5 of Run, only forwarding ports), then ask it to relay the
+ * datagrams of a new stream to hostname:port. The session with the jump host ends when the relay is closed.
+ */
+func (c *Client) openRelay(hostname string, port int) (error, *relayConn) {
+	if err := quic_utils.ServeClientPublicKeyWithSigner(c.session, c.firstStream, c.signer, c.publicKey); err != nil {
+		return err, nil
+	}
+	if err := c.setServerMode(); err != nil {
+		return err, nil
+	}
+	stream, err := c.session.OpenStreamSync()
+	if err != nil {
+		return err, nil
+	}
+	err = writeDynamicControlMessage(stream, hostname, uint16(port), PROTOCOL_UDP)
+	status := []byte{DYNAMIC_FAILURE}
+	if err == nil {
+		_, err = io.ReadFull(stream, status)
+		if quicErr, ok := err.(*qerr.QuicError); ok && quicErr.ErrorMessage != "" { // closed with a reason (service refused, ...)
+			err = errors.New("Connection closed by the server: " + quicErr.ErrorMessage)
+		}
+	}
+	if err == nil && status[0] != DYNAMIC_SUCCESS {
+		err = errors.New(fmt.Sprintf("relay to %s refused or failed (%s)", net.JoinHostPort(hostname, strconv.Itoa(port)), describeDynamicStatus(status[0])))
+	}
+	if err != nil {
+		stream.Close()
+		return err, nil
+	}
+	return nil, &relayConn{
+		hop:    c,
+		stream: stream,
+		remote: relayAddr(net.JoinHostPort(strings.ToLower(hostname), strconv.Itoa(port))),
+		buffer: make([]byte, maxDatagramSize, maxDatagramSize),
+	}
+}
+
+// reason of a failed dynamic port forwarding, given its status
+func describeDynamicStatus(status byte) string {
+	switch status {
+	case DYNAMIC_HOST_UNREACHABLE:
+		return "host unreachable"
+	case DYNAMIC_CONNECTION_REFUSED:
+		return "connection refused"
+	}
+	return "not allowed or general failure"
+}
+
+// address of the host behind a relay, as given by the user ("hostname:port")
+type relayAddr string
+
+func (addr relayAddr) Network() string {
+	return "udp"
+}
+
+func (addr relayAddr) String() string {
+	return string(addr)
+}
+
+// datagrams exchanged with the next host through a jump host (the UDP socket of the QUIC session with the next host)
+type relayConn struct {
+	hop        *Client // session with the jump host
+	stream     quic.Stream
+	remote     relayAddr
+	buffer     []byte     // datagram being read
+	writeMutex sync.Mutex // each datagram is written at once
+	closeOnce  sync.Once
+	closed     int32 // set to 1 by Close (read by the goroutine of quic-go reading the relay)
+}
+
+// read the next datagram relayed from the next host
+func (relay *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	err, datagram := readDatagram(relay.stream, relay.buffer)
+	if err != nil {
+		if atomic.LoadInt32(&relay.closed) == 1 {
+			return 0, nil, errRelayClosed
+		}
+		return 0, nil, err
+	}
+	return copy(p, datagram), relay.remote, nil
+}
+
+// send a datagram to the next host (addr is always the address of the relay)
+func (relay *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	relay.writeMutex.Lock()
+	defer relay.writeMutex.Unlock()
+	if err := writeDatagram(relay.stream, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// close the relay and the session with the jump host (telling it the session ends, see feature_negotiation.go)
+func (relay *relayConn) Close() error {
+	relay.closeOnce.Do(func() {
+		atomic.StoreInt32(&relay.closed, 1)
+		relay.stream.Close()
+		if !relay.hop.legacy {
+			relay.hop.firstStream.Write([]byte{SESSION_END})
+		}
+		relay.hop.session.Close(nil)
+	})
+	return nil
+}
+
+func (relay *relayConn) LocalAddr() net.Addr {
+	return relay.hop.session.LocalAddr()
+}
+
+func (relay *relayConn) RemoteAddr() net.Addr {
+	return relay.remote
+}
+
+// the deadlines are those of the session with the jump host (the relay is only read and written by quic-go)
+func (relay *relayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (relay *relayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (relay *relayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
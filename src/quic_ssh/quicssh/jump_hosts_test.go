@@ -0,0 +1,74 @@
+package quicssh
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func init() {
+	logTmp("19")
+}
+
+func TestParseJumpHosts(t *testing.T) {
+	err, hosts := parseJumpHosts("alice@bastion:4242,[::1]:5000")
+	checkValueBoolean("'valid jump hosts'", true, err == nil, t)
+	checkValueInt("number of jump hosts", 2, len(hosts), t)
+	checkValueString("first jump host", "alice@bastion:4242", hosts[0].String(), t)
+	checkValueString("second jump host", "::1", hosts[1].hostname, t)
+	checkValueInt("port of the second jump host", 5000, hosts[1].port, t)
+
+	for _, spec := range []string{"bastion", "bastion:0", "bastion:port", ":4242", "bastion:4242,"} {
+		err, _ = parseJumpHosts(spec)
+		checkValueBoolean("'invalid jump host "+spec+"'", true, err != nil, t)
+	}
+}
+
+func TestJumpHosts(t *testing.T) {
+	bastion, hop, server := 41141, 41142, 41143
+	auditLog := directory + "audit_jump.log"
+	os.Remove(auditLog)
+	go launchServerWithResult(bastion, &SSHConfig{auditLog: auditLog})
+	go launchServerWithResult(hop, &SSHConfig{})
+	go launchServerWithResult(server, &SSHConfig{allowedModes: []int{MODE_EXEC}})
+
+	// the command is run on the server through the two jump hosts, whose keys are checked
+	writeFile(directory+"known_hosts_jump", "127.0.0.1:41141 "+dummyServerPublicKeyInline+"\n"+
+		"127.0.0.1:41142 "+dummyServerPublicKeyInline+"\n127.0.0.1:41143 "+dummyServerPublicKeyInline+"\n")
+	output, errOutput := &testBuffer{}, &testBuffer{}
+	client, err := NewClient(context.Background(), "127.0.0.1", server, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithKnownHosts(directory+"known_hosts_jump"), WithJumpHosts("127.0.0.1:41141,127.0.0.1:41142"),
+		WithCommand("echo", "jumped"), WithTerminal(strings.NewReader(""), output, errOutput), WithLogLevel("quiet"))
+	if err != nil {
+		t.Fatalf("cannot contact the server through the jump hosts: %s", err)
+	}
+	checkValueBoolean("'command run'", true, client.Run(context.Background()) == nil, t)
+	checkValueString("standard output", "jumped\n", output.String(), t)
+	checkValueInt("exit status", 0, client.ExitStatus(), t)
+
+	// the first jump host only relayed the session with the second one
+	records := readAuditRecords(auditLog, 1)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 audit record of the jump host, got %d", len(records))
+	}
+	checkValueString("mode of the jump host", "forward", records[0].Mode, t)
+	if len(records[0].Forwards) != 1 {
+		t.Fatalf("expected 1 relay by the jump host, got %d", len(records[0].Forwards))
+	}
+	checkValueString("relay of the jump host", "-J 127.0.0.1:41142", records[0].Forwards[0].Forward, t)
+
+	// the key of the server is checked end-to-end: a changed key is refused behind a trusted jump host
+	writeFile(directory+"known_hosts_jump_changed", "127.0.0.1:41141 "+dummyServerPublicKeyInline+"\n"+
+		"127.0.0.1:41143 "+dummyClientPublicKeyInline+"\n")
+	_, err = NewClient(context.Background(), "127.0.0.1", server, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithKnownHosts(directory+"known_hosts_jump_changed"), WithJumpHosts("127.0.0.1:41141"),
+		WithTerminal(strings.NewReader(""), output, errOutput), WithLogLevel("quiet"))
+	checkValueBoolean("'changed server refused'", true, err != nil, t)
+	checkValueBoolean("'change reported'", true, strings.Contains(errOutput.String(), "HAS CHANGED"), t)
+
+	// a jump host which does not forward ports cannot relay the session
+	_, err = NewClient(context.Background(), "127.0.0.1", hop, WithKeys(directory+"pr_client", directory+"pk_client"),
+		WithJumpHosts("127.0.0.1:41143"), WithTerminal(strings.NewReader(""), output, errOutput), WithLogLevel("quiet"))
+	checkValueBoolean("'relay refused'", true, err != nil && strings.Contains(err.Error(), "AllowModes"), t)
+}
@@ -0,0 +1,284 @@
+package quicssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Options of a key in the authorized keys file of the server, written before the key and
+ * separated by commas (as in OpenSSH). Values are enclosed in double quotes.
+ *
+ *   restrict,port-forwarding,permitopen="db.example.com:5432",from="192.0.2.0/24" MIGJAoGBAMlB...
+ *
+ * > command="cmd": the command run instead of the command requested by the client (and instead of
+ *   the login shell). The requested command is given in QUIC_SSH_ORIGINAL_COMMAND. File copy and
+ *   subsystems are refused.
+ * > from="pattern,...": addresses the client can connect from (wildcards, CIDR and '!' negations).
+ * > expiry-time="YYYYMMDD[HHMM[SS]]": the key is refused after this date (local time).
+ * > no-pty, no-port-forwarding, no-agent-forwarding: refuse the remote login, the port forwardings
+ *   (-L, -R and -D) or the agent forwarding (-A). restrict refuses all of them, and pty,
+ *   port-forwarding and agent-forwarding allow them again.
+ * > permitopen="host:port": allowed destination of the local and dynamic port forwardings (can be
+ *   repeated, host or port can be '*'). Any destination is allowed if not given.
+ * > permitlisten="[host:]port": allowed listening address of the remote port forwardings (can be
+ *   repeated). Any address is allowed if not given.
+ * > user="name,...": accounts the client can open a session for (login, command, copy, subsystem).
+ *   Without this option, the key only opens sessions for the account running the server: a key
+ *   of the authorized keys of a server run by root cannot log in as another user.
+ */
+type keyOptions struct {
+	command           string    // forced command ("" if none)
+	from              []string  // patterns of the allowed addresses of the client (nil if any)
+	expiryTime        time.Time // zero if the key never expires
+	noPty             bool
+	noPortForwarding  bool
+	noAgentForwarding bool
+	permitOpen        []string // allowed destinations "host:port" (nil if any)
+	permitListen      []string // allowed listening addresses "[host:]port" (nil if any)
+	users             []string // accounts the sessions can be opened for (nil if only the account running the server)
+}
+
+// environment variable giving the command requested by the client when a forced command is run
+const ORIGINAL_COMMAND_ENV = "QUIC_SSH_ORIGINAL_COMMAND"
+
+// parse the options of a line of the authorized keys file
+func parseKeyOptions(str string) (err error, options keyOptions) {
+	for _, option := range splitOutsideQuotes(str, ',') {
+		name, value, hasValue := option, "", false
+		if equal := strings.Index(option, "="); equal >= 0 {
+			name, hasValue = option[:equal], true
+			if value, err = unquoteOptionValue(option[equal+1:]); err != nil {
+				return errors.New(fmt.Sprintf("invalid value of option '%s'", name)), options
+			}
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "restrict", "no-pty", "pty", "no-port-forwarding", "port-forwarding", "no-agent-forwarding", "agent-forwarding":
+			if hasValue {
+				return errors.New(fmt.Sprintf("option '%s' has no value", name)), options
+			}
+		default:
+			if !hasValue {
+				return errors.New(fmt.Sprintf("unknown option '%s'", name)), options
+			}
+		}
+
+		switch name {
+		case "restrict":
+			options.noPty, options.noPortForwarding, options.noAgentForwarding = true, true, true
+		case "no-pty", "pty":
+			options.noPty = name == "no-pty"
+		case "no-port-forwarding", "port-forwarding":
+			options.noPortForwarding = name == "no-port-forwarding"
+		case "no-agent-forwarding", "agent-forwarding":
+			options.noAgentForwarding = name == "no-agent-forwarding"
+		case "command":
+			options.command = value
+		case "from":
+			options.from = append(options.from, strings.Split(value, ",")...)
+		case "expiry-time":
+			if options.expiryTime, err = parseExpiryTime(value); err != nil {
+				return err, options
+			}
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return errors.New(fmt.Sprintf("invalid permitopen '%s' (host:port expected)", value)), options
+			}
+			options.permitOpen = append(options.permitOpen, value)
+		case "permitlisten":
+			options.permitListen = append(options.permitListen, value)
+		case "user":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					options.users = append(options.users, name)
+				}
+			}
+			if len(options.users) == 0 {
+				return errors.New("invalid user option (names expected)"), options
+			}
+		default:
+			return errors.New(fmt.Sprintf("unknown option '%s'", name)), options
+		}
+	}
+	return nil, options
+}
+
+// split a string on a separator, except inside double quotes
+func splitOutsideQuotes(str string, separator byte) []string {
+	parts := []string{}
+	inQuotes, start := false, 0
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && inQuotes {
+			i++
+		} else if str[i] == '"' {
+			inQuotes = !inQuotes
+		} else if str[i] == separator && !inQuotes {
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// remove the double quotes around an option value (\" is an escaped quote)
+func unquoteOptionValue(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", errors.New("value must be enclosed in double quotes")
+	}
+	return strings.Replace(value[1:len(value)-1], "\\\"", "\"", -1), nil
+}
+
+func parseExpiryTime(value string) (time.Time, error) {
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	if layout, found := layouts[len(value)]; found {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("invalid expiry-time '%s' (YYYYMMDD[HHMM[SS]] expected)", value))
+}
+
+/////// checks ///////
+
+// check the address of the client and the expiry time of the key
+func (options *keyOptions) allowsClient(remoteAddr net.Addr) error {
+	if !options.expiryTime.IsZero() && time.Now().After(options.expiryTime) {
+		return errors.New("key expired")
+	}
+	if options.from != nil {
+		ip := ""
+		if udpAddr, ok := remoteAddr.(*net.UDPAddr); ok {
+			ip = udpAddr.IP.String()
+		} else if host, _, err := net.SplitHostPort(remoteAddr.String()); err == nil {
+			ip = host
+		}
+		if !matchAddressPatterns(options.from, ip) {
+			return errors.New(fmt.Sprintf("connection from %s not allowed for this key", ip))
+		}
+	}
+	return nil
+}
+
+// check the account a session is opened for: one of the users of the key, or the account running the server
+func (options *keyOptions) allowsAccount(account *userAccount) error {
+	if options.users == nil {
+		if account.uid != uint32(os.Getuid()) {
+			return errors.New(fmt.Sprintf("This key cannot open a session for user '%s' (user option).", account.name))
+		}
+		return nil
+	}
+	for _, name := range options.users {
+		if name == account.name {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("This key cannot open a session for user '%s' (user option).", account.name))
+}
+
+// check a port forwarding request received by the server (or an agent forwarding stream)
+func (options *keyOptions) allowsForwarding(request portForwardingRequest) error {
+	if request.agent {
+		if options.noAgentForwarding {
+			return errors.New("agent forwarding not allowed for this key")
+		}
+		return nil
+	}
+	if options.noPortForwarding {
+		return errors.New("port forwarding not allowed for this key")
+	}
+	if request.local && options.permitOpen != nil && !options.permitsOpen(request) {
+		return errors.New("destination not permitted for this key (permitopen)")
+	}
+	if !request.local && options.permitListen != nil && !options.permitsListen(request) {
+		return errors.New("listening address not permitted for this key (permitlisten)")
+	}
+	return nil
+}
+
+// check the destination of a local or dynamic port forwarding
+func (options *keyOptions) permitsOpen(request portForwardingRequest) bool {
+	if request.remoteSocket != "" {
+		return false
+	}
+	name, ip := request.hostname, request.remoteIP
+	if request.dynamic {
+		ip = net.ParseIP(request.hostname)
+	}
+	for _, permitted := range options.permitOpen {
+		host, port, err := net.SplitHostPort(permitted)
+		if err == nil && matchPort(port, request.remotePort) && matchHost(host, name, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check the listening address of a remote port forwarding (all interfaces if no bind address)
+func (options *keyOptions) permitsListen(request portForwardingRequest) bool {
+	if request.localSocket != "" {
+		return false
+	}
+	for _, permitted := range options.permitListen {
+		host, port, err := net.SplitHostPort(permitted)
+		if err != nil {
+			host, port = "*", permitted // only a port
+		}
+		if matchPort(port, request.localPort) && (host == "*" || (request.bindIP != nil && matchHost(host, "", request.bindIP))) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(pattern string, port uint16) bool {
+	return pattern == "*" || pattern == strconv.Itoa(int(port))
+}
+
+// check a host of the options with the name and/or the IP address of a destination
+func matchHost(pattern string, name string, ip net.IP) bool {
+	if pattern == "*" || (name != "" && strings.EqualFold(pattern, name)) {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if patternIP := net.ParseIP(pattern); patternIP != nil {
+		return patternIP.Equal(ip)
+	}
+	addresses, err := net.LookupIP(pattern)
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check an IP address with patterns (wildcards or CIDR). A matching negated pattern refuses the address.
+func matchAddressPatterns(patterns []string, ip string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		match := false
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			match = network.Contains(net.ParseIP(ip))
+		} else {
+			match = matchWildcard(strings.ToLower(pattern), strings.ToLower(ip))
+		}
+		if match && negated {
+			return false
+		}
+		matched = matched || match
+	}
+	return matched
+}
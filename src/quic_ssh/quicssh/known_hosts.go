@@ -0,0 +1,330 @@
+package quicssh
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"quic_utils"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The known hosts file of the client lists the keys of the trusted servers, one server per line:
+ *
+ *   hostname,192.0.2.10 MIGJAoGBAKjbx1uVtvN+i/W+...
+ *   |1|kZ8nO0dK8kq3Oj2YcWx3hbzVn8o=|4vVv1xSxa2yTqXk5l0RkJt6MqxE= MCowBQYDK2VwAyEA...
+ *   *.example.com,!gw.example.com MCowBQYDK2VwAyEA...
+ *
+ * The first field is a comma-separated list of patterns matched against the hostname given on
+ * the command line and the IP address of the server (whatever the port):
+ * > "*" and "?" are wildcards, and a pattern starting with "!" excludes the hosts it matches,
+ * > "|1|salt|hash" is a hashed hostname (base64 of the HMAC-SHA1 of the hostname keyed by the salt),
+ * > "host:port" (or "[host]:port") only matches on this port (lines written by older versions).
+ * The second field is the single-line form of the public key. Empty lines and lines starting with
+ * '#' or "--" are ignored.
+ *
+ * The hostname and the IP address are checked separately: a line of the hostname with another key means
+ * the key changed, whatever the lines of the IP address. The lines of the IP address are only used for a
+ * hostname without line, and a known hostname whose IP address has another key is only reported.
+ */
+
+// result of the lookup of a server in the known hosts file
+type knownHostStatus int
+
+const (
+	hostUnknown knownHostStatus = iota // no line matches the server
+	hostKnown                          // a line matching the server has its key
+	hostChanged                        // lines match the server, but none has its key
+)
+
+// line of the known hosts file
+type knownHost struct {
+	patterns  []string
+	publicKey crypto.PublicKey
+	line      int
+}
+
+const hashedHostPrefix = "|1|"
+
+/*
+ * look for the server (as named by the hostname of the configuration and the address of the
+ * session) in the known hosts file. Returns the status, the server and the lines matching it.
+ */
+func checkRemotePublicKey(conf *SSHConfig, remoteAddr string, serverPk crypto.PublicKey) (knownHostStatus, serverInfo, []knownHost) {
+	names, port := remoteHostNames(conf.hostname, remoteAddr)
+	remoteServer := serverInfo{strings.Join(names, ","), serverPk}
+
+	err, knownHosts := getKnownHosts(conf.authorizedPublicKeysFile)
+	if err != nil {
+		conf.printErr(fmt.Sprintf("Cannot read the known hosts: %s", err))
+	}
+	status, matching := lookupKnownName(knownHosts, names[0], port, serverPk)
+	if len(names) > 1 {
+		ipStatus, ipMatching := lookupKnownName(knownHosts, names[1], port, serverPk)
+		if status == hostUnknown {
+			status, matching = ipStatus, ipMatching
+		} else if status == hostKnown && ipStatus == hostChanged {
+			conf.printErr(fmt.Sprintf("Warning: the %s key of host '%s' differs from the key of its IP address '%s' (line %d of the known hosts).",
+				describeKeyType(serverPk), names[0], names[1], ipMatching[0].line))
+		}
+	}
+	return status, remoteServer, matching
+}
+
+// status of one name of the server (hostname or IP address) in the known hosts, and the lines matching it
+func lookupKnownName(knownHosts []knownHost, name string, port string, serverPk crypto.PublicKey) (knownHostStatus, []knownHost) {
+	var matching []knownHost
+	for _, host := range knownHosts {
+		if matchHostPatterns(host.patterns, []string{name}, port) {
+			if quic_utils.ComparePublicKeys(host.publicKey, serverPk) {
+				return hostKnown, nil
+			}
+			matching = append(matching, host)
+		}
+	}
+	if len(matching) > 0 {
+		return hostChanged, matching
+	}
+	return hostUnknown, nil
+}
+
+// names of the server (hostname given by the user, then IP address) and port, given its address
+func remoteHostNames(hostname string, remoteAddr string) ([]string, string) {
+	ip, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	names := []string{}
+	hostname = strings.ToLower(strings.Trim(hostname, "[]"))
+	if hostname != "" && hostname != ip {
+		names = append(names, hostname)
+	}
+	return append(names, ip), port
+}
+
+// ask to user if the unknown host can be trusted. If trusted, add [names, key] to known hosts file
+func askForUnknownRemotePublicKey(remoteServer serverInfo, conf *SSHConfig) bool {
+	conf.printMsg(fmt.Sprintf("\nThe authenticity of host '%s' cannot be established.\n%s key fingerprint is %s.\n\nDo you still want to connect to this host (yes/no)?",
+		remoteServer.hosts, describeKeyType(remoteServer.publicKey), keyFingerprint(remoteServer.publicKey)))
+	answer := ""
+	fmt.Fscanln(conf.input(), &answer)
+	switch answer {
+	case "yes", "YES", "y", "Y":
+	default:
+		return false
+	}
+
+	hosts := remoteServer.hosts
+	if conf.hashKnownHosts {
+		hashed := []string{}
+		for _, name := range strings.Split(hosts, ",") {
+			err, hashedName := hashHostname(name)
+			if err != nil {
+				conf.printErr(fmt.Sprintf("Failed to add the host to the list of known hosts: %s", err))
+				return true
+			}
+			hashed = append(hashed, hashedName)
+		}
+		hosts = strings.Join(hashed, ",")
+	}
+	line, err := quic_utils.InlinePublicKey(remoteServer.publicKey)
+	if err == nil {
+		err = appendKnownHost(conf.authorizedPublicKeysFile, hosts+" "+line)
+	}
+	if err != nil {
+		conf.printErr(fmt.Sprintf("Failed to add the host to the list of known hosts: %s", err))
+		return true
+	}
+	conf.printMsg(fmt.Sprintf("Permanently added '%s' (%s) to the list of known hosts.", remoteServer.hosts, describeKeyType(remoteServer.publicKey)))
+	return true
+}
+
+// refuse the connection to a known host which does not have the key of the file anymore
+func reportChangedRemotePublicKey(remoteServer serverInfo, matching []knownHost, conf *SSHConfig) {
+	msg := "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"
+	msg += "@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n"
+	msg += "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"
+	msg += fmt.Sprintf("The host '%s' sent a key which is not the one recorded for it. Someone could be\n", remoteServer.hosts)
+	msg += "intercepting the connection (man-in-the-middle attack), or the key of the host was replaced.\n"
+	msg += fmt.Sprintf("The fingerprint of the %s key sent by the host is:\n%s\n", describeKeyType(remoteServer.publicKey), keyFingerprint(remoteServer.publicKey))
+	for _, host := range matching {
+		msg += fmt.Sprintf("Recorded %s key %s in %s:%d\n", describeKeyType(host.publicKey), keyFingerprint(host.publicKey), conf.authorizedPublicKeysFile, host.line)
+	}
+	msg += "If the new key is expected, remove these lines from the known hosts file.\n"
+	msg += "Host key verification failed."
+	conf.printErr(msg)
+}
+
+// open known hosts file to produce a list of trusted (patterns, publicKey). A missing file has no host.
+func getKnownHosts(file string) (error, []knownHost) {
+	var result []knownHost
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "--") {
+			continue
+		}
+		publicKey, err := quic_utils.ParseInlinePublicKey(fields[1])
+		if err != nil {
+			continue // invalid keys are ignored
+		}
+		result = append(result, knownHost{strings.Split(fields[0], ","), publicKey, i + 1})
+	}
+	return nil, result
+}
+
+// add a line at the end of the known hosts file (created if missing)
+func appendKnownHost(file string, line string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		line = "\n" + line
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write([]byte(line + "\n")); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/////// patterns ///////
+
+// check if the names of a server match a pattern list (a matching negated pattern rejects the line)
+func matchHostPatterns(patterns []string, names []string, port string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for _, name := range names {
+			if matchHostPattern(pattern, name, port) {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+func matchHostPattern(pattern string, name string, port string) bool {
+	if strings.HasPrefix(pattern, hashedHostPrefix) {
+		return matchHashedHostname(pattern, name)
+	}
+	if host, patternPort, found := splitPatternPort(pattern); found {
+		if patternPort != port {
+			return false
+		}
+		pattern = host
+	}
+	return matchWildcard(strings.ToLower(pattern), strings.ToLower(name))
+}
+
+// split "[host]:port" and "host:port" patterns (IPv6 addresses without brackets have no port)
+func splitPatternPort(pattern string) (string, string, bool) {
+	var host, port string
+	if strings.HasPrefix(pattern, "[") {
+		end := strings.Index(pattern, "]:")
+		if end < 0 {
+			return pattern, "", false
+		}
+		host, port = pattern[1:end], pattern[end+2:]
+	} else if strings.Count(pattern, ":") == 1 {
+		colon := strings.Index(pattern, ":")
+		host, port = pattern[:colon], pattern[colon+1:]
+	} else {
+		return pattern, "", false
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return pattern, "", false
+	}
+	return host, port, true
+}
+
+// match a name with a pattern where '*' matches any sequence of characters and '?' any character
+func matchWildcard(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchWildcard(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// hash a hostname for the known hosts file: "|1|" + base64(salt) + "|" + base64(HMAC-SHA1(salt, hostname))
+func hashHostname(name string) (error, string) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return err, ""
+	}
+	return nil, hashedHostPrefix + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(hostnameHMAC(salt, name))
+}
+
+func matchHashedHostname(pattern string, name string) bool {
+	parts := strings.Split(strings.TrimPrefix(pattern, hashedHostPrefix), "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+	hash, err2 := base64.StdEncoding.DecodeString(parts[1])
+	return err1 == nil && err2 == nil && hmac.Equal(hash, hostnameHMAC(salt, strings.ToLower(name)))
+}
+
+func hostnameHMAC(salt []byte, name string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+/////// display ///////
+
+// "ED25519", "ECDSA" or "RSA"
+func describeKeyType(key crypto.PublicKey) string {
+	return strings.ToUpper(strings.TrimSuffix(quic_utils.KeyType(key), "-p256"))
+}
+
+func keyFingerprint(key crypto.PublicKey) string {
+	fingerprint, err := quic_utils.Fingerprint(key)
+	if err != nil {
+		return "(invalid key)"
+	}
+	return fingerprint
+}
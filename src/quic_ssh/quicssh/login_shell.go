@@ -0,0 +1,201 @@
+package quicssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const defaultShell = "/bin/sh"
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// account of the user for which a remote login is requested
+type userAccount struct {
+	name   string
+	home   string
+	shell  string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// login shell running on the slave side of a pseudo-terminal
+type loginShell struct {
+	account *userAccount
+	cmd     *exec.Cmd
+	pty     *os.File  // master side of the pseudo-terminal
+	exited  chan bool // closed when the shell process exits
+}
+
+/*
+ * find the account of a user. An empty username means the user running the server.
+ * If the server is not run by root, it can only open sessions for its own user.
+ */
+func lookupAccount(username string) (*userAccount, error) {
+	var u *user.User
+	var err error
+	if username == "" {
+		u, err = user.Current()
+	} else {
+		u, err = user.Lookup(username)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unknown user '%s'.", username))
+	}
+
+	uid, err1 := strconv.Atoi(u.Uid)
+	gid, err2 := strconv.Atoi(u.Gid)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid account for user '%s'.", u.Username))
+	}
+	if os.Getuid() != 0 && os.Getuid() != uid {
+		return nil, errors.New(fmt.Sprintf("Server is not allowed to open a session for user '%s'.", u.Username))
+	}
+
+	account := &userAccount{
+		name:  u.Username,
+		home:  u.HomeDir,
+		shell: getLoginShell(u.Username),
+		uid:   uint32(uid),
+		gid:   uint32(gid),
+	}
+	groupIds, err := u.GroupIds()
+	if err == nil {
+		for _, group := range groupIds {
+			if id, err := strconv.Atoi(group); err == nil {
+				account.groups = append(account.groups, uint32(id))
+			}
+		}
+	}
+	return account, nil
+}
+
+// find the account of a user requested by a client, if the key of the client is bound to it (see keyOptions.allowsAccount)
+func (client *clientServed) lookupAccount(username string) (*userAccount, error) {
+	account, err := lookupAccount(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.options.allowsAccount(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+/*
+ * account of the port forwardings of a client, whose filesystem credentials are used for the Unix sockets on
+ * the server: the first user of the key of the client (see keyOptions.allowsAccount), or the account running the server.
+ */
+func (client *clientServed) forwardingAccount() (*userAccount, error) {
+	username := ""
+	if len(client.options.users) > 0 {
+		username = client.options.users[0]
+	}
+	return client.lookupAccount(username)
+}
+
+// get the login shell of a user from /etc/passwd (or defaultShell if not found)
+func getLoginShell(username string) string {
+	data, err := ioutil.ReadFile("/etc/passwd")
+	if err != nil {
+		return defaultShell
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := strings.Split(string(line), ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return defaultShell
+}
+
+// prepare the login shell of a user (with the given arguments), run from its home directory in a new session
+func newUserCommand(account *userAccount, args ...string) *exec.Cmd {
+	cmd := exec.Command(account.shell, args...)
+	cmd.Dir = account.home
+	cmd.Env = []string{
+		"HOME=" + account.home,
+		"USER=" + account.name,
+		"LOGNAME=" + account.name,
+		"SHELL=" + account.shell,
+		"PATH=" + defaultPath,
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if os.Getuid() == 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: account.uid, Gid: account.gid, Groups: account.groups}
+	}
+	return cmd
+}
+
+// spawn the login shell of the account (or the command if not empty) on a new pseudo-terminal (with additional environment variables)
+func startLoginShell(account *userAccount, request terminalRequest, command string, env []string) (*loginShell, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, errors.New("Cannot allocate a pseudo-terminal.")
+	}
+	defer slave.Close() // the shell keeps its own copy of the slave
+	if os.Getuid() == 0 { // otherwise the slave already belongs to the user running the server
+		if err = setPtyOwner(slave, account); err != nil {
+			master.Close()
+			return nil, errors.New("Cannot give the pseudo-terminal to the user.")
+		}
+	}
+	if request.rows > 0 && request.cols > 0 {
+		setWindowSize(master, request.rows, request.cols)
+	}
+
+	// a leading '-' in argv[0] asks the shell to behave as a login shell
+	cmd := newUserCommand(account)
+	cmd.Args = []string{"-" + filepath.Base(account.shell)}
+	if command != "" { // forced command of the key of the client
+		cmd = newUserCommand(account, "-c", command)
+	}
+	cmd.Env = append(append(cmd.Env, "TERM="+request.term), env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	if err = cmd.Start(); err != nil {
+		master.Close()
+		return nil, errors.New(fmt.Sprintf("Cannot start shell '%s'.", account.shell))
+	}
+
+	shell := &loginShell{account: account, cmd: cmd, pty: master, exited: make(chan bool)}
+	go func() {
+		cmd.Wait()
+		close(shell.exited)
+	}()
+	return shell, nil
+}
+
+// hang up the shell (if still running) and release the pseudo-terminal
+func (shell *loginShell) stop() {
+	select {
+	case <-shell.exited:
+	default:
+		syscall.Kill(-shell.cmd.Process.Pid, syscall.SIGHUP) // the shell leads its own process group (setsid)
+	}
+	shell.pty.Close()
+}
+
+// apply a new window size to the pseudo-terminal (the kernel sends SIGWINCH to the foreground processes)
+func (shell *loginShell) resize(rows uint16, cols uint16) error {
+	return setWindowSize(shell.pty, rows, cols)
+}
+
+// deliver a signal to the foreground process group of the pseudo-terminal (or to the shell itself)
+func (shell *loginShell) signal(sig syscall.Signal) error {
+	pgid, err := getForegroundProcessGroup(shell.pty)
+	if err != nil || pgid <= 0 {
+		pgid = shell.cmd.Process.Pid
+	}
+	return syscall.Kill(-pgid, sig)
+}
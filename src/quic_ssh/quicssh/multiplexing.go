@@ -0,0 +1,302 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+ * Multiplexing of a session (MODE_MUX), used for the connection sharing (-M and -S): once
+ * authenticated, the client asks the session sharing (mode "7" of the older protocol, see
+ * feature_negotiation.go) and the session carries several channels. A channel
+ * behaves as a whole session for the other parts of the program (see channelSession): it starts
+ * with a first stream opened by the client, on which the mode of the channel is asked as usual.
+ * > each stream starts with the id of its channel (4 bytes), written by the side opening it,
+ * > the first stream of the session becomes the control stream of the multiplexing, on which
+ *   |CHANNEL_CLOSE|channel id (4 bytes)| tells the other side that a channel is closed,
+ * > a stream of an unknown channel opened by the client is the first stream of a new channel.
+ * The session is closed by the client when it does not share it anymore.
+ */
+
+const MODE_MUX = 7
+
+const CHANNEL_CLOSE = 0x01
+
+// channels of a multiplexed session
+type sessionMux struct {
+	session       quic.Session
+	controlStream quic.Stream
+	server        bool // the channels are opened by the client
+	mutex         sync.Mutex
+	writeMutex    sync.Mutex // control messages can be written by several channels
+	channels      map[uint32]*channelSession
+	nextChannel   uint32
+	newChannels   chan *channelSession // if server, channels opened by the client
+	closed        chan bool            // closed when the session or the control stream is closed
+}
+
+// channel of a multiplexed session, used as a session (its streams are streams of the shared session)
+type channelSession struct {
+	quic.Session
+	mux       *sessionMux
+	id        uint32
+	mutex     sync.Mutex
+	accepted  []quic.Stream // streams opened by the other side, not accepted yet
+	streams   []quic.Stream // all the streams of the channel, reset when it is closed
+	notify    chan bool     // a stream was added to accepted
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+/*
+ * start multiplexing a session whose control stream is the first stream. The streams opened by the
+ * other side are dispatched to their channel until the session is closed.
+ */
+func newSessionMux(session quic.Session, controlStream quic.Stream, server bool) *sessionMux {
+	mux := &sessionMux{
+		session:       session,
+		controlStream: controlStream,
+		server:        server,
+		channels:      make(map[uint32]*channelSession),
+		nextChannel:   1,
+		newChannels:   make(chan *channelSession),
+		closed:        make(chan bool),
+	}
+	go mux.readControlMessages()
+	go mux.dispatchStreams()
+	return mux
+}
+
+// if client, open a new channel (its first stream is opened by the caller)
+func (mux *sessionMux) openChannel() (*channelSession, error) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	select {
+	case <-mux.closed:
+		return nil, errors.New("shared session closed")
+	default:
+	}
+	channel := mux.newChannel(mux.nextChannel)
+	mux.nextChannel++
+	return channel, nil
+}
+
+// if server, wait for the next channel opened by the client (its first stream is already accepted)
+func (mux *sessionMux) acceptChannel() (*channelSession, error) {
+	select {
+	case channel := <-mux.newChannels:
+		return channel, nil
+	case <-mux.closed:
+		return nil, errors.New("shared session closed")
+	}
+}
+
+// channel not closed yet, given its id (nil if none)
+func (mux *sessionMux) channel(id uint32) *channelSession {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return mux.channels[id]
+}
+
+// number of channels not closed yet
+func (mux *sessionMux) activeChannels() int {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return len(mux.channels)
+}
+
+// must be called after locking the mutex
+func (mux *sessionMux) newChannel(id uint32) *channelSession {
+	ctx, cancel := context.WithCancel(mux.session.Context())
+	channel := &channelSession{
+		Session: mux.session,
+		mux:     mux,
+		id:      id,
+		notify:  make(chan bool, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	mux.channels[id] = channel
+	return channel
+}
+
+// accept the streams of the session and give them to their channel
+func (mux *sessionMux) dispatchStreams() {
+	for {
+		stream, err := mux.session.AcceptStream()
+		if err != nil {
+			mux.close()
+			return
+		}
+		header := make([]byte, 4, 4)
+		if _, err := io.ReadFull(stream, header); err != nil {
+			stream.CancelRead(0)
+			continue
+		}
+		id := uint32(decodeInt(header))
+
+		mux.mutex.Lock()
+		channel, found := mux.channels[id]
+		isNew := !found && mux.server && id >= mux.nextChannel
+		if isNew {
+			channel = mux.newChannel(id)
+			mux.nextChannel = id + 1
+		}
+		mux.mutex.Unlock()
+		if channel == nil { // stream of a closed channel
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			continue
+		}
+		channel.addAcceptedStream(stream)
+		if isNew {
+			select {
+			case mux.newChannels <- channel:
+			case <-mux.closed:
+			}
+		}
+	}
+}
+
+// read the control messages of the other side (channels closed)
+func (mux *sessionMux) readControlMessages() {
+	message := make([]byte, 5, 5)
+	for {
+		if _, err := io.ReadFull(mux.controlStream, message); err != nil || message[0] != CHANNEL_CLOSE {
+			mux.close()
+			return
+		}
+		mux.mutex.Lock()
+		channel := mux.channels[uint32(decodeInt(message[1:]))]
+		mux.mutex.Unlock()
+		if channel != nil {
+			channel.closeChannel(false)
+		}
+	}
+}
+
+// the session is closed (or not usable anymore): close all the channels
+func (mux *sessionMux) close() {
+	mux.mutex.Lock()
+	select {
+	case <-mux.closed:
+		mux.mutex.Unlock()
+		return
+	default:
+		close(mux.closed)
+	}
+	channels := make([]*channelSession, 0, len(mux.channels))
+	for _, channel := range mux.channels {
+		channels = append(channels, channel)
+	}
+	mux.mutex.Unlock()
+	for _, channel := range channels {
+		channel.closeChannel(false)
+	}
+}
+
+/////// channels ///////
+
+func (channel *channelSession) addAcceptedStream(stream quic.Stream) {
+	channel.mutex.Lock()
+	channel.accepted = append(channel.accepted, stream)
+	channel.streams = append(channel.streams, stream)
+	channel.mutex.Unlock()
+	select {
+	case channel.notify <- true:
+	default:
+	}
+}
+
+func (channel *channelSession) AcceptStream() (quic.Stream, error) {
+	for {
+		channel.mutex.Lock()
+		if len(channel.accepted) > 0 {
+			stream := channel.accepted[0]
+			channel.accepted = channel.accepted[1:]
+			channel.mutex.Unlock()
+			return stream, nil
+		}
+		channel.mutex.Unlock()
+		select {
+		case <-channel.notify:
+		case <-channel.ctx.Done():
+			return nil, errors.New("channel closed")
+		}
+	}
+}
+
+func (channel *channelSession) OpenStream() (quic.Stream, error) {
+	return channel.OpenStreamSync()
+}
+
+// open a stream of the shared session and write the id of the channel on it
+func (channel *channelSession) OpenStreamSync() (quic.Stream, error) {
+	if channel.ctx.Err() != nil {
+		return nil, errors.New("channel closed")
+	}
+	stream, err := channel.Session.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(encodeInt(int(channel.id))); err != nil {
+		return nil, err
+	}
+	channel.mutex.Lock()
+	channel.streams = append(channel.streams, stream)
+	channel.mutex.Unlock()
+	return stream, nil
+}
+
+func (channel *channelSession) AcceptUniStream() (quic.ReceiveStream, error) {
+	return nil, errors.New("unidirectional streams are not multiplexed")
+}
+
+func (channel *channelSession) OpenUniStream() (quic.SendStream, error) {
+	return nil, errors.New("unidirectional streams are not multiplexed")
+}
+
+func (channel *channelSession) OpenUniStreamSync() (quic.SendStream, error) {
+	return nil, errors.New("unidirectional streams are not multiplexed")
+}
+
+// close the channel only (the other channels keep the session)
+func (channel *channelSession) Close(error) error {
+	channel.closeChannel(true)
+	return nil
+}
+
+// the context is cancelled when the channel is closed
+func (channel *channelSession) Context() context.Context {
+	return channel.ctx
+}
+
+// reset the streams of the channel, and tell it to the other side if closed on this side
+func (channel *channelSession) closeChannel(notifyPeer bool) {
+	channel.closeOnce.Do(func() {
+		mux := channel.mux
+		mux.mutex.Lock()
+		delete(mux.channels, channel.id)
+		mux.mutex.Unlock()
+		channel.cancel()
+
+		channel.mutex.Lock()
+		streams := channel.streams
+		channel.streams, channel.accepted = nil, nil
+		channel.mutex.Unlock()
+		for _, stream := range streams {
+			stream.CancelRead(0)
+			stream.CancelWrite(0) // fails if the stream was already closed
+		}
+
+		if notifyPeer {
+			mux.writeMutex.Lock()
+			mux.controlStream.Write(append([]byte{CHANNEL_CLOSE}, encodeInt(int(channel.id))...))
+			mux.writeMutex.Unlock()
+		}
+	})
+}
@@ -0,0 +1,689 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"quic_utils"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ * Persistent remote logins (--persist and --attach): the shell of a persistent session keeps running
+ * when its client disconnects, and a client presenting the same key and the token of the session
+ * reattaches it, as with tmux or mosh.
+ * > the client asks for a persistent session (or gives the token of the session to reattach) just
+ *   before its terminal request, and the server answers with the token of the session (see
+ *   terminal_control.go). The shell also gets its token in QUIC_SSH_SESSION,
+ * > the output of the shell is read by the server even without client: the output written since the
+ *   screen was last cleared is kept (at most screenBufferSize bytes, see screenBuffer). While a client
+ *   is attached, the shell waits for the client to get its output instead (nothing is lost),
+ * > the client reattaching gets this output replayed on a cleared screen, then the size of its
+ *   terminal is applied and the programs running on the pseudo-terminal are asked to redraw (SIGWINCH),
+ * > a client reattaching a session that is still attached (its connection is not detected as lost
+ *   yet) takes it over,
+ * > a detached shell is stopped after DetachTimeout (defaultDetachTimeout if not set).
+ * The client reconnects by itself when its connection is lost, during reconnectTimeout.
+ */
+
+// environment variable giving its token to the shell of a persistent session
+const sessionTokenEnv = "QUIC_SSH_SESSION"
+
+const defaultDetachTimeout = time.Hour
+const screenBufferSize = 64 * 1024
+
+const reconnectTimeout = 2 * time.Minute
+const reconnectInterval = 2 * time.Second
+
+// sequences clearing the whole screen: the output written before is not needed to redraw it
+var clearScreenSequences = [][]byte{[]byte("\x1b[2J"), []byte("\x1bc")}
+
+// sequences switching to the alternate screen of the full-screen programs, and back
+var alternateScreenOn = [][]byte{[]byte("\x1b[?1049h"), []byte("\x1b[?1047h"), []byte("\x1b[?47h")}
+var alternateScreenOff = [][]byte{[]byte("\x1b[?1049l"), []byte("\x1b[?1047l"), []byte("\x1b[?47l")}
+
+/////////////////
+// server part //
+/////////////////
+
+// shells of the persistent sessions of a server, given their token
+type persistentShells struct {
+	mutex  sync.Mutex
+	shells map[string]*persistentShell
+}
+
+// login shell of a persistent session, attached to at most one client at a time
+type persistentShell struct {
+	token       string
+	registry    *persistentShells
+	shell       *loginShell
+	publicKey   crypto.PublicKey // key of the client that started the session, required to reattach it
+	agent       *agentForwarding // nil if the agent is not forwarded
+	screen      *screenBuffer
+	mutex       sync.Mutex
+	attachment  *shellAttachment // client attached (nil if detached)
+	detachTimer *time.Timer      // stops the shell if no client reattaches it
+	stopOnce    sync.Once
+}
+
+// client attached to a persistent shell
+type shellAttachment struct {
+	stream   quic.Stream
+	detached chan bool // closed when the client leaves, or when another client takes the shell over
+	done     chan bool // closed once the output is not sent to this client anymore (detached, or all sent)
+}
+
+/*
+ * output of a shell since the screen was last cleared. While a client is attached, the output it did not get
+ * yet is kept too, and the shell is blocked once screenBufferSize bytes wait for the client.
+ */
+type screenBuffer struct {
+	mutex       sync.Mutex
+	changed     *sync.Cond
+	data        []byte
+	total       int64 // bytes written since the shell started (data are the last ones)
+	screenStart int64 // offset of the output redrawing the screen (last clear, or trimmed to screenBufferSize bytes)
+	sent        int64 // offset of the output the attached client did not get yet
+	attached    bool  // a client gets the output ?
+	alternate   bool  // alternate screen in use ?
+	closed      bool  // output of the shell ended
+}
+
+func newPersistentShells() *persistentShells {
+	return &persistentShells{shells: make(map[string]*persistentShell)}
+}
+
+// random token of a new persistent session
+func newSessionToken() (string, error) {
+	token := make([]byte, 16, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func persistentLoginServerLoops(client *clientServed, serverConfig *Server, request terminalRequest, stopChanel chan bool) {
+	stream, controlStream := client.firstStream, client.controlStream
+	errorChannel := make(chan error, 2)
+	forwardAgent := request.forwardAgent && !client.options.noAgentForwarding && !serverConfig.conf.noAgentForwarding
+
+	// step 1) spawn a new shell, or take the shell of the token if the client has the key of the session
+	var err error
+	var p *persistentShell
+	var attachment *shellAttachment
+	if request.token == "" {
+		err, p, attachment = serverConfig.shells.start(client, request, forwardAgent)
+	} else {
+		err, p, attachment = serverConfig.shells.reattach(client, request, forwardAgent)
+	}
+	if err != nil {
+		stopRemoteLogin(stream, err.Error(), stopChanel)
+		return
+	}
+	serverConfig.conf.printDebug(fmt.Sprintf("Persistent session of user '%s' attached", p.shell.account.name))
+	writeTerminalControlMessage(controlStream, SESSION_TOKEN, []byte(p.token))
+
+	// step 2) send and receive data from QUIC stream/pseudo-terminal to pseudo-terminal/QUIC stream
+	go receiveCommand(errorChannel, serverConfig, p.shell.pty, stream)
+	go p.sendOutput(attachment, request, request.token != "")
+	go receiveTerminalControl(serverConfig, p.shell, controlStream)
+
+	// step 3) wait for end of service: the client leaves, another client takes the shell over, or the shell exits
+	select {
+	case <-errorChannel:
+		timeout := serverConfig.conf.detachTimeout
+		if timeout == 0 {
+			timeout = defaultDetachTimeout
+		}
+		p.detach(attachment, timeout)
+		serverConfig.conf.printDebug(fmt.Sprintf("Persistent session of user '%s' detached", p.shell.account.name))
+	case <-attachment.detached:
+		// end of the stream: the client must not reconnect
+		<-attachment.done
+		stream.Write([]byte("\r\n[Session attached by another client]\r\n"))
+		stream.Close()
+		select {
+		case <-errorChannel:
+		case <-time.After(shellExitTimeout):
+		}
+		serverConfig.conf.printDebug(fmt.Sprintf("Persistent session of user '%s' taken over by another client", p.shell.account.name))
+	case <-p.shell.exited:
+		select {
+		case <-attachment.done:
+		case <-time.After(time.Second):
+		}
+		stream.Close()
+		select {
+		case <-errorChannel:
+		case <-time.After(shellExitTimeout):
+		}
+		p.stop()
+	}
+	stopChanel <- true
+}
+
+// spawn the shell of a new persistent session, attached to the client
+func (shells *persistentShells) start(client *clientServed, request terminalRequest, forwardAgent bool) (error, *persistentShell, *shellAttachment) {
+	account, err := client.lookupAccount(request.username)
+	if err != nil {
+		return err, nil, nil
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return errors.New("Cannot create a session token."), nil, nil
+	}
+	p := &persistentShell{token: token, registry: shells, publicKey: client.publicKey, screen: newScreenBuffer()}
+	env := append(append([]string{}, client.env...), sessionTokenEnv+"="+token)
+	if forwardAgent {
+		if p.agent, err = startAgentForwarding(client.session, account); err != nil {
+			return errors.New("Cannot forward the agent."), nil, nil
+		}
+		env = append(env, p.agent.env())
+	}
+	if p.shell, err = startLoginShell(account, request, client.options.command, env); err != nil {
+		if p.agent != nil {
+			p.agent.stop()
+		}
+		return err, nil, nil
+	}
+	attachment := p.attach(client.session, client.firstStream, forwardAgent)
+	shells.mutex.Lock()
+	shells.shells[token] = p
+	shells.mutex.Unlock()
+
+	// the output is read even without client, and the session ends with the shell
+	go func() {
+		io.Copy(p.screen, p.shell.pty)
+		p.screen.close()
+	}()
+	go func() {
+		<-p.shell.exited
+		shells.mutex.Lock()
+		delete(shells.shells, p.token)
+		shells.mutex.Unlock()
+		p.mutex.Lock()
+		detached := p.attachment == nil
+		p.mutex.Unlock()
+		if detached {
+			p.stop()
+		}
+	}()
+	return nil, p, attachment
+}
+
+// attach the shell of a token to the client, if the client has the key of the session and asks the same user
+func (shells *persistentShells) reattach(client *clientServed, request terminalRequest, forwardAgent bool) (error, *persistentShell, *shellAttachment) {
+	account, err := client.lookupAccount(request.username)
+	if err != nil {
+		return err, nil, nil
+	}
+	shells.mutex.Lock()
+	defer shells.mutex.Unlock() // not expired while attached
+	p, found := shells.shells[request.token]
+	if !found || !quic_utils.ComparePublicKeys(p.publicKey, client.publicKey) || p.shell.account.name != account.name {
+		return errors.New("No persistent session with this token for this key (the session may have ended)."), nil, nil
+	}
+	return nil, p, p.attach(client.session, client.firstStream, forwardAgent)
+}
+
+// stop the shell of a session left detached, unless it was reattached in the meantime
+func (shells *persistentShells) expire(p *persistentShell) {
+	shells.mutex.Lock()
+	p.mutex.Lock()
+	expired := p.attachment == nil
+	p.mutex.Unlock()
+	if expired {
+		delete(shells.shells, p.token)
+	}
+	shells.mutex.Unlock()
+	if expired {
+		p.stop()
+	}
+}
+
+// stop the shells of all the persistent sessions, attached or not (the server shuts down)
+func (shells *persistentShells) stopAll() {
+	shells.mutex.Lock()
+	stopped := shells.shells
+	shells.shells = make(map[string]*persistentShell)
+	shells.mutex.Unlock()
+	for _, p := range stopped {
+		p.stop()
+	}
+}
+
+// attach a client to the shell (the client previously attached, if any, is detached)
+func (p *persistentShell) attach(session quic.Session, stream quic.Stream, forwardAgent bool) *shellAttachment {
+	attachment := &shellAttachment{stream: stream, detached: make(chan bool), done: make(chan bool)}
+	p.mutex.Lock()
+	if p.attachment != nil {
+		close(p.attachment.detached)
+	}
+	if p.detachTimer != nil {
+		p.detachTimer.Stop()
+		p.detachTimer = nil
+	}
+	p.attachment = attachment
+	p.mutex.Unlock()
+	p.screen.setAttached(true)
+	if p.agent != nil {
+		if forwardAgent {
+			p.agent.setSession(session)
+		} else {
+			p.agent.setSession(nil)
+		}
+	}
+	return attachment
+}
+
+// the client left: the shell keeps running until a client reattaches it, or until timeout
+func (p *persistentShell) detach(attachment *shellAttachment, timeout time.Duration) {
+	p.mutex.Lock()
+	if p.attachment != attachment { // already taken over
+		p.mutex.Unlock()
+		return
+	}
+	p.attachment = nil
+	close(attachment.detached)
+	p.detachTimer = time.AfterFunc(timeout, func() {
+		p.registry.expire(p)
+	})
+	p.mutex.Unlock()
+	p.screen.setAttached(false)
+	if p.agent != nil {
+		p.agent.setSession(nil)
+	}
+	select {
+	case <-p.shell.exited: // exited while the client was leaving
+		p.stop()
+	default:
+	}
+}
+
+// hang up the shell (if still running) and release its pseudo-terminal and agent socket
+func (p *persistentShell) stop() {
+	p.stopOnce.Do(func() {
+		p.mutex.Lock()
+		if p.detachTimer != nil {
+			p.detachTimer.Stop()
+		}
+		p.mutex.Unlock()
+		p.shell.stop()
+		if p.agent != nil {
+			p.agent.stop()
+		}
+	})
+}
+
+/*
+ * send the output of the shell to an attached client, until it is detached or the output of the shell
+ * ends. A client reattaching gets the screen redrawn first.
+ */
+func (p *persistentShell) sendOutput(attachment *shellAttachment, request terminalRequest, reattached bool) {
+	defer close(attachment.done)
+	var offset int64
+	if reattached {
+		var redraw []byte
+		redraw, offset = p.screen.redraw()
+		if _, err := attachment.stream.Write(redraw); err != nil {
+			return
+		}
+		p.resize(request.rows, request.cols)
+	}
+	for {
+		data, next := p.screen.next(offset, attachment.detached)
+		if data == nil {
+			return
+		}
+		if _, err := attachment.stream.Write(data); err != nil {
+			return
+		}
+		offset = next
+	}
+}
+
+// apply the terminal size of the client reattaching (if it did not change, only ask the programs to redraw)
+func (p *persistentShell) resize(rows uint16, cols uint16) {
+	if currentRows, currentCols, err := getWindowSize(p.shell.pty); err == nil && currentRows == rows && currentCols == cols {
+		p.shell.signal(syscall.SIGWINCH)
+		return
+	}
+	p.shell.resize(rows, cols)
+}
+
+/////// screen buffer ///////
+
+func newScreenBuffer() *screenBuffer {
+	screen := &screenBuffer{}
+	screen.changed = sync.NewCond(&screen.mutex)
+	return screen
+}
+
+/*
+ * keep the output of the shell: what is needed to redraw the screen, and what the attached client did not get yet.
+ * Blocks while the attached client has screenBufferSize bytes to get (the shell waits for the client).
+ */
+func (screen *screenBuffer) Write(output []byte) (int, error) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	for screen.attached && screen.total-screen.sent >= screenBufferSize {
+		screen.changed.Wait()
+	}
+	start := screen.total - int64(len(screen.data))
+	previous := len(screen.data)
+	screen.data = append(screen.data, output...)
+	screen.total += int64(len(output))
+
+	// the sequences can be split between two writes: they are also searched at the end of the previous output
+	from := previous - 8
+	if from < 0 {
+		from = 0
+	}
+	recent := screen.data[from:]
+	if on, off := lastIndex(recent, alternateScreenOn), lastIndex(recent, alternateScreenOff); on != off {
+		screen.alternate = on > off
+	}
+	if clear := lastIndex(recent, clearScreenSequences); clear >= 0 && start+int64(from+clear) > screen.screenStart {
+		screen.screenStart = start + int64(from+clear)
+	}
+	if screen.total-screen.screenStart > screenBufferSize {
+		// start at a new line, rather than in the middle of an escape sequence
+		screen.screenStart = screen.total - screenBufferSize
+		if newLine := bytes.IndexByte(screen.data[screen.screenStart-start:], '\n'); newLine >= 0 {
+			screen.screenStart += int64(newLine + 1)
+		}
+	}
+
+	// drop the output before the screen, unless the attached client did not get it yet
+	keepFrom := screen.screenStart
+	if screen.attached && screen.sent < keepFrom {
+		keepFrom = screen.sent
+	}
+	if keepFrom > start {
+		screen.data = append([]byte{}, screen.data[keepFrom-start:]...)
+	}
+	screen.changed.Broadcast()
+	return len(output), nil
+}
+
+// the output of the shell ended
+func (screen *screenBuffer) close() {
+	screen.mutex.Lock()
+	screen.closed = true
+	screen.mutex.Unlock()
+	screen.changed.Broadcast()
+}
+
+// a client is attached or detached (the client previously attached, if any, is woken up to see it is detached)
+func (screen *screenBuffer) setAttached(attached bool) {
+	screen.mutex.Lock()
+	screen.attached = attached
+	screen.changed.Broadcast()
+	screen.mutex.Unlock()
+}
+
+// what redraws the screen on a cleared terminal, and the offset of the output following it
+func (screen *screenBuffer) redraw() ([]byte, int64) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	redraw := []byte("\x1b[H\x1b[2J")
+	if screen.alternate {
+		redraw = append([]byte("\x1b[?1049h"), redraw...)
+	}
+	screen.setSent(screen.total)
+	start := screen.total - int64(len(screen.data))
+	return append(redraw, screen.data[screen.screenStart-start:]...), screen.total
+}
+
+/*
+ * wait for the output following offset and return it with the offset of the output following it (the output
+ * before offset was sent to the client). The output that is not kept anymore (while detached) is skipped.
+ * Returns nil once the output ended or stop is closed.
+ */
+func (screen *screenBuffer) next(offset int64, stop chan bool) ([]byte, int64) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	screen.setSent(offset)
+	for offset == screen.total && !screen.closed && !isClosed(stop) {
+		screen.changed.Wait()
+	}
+	if offset == screen.total || isClosed(stop) {
+		return nil, offset
+	}
+	start := screen.total - int64(len(screen.data))
+	if offset < start {
+		offset = start
+	}
+	return append([]byte{}, screen.data[offset-start:]...), screen.total
+}
+
+// the client got the output before offset: the shell can write again (the mutex must be locked)
+func (screen *screenBuffer) setSent(offset int64) {
+	if offset > screen.sent {
+		screen.sent = offset
+		screen.changed.Broadcast()
+	}
+}
+
+// index of the last occurrence of one of the sequences (-1 if none)
+func lastIndex(data []byte, sequences [][]byte) int {
+	last := -1
+	for _, sequence := range sequences {
+		if index := bytes.LastIndex(data, sequence); index > last {
+			last = index
+		}
+	}
+	return last
+}
+
+func isClosed(channel chan bool) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// remote login of a client launched with --persist or --attach, whose streams are replaced on each reconnection
+type persistentLogin struct {
+	client      *Client
+	mutex       sync.Mutex // protects the session and the streams of the client, and the token
+	token       string
+	confirmed   bool      // token given by the server (the session was attached at least once)
+	reconnected chan bool // closed when the streams are replaced, or when the client stops
+	stopped     bool
+}
+
+// writes on the current stream (or terminal control stream) of a persistent login, and waits for the reconnection if lost
+type persistentWriter struct {
+	login   *persistentLogin
+	control bool
+}
+
+func persistentLoginClientLoops(c *Client, stopChanel chan bool) {
+	login := &persistentLogin{client: c, token: c.conf.attachToken, reconnected: make(chan bool)}
+	c.login = login
+	if writeTerminalRequest(c.controlStream, login.terminalRequest()) != nil {
+		c.conf.printMsg("A problem appeared when requesting a terminal to the server")
+		stopChanel <- true
+		return
+	}
+	terminal := c.conf.terminal()
+	terminalState := setRawTerminal(terminal)
+
+	inputChannel := make(chan error, 1)
+	go writeMessageLoop(inputChannel, c, c.conf.input(), persistentWriter{login: login})
+	stopControl := make(chan bool, 1)
+	if c.conf.handleSignals {
+		go sendTerminalControl(persistentWriter{login: login, control: true}, terminal, stopControl)
+	}
+
+	// wait for end of service: the shell exits (end of the stream), or the standard input is closed. If
+	// the connection is lost, reconnect and reattach the session.
+	ended, sessionEnded := false, false
+	for !ended {
+		outputChannel := make(chan error, 1)
+		go login.readSessionToken(c.controlStream)
+		go receiveMessageLoop(outputChannel, c, c.firstStream, c.conf.output())
+		select {
+		case <-inputChannel:
+			ended = true
+		case err := <-outputChannel:
+			if err == io.EOF || !login.isConfirmed() {
+				ended, sessionEnded = true, true
+			} else {
+				c.conf.printTerminalMsg("Connection lost, reconnecting to the persistent session...")
+				if err := login.reconnect(); err != nil {
+					c.conf.printTerminalMsg("Cannot reconnect: " + err.Error())
+					ended = true
+				}
+			}
+		}
+	}
+	login.stop()
+	stopControl <- true
+	restoreTerminal(terminal, terminalState)
+	if !sessionEnded && login.isConfirmed() {
+		c.conf.printMsg(fmt.Sprintf("Session detached, reattach it with: --attach %s", login.getToken()))
+	}
+	stopChanel <- true
+}
+
+func (login *persistentLogin) terminalRequest() terminalRequest {
+	request := login.client.getTerminalRequest()
+	request.persistent, request.token = true, login.getToken()
+	return request
+}
+
+func (login *persistentLogin) getToken() string {
+	login.mutex.Lock()
+	defer login.mutex.Unlock()
+	return login.token
+}
+
+func (login *persistentLogin) isConfirmed() bool {
+	login.mutex.Lock()
+	defer login.mutex.Unlock()
+	return login.confirmed
+}
+
+// read the token given by the server (the first time, tell it to the user), and its other messages
+func (login *persistentLogin) readSessionToken(controlStream quic.Stream) {
+	for {
+		err, msgType, value := readTerminalControlMessage(controlStream)
+		if err != nil {
+			return
+		}
+		if msgType != SESSION_TOKEN {
+			login.client.serverNotice(msgType, value)
+			continue
+		}
+		login.mutex.Lock()
+		first := !login.confirmed && login.token == ""
+		login.token, login.confirmed = string(value), true
+		login.mutex.Unlock()
+		if first {
+			login.client.conf.printTerminalMsg(fmt.Sprintf("Persistent session %s (reattach it with --attach %s)", value, value))
+		}
+	}
+}
+
+// the writers stop waiting for a reconnection
+func (login *persistentLogin) stop() {
+	login.mutex.Lock()
+	defer login.mutex.Unlock()
+	login.stopped = true
+	close(login.reconnected)
+}
+
+// reattach the session on a new session with the server, until it works or reconnectTimeout
+func (login *persistentLogin) reconnect() error {
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		err := login.reattach()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(reconnectInterval)
+	}
+}
+
+// open a new session, authenticate and ask a remote login with the token of the session (steps 1, 2, 4 to 5b of the client)
+func (login *persistentLogin) reattach() error {
+	c := login.client
+	err, session, stream := c.openAuthenticatedSession()
+	if err != nil {
+		return err
+	}
+	if c.legacy {
+		_, err = stream.Write([]byte("1"))
+	} else {
+		err = c.negotiateFeatures(stream)
+	}
+	var controlStream quic.Stream
+	if err == nil {
+		controlStream, err = session.OpenStreamSync()
+	}
+	if err == nil {
+		err = writeTerminalRequest(controlStream, login.terminalRequest())
+	}
+	if err != nil {
+		session.Close(nil)
+		return err
+	}
+
+	login.mutex.Lock()
+	previous := c.session
+	c.session, c.firstStream, c.controlStream = session, stream, controlStream
+	close(login.reconnected)
+	login.reconnected = make(chan bool)
+	login.mutex.Unlock()
+	previous.Close(nil)
+	c.resetForwarding() // the port forwardings added with ~C were bound to the previous session
+	if c.conf.forwardAgent {
+		c.launchPortForwarding(false) // accept the agent streams of the new session
+	}
+	return nil
+}
+
+func (w persistentWriter) Write(b []byte) (int, error) {
+	for {
+		w.login.mutex.Lock()
+		stream, reconnected, stopped := w.login.client.firstStream, w.login.reconnected, w.login.stopped
+		if w.control {
+			stream = w.login.client.controlStream
+		}
+		w.login.mutex.Unlock()
+		if stopped {
+			return 0, errors.New("persistent session stopped")
+		}
+		if n, err := stream.Write(b); err == nil {
+			return n, nil
+		}
+		<-reconnected
+	}
+}
+
+// print a message during a remote login (the terminal is in raw mode)
+func (c *SSHConfig) printTerminalMsg(str string) {
+	if c.printLevel < PRINT_LEVEL_NORMAL {
+		return
+	}
+	if c.terminal() == nil {
+		fmt.Fprintln(c.errOutput(), str)
+		return
+	}
+	fmt.Fprintf(c.errOutput(), "\r\n%s\r\n", str)
+}
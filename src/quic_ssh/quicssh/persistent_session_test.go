@@ -0,0 +1,145 @@
+package quicssh
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("12")
+}
+
+// config of a client asking a persistent session (or reattaching the session of token)
+func persistentClientConfig(port int, token string, input string) *SSHConfig {
+	return &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client", persistent: true, attachToken: token, stdin: typed(input)}
+}
+
+// run a client, and wait for its session token and for an output
+func startPersistentClient(conf *SSHConfig, expected string) (*Client, chan bool) {
+	sshClient := newTestClient(conf)
+	done := make(chan bool)
+	go func() {
+		sshClient.Run(context.Background())
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		if sshClient.login != nil && sshClient.login.getToken() != "" && strings.Contains(conf.testOutput(), expected) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return sshClient, done
+}
+
+func TestPersistentSession(t *testing.T) {
+	port := 41128
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+
+	// the connection is lost: the client reconnects and the shell is still running
+	conf := persistentClientConfig(port, "", "PERSIST=kept\necho first $PERSIST\nsleep 2; echo second $PERSIST; exit\n")
+	sshClient, done := startPersistentClient(conf, "first kept")
+	checkValueBoolean("'first output'", true, strings.Contains(conf.testOutput(), "first kept"), t)
+	time.Sleep(500 * time.Millisecond) // the last line is sent
+	sshClient.login.mutex.Lock()
+	sshClient.session.Close(nil)
+	sshClient.login.mutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatalf("the client did not reconnect")
+	}
+	checkValueBoolean("'output after reconnection'", true, strings.Contains(conf.testOutput(), "second kept"), t)
+
+	// another client with the same key and the token takes the session over, and gets the screen redrawn
+	conf = persistentClientConfig(port, "", "ATTACH=yes\n")
+	sshClient, done = startPersistentClient(conf, "ATTACH=yes")
+	token := sshClient.login.getToken()
+	checkValueInt("token length", 32, len(token), t)
+
+	other := persistentClientConfig(port, token, "\n")
+	other.privKeyFile, other.pubKeyFile = directory+"pr_server", directory+"pk_server"
+	newTestClient(other).Run(context.Background())
+	checkValueBoolean("'other key refused'", true, strings.Contains(other.testOutput(), "No persistent session"), t)
+
+	attached := persistentClientConfig(port, token, "echo attached $ATTACH $QUIC_SSH_SESSION; exit\n")
+	newTestClient(attached).Run(context.Background())
+	checkValueBoolean("'screen redrawn'", true, strings.Contains(attached.testOutput(), "\x1b[H\x1b[2J") &&
+		strings.Contains(attached.testOutput(), "ATTACH=yes"), t)
+	checkValueBoolean("'session reattached'", true, strings.Contains(attached.testOutput(), "attached yes "+token), t)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the first client did not stop")
+	}
+	checkValueBoolean("'first client told'", true, strings.Contains(conf.testOutput(), "another client"), t)
+
+	// the session ended with the shell
+	ended := persistentClientConfig(port, token, "\n")
+	newTestClient(ended).Run(context.Background())
+	checkValueBoolean("'ended session refused'", true, strings.Contains(ended.testOutput(), "No persistent session"), t)
+}
+
+func TestScreenBuffer(t *testing.T) {
+	screen := newScreenBuffer()
+	screen.Write([]byte("old output\x1b[2"))
+	screen.Write([]byte("Jprompt$ ")) // clear sequence split between two writes
+	redraw, offset := screen.redraw()
+	checkValueString("redraw", "\x1b[H\x1b[2J\x1b[2Jprompt$ ", string(redraw), t)
+	checkValueInt("offset", 22, int(offset), t)
+
+	screen.Write([]byte("\x1b[?1049hvim"))
+	redraw, _ = screen.redraw()
+	checkValueBoolean("'alternate screen restored'", true, strings.HasPrefix(string(redraw), "\x1b[?1049h\x1b[H\x1b[2J"), t)
+	data, next := screen.next(offset, make(chan bool))
+	checkValueString("next output", "\x1b[?1049hvim", string(data), t)
+
+	// the output is kept up to screenBufferSize bytes, from a new line
+	screen.Write([]byte("\x1b[?1049l" + strings.Repeat("line\n", screenBufferSize/5+10)))
+	checkValueBoolean("'alternate screen left'", false, screen.alternate, t)
+	checkValueBoolean("'output trimmed'", true, len(screen.data) <= screenBufferSize && strings.HasPrefix(string(screen.data), "line\n"), t)
+	data, _ = screen.next(next, make(chan bool))
+	checkValueBoolean("'trimmed output skipped'", true, len(data) == len(screen.data), t)
+	screen.close()
+	data, _ = screen.next(screen.total, make(chan bool))
+	checkValueBoolean("'end of output'", true, data == nil, t)
+}
+
+func TestScreenBufferAttached(t *testing.T) {
+	screen := newScreenBuffer()
+	screen.setAttached(true)
+
+	// the client attached gets all the output, even cleared or larger than the buffer: the shell waits for it
+	written := make(chan bool)
+	output := "first\x1b[2J" + strings.Repeat("line\n", screenBufferSize/5+10) + "\x1bclast"
+	go func() {
+		for i := 0; i < len(output); i += 4096 {
+			end := i + 4096
+			if end > len(output) {
+				end = len(output)
+			}
+			screen.Write([]byte(output[i:end]))
+		}
+		close(written)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	checkValueBoolean("'shell waiting for the client'", false, isClosed(written), t)
+	received := ""
+	var offset int64
+	for len(received) < len(output) {
+		data, next := screen.next(offset, make(chan bool))
+		received, offset = received+string(data), next
+	}
+	<-written
+	checkValueBoolean("'whole output received'", true, received == output, t)
+	redraw, _ := screen.redraw()
+	checkValueString("redraw", "\x1b[H\x1b[2J\x1bclast", string(redraw), t)
+
+	// once detached, the output is trimmed without waiting
+	screen.setAttached(false)
+	screen.Write([]byte(strings.Repeat("line\n", screenBufferSize/5+10)))
+	checkValueBoolean("'output trimmed while detached'", true, len(screen.data) <= screenBufferSize, t)
+}
@@ -0,0 +1,457 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"net"
+	"strconv"
+	"fmt"
+	"io"
+	"errors"
+	"sync"
+	"github.com/lucas-clemente/quic-go/qerr"
+)
+
+// port forwarding requested with -L, -R or -D
+type portForwardingRequest struct {
+	local      bool   // local (-L, -D) or remote (-R) port forwarding
+	dynamic    bool   // dynamic (-D) port forwarding: the destination is chosen by the application (SOCKS/HTTP proxy)
+	bindIP     net.IP // address to listen on (nil for all interfaces)
+	localPort  uint16 // port to listen on
+	remotePort uint16
+	remoteIP   net.IP
+	hostname   string // destination of a dynamic port forwarding (instead of remoteIP)
+	protocol   byte   // PROTOCOL_TCP or PROTOCOL_UDP (0 means TCP)
+	agent      bool   // stream of a connection to the forwarded agent (-A) instead of a port forwarding
+	cancel     bool   // cancellation of a remote port forwarding (-KR, see escape_sequences.go) instead of a request
+
+	// Unix sockets (instead of bindIP:localPort and remoteIP:remotePort if not empty)
+	localSocket  string // path of the Unix socket to listen on
+	remoteSocket string // path of the Unix socket to contact
+}
+
+// is a Unix socket used on one side of the port forwarding ?
+func (request *portForwardingRequest) usesUnixSocket() bool {
+	return request.localSocket != "" || request.remoteSocket != ""
+}
+
+// protocol to forward (TCP if not specified)
+func (request *portForwardingRequest) getProtocol() byte {
+	if request.protocol == 0 {
+		return PROTOCOL_TCP
+	}
+	return request.protocol
+}
+
+// describe a port forwarding request as given on the command line
+func (request *portForwardingRequest) String() string {
+	bind := ""
+	if request.bindIP != nil {
+		bind = ipToString(request.bindIP) + ":"
+	}
+	suffix := ""
+	if request.getProtocol() == PROTOCOL_UDP {
+		suffix = "/udp"
+	}
+	if request.dynamic && request.hostname == "" {
+		return fmt.Sprintf("%s%d", bind, request.localPort)
+	} else if request.dynamic {
+		return fmt.Sprintf("%s:%d%s", request.hostname, request.remotePort, suffix)
+	}
+	listening := fmt.Sprintf("%s%d", bind, request.localPort)
+	if request.localSocket != "" {
+		listening = request.localSocket
+	}
+	destination := fmt.Sprintf("%s:%d", ipToString(request.remoteIP), request.remotePort)
+	if request.remoteSocket != "" {
+		destination = request.remoteSocket
+	}
+	return fmt.Sprintf("%s:%s%s", listening, destination, suffix)
+}
+
+type portForwardingSession struct {
+	sshConfig       *SSHConfig
+	QUICSession     quic.Session
+	QUICFirstStream quic.Stream
+	client          *clientServed
+	forwards        *forwardRegistry // port forwardings listening (or requested to the server) through this session
+	destination     sync.Once        // runAsDestination is launched once per session
+}
+
+type portForwardingFlow struct {
+	initialConfig *portForwardingSession
+	TCPConnection net.Conn
+	QUICStream    quic.Stream
+	request       portForwardingRequest
+	forward       *activeForward // counts the connection and its bytes (nil if unknown)
+}
+
+func newPortForwardingSession(sshConfig *SSHConfig, session quic.Session, firstStream quic.Stream) (*portForwardingSession) {
+	return &portForwardingSession{
+		sshConfig:       sshConfig,
+		QUICSession:     session,
+		QUICFirstStream: firstStream,
+		forwards:        newForwardRegistry(),
+	}
+}
+
+// launch runAsDestination (runAsClientDestination on client side), if not already done for this session
+func (pFSession *portForwardingSession) startDestination() {
+	pFSession.destination.Do(func() {
+		if pFSession.sshConfig.listen {
+			go pFSession.runAsDestination()
+		} else {
+			go pFSession.runAsClientDestination()
+		}
+	})
+}
+
+func (pFSession *portForwardingSession) setClientServed(client *clientServed) {
+	pFSession.client = client
+}
+
+// assuming port forwarding forwards payloads from an intermediate A to another intermediate B,
+// runAsSource launch port forwarding for A. (Thus it listens on socket and forward payloads to B)
+func (pFSession *portForwardingSession) runAsSource(request portForwardingRequest) {
+	if request.getProtocol() == PROTOCOL_UDP {
+		pFSession.runAsUDPSource(request)
+		return
+	}
+
+	// step 1) open local TCPListener (socket TCPListener)
+	forward := pFSession.forwards.add(request)
+	defer pFSession.forwards.remove(forward)
+	TCPListener := pFSession.acceptLocalConnection(request, forward)
+	if TCPListener == nil {
+		writeError(pFSession, &request, nil,"Maybe chosen port is already used")
+		return
+	}
+
+	for {
+		// step 2) accept connections on the TCPListener
+		TCPConnection, err := TCPListener.Accept()
+		if err != nil {
+			// if err != nil , stop listening. This can be because QUICSession was closed (or the port forwarding cancelled) and thus we closed the TCPListener.
+			return
+		}
+		go func() {
+			// step 3) open a new QUICStream with port forwarding destination
+			stream, err := pFSession.QUICSession.OpenStreamSync()
+			if err != nil {
+				writeError(pFSession, &request, nil,"Cannot open stream")
+				TCPConnection.Close()
+				return
+			}
+
+			// step 4) create final port forwarding config
+			forwardingConfig := pFSession.newPortForwardingFlow(TCPConnection, stream, request, forward)
+
+			// step 5) Tell destination which hostname and port it must take through a well defined control message
+			localRequest := request
+			localRequest.local = true
+			err = writeControlMessage(stream, localRequest)
+			if err != nil {
+					writeError(pFSession, &request, stream,"Problem when writing on stream")
+					TCPConnection.Close()
+					return
+			}
+
+			// step 6) send and receive data from TCPConnection/QUICStream to QUICStream/TCPConnection
+			forwardingConfig.transfer()
+		}()
+
+	}
+}
+
+// assuming port forwarding forwards payloads from an intermediate A to another intermediate B,
+// runAsDestination launch port forwarding for B. (Thus it receives payloads from A and forwards them
+// to final destination + listen answers and forward them to A.)
+func (pFSession *portForwardingSession) runAsDestination() {
+	for{
+		// step 1) accept a QUICStream
+		QUICStream, err := pFSession.QUICSession.AcceptStream()
+		if err != nil {
+			quicErr := qerr.ToQuicError(err)
+			if quicErr.ErrorCode == qerr.PeerGoingAway || quicErr.ErrorCode == qerr.NetworkIdleTimeout {
+				// this is normal if the QUICStream was closed so just exit this function
+				return
+			} else {
+				writeError(pFSession, nil, nil,"Additional stream cannot be opened")
+				return
+			}
+		}
+
+		go func() {
+			// step 2) read control message
+			err, request := pFSession.readControlMessage(QUICStream)
+			if err != nil {
+				writeError(pFSession, nil, QUICStream,"A problem appeared when reading control informations about port forwarding.")
+				return
+			}else if(pFSession.sshConfig.listen){
+				// below: comment or uncomment to see port forwarding requests on server side
+				pFSession.sshConfig.printDebug(fmt.Sprintf("New forwarding: %s (StreamID=%d)", request.String(), QUICStream.StreamID()))
+			}
+			if request.cancel { // the client stops one of its remote port forwardings (no need to be allowed)
+				pFSession.cancelRemoteForwarding(QUICStream, request)
+				return
+			}
+			if pFSession.client != nil { // on server side, apply the options of the key of the client and the configuration
+				err := pFSession.client.options.allowsForwarding(request)
+				if err == nil && !request.agent && !pFSession.sshConfig.allowsMode(MODE_PORT_FORW) { // forwarding asked during a remote login
+					err = errors.New("port forwarding not allowed by the server (AllowModes)")
+				}
+				if err == nil {
+					err = pFSession.sshConfig.allowsForwarding(request)
+				}
+				pFSession.client.audit.requestedForward(request, err)
+				if err != nil {
+					if request.dynamic {
+						QUICStream.Write([]byte{DYNAMIC_FAILURE})
+					}
+					writeError(pFSession, &request, QUICStream, "Refused by the server: "+err.Error()+".")
+					return
+				}
+			}
+			if request.agent {
+				serveForwardedAgent(pFSession.sshConfig, QUICStream)
+				return
+			}
+
+			// step 3) [Optional] if local=false, then client asks for "remote" port forwarding so we must ask as source
+			if !request.local {
+				QUICStream.Close() // in this particular case the QUICStream was just used to ask the remote port forwarding
+				pFSession.runAsSource(request)
+				return
+			}
+
+			// step 4) Contact remoteIP (or the hostname of a dynamic port forwarding, then give the result to the source)
+			var TCPConn net.Conn
+			if request.getProtocol() == PROTOCOL_UDP {
+				pFSession.runAsUDPDestination(QUICStream, request, pFSession.destinationForward(request))
+				return
+			} else if request.dynamic {
+				TCPConn, err = dialDynamicDestination(QUICStream, request)
+				if err != nil {
+					QUICStream.Close()
+					return
+				}
+			} else {
+				TCPConn, err = pFSession.dialDestination(request)
+			}
+			if err != nil {
+				writeError(pFSession, &request, QUICStream, "Cannot connect to destination")
+				return
+			}
+
+			// step 5) create final port forwarding config (on client side, the remote port forwarding of this connection counts it)
+			forwardingConfig := pFSession.newPortForwardingFlow(TCPConn, QUICStream, request, pFSession.destinationForward(request))
+
+			// step 6) send and receive data from connection/QUICStream to QUICStream/connection
+			forwardingConfig.transfer()
+		}()
+	}
+}
+
+/*
+ * on client side, accept the streams opened by the server: the agent streams (served only with -A, see
+ * agent_forwarding.go) and the connections of the remote port forwardings asked by the client. Any other
+ * stream is refused: the server cannot make the client contact another destination, nor listen.
+ */
+func (pFSession *portForwardingSession) runAsClientDestination() {
+	for {
+		// step 1) accept a QUICStream
+		QUICStream, err := pFSession.QUICSession.AcceptStream()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			// step 2) an agent stream is recognized by its first byte, before any other control message
+			typeBuffer := make([]byte, 1, 1)
+			if _, err := io.ReadFull(QUICStream, typeBuffer); err != nil {
+				QUICStream.Close()
+				return
+			}
+			if typeBuffer[0] == AGENT_STREAM {
+				serveForwardedAgent(pFSession.sshConfig, QUICStream)
+				return
+			}
+
+			// step 3) otherwise, it must be a connection of one of our remote port forwardings
+			err, request := pFSession.readControlMessageOfType(QUICStream, typeBuffer[0])
+			var forward *activeForward
+			if err == nil && request.local && !request.dynamic && !request.agent && !request.cancel {
+				forward = pFSession.destinationForward(request)
+			}
+			if forward == nil {
+				writeError(pFSession, nil, QUICStream, "Stream opened by the server refused (not a connection of a remote port forwarding)")
+				return
+			}
+
+			// step 4) contact the destination and forward the connection
+			if request.getProtocol() == PROTOCOL_UDP {
+				pFSession.runAsUDPDestination(QUICStream, request, forward)
+				return
+			}
+			TCPConn, err := pFSession.dialDestination(request)
+			if err != nil {
+				writeError(pFSession, &request, QUICStream, "Cannot connect to destination")
+				return
+			}
+			pFSession.newPortForwardingFlow(TCPConn, QUICStream, request, forward).transfer()
+		}()
+	}
+}
+
+// contact the final destination of a port forwarding (IP and port, or Unix socket)
+func (pFSession *portForwardingSession) dialDestination(request portForwardingRequest) (conn net.Conn, err error) {
+	if request.remoteSocket != "" {
+		err = pFSession.asSocketUser(func() (err error) {
+			conn, err = net.Dial("unix", request.remoteSocket)
+			return err
+		})
+		return conn, err
+	}
+	return net.Dial("tcp", ipToString(request.remoteIP)+":"+strconv.Itoa(int(request.remotePort)))
+}
+
+/*
+ * run f, which contacts or creates a Unix socket, with the filesystem credentials of the account of the client
+ * on server side (see asUser): the permissions of the socket and of its directories are checked for this account,
+ * and the sockets created belong to it.
+ */
+func (pFSession *portForwardingSession) asSocketUser(f func() error) error {
+	if !pFSession.sshConfig.listen || pFSession.client == nil {
+		return f()
+	}
+	account, err := pFSession.client.forwardingAccount()
+	if err != nil {
+		return err
+	}
+	return account.asUser(f)
+}
+
+func (pFSession *portForwardingSession) acceptLocalConnection(request portForwardingRequest, forward *activeForward) (net.Listener) {
+	portStr := ":" + strconv.Itoa(int(request.localPort))
+	if request.bindIP != nil {
+		portStr = ipToString(request.bindIP) + portStr
+	}
+	var listener net.Listener
+	var err error
+	if request.localSocket != "" { // the socket file is removed when the listener is closed
+		err = pFSession.asSocketUser(func() (err error) {
+			listener, err = net.Listen("unix", request.localSocket)
+			return err
+		})
+	} else {
+		listener, err = net.Listen("tcp", portStr)
+	}
+	if err != nil { // do not crash because of one bad port forwarding request, the other ones can still work
+		return nil
+	}
+	pFSession.registerListener(listener)
+	pFSession.forwards.setListener(forward, listener)
+	return listener
+}
+
+// if i am server, register which client asked for this remote port forwarding to stop listening when connection finished
+func (pFSession *portForwardingSession) registerListener(listener closable) {
+	if pFSession.sshConfig.listen {
+		pFSession.client.listenersMutex.Lock()
+		addr := fmt.Sprintf("%s", pFSession.QUICSession.RemoteAddr())
+		pFSession.client.listActiveListeners[addr] = append(pFSession.client.listActiveListeners[addr], listener)
+		pFSession.client.listenersMutex.Unlock()
+	}
+}
+
+// if error appear, stop the port forwarding without crashing (the other port forwardings keep working).
+// On server side, the error is reported to the client on the first stream.
+func writeError(pFSession *portForwardingSession, request *portForwardingRequest, forwardingStream quic.Stream, msg string) {
+	description := "Error with port forwarding"
+	if request != nil {
+		description = description + " " + request.String()
+	}
+	if pFSession.sshConfig.listen{
+		toSend := []byte(fmt.Sprintf("%s. %s\n", description, msg))
+		pFSession.QUICFirstStream.Write(toSend)
+	}else{
+		pFSession.sshConfig.printMsg(fmt.Sprintf("%s. %s", description, msg))
+	}
+	if forwardingStream != nil{
+		forwardingStream.Close()
+	}
+}
+
+func (pFSession *portForwardingSession) newPortForwardingFlow(conn net.Conn, stream quic.Stream, request portForwardingRequest, forward *activeForward) (*portForwardingFlow) {
+	return &portForwardingFlow{
+		initialConfig: pFSession,
+		TCPConnection: conn,
+		QUICStream:    stream,
+		request:       request,
+		forward:       forward,
+	}
+}
+
+// send and receive data from TCPConnection/QUICStream to QUICStream/TCPConnection, until both directions are finished
+func (pFFlow *portForwardingFlow) transfer() {
+	pFFlow.forward.connectionOpened()
+	defer pFFlow.forward.connectionClosed()
+	finishQuicStreamToTCP := make(chan bool) // this channel is used to indicate when the QUIC stream seems closed when trying to read on it.
+	finishTCPToQUICStream := make(chan bool) // this channel is used to indicate when the TCP connection seems closed when reading on it.
+	go pFFlow.readQuicSendTCP(finishQuicStreamToTCP)
+	go pFFlow.readTCPSendQUIC(finishTCPToQUICStream)
+	select {
+	case <-finishQuicStreamToTCP:
+		<-finishTCPToQUICStream
+	case <-finishTCPToQUICStream:
+		<-finishQuicStreamToTCP
+	}
+}
+
+// Reads msg from TCP connection and forwards payloads on QUIC stream.
+// If TCP connection is detected closed, close the stream and stop this method.
+func (pFFlow *portForwardingFlow) readTCPSendQUIC(finish chan bool) {
+	bufSize := pFFlow.initialConfig.sshConfig.bufSize
+	readBuffer := make([]byte, bufSize, bufSize)
+	for {
+		n, err := io.ReadAtLeast(pFFlow.TCPConnection, readBuffer, 1)
+		if err != nil {
+			pFFlow.QUICStream.Close()
+			finish <- true
+			return
+		} else {
+			msg := readBuffer[:n]
+			n2, err2 := pFFlow.QUICStream.Write(msg)
+			pFFlow.forward.countSent(n2)
+			if n2 != n || err2 != nil {
+				pFFlow.QUICStream.Close()
+				finish <- true
+				return
+			}
+		}
+	}
+}
+
+// Reads payloads from QUIC stream and forwards them on TCP connection.
+// If QUIC stream is detected closed, close the TCP connection and stop this method.
+func (pFFlow *portForwardingFlow) readQuicSendTCP(finish chan bool) {
+	bufSize := pFFlow.initialConfig.sshConfig.bufSize
+	readBuffer := make([]byte, bufSize, bufSize)
+	for {
+		n, err := pFFlow.QUICStream.Read(readBuffer)
+		if err == nil || n > 0 {
+			msg := readBuffer[:n]
+			n2, err2 := pFFlow.TCPConnection.Write(msg)
+			pFFlow.forward.countReceived(n2)
+			if n != n2 || err2 != nil {
+				pFFlow.TCPConnection.Close()
+				finish <- true
+				return
+			}
+		}
+		if err != nil {
+			pFFlow.TCPConnection.Close()
+			finish <- true
+			return
+		}
+	}
+}
@@ -0,0 +1,609 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"encoding/binary"
+	"io"
+	"net"
+	"errors"
+)
+
+/*
+    Format for control messages:
+    ----------------------------
+
+	Arbitrary control message use TLV encoding:
+
+	0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |length | value
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Possible types are:
+    > 0x01 for "local port forwarding request",
+    > 0x02 for "remote port forwarding request",
+    > 0x03 for "dynamic port forwarding request",
+    > 0x04 for "local port forwarding request with endpoints",
+    > 0x05 for "remote port forwarding request with endpoints",
+    > 0x06 for "agent stream",
+    > 0x07 for "cancel remote port forwarding".
+
+	Below, we detail the local, remote and dynamic port forwarding request message:
+
+	1) local port forwarding request:
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x01 |l=0xF3 |  remote port  |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    | prot. |                       |
+	+-------+						+
+	|								|
+    .			remote IP 			.
+    .			(16 bytes)			.
+	|                               |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+
+	2) remote port forwarding request:
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x02 |l=0x15 |  local port   |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |  remote port  | prot. |       |
+    +-+-+-+-+-+-+-+-+-+-+-+-+       +
+	|                               |
+    .			remote IP 			.
+    .			(16 bytes)			.
+	|                       +-+-+-+-+
+	|                       |
+    +-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+	fields:
+	-------
+    remote port: The receiver of this control message will use it for forwarding message. Encoded on 2 bytes so limited to the range [0, 65535]
+	local port : The receiver of this control message will use it for listening new connections. Encoded on 2 bytes so limited to the range [0, 65535]
+	prot.      : The protocol to forward (0x06 for TCP, 0x11 for UDP). See udp_forwarding.go for the framing of UDP datagrams.
+	remote IP  : Final destination of port forwarding. Encoded as IPv6, it can handle IPv4 too by using a fixed IPv6 prefix : 64:ff9b::/96 (RFC 6052)
+
+	The receiver of a remote port forwarding request listens on all interfaces: a remote port forwarding listening
+	on a given address (bind address) is requested with message 5).
+
+	Note: remote port forwarding implementation is very simple and understandable by just relying on local port forwarding implementation.
+    The "cost" of this simplicity is to transmit remotePort & remoteIP inside remote port forwarding control message while it could not be transferred.
+
+
+
+	3) dynamic port forwarding request:
+
+	Sent by the client for each connection accepted by its SOCKS/HTTP proxy (-D). The destination is chosen at
+	runtime by the application, and can be a hostname: it is resolved by the receiver of this message.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x03 |length |  remote port  |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    | prot. |                       |
+    +-+-+-+-+                       +
+    .   hostname (length-3 bytes)   .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	hostname   : Final destination of port forwarding: a hostname or an IP address in its textual form.
+	prot.      : 0x06 for the connections of the local proxy. 0x11 asks the receiver to relay the datagrams framed on
+	             the stream to the destination (UDP), as for the session of a client contacting a server through
+	             a jump host (see jump_hosts.go).
+
+	The receiver answers with a single byte on the same stream before forwarding any payload:
+
+    0       8
+    +-+-+-+-+
+    |status |
+    +-+-+-+-+
+
+	status     : 0x00 if the connection to the destination is established, 0x01 for a general failure,
+	             0x04 if the hostname cannot be resolved, 0x05 if the connection is refused. (Same values as SOCKS5 replies)
+
+
+
+	4) and 5) local and remote port forwarding request with endpoints:
+
+	Used instead of messages 1) and 2) when one side of the port forwarding is a Unix socket, and instead of
+	message 2) when the remote port forwarding listens on a given address. The addresses are encoded as
+	variable-length endpoints, and the protocol can only be UDP (0x11) if no endpoint is a Unix socket. The local request only contains the destination endpoint, the remote
+	request contains the endpoint to listen on followed by the destination endpoint.
+
+    0       8       16      24
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    |t=0x04 |length | prot. | destination endpoint
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+    0       8       16      24
+    +-+-+-+-+-+-+-+-+-+-+-+-+---                 ---+---
+    |t=0x05 |length | prot. | listening endpoint    | destination endpoint
+    +-+-+-+-+-+-+-+-+-+-+-+-+---                 ---+---
+
+	endpoint:
+
+    0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    | kind  |  len  | address
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	fields:
+	-------
+	kind       : 0x01 for an IP address and a port: the address is the IP (16 bytes, same encoding as remote IP)
+	             followed by the port (2 bytes), thus len=0x12. For a listening endpoint, the unspecified address (::)
+	             means all interfaces.
+	             0x02 for a Unix socket: the address is the path of the socket (len bytes, at most 104).
+
+
+
+	6) agent stream:
+
+	Sent by the server at the beginning of each stream it opens for a connection to the forwarded agent (see
+	agent forwarding in terminal_control.go). The receiver forwards the stream to its own agent. This message
+	has no length nor value.
+
+    0       8
+    +-+-+-+-+
+    |t=0x06 |
+    +-+-+-+-+
+
+
+
+	7) cancel remote port forwarding:
+
+	Sent by the client on a new stream to stop a remote port forwarding during the session (see escape_sequences.go).
+	It is followed by the remote port forwarding request 2) or 5) given when the port forwarding was requested.
+	This message has no length.
+
+    0       8
+    +-+-+-+-+---
+    |t=0x07 | remote port forwarding request
+    +-+-+-+-+---
+
+	The receiver stops listening (the connections already forwarded are kept) and answers with a single byte:
+
+    0       8
+    +-+-+-+-+
+    |status |
+    +-+-+-+-+
+
+	status     : 0x00 if the port forwarding is cancelled, 0x01 if the receiver does not listen for this request.
+
+*/
+
+// protocol numbers (as in the IP header)
+const PROTOCOL_TCP = 0x06
+const PROTOCOL_UDP = 0x11
+
+/*
+ * read control message on stream following schema depicted above.
+ */
+func (pFSession *portForwardingSession) readControlMessage(stream io.Reader) (err error, request portForwardingRequest) {
+	// read type field
+	typeBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(stream, typeBuffer)
+	if err != nil || n != 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	return pFSession.readControlMessageOfType(stream, typeBuffer[0])
+}
+
+// read the fields following the type of a control message
+func (pFSession *portForwardingSession) readControlMessageOfType(stream io.Reader, localValue byte) (err error, request portForwardingRequest) {
+	lengthBuffer := make([]byte, 1, 1)
+	localPortBuffer := make([]byte, 2, 2)
+	remotePortBuffer := make([]byte, 2, 2)
+	protocolBuffer := make([]byte, 1, 1)
+	var n int
+
+	if localValue == 0x06 {
+		request.agent = true
+		return
+	} else if localValue == 0x07 {
+		return pFSession.readCancelControlMessage(stream)
+	} else if localValue == 0x03 {
+		return readDynamicControlMessage(stream)
+	} else if localValue == 0x04 || localValue == 0x05 {
+		return readEndpointsControlMessage(stream, localValue == 0x04)
+	} else if localValue == 0x01 {
+		request.local = true
+	} else if localValue == 0x02 {
+		request.local = false
+	} else {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+
+	// read length field
+	n, err = io.ReadFull(stream, lengthBuffer)
+	if err != nil || n != 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	lengthValue := uint8(lengthBuffer[0])
+	if (lengthValue != 19 && request.local) || (lengthValue != 21 && !request.local) {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+
+	// read port(s)
+	if request.local {
+		n, err = io.ReadFull(stream, remotePortBuffer)
+		if err != nil || n != 2 {
+			err = errors.New("error when reading stream")
+			return
+		}
+		request.remotePort = binary.BigEndian.Uint16(remotePortBuffer)
+	} else {
+		n, err = io.ReadFull(stream, localPortBuffer)
+		if err != nil || n != 2 {
+			err = errors.New("error when reading stream")
+			return
+		}
+		request.localPort = binary.BigEndian.Uint16(localPortBuffer)
+
+		n, err = io.ReadFull(stream, remotePortBuffer)
+		if err != nil || n != 2 {
+			err = errors.New("error when reading stream")
+			return
+		}
+		request.remotePort = binary.BigEndian.Uint16(remotePortBuffer)
+	}
+
+	// read protocol number (only tcp and udp can be forwarded).
+	n, err = io.ReadFull(stream, protocolBuffer)
+	if err != nil || n != 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	request.protocol = protocolBuffer[0]
+	if request.protocol != PROTOCOL_TCP && request.protocol != PROTOCOL_UDP {
+		err = errors.New("error with the values read on the stream (protocol not supported)")
+		return
+	}
+
+	// read remote ip
+	err, request.remoteIP = readIP(stream)
+	if err != nil {
+		return
+	}
+	err = nil
+	return
+}
+
+// read an IP address encoded on 16 bytes (see schema above)
+func readIP(stream io.Reader) (err error, ip net.IP) {
+	var ipBuffer net.IP = make([]byte, net.IPv6len, net.IPv6len)
+	n, err := io.ReadFull(stream, ipBuffer)
+	if err != nil || n != len(ipBuffer) {
+		return errors.New("error when reading stream"), nil
+	}
+	if isV4EncodedInV6(ipBuffer) {
+		return nil, getV4FromV6(ipBuffer)
+	}
+	return nil, ipBuffer
+}
+
+// does ipv6 begin with 64:ff9b::/96 ?
+var V4_TO_V6_PREFIX = [...]byte {0, 100, 255, 155, 0, 0, 0, 0, 0, 0, 0, 0}
+func isV4EncodedInV6(remoteIP net.IP) bool {
+	for i:= 0; i < 12; i++{
+		if V4_TO_V6_PREFIX[i] != remoteIP[i]{
+			return false
+		}
+	}
+	return true
+}
+
+func getV4FromV6(remoteIP net.IP) (result net.IP){
+	result = make([]byte, net.IPv4len, net.IPv4len)
+	for i, j:= 12, 0; i < 16; i, j = i+1, j+1{
+		result[j] = remoteIP[i]
+	}
+	return result
+}
+
+func ipv4to6(remoteIP net.IP) (result net.IP){
+	result = make([]byte, net.IPv6len, net.IPv6len)
+	for i:= 0; i < 12; i++{
+		result[i] = V4_TO_V6_PREFIX[i]
+	}
+	for i, j:= 12, 0; i < 16; i, j = i+1, j+1{
+		result[i] = remoteIP[j]
+	}
+	return result
+}
+
+// encode an IP address on 16 bytes (see schema above)
+func encodeIP(ip net.IP) (net.IP, error) {
+	if len(ip) == net.IPv4len {
+		return ipv4to6(ip), nil
+	} else if len(ip) == net.IPv6len {
+		return ip, nil
+	}
+	return nil, errors.New("error with the values passed in argument (len of IP not consistent)")
+}
+
+/*
+ * write control message on stream following schema depicted above.
+ */
+func writeControlMessage(stream io.Writer, request portForwardingRequest) (err error) {
+	if request.usesUnixSocket() || (!request.local && request.bindIP != nil) {
+		return writeEndpointsControlMessage(stream, request)
+	}
+	typeBuffer := make([]byte, 1, 1)
+	lengthBuffer := make([]byte, 1, 1)
+	locPoBuffer := make([]byte, 2, 2)
+	remPoBuffer := make([]byte, 2, 2)
+	protocolBuffer := make([]byte, 1, 1)
+	if request.local {
+		typeBuffer[0] = 0x01
+		lengthBuffer[0] = 19
+	} else {
+		typeBuffer[0] = 0x02
+		lengthBuffer[0] = 21
+	}
+	binary.BigEndian.PutUint16(locPoBuffer, request.localPort)
+	binary.BigEndian.PutUint16(remPoBuffer, request.remotePort)
+
+	protocolBuffer[0] = request.getProtocol()
+
+	remoteIPV6, err := encodeIP(request.remoteIP)
+	if err != nil {
+		return err
+	}
+
+	buf := append(typeBuffer, lengthBuffer...)
+	if request.local {
+		buf = append(buf, remPoBuffer...)
+	}else{
+		buf = append(buf, locPoBuffer...)
+		buf = append(buf, remPoBuffer...)
+	}
+
+	buf = append(buf, protocolBuffer...)
+	buf = append(buf, remoteIPV6...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+
+	return nil
+}
+
+const DYNAMIC_SUCCESS = 0x00
+const DYNAMIC_FAILURE = 0x01
+const DYNAMIC_HOST_UNREACHABLE = 0x04
+const DYNAMIC_CONNECTION_REFUSED = 0x05
+
+/*
+ * read the value of a dynamic port forwarding request following schema depicted above (type already read).
+ */
+func readDynamicControlMessage(stream io.Reader) (err error, request portForwardingRequest) {
+	lengthBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(stream, lengthBuffer)
+	if err != nil || n != 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	if lengthBuffer[0] < 4 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	valueBuffer := make([]byte, lengthBuffer[0], lengthBuffer[0])
+	n, err = io.ReadFull(stream, valueBuffer)
+	if err != nil || n != len(valueBuffer) {
+		err = errors.New("error when reading stream")
+		return
+	}
+	request.local = true
+	request.dynamic = true
+	request.remotePort = binary.BigEndian.Uint16(valueBuffer[0:2])
+	request.protocol = valueBuffer[2]
+	request.hostname = string(valueBuffer[3:])
+	err = nil
+	return
+}
+
+/*
+ * write dynamic port forwarding request on stream following schema depicted above.
+ */
+func writeDynamicControlMessage(stream quic.Stream, hostname string, remotePort uint16, protocol byte) error {
+	if len(hostname) == 0 || len(hostname) > 252 {
+		return errors.New("error with the values passed in argument (hostname too long)")
+	}
+	buf := []byte{0x03, byte(3 + len(hostname)), 0, 0, protocol}
+	binary.BigEndian.PutUint16(buf[2:4], remotePort)
+	buf = append(buf, []byte(hostname)...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+/*
+ * read the answer to a dynamic port forwarding request.
+ */
+func readDynamicStatus(stream quic.Stream) (err error, status byte) {
+	statusBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(stream, statusBuffer)
+	if err != nil || n != 1 {
+		return errors.New("error when reading stream"), DYNAMIC_FAILURE
+	}
+	return nil, statusBuffer[0]
+}
+
+const FORWARD_CANCELLED = 0x00
+const FORWARD_UNKNOWN = 0x01
+
+/*
+ * read the remote port forwarding request following a cancel message (type already read).
+ */
+func (pFSession *portForwardingSession) readCancelControlMessage(stream io.Reader) (err error, request portForwardingRequest) {
+	err, request = pFSession.readControlMessage(stream)
+	if err == nil && (request.local || request.agent || request.cancel) {
+		err = errors.New("error with the values read on the stream (not a remote port forwarding request)")
+	}
+	request.cancel = true
+	return
+}
+
+/*
+ * write cancel message of a remote port forwarding on stream following schema depicted above.
+ */
+func writeCancelControlMessage(stream quic.Stream, request portForwardingRequest) error {
+	if request.local {
+		return errors.New("error with the values passed in argument (not a remote port forwarding)")
+	}
+	if n, err := stream.Write([]byte{0x07}); err != nil || n != 1 {
+		return errors.New("error when writing on the stream")
+	}
+	return writeControlMessage(stream, request)
+}
+
+/*
+ * read the answer to a cancel message.
+ */
+func readCancelStatus(stream quic.Stream) (err error, status byte) {
+	statusBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(stream, statusBuffer)
+	if err != nil || n != 1 {
+		return errors.New("error when reading stream"), FORWARD_UNKNOWN
+	}
+	return nil, statusBuffer[0]
+}
+
+const ENDPOINT_IP = 0x01
+const ENDPOINT_UNIX = 0x02
+
+// longest path of a Unix socket (size of sun_path on most systems, minus the terminating null byte)
+const maxUnixSocketPath = 104
+
+/*
+ * read the value of a port forwarding request with endpoints following schema depicted above (type already read).
+ */
+func readEndpointsControlMessage(stream io.Reader, local bool) (err error, request portForwardingRequest) {
+	request.local = local
+	lengthBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(stream, lengthBuffer)
+	if err != nil || n != 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	valueBuffer := make([]byte, lengthBuffer[0], lengthBuffer[0])
+	n, err = io.ReadFull(stream, valueBuffer)
+	if err != nil || n != len(valueBuffer) || n < 1 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	request.protocol = valueBuffer[0]
+	if request.protocol != PROTOCOL_TCP && request.protocol != PROTOCOL_UDP {
+		err = errors.New("error with the values read on the stream (protocol not supported)")
+		return
+	}
+	value := valueBuffer[1:]
+
+	// listening endpoint (only for remote port forwarding)
+	if !local {
+		err, value, request.bindIP, request.localPort, request.localSocket = parseEndpoint(value)
+		if err != nil {
+			return
+		}
+		if request.bindIP != nil && request.bindIP.IsUnspecified() {
+			request.bindIP = nil
+		}
+	}
+
+	// destination endpoint
+	err, value, request.remoteIP, request.remotePort, request.remoteSocket = parseEndpoint(value)
+	if err == nil && len(value) != 0 {
+		err = errors.New("error with the values read on the stream")
+	} else if err == nil && request.protocol == PROTOCOL_UDP && request.usesUnixSocket() {
+		err = errors.New("error with the values read on the stream (protocol not supported)")
+	}
+	return
+}
+
+// parse the first endpoint of value and return the remaining bytes
+func parseEndpoint(value []byte) (err error, remaining []byte, ip net.IP, port uint16, path string) {
+	if len(value) < 2 || len(value) < 2+int(value[1]) {
+		return errors.New("error with the values read on the stream"), nil, nil, 0, ""
+	}
+	address := value[2 : 2+int(value[1])]
+	remaining = value[2+int(value[1]):]
+	switch value[0] {
+	case ENDPOINT_IP:
+		if len(address) != net.IPv6len+2 {
+			return errors.New("error with the values read on the stream"), nil, nil, 0, ""
+		}
+		ip = net.IP(append([]byte{}, address[:net.IPv6len]...))
+		if isV4EncodedInV6(ip) {
+			ip = getV4FromV6(ip)
+		}
+		return nil, remaining, ip, binary.BigEndian.Uint16(address[net.IPv6len:]), ""
+	case ENDPOINT_UNIX:
+		if len(address) == 0 || len(address) > maxUnixSocketPath {
+			return errors.New("error with the values read on the stream"), nil, nil, 0, ""
+		}
+		return nil, remaining, nil, 0, string(address)
+	}
+	return errors.New("error with the values read on the stream"), nil, nil, 0, ""
+}
+
+// encode an endpoint following schema depicted above (Unix socket if path is not empty)
+func encodeEndpoint(ip net.IP, port uint16, path string) ([]byte, error) {
+	if path != "" {
+		if len(path) > maxUnixSocketPath {
+			return nil, errors.New("error with the values passed in argument (path of Unix socket too long)")
+		}
+		return append([]byte{ENDPOINT_UNIX, byte(len(path))}, []byte(path)...), nil
+	}
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+	ipV6, err := encodeIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte{ENDPOINT_IP, net.IPv6len + 2}, ipV6...)
+	portBuffer := make([]byte, 2, 2)
+	binary.BigEndian.PutUint16(portBuffer, port)
+	return append(buf, portBuffer...), nil
+}
+
+/*
+ * write port forwarding request with endpoints on stream following schema depicted above.
+ */
+func writeEndpointsControlMessage(stream io.Writer, request portForwardingRequest) error {
+	msgType := byte(0x04)
+	value := []byte{request.getProtocol()}
+	if !request.local {
+		msgType = 0x05
+		listening, err := encodeEndpoint(request.bindIP, request.localPort, request.localSocket)
+		if err != nil {
+			return err
+		}
+		value = append(value, listening...)
+	}
+	destination, err := encodeEndpoint(request.remoteIP, request.remotePort, request.remoteSocket)
+	if err != nil {
+		return err
+	}
+	value = append(value, destination...)
+
+	buf := append([]byte{msgType, byte(len(value))}, value...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
@@ -0,0 +1,617 @@
+package quicssh
+
+import (
+	"context"
+	"testing"
+	"os/exec"
+	"time"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"strings"
+	"fmt"
+	"net"
+	"crypto/tls"
+	"github.com/lucas-clemente/quic-go"
+)
+
+func init() {
+	logTmp("4")
+}
+
+func launchPortForwardingClient(ctx context.Context, port int, local bool, localPort int, remotePort int) {
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	writeFile(directory+"known_hosts_client", fmt.Sprintf("127.0.0.1:%d ", port)+dummyServerPublicKeyInline)
+	conf.authorizedPublicKeysFile = directory + "known_hosts_client"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.onlyForwardPort = true
+	if local {
+		conf.localPortForwarding = true
+	} else {
+		conf.remotePortForwarding = true
+	}
+	_, remoteIP := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{{local: local, localPort: uint16(localPort), remotePort: uint16(remotePort), remoteIP: remoteIP}}
+	sshClient := newTestClient(&conf)
+	sshClient.Run(ctx)
+}
+
+func launchServer(port int) {
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.port = port
+	conf.listen = true
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.privKeyFile = directory + "pr_server"
+	conf.authorizedPublicKeysFile = directory + "authorized_hosts_server"
+	conf.pubKeyFile = directory + "pk_server"
+	sshServer := newTestServer(&conf)
+	sshServer.Run(context.Background())
+}
+
+/*
+ * launch command
+ * nc -l -p portToListen > directory/nc_dst_testID
+ */
+func launchNetcatServer(testID string, portToListen string, t *testing.T) {
+	blockingStdin, _ := io.Pipe()
+	outputReader, outputWriter := io.Pipe()
+	var stderr bytes.Buffer
+	go func() {
+		result := ""
+		readBuffer := make([]byte, 1000000, 1000000)
+		for {
+			n, err := outputReader.Read(readBuffer)
+			if err == nil {
+				result = result + string(readBuffer[:n])
+				writeFile(directory+"nc_dst_"+testID, result)
+			} else {
+				t.Errorf("Error when using a netcat server : %s\n", err)
+			}
+		}
+	}()
+	cmd := exec.Command("nc", "-l", "-p", portToListen)
+	//var stdout, stderr bytes.Buffer
+	cmd.Stdout = outputWriter
+	cmd.Stderr = &stderr
+	cmd.Stdin = blockingStdin
+	err := cmd.Run()
+	if err != nil {
+		t.Errorf("Cannot launch netcat server. Test failed to launch. %s\n:%s\n", err, string(stderr.Bytes()))
+	}
+
+}
+
+/*
+ * launch command
+ * netcat -l 127.0.0.1 -p portToListen < directory/nc_src_testID
+ */
+func launchNetcatClient(testID string, portToContact string, t *testing.T) {
+	inputReader, inputWriter := io.Pipe()
+	dat, err := ioutil.ReadFile(directory + "nc_src_" + testID)
+	if err != nil {
+		t.Errorf("Cannot launch netcat client. Test failed when reading on /tmp %s\n", err)
+	}
+	go func() {
+		inputWriter.Write(dat)
+		inputWriter.Close()
+	}()
+
+	cmd := exec.Command("nc", "127.0.0.1", portToContact)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Stdin = inputReader
+	err = cmd.Run()
+	if err != nil {
+		t.Errorf("Cannot launch netcat client. Test failed to launch. %s : %s\n", err, string(stderr.Bytes()))
+	}
+}
+
+func createLargeFile(sizeInBytes string, t *testing.T, testID string) {
+	cmd := exec.Command("head", "-c", sizeInBytes, "/dev/urandom")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Errorf("Problem when running tests when creating file from /dev/urandom %s\n", string(stderr.Bytes()))
+	}
+	outStr, _ := string(stdout.Bytes()), string(stderr.Bytes())
+	writeFile(directory+"nc_src_"+testID, outStr)
+}
+
+func getSha256OfFile(file string) string {
+	cmd := exec.Command("sha256sum", file)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return ""
+	}
+	outStr, _ := string(stdout.Bytes()), string(stderr.Bytes())
+	return strings.Split(outStr, " ")[0]
+}
+
+func compareHash(testID string)(bool){
+	hash1 := getSha256OfFile(directory+"nc_src_"+testID)
+	hash2 := getSha256OfFile(directory+"nc_dst_"+testID)
+	return hash1 != "" && hash2 != "" && hash1 == hash2
+}
+
+func TestLocalPortForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41113
+	localPort := 42222
+	remotePort := 43333
+	go launchServer(port)
+	go launchPortForwardingClient(ctx, port, true, localPort, remotePort)
+	time.Sleep(500 * time.Millisecond)
+
+	// verify that files are correctly transfered using netcat on top of local port forwarding
+
+	// very short file
+	writeFile(directory+"nc_src_1", "Short content!")
+	go launchNetcatServer("1", "43333", t)
+	time.Sleep(50 * time.Millisecond)
+	launchNetcatClient("1", "42222", t)
+	for i := 0; i < 30; i++{
+		time.Sleep(50 * time.Millisecond)
+		if compareHash("1") {
+			break
+		}
+	}
+	if !compareHash("1") {
+		t.Errorf("Cannot transfer properly short file with netcat on top of local port forwarding\n")
+	}
+
+	// 1Mo file
+	createLargeFile("1000000", t, "2")
+	go launchNetcatServer("2", "43333", t)
+	time.Sleep(50 * time.Millisecond)
+	launchNetcatClient("2", "42222", t)
+	for i := 0; i < 30; i++{
+		time.Sleep(50 * time.Millisecond)
+		if compareHash("2") {
+			break
+		}
+	}
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+	if !compareHash("2") {
+		t.Errorf("Cannot transfer properly 1Mo file with netcat on top of local port forwarding\n")
+	}
+}
+
+func TestRemotePortForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41114
+	localPort := 42224
+	remotePort := 43335
+	go launchServer(port)
+	go launchPortForwardingClient(ctx, port, false, localPort, remotePort)
+	time.Sleep(500 * time.Millisecond)
+
+	// verify that files are correctly transfered using netcat on top of local port forwarding
+	//// very short file
+	writeFile(directory+"nc_src_3", "Short content!")
+	go launchNetcatServer("3", "43335", t)
+	time.Sleep(100 * time.Millisecond)
+	launchNetcatClient("3", "42224", t)
+	for i := 0; i < 30; i++{
+		logTmp("ici3")
+		time.Sleep(50 * time.Millisecond)
+		if compareHash("3") {
+			break
+		}
+	}
+	if !compareHash("3") {
+		t.Errorf("Cannot transfer properly short file with netcat on top of remote port forwarding\n")
+	}
+
+	//// 1Mo file
+	createLargeFile("1000000", t, "4")
+	go launchNetcatServer("4", "43335", t)
+	time.Sleep(100 * time.Millisecond)
+	launchNetcatClient("4", "42224", t)
+	for i := 0; i < 30; i++{
+		logTmp("ici4")
+		time.Sleep(50 * time.Millisecond)
+		if compareHash("4") {
+			break
+		}
+	}
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+	if !compareHash("4") {
+		t.Errorf("Cannot transfer properly 1Mo file with netcat on top of remote port forwarding\n")
+	}
+
+}
+
+// accept connections on port and send back everything received, in upper case
+func launchUpperCaseServer(port int, t *testing.T) net.Listener {
+	return launchUpperCaseServerOn("tcp", fmt.Sprintf("127.0.0.1:%d", port), t)
+}
+
+func launchUpperCaseServerOn(network string, address string, t *testing.T) net.Listener {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Errorf("Cannot launch test server on %s: %s\n", address, err)
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				readBuffer := make([]byte, 1000, 1000)
+				for {
+					n, err := conn.Read(readBuffer)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					conn.Write([]byte(strings.ToUpper(string(readBuffer[:n]))))
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// send msg on port and return the answer (as long as msg)
+func sendThroughForwarding(port int, msg string) string {
+	return sendThroughForwardingOn("tcp", fmt.Sprintf("127.0.0.1:%d", port), msg)
+}
+
+func sendThroughForwardingOn(network string, address string, msg string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	answer := make([]byte, len(msg), len(msg))
+	n, _ := io.ReadFull(conn, answer)
+	return string(answer[:n])
+}
+
+func TestMultiplePortForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41116
+	go launchServer(port)
+
+	// port 42229 is already used: this remote port forwarding must fail without stopping the other ones
+	busyListener := launchUpperCaseServer(42229, t)
+	destination1 := launchUpperCaseServer(43337, t)
+	destination2 := launchUpperCaseServer(43338, t)
+	defer busyListener.Close()
+	defer destination1.Close()
+	defer destination2.Close()
+
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.onlyForwardPort = true
+	conf.localPortForwarding = true
+	conf.remotePortForwarding = true
+	_, localhost := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{
+		{local: true, bindIP: localhost, localPort: 42226, remotePort: 43337, remoteIP: localhost},
+		{local: false, localPort: 42229, remotePort: 43338, remoteIP: localhost},
+		{local: false, bindIP: localhost, localPort: 42227, remotePort: 43338, remoteIP: localhost},
+		{local: true, localPort: 42228, remotePort: 43338, remoteIP: localhost},
+	}
+	go newTestClient(&conf).Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	checkValueString("answer through first local forwarding", "FIRST", sendThroughForwarding(42226, "first"), t)
+	checkValueString("answer through remote forwarding", "SECOND", sendThroughForwarding(42227, "second"), t)
+	checkValueString("answer through second local forwarding", "THIRD", sendThroughForwarding(42228, "third"), t)
+	checkValueString("answer through busy port", "BUSY", sendThroughForwarding(42229, "busy"), t)
+
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// ask the local proxy to connect to the upper case server, then send msg through it and return the answer.
+// handshake is the proxy request, replyLength the length of the reply of the proxy.
+func sendThroughProxy(port int, handshake []byte, replyLength int, msg string) (reply []byte, answer string) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, ""
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	conn.Write(handshake)
+	reply = make([]byte, replyLength, replyLength)
+	n, _ := io.ReadFull(conn, reply)
+	reply = reply[:n]
+	conn.Write([]byte(msg))
+	answerBuffer := make([]byte, len(msg), len(msg))
+	n, _ = io.ReadFull(conn, answerBuffer)
+	return reply, string(answerBuffer[:n])
+}
+
+func TestDynamicPortForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41117
+	go launchServer(port)
+	destination := launchUpperCaseServer(43339, t) // 43339 = 0xA94B
+	defer destination.Close()
+
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.onlyForwardPort = true
+	conf.localPortForwarding = true
+	_, localhost := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{{local: true, dynamic: true, bindIP: localhost, localPort: 42230}}
+	go newTestClient(&conf).Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	// SOCKS5 with a hostname (resolved by the server)
+	socks5 := []byte{5, 1, 0, 5, 1, 0, 3, 9}
+	socks5 = append(socks5, []byte("localhost")...)
+	socks5 = append(socks5, 0xA9, 0x4B)
+	reply, answer := sendThroughProxy(42230, socks5, 12, "socks5")
+	checkValueString("SOCKS5 reply", string([]byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0}), string(reply), t)
+	checkValueString("answer through SOCKS5", "SOCKS5", answer, t)
+
+	// SOCKS4 with an IPv4 address, then SOCKS4a with a hostname
+	reply, answer = sendThroughProxy(42230, []byte{4, 1, 0xA9, 0x4B, 127, 0, 0, 1, 'u', 0}, 8, "socks4")
+	checkValueInt("SOCKS4 reply", 0x5A, int(reply[1]), t)
+	checkValueString("answer through SOCKS4", "SOCKS4", answer, t)
+	socks4a := append([]byte{4, 1, 0xA9, 0x4B, 0, 0, 0, 1, 0}, []byte("localhost")...)
+	reply, answer = sendThroughProxy(42230, append(socks4a, 0), 8, "socks4a")
+	checkValueInt("SOCKS4a reply", 0x5A, int(reply[1]), t)
+	checkValueString("answer through SOCKS4a", "SOCKS4A", answer, t)
+
+	// HTTP CONNECT
+	connect := "CONNECT 127.0.0.1:43339 HTTP/1.1\r\nHost: 127.0.0.1:43339\r\n\r\n"
+	established := "HTTP/1.1 200 Connection established\r\n\r\n"
+	reply, answer = sendThroughProxy(42230, []byte(connect), len(established), "http")
+	checkValueString("HTTP CONNECT reply", established, string(reply), t)
+	checkValueString("answer through HTTP CONNECT", "HTTP", answer, t)
+
+	// SOCKS5 to a closed port: connection refused
+	reply, _ = sendThroughProxy(42230, []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0xA9, 0x4A}, 12, "")
+	checkValueInt("SOCKS5 reply for a closed port", DYNAMIC_CONNECTION_REFUSED, int(reply[3]), t)
+
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// receive datagrams on port and send them back in upper case
+func launchUpperCaseUDPServer(port int, t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Errorf("Cannot launch UDP test server on port %d: %s\n", port, err)
+		return nil
+	}
+	go func() {
+		readBuffer := make([]byte, 65535, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(readBuffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(strings.ToUpper(string(readBuffer[:n]))), addr)
+		}
+	}()
+	return conn
+}
+
+// send each message as a datagram on port (from the same source address) and return the answers
+func sendDatagrams(port int, msgs ...string) []string {
+	answers := make([]string, 0)
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return answers
+	}
+	defer conn.Close()
+	readBuffer := make([]byte, 65535, 65535)
+	for _, msg := range msgs {
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(readBuffer)
+		if err != nil {
+			return answers
+		}
+		answers = append(answers, string(readBuffer[:n]))
+	}
+	return answers
+}
+
+func TestUDPPortForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41118
+	go launchServer(port)
+	destination := launchUpperCaseUDPServer(43340, t)
+	defer destination.Close()
+
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.onlyForwardPort = true
+	conf.localPortForwarding = true
+	conf.remotePortForwarding = true
+	_, localhost := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{
+		{local: true, protocol: PROTOCOL_UDP, localPort: 42231, remotePort: 43340, remoteIP: localhost},
+		{local: false, protocol: PROTOCOL_UDP, bindIP: localhost, localPort: 42232, remotePort: 43340, remoteIP: localhost},
+	}
+	go newTestClient(&conf).Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	// two sources on each forwarding: each one must receive its own answers
+	checkValueString("answers through local UDP forwarding", "A1,A2", strings.Join(sendDatagrams(42231, "a1", "a2"), ","), t)
+	checkValueString("answers through local UDP forwarding (2nd source)", "B1", strings.Join(sendDatagrams(42231, "b1"), ","), t)
+	checkValueString("answers through remote UDP forwarding", "C1,C2", strings.Join(sendDatagrams(42232, "c1", "c2"), ","), t)
+	large := strings.Repeat("x", 60000)
+	checkValueString("large datagram through remote UDP forwarding", strings.ToUpper(large), strings.Join(sendDatagrams(42232, large), ","), t)
+
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestUDPFlowsAndFraming(t *testing.T) {
+	// datagrams are framed with their length
+	buffer := &bytes.Buffer{}
+	writeDatagram(buffer, []byte("first"))
+	writeDatagram(buffer, []byte{})
+	writeDatagram(buffer, []byte("third"))
+	readBuffer := make([]byte, 100, 100)
+	for _, expected := range []string{"first", "", "third"} {
+		err, datagram := readDatagram(buffer, readBuffer)
+		checkValueBoolean("datagram read", true, err == nil, t)
+		checkValueString("datagram", expected, string(datagram), t)
+	}
+	err, _ := readDatagram(buffer, readBuffer)
+	checkValueBoolean("error at end of stream", true, err != nil, t)
+
+	// idle flows are expired, active ones are kept
+	flows := newUDPFlowTable()
+	addr1 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}
+	flows.add(&udpFlow{sourceAddr: addr1})
+	flows.add(&udpFlow{sourceAddr: addr2})
+	checkValueBoolean("flow found", true, flows.get(addr1) != nil, t)
+	checkValueInt("no flow expired", 0, len(flows.removeIdleFlows(time.Now())), t)
+	flows.get(addr2).lastActivity = time.Now().Add(-2 * udpFlowIdleTimeout)
+	expired := flows.removeIdleFlows(time.Now())
+	checkValueInt("flows expired", 1, len(expired), t)
+	checkValueInt("port of the flow expired", 2000, expired[0].sourceAddr.Port, t)
+	checkValueBoolean("expired flow removed", true, flows.get(addr2) == nil, t)
+	checkValueBoolean("active flow kept", true, flows.get(addr1) != nil, t)
+}
+
+func TestUnixSocketForwarding(t *testing.T) {
+	ctx, stopClient := context.WithCancel(context.Background())
+	port := 41119
+	go launchServer(port)
+	tcpDestination := launchUpperCaseServer(43341, t)
+	unixDestination := launchUpperCaseServerOn("unix", directory+"destination.sock", t)
+	defer tcpDestination.Close()
+	defer unixDestination.Close()
+
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.onlyForwardPort = true
+	conf.localPortForwarding = true
+	conf.remotePortForwarding = true
+	_, localhost := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{
+		{local: true, localSocket: directory + "local.sock", remotePort: 43341, remoteIP: localhost},
+		{local: true, localPort: 42233, remoteSocket: directory + "destination.sock"},
+		{local: false, localSocket: directory + "remote.sock", remoteSocket: directory + "destination.sock"},
+		{local: false, bindIP: localhost, localPort: 42234, remoteSocket: directory + "destination.sock"},
+	}
+	go newTestClient(&conf).Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	checkValueString("answer from Unix socket to TCP", "FIRST", sendThroughForwardingOn("unix", directory+"local.sock", "first"), t)
+	checkValueString("answer from TCP to Unix socket", "SECOND", sendThroughForwarding(42233, "second"), t)
+	checkValueString("answer from remote Unix socket to Unix socket", "THIRD", sendThroughForwardingOn("unix", directory+"remote.sock", "third"), t)
+	checkValueString("answer from remote TCP to Unix socket", "FOURTH", sendThroughForwarding(42234, "fourth"), t)
+
+	stopClient()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestStreamsOpenedByTheServer(t *testing.T) {
+	err, cert := loadHostCertificate(&SSHConfig{privKeyFile: directory + "pr_server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:41147", &tls.Config{Certificates: []tls.Certificate{cert}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	destination := launchUpperCaseServer(43342, t)
+	defer destination.Close()
+	session, err := quic.DialAddr("127.0.0.1:41147", &tls.Config{InsecureSkipVerify: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close(nil)
+	serverSession, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client forwarding only its agent (-A) accepts no connection asked by the server
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, forwardAgent: true}
+	conf.useTestTerminal()
+	pFSession := newPortForwardingSession(conf, session, nil)
+	pFSession.startDestination()
+	_, localhost := resolveHostname("127.0.0.1")
+	connect := func() string {
+		stream, err := serverSession.OpenStreamSync()
+		if err != nil {
+			return ""
+		}
+		defer stream.Close()
+		writeControlMessage(stream, portForwardingRequest{local: true, remotePort: 43342, remoteIP: localhost})
+		stream.Write([]byte("hello"))
+		answer := make([]byte, 5, 5)
+		n, _ := io.ReadFull(stream, answer)
+		return string(answer[:n])
+	}
+	checkValueString("answer to a connection asked by the server", "", connect(), t)
+
+	// the connections of its remote port forwardings are accepted
+	pFSession.forwards.add(portForwardingRequest{local: false, localPort: 42235, remotePort: 43342, remoteIP: localhost})
+	checkValueString("answer to a connection of a remote port forwarding", "HELLO", connect(), t)
+}
+
+func TestRemoteForwardingControlMessages(t *testing.T) {
+	pFSession := &portForwardingSession{}
+	_, localhost := resolveHostname("127.0.0.1")
+	buffer := &bytes.Buffer{}
+
+	// without bind address, the remote port forwarding request has its original length
+	writeControlMessage(buffer, portForwardingRequest{local: false, localPort: 8080, remotePort: 80, remoteIP: localhost})
+	checkValueString("type and length", "0215", fmt.Sprintf("%x", buffer.Bytes()[:2]), t)
+	checkValueInt("size of the request", 23, buffer.Len(), t)
+	err, request := pFSession.readControlMessage(buffer)
+	checkValueBoolean("'request read'", true, err == nil && !request.local && request.localPort == 8080 && request.remotePort == 80, t)
+	checkValueBoolean("'no bind address'", true, request.bindIP == nil, t)
+
+	// the bind address is given with the endpoints, for TCP and UDP
+	for _, protocol := range []byte{PROTOCOL_TCP, PROTOCOL_UDP} {
+		writeControlMessage(buffer, portForwardingRequest{local: false, protocol: protocol, bindIP: localhost, localPort: 8080, remotePort: 80, remoteIP: localhost})
+		checkValueInt("type of the request", 0x05, int(buffer.Bytes()[0]), t)
+		err, request = pFSession.readControlMessage(buffer)
+		checkValueBoolean("'request with endpoints read'", true, err == nil && request.getProtocol() == protocol && request.localPort == 8080 && request.remotePort == 80, t)
+		checkValueBoolean("'bind address read'", true, request.bindIP.Equal(localhost), t)
+	}
+}
@@ -0,0 +1,94 @@
+package quicssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// window size as used by the TIOCGWINSZ and TIOCSWINSZ ioctls
+type windowSize struct {
+	rows   uint16
+	cols   uint16
+	xPixel uint16
+	yPixel uint16
+}
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/*
+ * open a new pseudo-terminal.
+ * Returns the master side (kept by the server) and the slave side (given to the shell).
+ */
+func openPty() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, errors.New("cannot open /dev/ptmx")
+	}
+
+	// unlock the slave and get its number
+	var unlock int32 = 0
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, errors.New("cannot unlock pseudo-terminal")
+	}
+	var ptyNumber uint32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNumber))); err != nil {
+		master.Close()
+		return nil, nil, errors.New("cannot get pseudo-terminal number")
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNumber), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.New("cannot open pseudo-terminal slave")
+	}
+	return master, slave, nil
+}
+
+// apply a window size (rows, columns) to a terminal
+func setWindowSize(terminal *os.File, rows uint16, cols uint16) error {
+	size := windowSize{rows: rows, cols: cols}
+	return ioctl(terminal.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+}
+
+// read the window size (rows, columns) of a terminal
+func getWindowSize(terminal *os.File) (rows uint16, cols uint16, err error) {
+	size := windowSize{}
+	err = ioctl(terminal.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+	return size.rows, size.cols, err
+}
+
+// get the foreground process group of a terminal
+func getForegroundProcessGroup(terminal *os.File) (int, error) {
+	var pgid int32
+	err := ioctl(terminal.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+	return int(pgid), err
+}
+
+/*
+ * give the slave of a pseudo-terminal to the account of the login (as the terminals of a local login): owned by the
+ * user and the group "tty" (the group of the user if there is none), read and written by the user, written by the group.
+ */
+func setPtyOwner(slave *os.File, account *userAccount) error {
+	gid := int(account.gid)
+	if group, err := user.LookupGroup("tty"); err == nil {
+		if id, err := strconv.Atoi(group.Gid); err == nil {
+			gid = id
+		}
+	}
+	if err := slave.Chown(int(account.uid), gid); err != nil {
+		return err
+	}
+	return slave.Chmod(0620)
+}
@@ -0,0 +1,247 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/////////////////
+// server part //
+/////////////////
+
+func remoteExecServerLoops(client *clientServed, serverConfig *Server, stopChanel chan bool) {
+	stream := client.firstStream
+
+	// step 1) read the command requested by the client
+	err, request := readCommandRequest(stream)
+	if err != nil {
+		stream.Close()
+		stopChanel <- true
+		return
+	}
+	client.audit.requestedUser(request.username, request.command)
+
+	// step 2) open one stream for the standard output and one for the standard error
+	stdoutStream, err1 := openOutputStream(client.session, STDOUT_STREAM)
+	stderrStream, err2 := openOutputStream(client.session, STDERR_STREAM)
+	if err1 != nil || err2 != nil {
+		serverConfig.conf.printDebug("Cannot open the output streams of the command")
+		closeOutputStreams(stdoutStream, stderrStream, "Error with remote execution. Cannot open the output streams.\n")
+		endRemoteExec(client, stream, 255, stopChanel)
+		return
+	}
+
+	// step 3) find the account (the key of the client must be bound to it), [optional] listen on the socket of the forwarded agent
+	env := append([]string{}, client.env...) // variables accepted by the server (AcceptEnv)
+	account, err := client.lookupAccount(request.username)
+	if err == nil && request.forwardAgent && !client.options.noAgentForwarding && !serverConfig.conf.noAgentForwarding {
+		forwarding, err := startAgentForwarding(client.session, account)
+		if err != nil {
+			stderrStream.Write([]byte("Error with remote execution. Cannot forward the agent.\n"))
+		} else {
+			defer forwarding.stop()
+			env = append(env, forwarding.env())
+		}
+	}
+
+	// step 4) run the command (or the forced command of the key) and wait until it exits
+	if client.options.command != "" {
+		env = append(env, ORIGINAL_COMMAND_ENV+"="+request.command)
+		request.command = client.options.command
+	}
+	status := 255
+	if err != nil {
+		stderrStream.Write([]byte(fmt.Sprintf("Error with remote execution. %s\n", err)))
+	} else {
+		serverConfig.conf.printDebug(fmt.Sprintf("New command for user '%s': %s", account.name, request.command))
+		status = runRemoteCommand(account, request, serverConfig, stream, stdoutStream, stderrStream, env)
+	}
+	stdoutStream.Close()
+	stderrStream.Close()
+
+	// step 5) send the exit status, then let the client close the session
+	endRemoteExec(client, stream, status, stopChanel)
+}
+
+// send the exit status on the first stream and close it, then let the client close the session
+func endRemoteExec(client *clientServed, stream quic.Stream, status int, stopChanel chan bool) {
+	writeExitStatus(stream, status)
+	stream.Close()
+	select {
+	case <-client.session.Context().Done():
+	case <-time.After(shellExitTimeout):
+	}
+	stopChanel <- true
+}
+
+// open a stream for one of the outputs of the command (the first byte tells which output it is), nil if it failed
+func openOutputStream(session quic.Session, output byte) (quic.Stream, error) {
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = stream.Write([]byte{output}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// close the output streams opened (nil if not), after writing msg on the standard error (or else the standard output)
+func closeOutputStreams(stdoutStream quic.Stream, stderrStream quic.Stream, msg string) {
+	if stderrStream != nil {
+		stderrStream.Write([]byte(msg))
+		stderrStream.Close()
+	} else if stdoutStream != nil {
+		stdoutStream.Write([]byte(msg))
+	}
+	if stdoutStream != nil {
+		stdoutStream.Close()
+	}
+}
+
+// run the command with the login shell of the account (with additional environment variables) and return its exit status
+func runRemoteCommand(account *userAccount, request commandRequest, serverConf *Server, in quic.Stream, out writable, outErr writable, env []string) int {
+	cmd := newUserCommand(account, "-c", request.command)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = out
+	cmd.Stderr = outErr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		outErr.Write([]byte(fmt.Sprintf("Error with remote execution. Cannot start shell '%s'.\n", account.shell)))
+		return 255
+	}
+
+	exited := make(chan bool)
+	go forwardStandardInput(serverConf, in, stdin, cmd, exited)
+	cmd.Wait()
+	close(exited)
+	return getExitStatus(cmd)
+}
+
+// first stream -> standard input of the command. If the client leaves, hang up the command.
+func forwardStandardInput(serverConf *Server, stream quic.Stream, stdin io.WriteCloser, cmd *exec.Cmd, exited chan bool) {
+	readBuffer := make([]byte, serverConf.conf.bufSize, serverConf.conf.bufSize)
+	for {
+		n, err := stream.Read(readBuffer)
+		if n > 0 {
+			stdin.Write(readBuffer[:n])
+		}
+		if err != nil {
+			stdin.Close()
+			select {
+			case <-exited:
+			default:
+				if err != io.EOF { // the command leads its own process group (setsid)
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+				}
+			}
+			return
+		}
+	}
+}
+
+// exit status of a finished command, shell-like (128 + signal number if killed by a signal)
+func getExitStatus(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return 255
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+	return 255
+}
+
+/////////////////
+// client part //
+/////////////////
+
+func remoteExecClientLoops(c *Client, stopChanel chan bool) {
+	// step 1) send the command to execute (arguments are joined as ssh does)
+	request := commandRequest{username: c.getRemoteUsername(), command: strings.Join(c.conf.remoteCommand, " "), forwardAgent: c.conf.forwardAgent}
+	if writeCommandRequest(c.firstStream, request) != nil {
+		c.conf.printMsg("A problem appeared when sending the command to the server")
+		c.exitStatus = 255
+		stopChanel <- true
+		return
+	}
+
+	// step 2) forward our standard input on the first stream
+	go sendStandardInput(c, c.conf.input())
+
+	// step 3) receive standard output and standard error on the two streams opened by the server
+	outputsDone := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		stream, err := c.session.AcceptStream()
+		if err != nil {
+			outputsDone <- true
+			continue
+		}
+		go receiveCommandOutput(c, stream, outputsDone)
+	}
+	if c.conf.forwardAgent {
+		// the next streams opened by the server are connections to the forwarded agent
+		c.forwardingSession().startDestination()
+	}
+	<-outputsDone
+	<-outputsDone
+
+	// step 4) read the exit status of the command
+	err, status := readExitStatus(c.firstStream)
+	if err != nil {
+		c.conf.printMsg("A problem appeared when reading the exit status of the command")
+		status = 255
+	}
+	c.exitStatus = status
+	stopChanel <- true
+}
+
+// stdin -> first stream. End of input is signaled to the server by closing the stream.
+func sendStandardInput(c *Client, in readable) {
+	readBuffer := make([]byte, c.conf.bufSize, c.conf.bufSize)
+	for {
+		n, err := in.Read(readBuffer)
+		if n > 0 {
+			c.firstStream.Write(readBuffer[:n])
+		}
+		if err != nil {
+			c.firstStream.Close()
+			return
+		}
+	}
+}
+
+// output stream -> stdout or stderr (depending on the first byte of the stream)
+func receiveCommandOutput(c *Client, stream quic.Stream, outputsDone chan bool) {
+	header := make([]byte, 1, 1)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		outputsDone <- true
+		return
+	}
+	out := c.conf.output()
+	if header[0] == STDERR_STREAM {
+		out = c.conf.errOutput()
+	}
+	readBuffer := make([]byte, c.conf.bufSize, c.conf.bufSize)
+	for {
+		n, err := stream.Read(readBuffer)
+		if n > 0 {
+			out.Write(readBuffer[:n])
+		}
+		if err != nil {
+			outputsDone <- true
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"context"
+	"strings"
+	"testing"
+)
+
+func init() {
+	logTmp("6")
+}
+
+// run a command on the server and return the client config (with outputs) and the exit status
+func launchRemoteExecClient(port int, command []string, input string) (*SSHConfig, int) {
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.remoteCommand = command
+	conf.stdin = strings.NewReader(input)
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	return &conf, sshClient.exitStatus
+}
+
+func TestRemoteExec(t *testing.T) {
+	port := 41115
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+
+	// outputs are received on separate streams and the exit status is returned
+	conf, status := launchRemoteExecClient(port, []string{"echo", "to_stdout;", "echo", "to_stderr", ">&2;", "exit", "3"}, "")
+	checkValueString("standard output", "to_stdout\n", conf.testOutput(), t)
+	checkValueString("standard error", "to_stderr\n", conf.testErrOutput(), t)
+	checkValueInt("exit status", 3, status, t)
+
+	// standard input is forwarded until its end
+	conf, status = launchRemoteExecClient(port, []string{"tr", "a-z", "A-Z"}, "hello quic\n")
+	checkValueString("standard output", "HELLO QUIC\n", conf.testOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+
+	// commands killed by a signal
+	conf, status = launchRemoteExecClient(port, []string{"kill", "-9", "$$"}, "")
+	checkValueInt("exit status", 128+9, status, t)
+}
+
+// output stream of a command: only written and closed
+type outputStream struct {
+	quic.Stream
+	output testBuffer
+	closed bool
+}
+
+func (stream *outputStream) Write(p []byte) (int, error) {
+	return stream.output.Write(p)
+}
+
+func (stream *outputStream) Close() error {
+	stream.closed = true
+	return nil
+}
+
+func TestCloseOutputStreams(t *testing.T) {
+	// the error is written on the standard error, and both streams are closed
+	stdoutStream, stderrStream := &outputStream{}, &outputStream{}
+	closeOutputStreams(stdoutStream, stderrStream, "failed\n")
+	checkValueString("standard output", "", stdoutStream.output.String(), t)
+	checkValueString("standard error", "failed\n", stderrStream.output.String(), t)
+	checkValueBoolean("'standard output closed'", true, stdoutStream.closed, t)
+	checkValueBoolean("'standard error closed'", true, stderrStream.closed, t)
+
+	// without standard error, the error is written on the standard output
+	stdoutStream = &outputStream{}
+	closeOutputStreams(stdoutStream, nil, "failed\n")
+	checkValueString("standard output", "failed\n", stdoutStream.output.String(), t)
+	checkValueBoolean("'standard output closed'", true, stdoutStream.closed, t)
+}
@@ -0,0 +1,330 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"io/ioutil"
+	"strings"
+	"os/exec"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+	"os/signal"
+	"syscall"
+)
+
+/////////////////
+// server part //
+/////////////////
+
+// time given to the client to close the session once the remote shell exited
+const shellExitTimeout = 5 * time.Second
+
+func remoteLoginServerLoops(client *clientServed, serverConfig *Server, stopChanel chan bool) {
+	session, stream, controlStream := client.session, client.firstStream, client.controlStream
+	errorChannel := make(chan error, 2)
+	outputDone := make(chan bool)
+
+	// step 1) read the terminal requested by the client (user, terminal type and size) on the control stream
+	err, request := readTerminalRequest(controlStream)
+	if err != nil {
+		stopRemoteLogin(stream, "Cannot read terminal request.", stopChanel)
+		return
+	}
+	if client.options.noPty {
+		stopRemoteLogin(stream, "PTY allocation is not allowed for this key.", stopChanel)
+		return
+	}
+	client.audit.requestedUser(request.username, "")
+
+	// step 1b) [optional] record the terminal I/O (RecordSessions, see session_recording.go)
+	recording := serverConfig.startRecording(client, request)
+	defer recording.close()
+	client.firstStream = recording.wrap(client.firstStream)
+	stream = client.firstStream
+	if request.persistent { // the shell outlives the session (see persistent_session.go)
+		persistentLoginServerLoops(client, serverConfig, request, stopChanel)
+		return
+	}
+
+	// step 2) [optional] listen on the socket of the forwarded agent (the key of the client must be bound to the account)
+	account, err := client.lookupAccount(request.username)
+	if err != nil {
+		stopRemoteLogin(stream, err.Error(), stopChanel)
+		return
+	}
+	env := append([]string{}, client.env...) // variables accepted by the server (AcceptEnv)
+	if request.forwardAgent && !client.options.noAgentForwarding && !serverConfig.conf.noAgentForwarding {
+		forwarding, err := startAgentForwarding(session, account)
+		if err != nil {
+			stopRemoteLogin(stream, "Cannot forward the agent.", stopChanel)
+			return
+		}
+		defer forwarding.stop()
+		env = append(env, forwarding.env())
+	}
+
+	// step 3) spawn the login shell of the user (or the forced command of the key) on a new pseudo-terminal
+	shell, err := startLoginShell(account, request, client.options.command, env)
+	if err != nil {
+		stopRemoteLogin(stream, err.Error(), stopChanel)
+		return
+	}
+	serverConfig.conf.printDebug(fmt.Sprintf("New shell for user '%s' (TERM=%s, %dx%d)", shell.account.name, request.term, request.cols, request.rows))
+
+	// step 4) send and receive data from QUIC stream/pseudo-terminal to pseudo-terminal/QUIC stream
+	go receiveCommand(errorChannel, serverConfig, shell.pty, stream)
+	go sendOutputResult(outputDone, serverConfig, shell.pty, stream)
+	go receiveTerminalControl(serverConfig, shell, controlStream)
+
+	// step 5) wait for end of service: either the client leaves or the shell exits
+	select {
+	case <-errorChannel:
+	case <-shell.exited:
+		// forward last output, then tell the client the session is over and let it close the session
+		select {
+		case <-outputDone:
+		case <-time.After(time.Second):
+		}
+		stream.Close()
+		select {
+		case <-errorChannel:
+		case <-time.After(shellExitTimeout):
+		}
+	}
+	shell.stop()
+	stopChanel <- true
+}
+
+// report a remote login error to the client and end the session (once the client read the error and left)
+func stopRemoteLogin(stream quic.Stream, msg string, stopChanel chan bool) {
+	stream.Write([]byte(fmt.Sprintf("Error with remote login. %s\r\n", msg)))
+	stream.Close()
+	left := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		close(left)
+	}()
+	select {
+	case <-left:
+	case <-time.After(shellExitTimeout):
+	}
+	stopChanel <- true
+}
+
+// receives the commands from the stream and sends them to the shell
+func receiveCommand(communicationChannel chan error, serverConf *Server, in writable, stream quic.Stream) {
+	readBuffer := make([]byte, serverConf.conf.bufSize, serverConf.conf.bufSize)
+	for {
+		n, err := stream.Read(readBuffer)
+		msg := readBuffer[:n]
+		if n > 0 {
+			in.Write(msg)
+		}
+		if err != nil {
+			communicationChannel <- err
+			return
+		}
+	}
+}
+
+// receives window changes and signals on the control stream and applies them to the shell
+func receiveTerminalControl(serverConf *Server, shell *loginShell, controlStream quic.Stream) {
+	for {
+		err, msgType, value := readTerminalControlMessage(controlStream)
+		if err != nil {
+			return
+		}
+		if msgType == WINDOW_CHANGE {
+			if err, rows, cols := parseWindowChange(value); err == nil {
+				shell.resize(rows, cols)
+			}
+		} else if msgType == SIGNAL {
+			if err, sig := parseSignal(value); err == nil {
+				serverConf.conf.printDebug(fmt.Sprintf("Signal received from client: %s", sig))
+				shell.signal(sig)
+			}
+		}
+	}
+}
+
+// sends the shell output on the stream until the pseudo-terminal is closed
+func sendOutputResult(outputDone chan bool, serverConf *Server, in readable, stream quic.Stream) {
+	readBuffer := make([]byte, serverConf.conf.bufSize, serverConf.conf.bufSize)
+	for {
+		n, err := in.Read(readBuffer)
+		if n > 0 {
+			stream.Write(readBuffer[:n])
+		}
+		if err != nil {
+			close(outputDone)
+			return
+		}
+	}
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// put the local terminal in raw mode (echo and line editing are done by the remote pseudo-terminal).
+// Returns the previous terminal state ("" without terminal).
+func setRawTerminal(terminal *os.File) string {
+	if terminal == nil {
+		return ""
+	}
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = terminal
+	state, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	cmd = exec.Command("stty", "raw", "-echo")
+	cmd.Stdin = terminal
+	cmd.Output()
+	return strings.TrimSpace(string(state))
+}
+
+func restoreTerminal(terminal *os.File, state string) {
+	if state == "" {
+		return
+	}
+	cmd := exec.Command("stty", state)
+	cmd.Stdin = terminal
+	cmd.Output()
+}
+
+// remote user to log in as (by default, the local user)
+func (c *Client) getRemoteUsername() string {
+	if c.conf.username != "" {
+		return c.conf.username
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// describe the local terminal (type and size) and the remote user to log in as
+func (c *Client) getTerminalRequest() terminalRequest {
+	request := terminalRequest{rows: 24, cols: 80, term: os.Getenv("TERM"), username: c.getRemoteUsername(), forwardAgent: c.conf.forwardAgent}
+	if request.term == "" {
+		request.term = "vt100"
+	}
+	if terminal := c.conf.terminal(); terminal != nil {
+		if rows, cols, err := getWindowSize(terminal); err == nil && rows > 0 && cols > 0 {
+			request.rows, request.cols = rows, cols
+		}
+	}
+	return request
+}
+
+func remoteLoginClientLoops(stream quic.Stream, controlStream quic.Stream, clientConfig *Client, stopChanel chan bool) {
+	errorChannel := make(chan error, 2)
+	if writeTerminalRequest(controlStream, clientConfig.getTerminalRequest()) != nil {
+		clientConfig.conf.printMsg("A problem appeared when requesting a terminal to the server")
+		stopChanel <- true
+		return
+	}
+	terminal := clientConfig.conf.terminal()
+	terminalState := setRawTerminal(terminal)
+
+	go writeMessageLoop(errorChannel, clientConfig, clientConfig.conf.input(), stream)
+	go receiveMessageLoop(errorChannel, clientConfig, stream, clientConfig.conf.output())
+	go receiveServerNotices(clientConfig, controlStream)
+
+	stopControl := make(chan bool, 1)
+	if clientConfig.conf.handleSignals {
+		go sendTerminalControl(controlStream, terminal, stopControl)
+	}
+
+	// wait for end of service
+	<-errorChannel
+	stopControl <- true
+	restoreTerminal(terminal, terminalState)
+	stopChanel <- true
+}
+
+// read the messages of the server on the terminal control stream, until the session ends
+func receiveServerNotices(c *Client, controlStream readable) {
+	for {
+		err, msgType, value := readTerminalControlMessage(controlStream)
+		if err != nil {
+			return
+		}
+		c.serverNotice(msgType, value)
+	}
+}
+
+// tell the user about a message of the server on the terminal control stream (see terminal_control.go)
+func (c *Client) serverNotice(msgType byte, value []byte) {
+	if msgType != SERVER_GOING_AWAY {
+		return
+	}
+	if err, gracePeriod := parseGoingAway(value); err == nil {
+		c.conf.printTerminalMsg(fmt.Sprintf("The server is shutting down, the session will be closed in %s", gracePeriod))
+	}
+}
+
+// forward window changes (SIGWINCH) and signals (SIGINT, SIGQUIT, SIGTERM) on the control stream
+func sendTerminalControl(controlStream writable, terminal *os.File, stopControl chan bool) {
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGWINCH, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+	for {
+		select {
+		case sig := <-sigchan:
+			if sig == syscall.SIGWINCH {
+				if terminal == nil {
+					continue
+				}
+				if rows, cols, err := getWindowSize(terminal); err == nil {
+					writeWindowChange(controlStream, rows, cols)
+				}
+			} else {
+				writeSignal(controlStream, sig)
+			}
+		case <-stopControl:
+			return
+		}
+	}
+}
+
+// stdin -> prepare for sending
+func writeMessageLoop(communicationChannel chan error, c *Client, in readable, stream writable) {
+	escape := newEscapeHandler(c) // escape sequences of the client (see escape_sequences.go)
+	readBuffer := make([]byte, c.conf.bufSize, c.conf.bufSize)
+	for {
+		n, err := in.Read(readBuffer)
+		if err == nil {
+			msg := escape.filter(readBuffer[:n])
+			if len(msg) > 0 {
+				stream.Write(msg)
+			}
+			if escape.disconnected {
+				communicationChannel <- errEscapeDisconnect
+				return
+			}
+		} else {
+			communicationChannel <- err
+			return
+		}
+	}
+}
+
+// message received on stream -> stdout.
+func receiveMessageLoop(communicationChannel chan error, c *Client, stream quic.Stream, out writable) {
+	for {
+		readBuffer := make([]byte, c.conf.bufSize, c.conf.bufSize)
+		n, err := stream.Read(readBuffer)
+		if n > 0 {
+			//show msg to the user
+			out.Write(readBuffer[:n])
+		}
+		if err != nil {
+			communicationChannel <- err
+			return
+		}
+	}
+}
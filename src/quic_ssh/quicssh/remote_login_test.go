@@ -0,0 +1,211 @@
+package quicssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"strings"
+	"bytes"
+	"syscall"
+	"time"
+	"quic_utils"
+)
+
+func init() {
+	logTmp("5")
+}
+
+func launchServerWithResult(port int, conf *SSHConfig) {
+	conf.bufSize = 100000
+	conf.port = port
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.privKeyFile = directory + "pr_server"
+	conf.pubKeyFile = directory + "pk_server"
+	sshServer := newTestServer(conf)
+	sshServer.Run(context.Background())
+}
+
+func TestRemoteLogin(t *testing.T) {
+	port := 41112
+	recordings := directory + "recordings_login"
+	os.RemoveAll(recordings)
+	os.Mkdir(recordings, 0700)
+	confServer := SSHConfig{recordSessions: recordings}
+	go launchServerWithResult(port, &confServer)
+	writeFile(directory+"known_hosts_client", "127.0.0.1:41112 "+dummyServerPublicKeyInline)
+	conf := SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.stdin = typed("stty size\necho quic_ssh_$((40+2))\nexit\n") // the session ends when the shell exits
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	if !strings.Contains(readRecordings(recordings), `"i","echo quic_ssh_`) {
+		t.Errorf("Error with remote login: cannot submit command to server")
+	}
+	if !strings.Contains(conf.testOutput(), "quic_ssh_42") {
+		t.Errorf("Error with remote login: cannot receive answer from server, received : %s", conf.testOutput())
+	}
+	if !strings.Contains(conf.testOutput(), "24 80") {
+		t.Errorf("Error with remote login: terminal size not applied, received : %s", conf.testOutput())
+	}
+
+	// test a second client with also port forwarding active:
+	conf = SSHConfig{}
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.localPortForwarding = true
+	_, remoteIP := resolveHostname("127.0.0.1")
+	conf.forwards = []portForwardingRequest{{local: true, localPort: 9876, remotePort: 5432, remoteIP: remoteIP}}
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.stdin = typed("echo quic_ssh_$((40+3))\nexit\n")
+	sshClient = newTestClient(&conf)
+	sshClient.Run(context.Background())
+	if !strings.Contains(conf.testOutput(), "quic_ssh_43") {
+		t.Errorf("Error with remote login: cannot receive answer from server, received : %s", conf.testOutput())
+	}
+}
+
+// content of all the recordings of a directory (the input typed by the clients is recorded by the server)
+func readRecordings(recordings string) string {
+	content := ""
+	files, _ := ioutil.ReadDir(recordings)
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(recordings, file.Name()))
+		content += string(data)
+	}
+	return content
+}
+
+func TestTerminalRequest(t *testing.T) {
+	// write a terminal request in a pipe and read it back
+	buffer := &bytes.Buffer{}
+	request := terminalRequest{rows: 42, cols: 132, term: "xterm-256color", username: "remi"}
+	if err := writeTerminalRequest(buffer, request); err != nil {
+		t.Errorf("Cannot write terminal request: %s", err)
+	}
+	err, result := readTerminalRequest(buffer)
+	if err != nil {
+		t.Errorf("Cannot read terminal request: %s", err)
+	}
+	checkValueInt("rows", 42, int(result.rows), t)
+	checkValueInt("columns", 132, int(result.cols), t)
+	checkValueString("terminal type", "xterm-256color", result.term, t)
+	checkValueString("username", "remi", result.username, t)
+
+	// truncated request must be rejected
+	buffer = &bytes.Buffer{}
+	writeTerminalRequest(buffer, request)
+	err, _ = readTerminalRequest(bytes.NewReader(buffer.Bytes()[:10]))
+	if err == nil {
+		t.Errorf("A truncated terminal request should not be accepted")
+	}
+}
+
+func TestTerminalControlMessages(t *testing.T) {
+	// window change
+	buffer := &bytes.Buffer{}
+	writeWindowChange(buffer, 50, 160)
+	err, msgType, value := readTerminalControlMessage(buffer)
+	checkValueBoolean("error when reading window change", false, err != nil, t)
+	checkValueInt("message type", WINDOW_CHANGE, int(msgType), t)
+	err, rows, cols := parseWindowChange(value)
+	checkValueBoolean("error when parsing window change", false, err != nil, t)
+	checkValueInt("rows", 50, int(rows), t)
+	checkValueInt("columns", 160, int(cols), t)
+
+	// signals: only SIGINT, SIGQUIT and SIGTERM can be forwarded
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM} {
+		buffer = &bytes.Buffer{}
+		writeSignal(buffer, sig)
+		err, msgType, value = readTerminalControlMessage(buffer)
+		checkValueInt("message type", SIGNAL, int(msgType), t)
+		err, result := parseSignal(value)
+		checkValueBoolean("error when parsing signal", false, err != nil, t)
+		checkValueInt("signal", int(sig), int(result), t)
+	}
+	if writeSignal(&bytes.Buffer{}, syscall.SIGKILL) == nil {
+		t.Errorf("SIGKILL should not be forwarded")
+	}
+	if err, _ := parseSignal([]byte{9}); err == nil {
+		t.Errorf("SIGKILL should not be accepted by the server")
+	}
+}
+
+// wait until the output of the shell contains expected
+func waitForShellOutput(output *testBuffer, expected string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(output.String(), expected) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTerminalControl(t *testing.T) {
+	// the pseudo-terminal of the shell takes the size given
+	account, _ := lookupAccount("")
+	shell, err := startLoginShell(account, terminalRequest{rows: 24, cols: 80, term: "vt100"}, "", nil)
+	if err != nil {
+		t.Fatalf("Cannot start the shell: %s", err)
+	}
+	shell.resize(50, 160)
+	rows, cols, err := getWindowSize(shell.pty)
+	checkValueBoolean("error when reading window size", false, err != nil, t)
+	checkValueInt("rows", 50, int(rows), t)
+	checkValueInt("columns", 160, int(cols), t)
+
+	// the slave of the pseudo-terminal belongs to the account (given to it by a server run by root)
+	info, err := os.Stat(fmt.Sprintf("/proc/%d/fd/0", shell.cmd.Process.Pid))
+	if err != nil {
+		t.Fatalf("Cannot read the terminal of the shell: %s", err)
+	}
+	checkValueInt("owner of the terminal", int(account.uid), int(info.Sys().(*syscall.Stat_t).Uid), t)
+	if os.Getuid() == 0 {
+		checkValueInt("mode of the terminal", 0620, int(info.Mode().Perm()), t)
+	}
+	shell.stop()
+
+	// the window changes and signals sent on the terminal control stream reach the shell of the remote login
+	port := 41148
+	go launchServerWithResult(port, &SSHConfig{})
+	conf := &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client",
+		pubKeyFile: directory + "pk_client"}
+	sshClient := newTestClient(conf)
+	defer sshClient.session.Close(nil)
+	quic_utils.ServeClientPublicKeyWithSigner(sshClient.session, sshClient.firstStream, sshClient.signer, sshClient.publicKey)
+	if err := sshClient.setServerMode(); err != nil {
+		t.Fatalf("Remote login refused: %s", err)
+	}
+	controlStream, _ := sshClient.session.OpenStreamSync()
+	writeTerminalRequest(controlStream, terminalRequest{rows: 24, cols: 80, term: "vt100"})
+	output := &testBuffer{}
+	go io.Copy(output, sshClient.firstStream)
+
+	writeWindowChange(controlStream, 40, 100)
+	time.Sleep(200 * time.Millisecond)
+	sshClient.firstStream.Write([]byte("stty size\n"))
+	if !waitForShellOutput(output, "40 100") {
+		t.Errorf("Window change not applied to the pseudo-terminal, received : %s", output.String())
+	}
+
+	// SIGINT is delivered to the foreground process group (the command run by the shell)
+	sshClient.firstStream.Write([]byte("sh -c 'trap \"echo interrupted_$((40+2)); exit\" INT; while :; do sleep 0.1; done'\n"))
+	time.Sleep(time.Second)
+	writeSignal(controlStream, syscall.SIGINT)
+	if !waitForShellOutput(output, "interrupted_42") {
+		t.Errorf("SIGINT not delivered to the process group of the shell, received : %s", output.String())
+	}
+	sshClient.firstStream.Write([]byte("exit\n"))
+}
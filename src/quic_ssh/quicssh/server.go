@@ -0,0 +1,591 @@
+package quicssh
+
+import (
+	"context"
+	"github.com/lucas-clemente/quic-go"
+	"quic_utils"
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"io"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type Server struct {
+	conf         *SSHConfig       // configuration of the sessions accepted from now (replaced on SIGHUP)
+	mutex        sync.Mutex       // protects conf, certificate, listeners, shuttingDown and drained
+	certificate  *tls.Certificate // certificate of the host key, sent to the new clients
+	listeners    map[string]*serverListener
+	shells       *persistentShells // shells of the persistent sessions, shared by all the sessions of the server
+	admission    *quic_utils.AdmissionControl // limits the sessions not authenticated yet and bans the addresses failing to authenticate
+	active       *activeSessions // sessions being served, closed at the end of a shutdown (see shutdown.go)
+	failures     chan error      // error of a listener that failed
+	shuttingDown bool            // SIGTERM or SIGINT received: every address is retired
+	drained      chan bool       // closed after the last listener once the server shuts down
+}
+
+// listener of one of the addresses of the configuration
+type serverListener struct {
+	listener quic.Listener
+	sessions int  // sessions accepted on this listener and not closed yet
+	retired  bool // address removed from the configuration: new sessions are refused and the listener is closed after the last session
+}
+
+type clientServed struct {
+	session             quic.Session
+	firstStream         quic.Stream
+	controlStream       quic.Stream // terminal control stream (only if remote login)
+	stopSessionChannel  chan bool
+	listActiveListeners map[string][]closable
+	listenersMutex      sync.Mutex // multiple remote port forwardings can register listeners at the same time
+	subsystem           string     // subsystem requested by the client (only if MODE_SUBSYSTEM)
+	options             keyOptions // restrictions given by the line of the key of the client in the authorized keys file
+	publicKey           crypto.PublicKey // key the client authenticated with
+	version             byte             // version of the protocol negotiated with the client (0 if the client does not negotiate, see feature_negotiation.go)
+	env                 []string         // environment variables of the client accepted by the server (AcceptEnv)
+	audit               *sessionAudit    // audit record of the session (nil if no AuditLog, shared by the channels of a shared session)
+}
+
+const MODE_REM_LOGIN = 1
+const MODE_PORT_FORW = 2
+const MODE_BOTH = 3
+const MODE_EXEC = 4
+const MODE_COPY = 5
+const MODE_SUBSYSTEM = 6
+
+const SUBSYSTEM_ACCEPTED = 0x00
+const SUBSYSTEM_UNKNOWN = 0x01
+const SUBSYSTEM_REFUSED = 0x02 // not allowed by the options of the key of the client or by the configuration
+
+// returned by acceptNewClient once the listener of a retired address is closed
+var errListenerClosed = errors.New("listener closed")
+
+// returned by acceptNewClient when a client leaves before its session is accepted
+var errClientLeft = errors.New("normal error: it was just a client that leaves")
+
+// subsystems that can be requested by the clients (MODE_SUBSYSTEM), given their name
+var subsystems = map[string]func(client *clientServed, serverConfig *Server, stopChanel chan bool){
+	"sftp": sftpServerLoops,
+}
+
+// check the configuration of the server and listen on all its addresses
+func newServer(config *SSHConfig) (error, *Server) {
+	// extract public and private keys from files and build certificates
+	err, cert := config.checkServerConfig()
+	if err != nil {
+		return err, nil
+	}
+	s := &Server{
+		conf:        config,
+		certificate: &cert,
+		listeners:   make(map[string]*serverListener),
+		shells:      newPersistentShells(),
+		admission:   quic_utils.NewAdmissionControl(config.admissionConfig()),
+		active:      newActiveSessions(),
+		failures:    make(chan error, 1),
+	}
+
+	// creating listeners to listen to clients when calling Run method
+	for _, address := range config.listenAddresses() {
+		if _, err := s.listen(address, config); err != nil {
+			for _, l := range s.listeners {
+				l.listener.Close()
+			}
+			return err, nil
+		}
+	}
+	return nil, s
+}
+
+// listen a new address (the certificate is the one of the current host key, even after a reload)
+func (s *Server) listen(address string, config *SSHConfig) (*serverListener, error) {
+	tlsConf := tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.certificate, nil
+	}}
+	var quicConf *quic.Config
+	if config.idleTimeout != 0 {
+		quicConf = &quic.Config{IdleTimeout: config.idleTimeout}
+	}
+	listener, err := quic.ListenAddr(address, &tlsConf, quicConf)
+	if err != nil {
+		return nil, err
+	}
+	l := &serverListener{listener: listener}
+	s.listeners[address] = l
+	return l, nil
+}
+
+// Run the program in server mode. This allows multiple clients to connect simultaneously,
+// on all the addresses of the configuration. The configuration file is read again on SIGHUP.
+// Returns once the server is shut down, when ctx is done or by SIGTERM or SIGINT (see shutdown.go),
+// with an error if sessions had to be closed.
+func (s *Server) Run(ctx context.Context) error {
+	if s.conf.configFile != "" && s.conf.handleSignals {
+		go s.reloadOnSignal()
+	}
+	stop := s.shutdownSignals(ctx)
+	s.mutex.Lock()
+	for address, l := range s.listeners {
+		s.conf.printMsg("Listening on " + address)
+		go s.acceptClients(l)
+	}
+	s.mutex.Unlock()
+
+	// the sessions are accepted and served by other goroutines until the server shuts down
+	var failure error
+	select {
+	case <-stop:
+	case failure = <-s.failures:
+		s.currentConfig().printErr("Cannot accept sessions anymore: " + failure.Error())
+	}
+	return s.shutdown(stop, failure)
+}
+
+// accept the sessions of a listener until it is closed. Each session keeps the configuration it was accepted with.
+func (s *Server) acceptClients(l *serverListener) {
+	for {
+		// Step 1) accept a new session
+		client, err := s.acceptNewClient(l)
+		if err == errListenerClosed {
+			return
+		}
+		if err == errClientLeft {
+			continue
+		}
+		if err != nil {
+			s.listenerFailed(err)
+			return
+		}
+		s.mutex.Lock()
+		conf, retired, shuttingDown := s.conf, l.retired, s.shuttingDown
+		if !retired {
+			l.sessions++
+		}
+		s.mutex.Unlock()
+		if shuttingDown {
+			client.session.Close(errServerShutdown)
+			continue
+		} else if retired {
+			client.session.Close(errors.New("address not listened anymore by the server"))
+			continue
+		}
+		conf.printDebug("New session opened")
+		go func() {
+			session := &Server{conf: conf, shells: s.shells, admission: s.admission, active: s.active}
+			session.serveClient(client)
+			s.sessionClosed(l)
+		}()
+	}
+}
+
+// serve a session until it is closed. It is decomposed in 8 steps as described inside the function (step 1 is the accept).
+func (s *Server) serveClient(client *clientServed) {
+	// the session is written in the audit log once closed
+	client.audit = s.newSessionAudit(client)
+	defer s.writeAudit(client)
+	s.active.register(client, false)
+	defer s.active.unregister(client)
+
+	// Step 1b) admit the session until the client is authenticated: the banned addresses are refused before
+	// any signature is verified, and the clients not authenticated after LoginGraceTime are disconnected
+	admission, err := s.admission.Admit(client.session.RemoteAddr(), func() {
+		client.audit.closed("authentication timeout")
+		client.session.Close(errors.New("authentication timeout"))
+	})
+	if err != nil {
+		s.conf.printDebug(fmt.Sprintf("Session of %s refused: %s", client.session.RemoteAddr(), err))
+		client.audit.closed(err.Error())
+		client.session.Close(err)
+		return
+	}
+
+	// Step 2) accept a new first stream for this session
+	if s.acceptNewStream(client) != nil {
+		admission.Release()
+		client.audit.closed("no stream opened by the client")
+		client.session.Close(nil)
+		return
+	}
+	s.conf.printDebug("New stream opened")
+
+	// Step 3) authenticate and then allow or reject this client
+	if !s.allowClient(client) {
+		admission.Failed()
+		client.audit.closed("public key not allowed")
+		client.session.Close(errors.New("connection refused (public key not allowed)"))
+		return
+	}
+	admission.Authenticated()
+
+	// Step 4) ask the server mode to the client (1 = only remote login, 2 = only port forwarding, 3 = both, 4 = remote command, 5 = file copy, 6 = subsystem, 7 = shared session, V = negotiated features)
+	err, serverMode := s.askServerMode(client)
+	if err != nil {
+		client.audit.closed("no service granted: " + err.Error())
+		client.session.Close(nil)
+		return
+	}
+	if serverMode == MODE_MUX {
+		client.audit.requestedMode(serverMode)
+		s.serveChannels(client)
+		client.session.Close(nil)
+		return
+	}
+	s.serveMode(client, serverMode)
+}
+
+// serve the mode asked by the client (in a session, or in a channel of a shared session)
+func (s *Server) serveMode(client *clientServed, serverMode int) {
+	client.audit.requestedMode(serverMode)
+	if !s.conf.allowsMode(serverMode) {
+		client.audit.closed("service not allowed by the server (AllowModes)")
+		client.session.Close(errors.New("service not allowed by the server (AllowModes)"))
+		return
+	}
+
+	// Step 5) [optional] accept the terminal control stream (opened by the client before any port forwarding stream)
+	if serverMode == MODE_REM_LOGIN || serverMode == MODE_BOTH {
+		if s.acceptControlStream(client) != nil {
+			client.session.Close(nil)
+			return
+		}
+		s.active.loginStarted(client)
+	}
+
+	// Step 6) launch port forwarding and/or remote login. (port forwardings can also be requested during a remote login, see escape_sequences.go)
+	if serverMode == MODE_PORT_FORW || serverMode == MODE_BOTH || serverMode == MODE_REM_LOGIN {
+		s.launchPortForwarding(client)
+	}
+	if serverMode == MODE_REM_LOGIN || serverMode == MODE_BOTH {
+		s.launchRemoteLogin(client)
+	}
+	if serverMode == MODE_EXEC {
+		s.launchRemoteExec(client)
+	}
+	if serverMode == MODE_COPY {
+		s.launchRemoteCopy(client)
+	}
+	if serverMode == MODE_SUBSYSTEM {
+		s.launchSubsystem(client)
+	}
+
+	// Step 7) [optional] if MODE_PORT_FORW, listen on first stream for end of service request
+	if serverMode == MODE_PORT_FORW {
+		s.waitForClientStopRequest(client)
+	}
+
+	// Step 8) wait for message received on stopSessionChannel then close the session
+	<-client.stopSessionChannel
+	client.session.Close(nil)
+	s.conf.printDebug("Connection closed with foreign host");
+	stopListener(client)
+}
+
+/*
+ * serve the channels of a shared session (MODE_MUX) until it is closed: each channel asks its own
+ * mode (steps 2, 4 to 8), with the key of the client authenticated on the session.
+ */
+func (s *Server) serveChannels(client *clientServed) {
+	s.conf.printDebug("Session shared by the client")
+	mux := newSessionMux(client.session, client.firstStream, true)
+	for {
+		channel, err := mux.acceptChannel()
+		if err != nil {
+			return
+		}
+		channelClient := &clientServed{
+			session:             channel,
+			listActiveListeners: make(map[string][]closable),
+			stopSessionChannel:  make(chan bool),
+			options:             client.options,
+			publicKey:           client.publicKey,
+			audit:               client.audit,
+		}
+		go func() {
+			s.active.register(channelClient, true)
+			defer s.active.unregister(channelClient)
+			if s.acceptNewStream(channelClient) != nil {
+				return
+			}
+			err, serverMode := s.askServerMode(channelClient)
+			if err != nil || serverMode == MODE_MUX {
+				channelClient.session.Close(nil)
+				return
+			}
+			s.serveMode(channelClient, serverMode)
+		}()
+	}
+}
+
+// a session of a listener ended: a retired listener is closed after its last session
+func (s *Server) sessionClosed(l *serverListener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l.sessions--
+	if l.retired && l.sessions == 0 {
+		s.closeListener(l)
+	}
+}
+
+// close a listener without session (closing a listener of quic-go closes all its sessions)
+func (s *Server) closeListener(l *serverListener) {
+	for address, listener := range s.listeners {
+		if listener == l {
+			delete(s.listeners, address)
+		}
+	}
+	l.listener.Close()
+	s.checkDrained()
+}
+
+/////// reload ///////
+
+// read the configuration file again on each SIGHUP
+func (s *Server) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := s.reload(); err != nil {
+			s.currentConfig().printErr("Configuration not reloaded, the previous one is kept: " + err.Error())
+		} else {
+			s.currentConfig().printMsg("Configuration reloaded")
+		}
+	}
+}
+
+/*
+ * replace the configuration of the server by the one of the configuration file, without closing
+ * the established sessions (they keep the configuration they were accepted with):
+ * > the new sessions get the new configuration and the new host key,
+ * > the new addresses are listened, and the removed addresses refuse the new sessions (their
+ *   listener is closed after their last session),
+ * > a new IdleTimeout only applies to the addresses listened after the reload, since the listener
+ *   of an address cannot be replaced while it has sessions.
+ * Nothing is changed if the new configuration is invalid.
+ */
+func (s *Server) reload() error {
+	err, conf := s.currentConfig().reloadServerConfig()
+	if err != nil {
+		return err
+	}
+	err, cert := conf.checkServerConfig()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return errServerShutdown
+	}
+	addresses := conf.listenAddresses()
+	opened := make(map[string]*serverListener)
+	for _, address := range addresses {
+		if _, found := s.listeners[address]; found {
+			continue
+		}
+		l, err := s.listen(address, conf)
+		if err != nil {
+			for _, l := range opened {
+				s.closeListener(l)
+			}
+			return err
+		}
+		opened[address] = l
+	}
+	for address, l := range s.listeners {
+		l.retired = !containsString(addresses, address)
+		if l.retired && l.sessions == 0 {
+			s.closeListener(l)
+		}
+	}
+	for address, l := range opened {
+		conf.printMsg("Listening on " + address)
+		go s.acceptClients(l)
+	}
+	s.conf, s.certificate = conf, &cert
+	s.admission.Configure(conf.admissionConfig())
+	return nil
+}
+
+func (s *Server) currentConfig() *SSHConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conf
+}
+
+// accept a new session with a client.
+func (s *Server) acceptNewClient(l *serverListener) (client *clientServed, err error) {
+	session, err := l.listener.Accept()
+	if err != nil {
+		quicErr := qerr.ToQuicError(err)
+		s.mutex.Lock()
+		retired := l.retired
+		s.mutex.Unlock()
+		if quicErr.ErrorCode == qerr.PeerGoingAway || quicErr.ErrorCode == qerr.NetworkIdleTimeout {
+			return nil, errClientLeft
+		} else if retired {
+			return nil, errListenerClosed
+		}
+		return nil, err // the listener failed
+	}
+	return &clientServed{
+		session:             session,
+		listActiveListeners: make(map[string][]closable),
+		stopSessionChannel:  make(chan bool),
+	}, nil
+}
+
+func (s *Server) acceptNewStream(client *clientServed) (err error) {
+	stream, err := client.session.AcceptStream()
+	if err != nil {
+		quicErr := qerr.ToQuicError(err)
+		if quicErr.ErrorCode == qerr.PeerGoingAway || quicErr.ErrorCode == qerr.NetworkIdleTimeout {
+			client.session.Close(nil)
+			return errors.New("normal error: a client leaved and thus no stream can be accepted anymore for him")
+		}
+		return err // the session was closed by the server (authentication timeout) or is broken: only this session stops
+	}
+	client.firstStream = stream
+	return nil
+}
+
+func (s *Server) acceptControlStream(client *clientServed) (err error) {
+	stream, err := client.session.AcceptStream()
+	if err != nil {
+		return errors.New("terminal control stream cannot be accepted")
+	}
+	client.controlStream = stream
+	return nil
+}
+
+func (s *Server) allowClient(client *clientServed) (result bool) {
+	receivedKey , err := quic_utils.AskClientPublicKey(client.session, client.firstStream)
+	if err != nil{
+		return false
+	}
+	allowed, options := checkClientPublicKey(s, receivedKey, client.session.RemoteAddr())
+	client.options, client.publicKey = options, receivedKey
+	return allowed
+}
+
+/*
+ * after getting allowed, first message the client sent is:
+ * > "1" if the client wants remote login only
+ * > "2" if the client wants port forwarding only
+ * > "3" if the client wants both remote login and port forwarding
+ * > "4" if the client wants remote command execution
+ * > "5" if the client wants to copy files
+ * > "6" if the client wants a subsystem. The name of the subsystem follows: |name l. (1 byte)|name|
+ *   and the server answers with 0x00 if the subsystem is accepted, 0x01 if it is unknown, 0x02 if
+ *   the key of the client has a forced command or if the subsystems are not allowed (AllowModes).
+ * > "7" if the client shares the session between several invocations (see multiplexing.go). Each
+ *   channel of the session then asks its own mode.
+ * > "V" if the client negotiates the features of the session (see feature_negotiation.go). The mode
+ *   is then given by the features granted.
+ * This method listen on the stream and return this number as an integer.
+ */
+func (s *Server) askServerMode(client *clientServed) (err error, result int) {
+	readBuffer := make([]byte, 1, 1)
+	n, err := io.ReadFull(client.firstStream, readBuffer)
+	if n == 1 {
+		msg := string(readBuffer[:n])
+		if msg == "1" {
+			result = MODE_REM_LOGIN
+		} else if msg == "2" {
+			result = MODE_PORT_FORW
+		} else if msg == "3" {
+			result = MODE_BOTH
+		} else if msg == "4" {
+			result = MODE_EXEC
+		} else if msg == "5" {
+			result = MODE_COPY
+		} else if msg == "6" {
+			result = MODE_SUBSYSTEM
+			err = s.askSubsystem(client)
+		} else if msg == "7" {
+			result = MODE_MUX
+		} else if msg == string(HELLO_MAGIC) {
+			err, result = s.negotiateFeatures(client)
+		} else {
+			err = errors.New("bad server mode request")
+		}
+	}
+	if err != nil {
+		err = errors.New("error when reading server mode on stream")
+	}
+	return err, result
+}
+
+// read the name of the subsystem requested by the client and tell whether it is accepted
+func (s *Server) askSubsystem(client *clientServed) error {
+	length := make([]byte, 1, 1)
+	if _, err := io.ReadFull(client.firstStream, length); err != nil {
+		return err
+	}
+	name := make([]byte, length[0], length[0])
+	if _, err := io.ReadFull(client.firstStream, name); err != nil {
+		return err
+	}
+	if subsystems[string(name)] == nil {
+		client.firstStream.Write([]byte{SUBSYSTEM_UNKNOWN})
+		return errors.New("unknown subsystem")
+	}
+	if client.options.command != "" || !s.conf.allowsMode(MODE_SUBSYSTEM) { // only the forced command can be run, or no subsystem at all
+		client.firstStream.Write([]byte{SUBSYSTEM_REFUSED})
+		return errors.New("subsystem refused by the options of the key")
+	}
+	client.subsystem = string(name)
+	_, err := client.firstStream.Write([]byte{SUBSYSTEM_ACCEPTED})
+	return err
+}
+
+func (s *Server) launchPortForwarding(client *clientServed) {
+	initialForwardingConfig := newPortForwardingSession(s.conf, client.session, client.firstStream)
+	initialForwardingConfig.setClientServed(client)
+	go initialForwardingConfig.runAsDestination()
+}
+
+func (s *Server) launchRemoteLogin(client *clientServed) {
+	go remoteLoginServerLoops(client, s, client.stopSessionChannel)
+}
+
+func (s *Server) launchRemoteExec(client *clientServed) {
+	go remoteExecServerLoops(client, s, client.stopSessionChannel)
+}
+
+func (s *Server) launchRemoteCopy(client *clientServed) {
+	go remoteCopyServerLoops(client, s, client.stopSessionChannel)
+}
+
+func (s *Server) launchSubsystem(client *clientServed) {
+	go subsystems[client.subsystem](client, s, client.stopSessionChannel)
+}
+
+func (s *Server) waitForClientStopRequest(client *clientServed) {
+	go func() {
+		stopBuffer := make([]byte, 4, 4) // stop message is "stop" (4 letters), or SESSION_END if the features were negotiated
+		if client.version >= 1 {
+			stopBuffer = stopBuffer[:1]
+		}
+		io.ReadFull(client.firstStream, stopBuffer)
+		s.conf.printDebug("Connection closed with foreign host");
+		client.stopSessionChannel <- true // we anyway also stop if message is not "stop" because then something went wrong.
+	}()
+}
+
+func stopListener(client *clientServed) {
+	client.listenersMutex.Lock()
+	defer client.listenersMutex.Unlock()
+	addr := fmt.Sprintf("%s", client.session.RemoteAddr())
+	for _, element := range client.listActiveListeners[addr] {
+		element.Close()
+	}
+	client.listActiveListeners[addr] = nil
+}
@@ -0,0 +1,385 @@
+package quicssh
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"quic_utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Configuration file of the server (-f), one "Keyword arguments" per line as in sshd_config.
+ * Keywords are case-insensitive, empty lines and lines starting with '#' are ignored. The options
+ * given on the command line take precedence over the file.
+ *
+ *   ListenAddress 0.0.0.0:4242
+ *   HostKey /etc/quic_ssh/host_ed25519_key
+ *   AuthorizedKeysFile /etc/quic_ssh/authorized_keys
+ *   AllowModes login exec copy subsystem
+ *   AllowTcpForwarding local
+ *
+ * > ListenAddress host[:port]: address to listen (can be repeated, Port is used if no port is given),
+ * > Port port: port of the listen addresses given without port (and of the hostname if no ListenAddress),
+ * > HostKey file: private key of the server (the public key is derived from it if --pub is not given),
+ * > AuthorizedKeysFile file: authorized keys of the clients (as --req),
+ * > AllowModes mode...: services the clients can ask among login, forward, exec, copy and subsystem (all by default),
+ * > AllowTcpForwarding yes|no|local|remote: allowed port forwardings, TCP and UDP (yes by default),
+ * > AllowStreamLocalForwarding yes|no|local|remote: same for the forwardings of Unix sockets (contacted or created
+ *   by the server with the filesystem rights of the account of the client),
+ * > AllowAgentForwarding yes|no (yes by default),
+ * > PermitOpen host:port...: allowed destinations of the local and dynamic forwardings (any by default),
+ * > PermitListen [host:]port...: allowed listening addresses of the remote forwardings (any by default),
+ * > AcceptEnv pattern...: environment variables sent by the clients and given to their shell or command,
+ *   with '*' and '?' wildcards (none by default, see feature_negotiation.go),
+ * > MaxStartups n: sessions not authenticated yet, the next ones are refused (no limit by default),
+ * > MaxAuthFailures n: authentication failures of an address (IP) before it is banned (never by default),
+ * > BanTime duration: first ban of an address (1 minute by default), doubled at each new ban of the address,
+ * > MaxBanTime duration: longest ban of an address (1 day by default). The sessions of a banned address are
+ *   refused before any signature is verified (see quic_utils/admission.go),
+ * > LoginGraceTime duration: the clients not authenticated after this duration are disconnected and their
+ *   address counts a failure (2 minutes by default, 0 for no limit),
+ * > ShutdownGraceTime duration: on SIGTERM or SIGINT, time given to the established sessions to end before
+ *   they are closed (30 seconds by default, 0 to close them at once, see shutdown.go),
+ * > AuditLog file: one JSON record per session is appended to this file (see audit.go),
+ * > RecordSessions directory: the terminal I/O of the remote logins is recorded in this directory, in the
+ *   asciicast format (see session_recording.go),
+ * > IdleTimeout duration: sessions without any packet from the client are closed after this duration
+ *   (seconds, or a duration as "90s" or "5m"),
+ * > DetachTimeout duration: the shell of a persistent session is stopped after this duration without
+ *   client (1 hour by default, see persistent_session.go),
+ * > LogLevel QUIET|INFO|DEBUG: messages printed by the server (DEBUG by default),
+ * > BufferSize bytes: internal buffer size (as -b).
+ *
+ * The file is read again when the server receives SIGHUP (see Server.reload). The sessions already
+ * established keep the configuration they were accepted with.
+ */
+
+// time given to the clients to authenticate if no LoginGraceTime (the user may have to check the key of the
+// server and type the passphrase of its key)
+const defaultLoginGraceTime = 2 * time.Minute
+
+// time given to the established sessions to end when the server stops, if no ShutdownGraceTime
+const defaultShutdownGraceTime = 30 * time.Second
+
+// "yes", "no", "local" or "remote" (Allow*Forwarding)
+var forwardingPolicies = []string{"yes", "no", "local", "remote"}
+
+// modes of AllowModes, given their name
+var modeNames = map[string]int{
+	"login":     MODE_REM_LOGIN,
+	"forward":   MODE_PORT_FORW,
+	"exec":      MODE_EXEC,
+	"copy":      MODE_COPY,
+	"subsystem": MODE_SUBSYSTEM,
+}
+
+// LogLevel values, given their name
+var printLevelNames = map[string]int{
+	"quiet": PRINT_LEVEL_QUIET,
+	"info":  PRINT_LEVEL_NORMAL,
+	"debug": PRINT_LEVEL_DEBUG,
+}
+
+// read the configuration file of the server (conf.configFile). Returns the first invalid line.
+func (conf *SSHConfig) readServerConfigFile() error {
+	data, err := ioutil.ReadFile(conf.configFile)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) == 1 {
+			return errors.New(fmt.Sprintf("%s line %d: missing argument for '%s'", conf.configFile, i+1, fields[0]))
+		}
+		if err := conf.parseServerConfigLine(strings.ToLower(fields[0]), fields[1:]); err != nil {
+			return errors.New(fmt.Sprintf("%s line %d: %s", conf.configFile, i+1, err))
+		}
+	}
+	return nil
+}
+
+func (conf *SSHConfig) parseServerConfigLine(keyword string, args []string) (err error) {
+	switch keyword {
+	case "listenaddress", "permitopen", "permitlisten", "allowmodes", "acceptenv":
+	default:
+		if len(args) != 1 {
+			return errors.New(fmt.Sprintf("'%s' takes a single argument", keyword))
+		}
+	}
+
+	switch keyword {
+	case "listenaddress":
+		conf.addresses = append(conf.addresses, args...)
+	case "port":
+		if conf.port, err = strconv.Atoi(args[0]); err != nil || conf.port <= 0 || conf.port > 65535 {
+			return errors.New(fmt.Sprintf("invalid port '%s'", args[0]))
+		}
+	case "hostkey":
+		conf.privKeyFile = args[0]
+	case "authorizedkeysfile":
+		conf.authorizedPublicKeysFile = args[0]
+	case "allowmodes":
+		conf.allowedModes = []int{}
+		for _, name := range args {
+			mode, found := modeNames[strings.ToLower(name)]
+			if !found {
+				return errors.New(fmt.Sprintf("unknown mode '%s' (login, forward, exec, copy or subsystem)", name))
+			}
+			conf.allowedModes = append(conf.allowedModes, mode)
+		}
+	case "allowtcpforwarding", "allowstreamlocalforwarding":
+		policy := strings.ToLower(args[0])
+		if !containsString(forwardingPolicies, policy) {
+			return errors.New(fmt.Sprintf("invalid value '%s' (yes, no, local or remote)", args[0]))
+		}
+		if keyword == "allowtcpforwarding" {
+			conf.allowTcpForwarding = policy
+		} else {
+			conf.allowStreamLocalForwarding = policy
+		}
+	case "allowagentforwarding":
+		switch strings.ToLower(args[0]) {
+		case "yes":
+			conf.noAgentForwarding = false
+		case "no":
+			conf.noAgentForwarding = true
+		default:
+			return errors.New(fmt.Sprintf("invalid value '%s' (yes or no)", args[0]))
+		}
+	case "permitopen":
+		for _, permitted := range args {
+			if _, _, err := net.SplitHostPort(permitted); err != nil {
+				return errors.New(fmt.Sprintf("invalid destination '%s' (host:port expected)", permitted))
+			}
+		}
+		conf.permitOpen = append(conf.permitOpen, args...)
+	case "permitlisten":
+		conf.permitListen = append(conf.permitListen, args...)
+	case "acceptenv":
+		conf.acceptEnv = append(conf.acceptEnv, args...)
+	case "maxstartups", "maxauthfailures":
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 0 {
+			return errors.New(fmt.Sprintf("invalid number '%s'", args[0]))
+		}
+		if keyword == "maxstartups" {
+			conf.maxStartups = value
+		} else {
+			conf.maxAuthFailures = value
+		}
+	case "bantime":
+		if conf.banTime, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+	case "maxbantime":
+		if conf.maxBanTime, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+	case "logingracetime":
+		if conf.loginGraceTime, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+		if conf.loginGraceTime == 0 {
+			conf.loginGraceTime = -1 // no limit
+		}
+	case "shutdowngracetime":
+		if conf.shutdownGraceTime, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+		if conf.shutdownGraceTime == 0 {
+			conf.shutdownGraceTime = -1 // sessions closed at once
+		}
+	case "auditlog":
+		conf.auditLog = args[0]
+	case "recordsessions":
+		conf.recordSessions = args[0]
+	case "idletimeout":
+		if conf.idleTimeout, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+	case "detachtimeout":
+		if conf.detachTimeout, err = parseTimeout(args[0]); err != nil {
+			return err
+		}
+	case "loglevel":
+		level, found := printLevelNames[strings.ToLower(args[0])]
+		if !found {
+			return errors.New(fmt.Sprintf("invalid log level '%s' (QUIET, INFO or DEBUG)", args[0]))
+		}
+		conf.printLevel = level
+	case "buffersize":
+		if conf.bufSize, err = strconv.Atoi(args[0]); err != nil || conf.bufSize <= 0 {
+			return errors.New(fmt.Sprintf("invalid buffer size '%s'", args[0]))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown keyword '%s'", keyword))
+	}
+	return nil
+}
+
+// a number of seconds or a duration as "90s" or "5m"
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return duration, nil
+	}
+	return 0, errors.New(fmt.Sprintf("invalid timeout '%s'", value))
+}
+
+func containsString(list []string, str string) bool {
+	for _, element := range list {
+		if element == str {
+			return true
+		}
+	}
+	return false
+}
+
+/////// validation ///////
+
+/*
+ * check everything needed to start the server with this configuration (-t): the host key, the
+ * authorized keys file and the listen addresses. Returns the certificate of the host key.
+ */
+func (conf *SSHConfig) checkServerConfig() (error, tls.Certificate) {
+	err, cert := loadHostCertificate(conf)
+	if err != nil {
+		return err, cert
+	}
+	if conf.authorizedPublicKeysFile != "" {
+		if _, err := ioutil.ReadFile(conf.authorizedPublicKeysFile); err != nil {
+			return err, cert
+		}
+	}
+	for _, address := range conf.listenAddresses() {
+		if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+			return errors.New(fmt.Sprintf("invalid listen address '%s': %s", address, err)), cert
+		}
+	}
+	if conf.recordSessions != "" {
+		if info, err := os.Stat(conf.recordSessions); err != nil || !info.IsDir() {
+			return errors.New(fmt.Sprintf("invalid directory of the recordings '%s'", conf.recordSessions)), cert
+		}
+	}
+	return nil, cert
+}
+
+// certificate of the host key (the public key is derived from the private key if no file is given)
+func loadHostCertificate(conf *SSHConfig) (error, tls.Certificate) {
+	privateKey, err := quic_utils.ExtractPrivateKey(conf.privKeyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot load the host key '%s': %s", conf.privKeyFile, err)), tls.Certificate{}
+	}
+	publicKey := privateKey.Public()
+	if conf.pubKeyFile != "" {
+		if publicKey, err = quic_utils.ExtractPublicKey(conf.pubKeyFile); err != nil {
+			return errors.New(fmt.Sprintf("cannot load the public key '%s': %s", conf.pubKeyFile, err)), tls.Certificate{}
+		}
+		if !quic_utils.ComparePublicKeys(publicKey, privateKey.Public()) {
+			return errors.New(fmt.Sprintf("the public key '%s' does not match the host key '%s'", conf.pubKeyFile, conf.privKeyFile)), tls.Certificate{}
+		}
+	}
+	if err := checkHostKeyType(publicKey); err != nil {
+		return errors.New(fmt.Sprintf("cannot use the host key '%s': %s", conf.privKeyFile, err)), tls.Certificate{}
+	}
+	cert, err := quic_utils.MakeCertificate(publicKey, privateKey)
+	return err, cert
+}
+
+// addresses to listen: ListenAddress (with Port if no port given), or the hostname and port
+func (conf *SSHConfig) listenAddresses() []string {
+	if len(conf.addresses) == 0 {
+		return []string{conf.formatAddress()}
+	}
+	addresses := make([]string, 0, len(conf.addresses))
+	for _, address := range conf.addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(conf.port))
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+/////// policy ///////
+
+// limits of the sessions not authenticated yet (see quic_utils/admission.go)
+func (conf *SSHConfig) admissionConfig() quic_utils.AdmissionConfig {
+	graceTime := conf.loginGraceTime
+	if graceTime == 0 {
+		graceTime = defaultLoginGraceTime
+	} else if graceTime < 0 {
+		graceTime = 0
+	}
+	return quic_utils.AdmissionConfig{MaxUnauthenticated: conf.maxStartups, MaxFailures: conf.maxAuthFailures,
+		BanTime: conf.banTime, MaxBanTime: conf.maxBanTime, AuthTimeout: graceTime}
+}
+
+// check a mode asked by a client (MODE_BOTH needs both login and forward)
+func (conf *SSHConfig) allowsMode(mode int) bool {
+	if conf.allowedModes == nil || mode == MODE_MUX { // the mode of each channel is checked
+		return true
+	}
+	if mode == MODE_BOTH {
+		return conf.allowsMode(MODE_REM_LOGIN) && conf.allowsMode(MODE_PORT_FORW)
+	}
+	for _, allowed := range conf.allowedModes {
+		if allowed == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// check a port forwarding request received by the server (or an agent forwarding stream)
+func (conf *SSHConfig) allowsForwarding(request portForwardingRequest) error {
+	if request.agent {
+		if conf.noAgentForwarding {
+			return errors.New("agent forwarding not allowed by the server")
+		}
+		return nil
+	}
+	policy, kind := conf.allowTcpForwarding, "port forwarding"
+	if request.localSocket != "" || request.remoteSocket != "" {
+		policy, kind = conf.allowStreamLocalForwarding, "forwarding of Unix sockets"
+	}
+	if policy == "no" || (policy == "local" && !request.local) || (policy == "remote" && request.local) {
+		return errors.New(kind + " not allowed by the server")
+	}
+	// PermitOpen and PermitListen are checked as the options of a key
+	options := keyOptions{permitOpen: conf.permitOpen, permitListen: conf.permitListen}
+	if request.local && options.permitOpen != nil && !options.permitsOpen(request) {
+		return errors.New("destination not permitted by the server (PermitOpen)")
+	}
+	if !request.local && options.permitListen != nil && !options.permitsListen(request) {
+		return errors.New("listening address not permitted by the server (PermitListen)")
+	}
+	return nil
+}
+
+// configuration read again from the file and the same command line, or the same options of NewServer (on SIGHUP)
+func (conf *SSHConfig) reloadServerConfig() (error, *SSHConfig) {
+	newConf := &SSHConfig{stdin: conf.stdin, stdout: conf.stdout, stderr: conf.stderr, handleSignals: conf.handleSignals, options: conf.options}
+	newConf.setDefaults()
+	newConf.configFile = conf.configFile
+	if err := newConf.readServerConfigFile(); err != nil {
+		return err, nil
+	}
+	if newConf.options == nil {
+		newConf.parseCommandLine() // already checked when the server was started
+	} else if err := newConf.applyOptions(newConf.options); err != nil {
+		return err, nil
+	}
+	return nil, newConf
+}
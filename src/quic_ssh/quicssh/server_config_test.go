@@ -0,0 +1,126 @@
+package quicssh
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("10")
+}
+
+// parse the command line of a server (the usage is kept in testOutput)
+func parseServerArguments(command string) *SSHConfig {
+	os.Args = strings.Split(command, " ")
+	conf := SSHConfig{}
+	conf.useTestTerminal()
+	conf.parseArguments()
+	return &conf
+}
+
+func TestServerConfigFile(t *testing.T) {
+	file := directory + "config_server"
+	writeFile(file, "# comment\n\nListenAddress 127.0.0.1:4242 [::1]\nport 4243\nHostKey "+directory+"pr_server\n"+
+		"AuthorizedKeysFile "+directory+"authorized_hosts_server\nAllowModes login EXEC\nAllowTcpForwarding local\n"+
+		"AllowAgentForwarding no\nPermitOpen localhost:80 *:443\nAcceptEnv LANG LC_*\nAuditLog /var/log/quic_ssh/audit.log\nMaxStartups 10\nMaxAuthFailures 3\nBanTime 30s\nLoginGraceTime 0\nIdleTimeout 5m\nDetachTimeout 2h\nShutdownGraceTime 10s\nLogLevel QUIET\nBufferSize 2000\n")
+	conf := parseServerArguments("quic_ssh -f " + file + " -b 3000")
+	checkValueBoolean("'absence of usage printed'", true, !strings.Contains(conf.testOutput(), "Usage:"), t)
+	checkValueBoolean("conf.listen", true, conf.listen, t)
+	checkValueString("listen addresses", "127.0.0.1:4242 [::1]:4243", strings.Join(conf.listenAddresses(), " "), t)
+	checkValueString("host key", directory+"pr_server", conf.privKeyFile, t)
+	checkValueString("authorized keys file", directory+"authorized_hosts_server", conf.authorizedPublicKeysFile, t)
+	checkValueBoolean("'exec allowed'", true, conf.allowsMode(MODE_EXEC), t)
+	checkValueBoolean("'login and forward allowed'", false, conf.allowsMode(MODE_BOTH), t)
+	checkValueString("audit log", "/var/log/quic_ssh/audit.log", conf.auditLog, t)
+	checkValueString("accepted environment", "LANG=C LC_ALL=C", strings.Join(conf.acceptedEnvironment([]string{"LANG=C", "TERM=xterm", "LC_ALL=C"}), " "), t)
+	admission := conf.admissionConfig()
+	checkValueInt("max startups", 10, admission.MaxUnauthenticated, t)
+	checkValueInt("max auth failures", 3, admission.MaxFailures, t)
+	checkValueInt("ban time", 30, int(admission.BanTime.Seconds()), t)
+	checkValueInt("login grace time (no limit)", 0, int(admission.AuthTimeout), t)
+	checkValueInt("idle timeout", 300, int(conf.idleTimeout.Seconds()), t)
+	checkValueInt("detach timeout", 7200, int(conf.detachTimeout.Seconds()), t)
+	checkValueInt("shutdown grace time", 10, int(conf.shutdownGraceTime.Seconds()), t)
+	checkValueInt("log level", PRINT_LEVEL_QUIET, conf.printLevel, t)
+	checkValueInt("buffer size (command line first)", 3000, conf.bufSize, t)
+
+	// forwarding policy
+	forwards := []struct {
+		request  portForwardingRequest
+		expected bool
+	}{
+		{portForwardingRequest{local: true, hostname: "localhost", remoteIP: []byte{127, 0, 0, 1}, remotePort: 80}, true},
+		{portForwardingRequest{local: true, hostname: "example.com", remotePort: 443, dynamic: true}, true},
+		{portForwardingRequest{local: true, hostname: "localhost", remoteIP: []byte{127, 0, 0, 1}, remotePort: 22}, false},
+		{portForwardingRequest{local: false, localPort: 8080}, false},
+		{portForwardingRequest{local: true, remoteSocket: "/tmp/socket"}, false},
+		{portForwardingRequest{agent: true}, false},
+	}
+	for _, forward := range forwards {
+		checkValueBoolean("'forwarding "+forward.request.String()+" allowed'", forward.expected, conf.allowsForwarding(forward.request) == nil, t)
+	}
+
+	// -t checks the keys
+	err, _ := conf.checkServerConfig()
+	checkValueBoolean("'valid configuration'", true, err == nil, t)
+	conf = parseServerArguments("quic_ssh -t -f " + file + " --pub " + directory + "pk_client")
+	checkValueBoolean("conf.checkConfig", true, conf.checkConfig, t)
+	err, _ = conf.checkServerConfig()
+	checkValueBoolean("'public key not matching the host key'", true, err != nil, t)
+
+	// invalid lines
+	for _, invalid := range []string{"Unknown yes", "Port", "Port 70000", "AllowModes shell", "AllowTcpForwarding maybe",
+		"PermitOpen localhost", "IdleTimeout soon", "MaxStartups many", "MaxAuthFailures -1", "LogLevel VERBOSE", "HostKey a b"} {
+		writeFile(file, "HostKey "+directory+"pr_server\n"+invalid+"\n")
+		conf = parseServerArguments("quic_ssh -f " + file)
+		checkValueBoolean("'usage printed for "+invalid+"'", true, strings.Contains(conf.testOutput(), "line 2"), t)
+	}
+}
+
+func TestServerConfigReload(t *testing.T) {
+	port, newPort := 41125, 41126
+	file := directory + "config_server_reload"
+	hostKey := "HostKey " + directory + "pr_server\n"
+	writeFile(file, hostKey+"Port 41125\nAllowModes login\n")
+	confServer := parseServerArguments("quic_ssh -f " + file)
+	sshServer := newTestServer(confServer)
+	go sshServer.Run(context.Background())
+
+	// the modes are checked
+	_, status := launchRemoteExecClient(port, []string{"echo", "refused"}, "")
+	checkValueBoolean("'exec refused'", true, status != 0, t)
+	writeFile(file, hostKey+"Port 41125\nAllowModes login exec\n")
+	checkValueBoolean("'reloaded'", true, sshServer.reload() == nil, t)
+	conf, _ := launchRemoteExecClient(port, []string{"echo", "allowed"}, "")
+	checkValueString("standard output", "allowed\n", conf.testOutput(), t)
+
+	// an invalid file keeps the configuration
+	writeFile(file, hostKey+"Port 41125\nAllowModes none\n")
+	checkValueBoolean("'invalid file not reloaded'", true, sshServer.reload() != nil, t)
+	conf, _ = launchRemoteExecClient(port, []string{"echo", "allowed"}, "")
+	checkValueString("standard output", "allowed\n", conf.testOutput(), t)
+
+	// the session established on a removed address is kept, its listener is closed after the session
+	kept := make(chan *SSHConfig)
+	go func() {
+		conf, _ := launchRemoteExecClient(port, []string{"sleep", "1;", "echo", "kept"}, "")
+		kept <- conf
+	}()
+	time.Sleep(500 * time.Millisecond)
+	writeFile(file, hostKey+"ListenAddress 127.0.0.1:41126\n")
+	checkValueBoolean("'reloaded'", true, sshServer.reload() == nil, t)
+	conf, _ = launchRemoteExecClient(newPort, []string{"echo", "new address"}, "")
+	checkValueString("standard output", "new address\n", conf.testOutput(), t)
+	checkValueString("standard output of the kept session", "kept\n", (<-kept).testOutput(), t)
+	listeners := 0
+	for i := 0; i < 20 && listeners != 1; i++ {
+		time.Sleep(100 * time.Millisecond)
+		sshServer.mutex.Lock()
+		listeners = len(sshServer.listeners)
+		sshServer.mutex.Unlock()
+	}
+	checkValueInt("listeners", 1, listeners, t)
+}
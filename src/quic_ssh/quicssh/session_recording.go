@@ -0,0 +1,137 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Session recording:
+	------------------
+
+	If the configuration of the server has a RecordSessions directory, the terminal I/O of each remote login is
+	recorded in a file of this directory, in the asciicast format (version 2) of asciinema, so that it can be
+	replayed with "asciinema play". The file is named after the start of the session and its connection ID, and
+	given in the audit record of the session (see audit.go).
+
+	{"version":2,"width":80,"height":24,"timestamp":1556784000,"title":"alice@10.0.0.2:50123","env":{"TERM":"xterm"}}
+	[0.215,"o","alice@server:~$ "]
+	[1.503,"i","ls\r"]
+
+	The first line describes the terminal requested by the client. Each following line is an event: its time in
+	seconds since the start of the recording, "o" for the output of the shell sent to the client, "i" for the
+	input typed by the user, and the data (the UTF-8 characters split between two reads are kept for the next
+	event). A persistent session is recorded as long as the client is attached.
+*/
+
+type sessionRecording struct {
+	mutex   sync.Mutex
+	file    *os.File
+	start   time.Time
+	pending map[string][]byte // end of the last data of each kind, not a whole UTF-8 character yet
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+// first stream of a recorded remote login: what is read is the input, what is written the output
+type recordedStream struct {
+	quic.Stream
+	recording *sessionRecording
+}
+
+/*
+ * start recording the remote login of client in the directory of RecordSessions. Returns nil if the sessions
+ * are not recorded, or if the file cannot be created (the remote login is not refused).
+ */
+func (s *Server) startRecording(client *clientServed, request terminalRequest) *sessionRecording {
+	if s.conf.recordSessions == "" {
+		return nil
+	}
+	start := time.Now()
+	name := fmt.Sprintf("%s-%016x.cast", start.Format("20060102-150405.000000"), client.session.AddedForThesis_getConnectionId())
+	path := filepath.Join(s.conf.recordSessions, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		s.conf.printErr("Cannot record the session: " + err.Error())
+		return nil
+	}
+	header, _ := json.Marshal(asciicastHeader{Version: 2, Width: request.cols, Height: request.rows, Timestamp: start.Unix(),
+		Title: request.username + "@" + client.session.RemoteAddr().String(), Env: map[string]string{"TERM": request.term}})
+	file.Write(append(header, '\n'))
+	client.audit.recordedIn(path)
+	return &sessionRecording{file: file, start: start, pending: make(map[string][]byte)}
+}
+
+// record the data read and written on stream (stream itself if the session is not recorded)
+func (recording *sessionRecording) wrap(stream quic.Stream) quic.Stream {
+	if recording == nil {
+		return stream
+	}
+	return &recordedStream{Stream: stream, recording: recording}
+}
+
+// write an event ("o" or "i") of data
+func (recording *sessionRecording) event(kind string, data []byte) {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+	if recording.file == nil {
+		return
+	}
+	data = append(recording.pending[kind], data...)
+	end := len(data)
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ { // beginning of a character at the end of data ?
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				end = len(data) - i
+			}
+			break
+		}
+	}
+	recording.pending[kind] = append([]byte{}, data[end:]...)
+	if end == 0 {
+		return
+	}
+	line, _ := json.Marshal([]interface{}{float64(time.Since(recording.start).Nanoseconds()/1000) / 1e6, kind, string(data[:end])})
+	recording.file.Write(append(line, '\n'))
+}
+
+func (recording *sessionRecording) close() {
+	if recording == nil {
+		return
+	}
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+	if recording.file != nil {
+		recording.file.Close()
+		recording.file = nil
+	}
+}
+
+func (stream *recordedStream) Read(b []byte) (int, error) {
+	n, err := stream.Stream.Read(b)
+	if n > 0 {
+		stream.recording.event("i", b[:n])
+	}
+	return n, err
+}
+
+func (stream *recordedStream) Write(b []byte) (int, error) {
+	n, err := stream.Stream.Write(b)
+	if n > 0 {
+		stream.recording.event("o", b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,605 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// largest number of bytes read or written by a single request
+const sftpMaxChunk = 256 * 1024
+
+// state of the file access subsystem for one client
+type sftpServer struct {
+	account    *userAccount
+	handles    map[uint32]*os.File
+	nextHandle uint32
+}
+
+/////////////////
+// server part //
+/////////////////
+
+func sftpServerLoops(client *clientServed, serverConfig *Server, stopChanel chan bool) {
+	stream := client.firstStream
+
+	// step 1) read the init request and check the user
+	err, packet := readSFTPPacket(stream)
+	if err != nil || packet.msgType != SFTP_INIT {
+		stream.Close()
+		stopChanel <- true
+		return
+	}
+	account, err := client.lookupAccount(string(packet.payload))
+	if err != nil {
+		writeSFTPPacket(stream, sftpPacket{SFTP_STATUS, packet.id, encodeSFTPStatus(SFTP_PERMISSION_DENIED, err.Error())})
+		stream.Close()
+		stopChanel <- true
+		return
+	}
+	writeSFTPPacket(stream, sftpPacket{SFTP_STATUS, packet.id, encodeSFTPStatus(SFTP_OK, "")})
+	serverConfig.conf.printDebug(fmt.Sprintf("New sftp session for user '%s'", account.name))
+
+	// step 2) answer the requests until the client leaves
+	server := &sftpServer{account: account, handles: make(map[uint32]*os.File)}
+	for {
+		err, packet = readSFTPPacket(stream)
+		if err != nil {
+			break
+		}
+		msgType, payload := server.handle(packet)
+		if writeSFTPPacket(stream, sftpPacket{msgType, packet.id, payload}) != nil {
+			break
+		}
+	}
+
+	// step 3) close the files left open by the client
+	for _, file := range server.handles {
+		file.Close()
+	}
+	stream.Close()
+	stopChanel <- true
+}
+
+/*
+ * answer one request: returns the type and the payload of the response.
+ * The files are accessed with the credentials of the user (see asUser): the kernel checks the permissions.
+ */
+func (server *sftpServer) handle(packet sftpPacket) (msgType byte, payload []byte) {
+	err := server.account.asUser(func() error {
+		msgType, payload = server.answer(packet)
+		return nil
+	})
+	if err != nil {
+		return SFTP_STATUS, getSFTPStatus(errPermissionDenied())
+	}
+	return msgType, payload
+}
+
+// answer one request (to be called by asUser)
+func (server *sftpServer) answer(packet sftpPacket) (byte, []byte) {
+	request := packet.payload
+	var response []byte
+	var err error
+	responseType := byte(SFTP_STATUS)
+	switch {
+	case packet.msgType == SFTP_LIST:
+		responseType = SFTP_NAMES
+		response, err = server.list(string(request))
+	case packet.msgType == SFTP_STAT && len(request) >= 1:
+		responseType = SFTP_ATTRS
+		response, err = server.stat(string(request[1:]), request[0] != 0)
+	case packet.msgType == SFTP_OPEN && len(request) >= 5:
+		responseType = SFTP_HANDLE
+		response, err = server.open(string(request[5:]), request[0], binary.BigEndian.Uint32(request[1:5]))
+	case packet.msgType == SFTP_CLOSE && len(request) == 4:
+		err = server.close(binary.BigEndian.Uint32(request[0:4]))
+	case packet.msgType == SFTP_READ && len(request) == 16:
+		responseType = SFTP_DATA
+		response, err = server.read(binary.BigEndian.Uint32(request[0:4]), int64(binary.BigEndian.Uint64(request[4:12])), binary.BigEndian.Uint32(request[12:16]))
+	case packet.msgType == SFTP_WRITE && len(request) >= 12:
+		err = server.write(binary.BigEndian.Uint32(request[0:4]), int64(binary.BigEndian.Uint64(request[4:12])), request[12:])
+	case packet.msgType == SFTP_RENAME:
+		errDecode, oldPath, newPath := decodeSFTPString(request)
+		if errDecode != nil {
+			return SFTP_STATUS, encodeSFTPStatus(SFTP_BAD_MESSAGE, "bad message")
+		}
+		err = server.rename(oldPath, string(newPath))
+	case packet.msgType == SFTP_REMOVE:
+		err = server.remove(string(request))
+	case packet.msgType == SFTP_MKDIR && len(request) >= 4:
+		err = server.mkdir(string(request[4:]), binary.BigEndian.Uint32(request[0:4]))
+	case packet.msgType == SFTP_SYMLINK:
+		errDecode, target, link := decodeSFTPString(request)
+		if errDecode != nil {
+			return SFTP_STATUS, encodeSFTPStatus(SFTP_BAD_MESSAGE, "bad message")
+		}
+		err = server.symlink(target, string(link))
+	case packet.msgType == SFTP_CHECKSUM && len(request) >= 16:
+		responseType = SFTP_SUM
+		response, err = server.checksum(string(request[16:]), int64(binary.BigEndian.Uint64(request[0:8])), int64(binary.BigEndian.Uint64(request[8:16])))
+	default:
+		return SFTP_STATUS, encodeSFTPStatus(SFTP_BAD_MESSAGE, "bad message")
+	}
+	if err != nil || responseType == SFTP_STATUS {
+		return SFTP_STATUS, getSFTPStatus(err)
+	}
+	return responseType, response
+}
+
+// status response given the result of a request
+func getSFTPStatus(err error) []byte {
+	if err == nil {
+		return encodeSFTPStatus(SFTP_OK, "")
+	} else if sftpErr, ok := err.(*sftpError); ok {
+		return encodeSFTPStatus(sftpErr.code, sftpErr.msg)
+	} else if err == io.EOF {
+		return encodeSFTPStatus(SFTP_EOF, "end of file")
+	} else if os.IsNotExist(err) {
+		return encodeSFTPStatus(SFTP_NO_SUCH_FILE, "no such file or directory")
+	} else if os.IsPermission(err) {
+		return encodeSFTPStatus(SFTP_PERMISSION_DENIED, "permission denied")
+	}
+	return encodeSFTPStatus(SFTP_FAILURE, "failure")
+}
+
+func errPermissionDenied() error {
+	return &sftpError{SFTP_PERMISSION_DENIED, "permission denied"}
+}
+
+func (server *sftpServer) list(p string) ([]byte, error) {
+	p = resolveCopyPath(server.account, p)
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]sftpAttrs, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, newSFTPAttrs(info))
+	}
+	return encodeSFTPNames(files), nil
+}
+
+func (server *sftpServer) stat(p string, follow bool) ([]byte, error) {
+	p = resolveCopyPath(server.account, p)
+	var info os.FileInfo
+	var err error
+	if follow {
+		info, err = os.Stat(p)
+	} else {
+		info, err = os.Lstat(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encodeSFTPAttrs(newSFTPAttrs(info)), nil
+}
+
+func (server *sftpServer) open(p string, flags byte, mode uint32) ([]byte, error) {
+	p = resolveCopyPath(server.account, p)
+	osFlags := 0
+	if flags&SFTP_OPEN_READ != 0 && flags&SFTP_OPEN_WRITE != 0 {
+		osFlags = os.O_RDWR
+	} else if flags&SFTP_OPEN_WRITE != 0 {
+		osFlags = os.O_WRONLY
+	} else if flags&SFTP_OPEN_READ == 0 {
+		return nil, &sftpError{SFTP_BAD_MESSAGE, "file must be opened for reading or writing"}
+	}
+	if flags&SFTP_OPEN_CREATE != 0 {
+		osFlags |= os.O_CREATE
+	}
+	if flags&SFTP_OPEN_TRUNCATE != 0 {
+		osFlags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(p, osFlags, os.FileMode(mode&0777))
+	if err != nil {
+		return nil, err
+	}
+	server.nextHandle++
+	server.handles[server.nextHandle] = file
+	handle := make([]byte, 4, 4)
+	binary.BigEndian.PutUint32(handle, server.nextHandle)
+	return handle, nil
+}
+
+func (server *sftpServer) close(handle uint32) error {
+	file := server.handles[handle]
+	if file == nil {
+		return &sftpError{SFTP_FAILURE, "invalid handle"}
+	}
+	delete(server.handles, handle)
+	return file.Close()
+}
+
+func (server *sftpServer) read(handle uint32, offset int64, length uint32) ([]byte, error) {
+	file := server.handles[handle]
+	if file == nil {
+		return nil, &sftpError{SFTP_FAILURE, "invalid handle"}
+	}
+	if length > sftpMaxChunk {
+		length = sftpMaxChunk
+	}
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, offset)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+func (server *sftpServer) write(handle uint32, offset int64, data []byte) error {
+	file := server.handles[handle]
+	if file == nil {
+		return &sftpError{SFTP_FAILURE, "invalid handle"}
+	}
+	_, err := file.WriteAt(data, offset)
+	return err
+}
+
+func (server *sftpServer) rename(oldPath string, newPath string) error {
+	oldPath = resolveCopyPath(server.account, oldPath)
+	newPath = resolveCopyPath(server.account, newPath)
+	return os.Rename(oldPath, newPath)
+}
+
+func (server *sftpServer) remove(p string) error {
+	p = resolveCopyPath(server.account, p)
+	return os.Remove(p)
+}
+
+func (server *sftpServer) mkdir(p string, mode uint32) error {
+	p = resolveCopyPath(server.account, p)
+	return os.Mkdir(p, os.FileMode(mode&0777))
+}
+
+func (server *sftpServer) symlink(target string, link string) error {
+	link = resolveCopyPath(server.account, link)
+	return os.Symlink(target, link)
+}
+
+func (server *sftpServer) checksum(p string, offset int64, length int64) ([]byte, error) {
+	p = resolveCopyPath(server.account, p)
+	size, sum, err := fileChecksum(p, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(sum))
+	binary.BigEndian.PutUint64(buf, uint64(size))
+	return append(buf, sum...), nil
+}
+
+/*
+ * SHA-256 of length bytes of a file starting at offset (until the end of the file if length < 0).
+ * Returns the number of bytes hashed.
+ */
+func fileChecksum(p string, offset int64, length int64) (int64, []byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	var in io.Reader = file
+	if length >= 0 {
+		in = io.LimitReader(file, length)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, in)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, hash.Sum(nil), nil
+}
+
+/////////////////
+// client part //
+/////////////////
+
+// client of the file access subsystem: one request at a time on the first stream
+type sftpClient struct {
+	stream quic.Stream
+	nextID uint32
+	mutex  sync.Mutex
+}
+
+// start the file access subsystem for a remote user
+func newSFTPClient(stream quic.Stream, username string) (*sftpClient, error) {
+	client := &sftpClient{stream: stream}
+	msgType, payload, err := client.request(SFTP_INIT, []byte(username))
+	if err != nil {
+		return nil, err
+	}
+	return client, client.checkStatus(msgType, payload)
+}
+
+// send a request and wait for its response
+func (client *sftpClient) request(msgType byte, payload []byte) (byte, []byte, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.nextID++
+	if err := writeSFTPPacket(client.stream, sftpPacket{msgType, client.nextID, payload}); err != nil {
+		return 0, nil, err
+	}
+	err, response := readSFTPPacket(client.stream)
+	if err != nil {
+		return 0, nil, err
+	}
+	if response.id != client.nextID {
+		return 0, nil, errors.New("error with the values read on the stream (unexpected response)")
+	}
+	return response.msgType, response.payload, nil
+}
+
+// error of a request answered by a status (or by an unexpected response)
+func (client *sftpClient) checkStatus(msgType byte, payload []byte) error {
+	if msgType != SFTP_STATUS {
+		return errors.New("error with the values read on the stream (unexpected response)")
+	}
+	return decodeSFTPStatus(payload)
+}
+
+// request expecting a status as response
+func (client *sftpClient) requestStatus(msgType byte, payload []byte) error {
+	respType, respPayload, err := client.request(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return client.checkStatus(respType, respPayload)
+}
+
+// request expecting a response of type expected (or an error status)
+func (client *sftpClient) requestValue(msgType byte, payload []byte, expected byte) ([]byte, error) {
+	respType, respPayload, err := client.request(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	if respType != expected {
+		if err = client.checkStatus(respType, respPayload); err == nil {
+			err = errors.New("error with the values read on the stream (unexpected response)")
+		}
+		return nil, err
+	}
+	return respPayload, nil
+}
+
+func (client *sftpClient) list(p string) ([]sftpAttrs, error) {
+	payload, err := client.requestValue(SFTP_LIST, []byte(p), SFTP_NAMES)
+	if err != nil {
+		return nil, err
+	}
+	err, files := decodeSFTPNames(payload)
+	return files, err
+}
+
+func (client *sftpClient) stat(p string, follow bool) (sftpAttrs, error) {
+	flag := byte(0)
+	if follow {
+		flag = 1
+	}
+	payload, err := client.requestValue(SFTP_STAT, append([]byte{flag}, []byte(p)...), SFTP_ATTRS)
+	if err != nil {
+		return sftpAttrs{}, err
+	}
+	err, attrs := decodeSFTPAttrs(payload)
+	attrs.name = filepath.Base(p)
+	return attrs, err
+}
+
+func (client *sftpClient) open(p string, flags byte, mode uint32) (uint32, error) {
+	buf := make([]byte, 5, 5+len(p))
+	buf[0] = flags
+	binary.BigEndian.PutUint32(buf[1:5], mode)
+	payload, err := client.requestValue(SFTP_OPEN, append(buf, []byte(p)...), SFTP_HANDLE)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) != 4 {
+		return 0, errors.New("error with the values read on the stream")
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+func (client *sftpClient) close(handle uint32) error {
+	buf := make([]byte, 4, 4)
+	binary.BigEndian.PutUint32(buf, handle)
+	return client.requestStatus(SFTP_CLOSE, buf)
+}
+
+// read at most length bytes at offset (io.EOF at the end of the file)
+func (client *sftpClient) readAt(handle uint32, offset int64, length uint32) ([]byte, error) {
+	buf := make([]byte, 16, 16)
+	binary.BigEndian.PutUint32(buf[0:4], handle)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(offset))
+	binary.BigEndian.PutUint32(buf[12:16], length)
+	payload, err := client.requestValue(SFTP_READ, buf, SFTP_DATA)
+	if sftpErr, ok := err.(*sftpError); ok && sftpErr.code == SFTP_EOF {
+		return nil, io.EOF
+	}
+	return payload, err
+}
+
+func (client *sftpClient) writeAt(handle uint32, offset int64, data []byte) error {
+	buf := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], handle)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(offset))
+	return client.requestStatus(SFTP_WRITE, append(buf, data...))
+}
+
+func (client *sftpClient) rename(oldPath string, newPath string) error {
+	return client.requestStatus(SFTP_RENAME, append(encodeSFTPString(oldPath), []byte(newPath)...))
+}
+
+func (client *sftpClient) remove(p string) error {
+	return client.requestStatus(SFTP_REMOVE, []byte(p))
+}
+
+func (client *sftpClient) mkdir(p string, mode uint32) error {
+	buf := make([]byte, 4, 4+len(p))
+	binary.BigEndian.PutUint32(buf, mode)
+	return client.requestStatus(SFTP_MKDIR, append(buf, []byte(p)...))
+}
+
+func (client *sftpClient) symlink(target string, link string) error {
+	return client.requestStatus(SFTP_SYMLINK, append(encodeSFTPString(target), []byte(link)...))
+}
+
+// SHA-256 of length bytes of a remote file starting at offset (until the end of the file if length < 0)
+func (client *sftpClient) checksum(p string, offset int64, length int64) (int64, []byte, error) {
+	buf := make([]byte, 16, 16+len(p))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(length))
+	payload, err := client.requestValue(SFTP_CHECKSUM, append(buf, []byte(p)...), SFTP_SUM)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) != 8+sha256.Size {
+		return 0, nil, errors.New("error with the values read on the stream")
+	}
+	return int64(binary.BigEndian.Uint64(payload[0:8])), payload[8:], nil
+}
+
+/*
+ * copy a remote file to a local file. If resume is set and the local file is the beginning of the remote file
+ * (same SHA-256 for its size), only the rest is transferred. The whole file is verified with its SHA-256.
+ * Returns the offset at which the transfer started.
+ */
+func (client *sftpClient) download(remote string, local string, resume bool) (int64, error) {
+	attrs, err := client.stat(remote, true)
+	if err != nil {
+		return 0, err
+	}
+	if attrs.kind != SFTP_KIND_REGULAR {
+		return 0, errors.New("not a regular file")
+	}
+	offset := int64(0)
+	if info, err := os.Stat(local); resume && err == nil && info.Mode().IsRegular() && info.Size() <= attrs.size {
+		_, localSum, errLocal := fileChecksum(local, 0, info.Size())
+		_, remoteSum, errRemote := client.checksum(remote, 0, info.Size())
+		if errLocal == nil && errRemote == nil && bytes.Equal(localSum, remoteSum) {
+			offset = info.Size()
+		}
+	}
+
+	handle, err := client.open(remote, SFTP_OPEN_READ, 0)
+	if err != nil {
+		return offset, err
+	}
+	defer client.close(handle)
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(local, flags, os.FileMode(attrs.mode))
+	if err != nil {
+		return offset, err
+	}
+	position := offset
+	for {
+		data, err := client.readAt(handle, position, sftpMaxChunk)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return offset, err
+		}
+		if _, err = file.WriteAt(data, position); err != nil {
+			file.Close()
+			return offset, err
+		}
+		position += int64(len(data))
+	}
+	if err = file.Close(); err != nil {
+		return offset, err
+	}
+	os.Chtimes(local, time.Now(), attrs.modTime)
+	return offset, client.verify(remote, local)
+}
+
+/*
+ * copy a local file to a remote file. If resume is set and the remote file is the beginning of the local file
+ * (same SHA-256 for its size), only the rest is transferred. The whole file is verified with its SHA-256.
+ * Returns the offset at which the transfer started.
+ */
+func (client *sftpClient) upload(local string, remote string, resume bool) (int64, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, errors.New("not a regular file")
+	}
+	offset := int64(0)
+	if attrs, err := client.stat(remote, true); resume && err == nil && attrs.kind == SFTP_KIND_REGULAR && attrs.size <= info.Size() {
+		_, localSum, errLocal := fileChecksum(local, 0, attrs.size)
+		_, remoteSum, errRemote := client.checksum(remote, 0, attrs.size)
+		if errLocal == nil && errRemote == nil && bytes.Equal(localSum, remoteSum) {
+			offset = attrs.size
+		}
+	}
+
+	flags := byte(SFTP_OPEN_WRITE | SFTP_OPEN_CREATE)
+	if offset == 0 {
+		flags |= SFTP_OPEN_TRUNCATE
+	}
+	handle, err := client.open(remote, flags, uint32(info.Mode().Perm()))
+	if err != nil {
+		return offset, err
+	}
+	buf := make([]byte, sftpMaxChunk)
+	position := offset
+	for {
+		n, errRead := file.ReadAt(buf, position)
+		if n > 0 {
+			if err = client.writeAt(handle, position, buf[:n]); err != nil {
+				client.close(handle)
+				return offset, err
+			}
+			position += int64(n)
+		}
+		if errRead == io.EOF {
+			break
+		} else if errRead != nil {
+			client.close(handle)
+			return offset, errRead
+		}
+	}
+	if err = client.close(handle); err != nil {
+		return offset, err
+	}
+	return offset, client.verify(remote, local)
+}
+
+// compare the SHA-256 of a remote file and of a local file
+func (client *sftpClient) verify(remote string, local string) error {
+	localSize, localSum, err := fileChecksum(local, 0, -1)
+	if err != nil {
+		return err
+	}
+	remoteSize, remoteSum, err := client.checksum(remote, 0, -1)
+	if err != nil {
+		return err
+	}
+	if localSize != remoteSize || !bytes.Equal(localSum, remoteSum) {
+		return errors.New("integrity check failed (SHA-256 mismatch)")
+	}
+	return nil
+}
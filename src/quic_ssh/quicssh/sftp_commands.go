@@ -0,0 +1,195 @@
+package quicssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// interactive session of "quic_ssh sftp": one command per line
+type sftpSession struct {
+	c      *Client
+	client *sftpClient
+	cwd    string // remote working directory (relative to the home directory of the user if empty)
+	failed bool   // did a command fail ?
+}
+
+const sftpHelp = `Available commands:
+ls [path]                     list a remote directory
+stat path                     show the attributes of a remote file
+cd path                       change the remote directory
+pwd                           show the remote directory
+get [-a] remote [local]       download a file (-a resumes an interrupted transfer)
+put [-a] local [remote]       upload a file (-a resumes an interrupted transfer)
+rename old new                rename a remote file
+rm path                       remove a remote file or an empty directory
+mkdir path                    create a remote directory
+ln -s target link             create a remote symbolic link
+sum path                      show the SHA-256 of a remote file
+help                          show this help
+exit                          leave`
+
+func sftpClientLoops(c *Client, stopChanel chan bool) {
+	client, err := newSFTPClient(c.firstStream, c.getRemoteUsername())
+	if err != nil {
+		c.conf.printMsg(fmt.Sprintf("File access refused by the server. %s", err))
+		c.exitStatus = 1
+		stopChanel <- true
+		return
+	}
+	session := &sftpSession{c: c, client: client}
+
+	scanner := bufio.NewScanner(c.conf.input())
+	for {
+		if c.conf.terminal() != nil {
+			fmt.Fprint(c.conf.output(), "sftp> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		if !session.run(strings.Fields(scanner.Text())) {
+			break
+		}
+	}
+	if session.failed {
+		c.exitStatus = 1
+	}
+	c.firstStream.Close()
+	stopChanel <- true
+}
+
+// run one command, returns false to leave
+func (session *sftpSession) run(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	var err error
+	switch {
+	case args[0] == "exit" || args[0] == "quit" || args[0] == "bye":
+		return false
+	case args[0] == "help" || args[0] == "?":
+		session.print(sftpHelp)
+	case args[0] == "pwd":
+		session.print(session.remotePath("."))
+	case args[0] == "ls" && len(args) <= 2:
+		err = session.list(append(args, ".")[1])
+	case args[0] == "stat" && len(args) == 2:
+		err = session.stat(args[1])
+	case args[0] == "cd" && len(args) == 2:
+		err = session.changeDirectory(args[1])
+	case (args[0] == "get" || args[0] == "put") && len(args) >= 2:
+		err = session.transfer(args[0] == "get", args[1:])
+	case args[0] == "rename" && len(args) == 3:
+		err = session.client.rename(session.remotePath(args[1]), session.remotePath(args[2]))
+	case args[0] == "rm" && len(args) == 2:
+		err = session.client.remove(session.remotePath(args[1]))
+	case args[0] == "mkdir" && len(args) == 2:
+		err = session.client.mkdir(session.remotePath(args[1]), 0755)
+	case args[0] == "ln" && len(args) == 4 && args[1] == "-s":
+		err = session.client.symlink(args[2], session.remotePath(args[3]))
+	case args[0] == "sum" && len(args) == 2:
+		var size int64
+		var sum []byte
+		size, sum, err = session.client.checksum(session.remotePath(args[1]), 0, -1)
+		if err == nil {
+			session.print(fmt.Sprintf("%x  %s (%d bytes)", sum, args[1], size))
+		}
+	default:
+		err = errors.New("invalid command (type 'help' to list the commands)")
+	}
+	if err != nil {
+		session.failed = true
+		session.printError(fmt.Sprintf("%s: %s", args[0], err))
+	}
+	return true
+}
+
+// remote path relative to the remote working directory
+func (session *sftpSession) remotePath(p string) string {
+	if path.IsAbs(p) || strings.HasPrefix(p, "~") || session.cwd == "" {
+		return path.Clean(p)
+	}
+	return path.Join(session.cwd, p)
+}
+
+func (session *sftpSession) list(p string) error {
+	files, err := session.client.list(session.remotePath(p))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		session.print(formatSFTPAttrs(file))
+	}
+	return nil
+}
+
+func (session *sftpSession) stat(p string) error {
+	attrs, err := session.client.stat(session.remotePath(p), false)
+	if err != nil {
+		return err
+	}
+	session.print(formatSFTPAttrs(attrs))
+	return nil
+}
+
+func (session *sftpSession) changeDirectory(p string) error {
+	attrs, err := session.client.stat(session.remotePath(p), true)
+	if err != nil {
+		return err
+	}
+	if attrs.kind != SFTP_KIND_DIRECTORY {
+		return errors.New("not a directory")
+	}
+	session.cwd = session.remotePath(p)
+	return nil
+}
+
+// get/put [-a] source [destination]
+func (session *sftpSession) transfer(download bool, args []string) error {
+	resume := args[0] == "-a"
+	if resume {
+		args = args[1:]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("invalid arguments")
+	}
+	source := args[0]
+	destination := filepath.Base(source)
+	if len(args) == 2 {
+		destination = args[1]
+	}
+	var offset int64
+	var err error
+	if download {
+		offset, err = session.client.download(session.remotePath(source), destination, resume)
+	} else {
+		offset, err = session.client.upload(source, session.remotePath(destination), resume)
+	}
+	if offset > 0 {
+		session.print(fmt.Sprintf("Resuming transfer of %s at byte %d", source, offset))
+	}
+	return err
+}
+
+// one line describing a file, as "ls -l"
+func formatSFTPAttrs(attrs sftpAttrs) string {
+	mode := os.FileMode(attrs.mode)
+	if attrs.kind == SFTP_KIND_DIRECTORY {
+		mode |= os.ModeDir
+	} else if attrs.kind == SFTP_KIND_SYMLINK {
+		mode |= os.ModeSymlink
+	}
+	return fmt.Sprintf("%s %10d %s %s", mode, attrs.size, attrs.modTime.Format("2006-01-02 15:04"), attrs.name)
+}
+
+func (session *sftpSession) print(msg string) {
+	fmt.Fprintln(session.c.conf.output(), msg)
+}
+
+func (session *sftpSession) printError(msg string) {
+	session.c.conf.printErr(msg)
+}
@@ -0,0 +1,278 @@
+package quicssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+    Format for file access (sftp subsystem) packets:
+    ------------------------------------------------
+
+	Once the "sftp" subsystem is accepted (see server mode), the first stream carries requests of the client
+	and responses of the server. Each response has the id of its request.
+
+	0       8                               40                              72
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |         id (4 bytes)          |       length (4 bytes)        | payload
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Requests (client -> server):
+
+	type   name       payload                                    response
+	----   ----       -------                                    --------
+	0x01   init       username                                   status
+	0x02   list       path                                       names
+	0x03   stat       follow links (1), path                     attributes
+	0x04   open       flags (1), mode (4), path                  handle
+	0x05   close      handle (4)                                 status
+	0x06   read       handle (4), offset (8), length (4)         data (or status "end of file")
+	0x07   write      handle (4), offset (8), data               status
+	0x08   rename     old path l. (2), old path, new path        status
+	0x09   remove     path (file or empty directory)             status
+	0x0A   mkdir      mode (4), path                             status
+	0x0B   symlink    target l. (2), target, path of the link    status
+	0x0C   checksum   offset (8), length (8), path               checksum
+
+	Responses (server -> client):
+
+	type   name        payload
+	----   ----        -------
+	0x81   status      code (1), message
+	0x82   handle      handle (4)
+	0x83   data        data read
+	0x84   attributes  attributes
+	0x85   names       count (4), then for each file: attributes, name l. (2), name
+	0x86   checksum    number of bytes hashed (8), SHA-256 (32)
+
+	Attributes:
+
+    0       8                              40
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    | kind  |          mode (4 bytes)       |            size (8 bytes)         .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .       |               modification time (8 bytes)                         |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+	kind              : 0x01 for a regular file, 0x02 for a directory, 0x03 for a symbolic link, 0x04 for anything else.
+	mode              : Permission bits of the file.
+	modification time : In nanoseconds since January 1, 1970 UTC.
+	flags (open)      : 0x01 read, 0x02 write, 0x04 create if missing, 0x08 truncate.
+	code (status)     : 0x00 success, 0x01 end of file, 0x02 no such file, 0x03 permission denied, 0x04 failure,
+	                    0x05 bad message.
+	Relative paths are relative to the home directory of the user.
+*/
+
+const SFTP_INIT = 0x01
+const SFTP_LIST = 0x02
+const SFTP_STAT = 0x03
+const SFTP_OPEN = 0x04
+const SFTP_CLOSE = 0x05
+const SFTP_READ = 0x06
+const SFTP_WRITE = 0x07
+const SFTP_RENAME = 0x08
+const SFTP_REMOVE = 0x09
+const SFTP_MKDIR = 0x0A
+const SFTP_SYMLINK = 0x0B
+const SFTP_CHECKSUM = 0x0C
+
+const SFTP_STATUS = 0x81
+const SFTP_HANDLE = 0x82
+const SFTP_DATA = 0x83
+const SFTP_ATTRS = 0x84
+const SFTP_NAMES = 0x85
+const SFTP_SUM = 0x86
+
+const SFTP_OK = 0x00
+const SFTP_EOF = 0x01
+const SFTP_NO_SUCH_FILE = 0x02
+const SFTP_PERMISSION_DENIED = 0x03
+const SFTP_FAILURE = 0x04
+const SFTP_BAD_MESSAGE = 0x05
+
+const SFTP_OPEN_READ = 0x01
+const SFTP_OPEN_WRITE = 0x02
+const SFTP_OPEN_CREATE = 0x04
+const SFTP_OPEN_TRUNCATE = 0x08
+
+const SFTP_KIND_REGULAR = 0x01
+const SFTP_KIND_DIRECTORY = 0x02
+const SFTP_KIND_SYMLINK = 0x03
+const SFTP_KIND_OTHER = 0x04
+
+const sftpAttrsLength = 21
+
+// largest payload accepted in a packet (a read or a write of sftpMaxChunk bytes plus its header)
+const sftpMaxPayload = sftpMaxChunk + 64
+
+// one file access packet
+type sftpPacket struct {
+	msgType byte
+	id      uint32
+	payload []byte
+}
+
+// attributes of a file (and its name when listed)
+type sftpAttrs struct {
+	name    string
+	kind    byte
+	mode    uint32
+	size    int64
+	modTime time.Time
+}
+
+// error reported by the server in a status response
+type sftpError struct {
+	code byte
+	msg  string
+}
+
+func (err *sftpError) Error() string {
+	return err.msg
+}
+
+/*
+ * read one file access packet on stream following schema depicted above.
+ */
+func readSFTPPacket(stream readable) (err error, packet sftpPacket) {
+	header := make([]byte, 9, 9)
+	n, err := io.ReadFull(stream, header)
+	if err != nil || n != 9 {
+		return errors.New("error when reading stream"), packet
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > sftpMaxPayload {
+		return errors.New("error with the values read on the stream (packet too large)"), packet
+	}
+	packet = sftpPacket{msgType: header[0], id: binary.BigEndian.Uint32(header[1:5]), payload: make([]byte, length)}
+	n, err = io.ReadFull(stream, packet.payload)
+	if err != nil || n != len(packet.payload) {
+		return errors.New("error when reading stream"), packet
+	}
+	return nil, packet
+}
+
+/*
+ * write one file access packet on stream following schema depicted above.
+ */
+func writeSFTPPacket(stream writable, packet sftpPacket) error {
+	if len(packet.payload) > sftpMaxPayload {
+		return errors.New("error with the values passed in argument (payload too long)")
+	}
+	buf := make([]byte, 9, 9+len(packet.payload))
+	buf[0] = packet.msgType
+	binary.BigEndian.PutUint32(buf[1:5], packet.id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(packet.payload)))
+	buf = append(buf, packet.payload...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+// encode a status response
+func encodeSFTPStatus(code byte, msg string) []byte {
+	return append([]byte{code}, []byte(msg)...)
+}
+
+// decode a status response: nil if success, an *sftpError otherwise
+func decodeSFTPStatus(payload []byte) error {
+	if len(payload) < 1 {
+		return &sftpError{SFTP_BAD_MESSAGE, "bad message"}
+	}
+	if payload[0] == SFTP_OK {
+		return nil
+	}
+	return &sftpError{payload[0], string(payload[1:])}
+}
+
+// encode attributes following schema depicted above
+func encodeSFTPAttrs(attrs sftpAttrs) []byte {
+	buf := make([]byte, sftpAttrsLength, sftpAttrsLength)
+	buf[0] = attrs.kind
+	binary.BigEndian.PutUint32(buf[1:5], attrs.mode)
+	binary.BigEndian.PutUint64(buf[5:13], uint64(attrs.size))
+	binary.BigEndian.PutUint64(buf[13:21], uint64(attrs.modTime.UnixNano()))
+	return buf
+}
+
+// decode attributes following schema depicted above
+func decodeSFTPAttrs(buf []byte) (err error, attrs sftpAttrs) {
+	if len(buf) < sftpAttrsLength {
+		return errors.New("error with the values read on the stream"), attrs
+	}
+	attrs.kind = buf[0]
+	attrs.mode = binary.BigEndian.Uint32(buf[1:5])
+	attrs.size = int64(binary.BigEndian.Uint64(buf[5:13]))
+	attrs.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(buf[13:21])))
+	return nil, attrs
+}
+
+// encode the files of a directory following schema depicted above
+func encodeSFTPNames(files []sftpAttrs) []byte {
+	buf := make([]byte, 4, 4)
+	binary.BigEndian.PutUint32(buf, uint32(len(files)))
+	for _, file := range files {
+		buf = append(buf, encodeSFTPAttrs(file)...)
+		buf = append(buf, encodeSFTPString(file.name)...)
+	}
+	return buf
+}
+
+// decode the files of a directory following schema depicted above
+func decodeSFTPNames(buf []byte) (err error, files []sftpAttrs) {
+	if len(buf) < 4 {
+		return errors.New("error with the values read on the stream"), nil
+	}
+	count := int(binary.BigEndian.Uint32(buf[0:4]))
+	buf = buf[4:]
+	for i := 0; i < count; i++ {
+		err, file := decodeSFTPAttrs(buf)
+		if err != nil {
+			return err, nil
+		}
+		err, name, rest := decodeSFTPString(buf[sftpAttrsLength:])
+		if err != nil {
+			return err, nil
+		}
+		file.name = name
+		files = append(files, file)
+		buf = rest
+	}
+	return nil, files
+}
+
+// encode a string preceded by its length (2 bytes), used when a payload contains two paths
+func encodeSFTPString(str string) []byte {
+	buf := make([]byte, 2, 2+len(str))
+	binary.BigEndian.PutUint16(buf, uint16(len(str)))
+	return append(buf, []byte(str)...)
+}
+
+// decode a string preceded by its length (2 bytes) and return the remaining bytes
+func decodeSFTPString(buf []byte) (err error, str string, rest []byte) {
+	if len(buf) < 2 || len(buf) < 2+int(binary.BigEndian.Uint16(buf[0:2])) {
+		return errors.New("error with the values read on the stream"), "", nil
+	}
+	length := int(binary.BigEndian.Uint16(buf[0:2]))
+	return nil, string(buf[2 : 2+length]), buf[2+length:]
+}
+
+// attributes of a file given its os.FileInfo
+func newSFTPAttrs(info os.FileInfo) sftpAttrs {
+	attrs := sftpAttrs{name: info.Name(), kind: SFTP_KIND_OTHER, mode: uint32(info.Mode().Perm()), size: info.Size(), modTime: info.ModTime()}
+	if info.Mode().IsRegular() {
+		attrs.kind = SFTP_KIND_REGULAR
+	} else if info.IsDir() {
+		attrs.kind = SFTP_KIND_DIRECTORY
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		attrs.kind = SFTP_KIND_SYMLINK
+	}
+	return attrs
+}
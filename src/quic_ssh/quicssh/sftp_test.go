@@ -0,0 +1,179 @@
+package quicssh
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func init() {
+	logTmp("8")
+}
+
+// run sftp commands on the server and return the client config (with outputs) and the exit status
+func launchSFTPClient(port int, commands string) (*SSHConfig, int) {
+	return launchSFTPClientAs(port, "", commands)
+}
+
+// same as launchSFTPClient, for the given user
+func launchSFTPClientAs(port int, username string, commands string) (*SSHConfig, int) {
+	conf := SSHConfig{}
+	conf.username = username
+	conf.bufSize = 100000
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.hostname = "127.0.0.1"
+	conf.port = port
+	conf.privKeyFile = directory + "pr_client"
+	conf.pubKeyFile = directory + "pk_client"
+	conf.subsystem = "sftp"
+	conf.stdin = strings.NewReader(commands)
+	sshClient := newTestClient(&conf)
+	sshClient.Run(context.Background())
+	return &conf, sshClient.exitStatus
+}
+
+func TestSFTP(t *testing.T) {
+	port := 41121
+	confServer := SSHConfig{}
+	go launchServerWithResult(port, &confServer)
+
+	remote := directory + "sftp_remote"
+	os.MkdirAll(remote, 0755)
+	content := strings.Repeat("0123456789", 60000) // more than one read request
+	writeFile(directory+"sftp_local.txt", content)
+
+	// file management and transfers
+	conf, status := launchSFTPClient(port, "cd "+remote+"\n"+
+		"mkdir dir\n"+
+		"put "+directory+"sftp_local.txt dir/file.txt\n"+
+		"rename dir/file.txt dir/renamed.txt\n"+
+		"ln -s renamed.txt dir/link\n"+
+		"ls dir\n"+
+		"stat dir/link\n"+
+		"get dir/link "+directory+"sftp_downloaded.txt\n"+
+		"sum dir/renamed.txt\n"+
+		"pwd\n")
+	checkValueString("errors", "", conf.testErrOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+	checkValueBoolean("'renamed file listed'", true, strings.Contains(conf.testOutput(), "-rw-------     600000 ") && strings.Contains(conf.testOutput(), " renamed.txt\n"), t)
+	checkValueBoolean("'symbolic link listed'", true, strings.Contains(conf.testOutput(), "Lrwxrwxrwx"), t)
+	checkValueBoolean("'checksum shown'", true, strings.Contains(conf.testOutput(), "dir/renamed.txt (600000 bytes)"), t)
+	checkValueBoolean("'working directory shown'", true, strings.HasSuffix(conf.testOutput(), remote+"\n"), t)
+	target, _ := os.Readlink(remote + "/dir/link")
+	checkValueString("target of the link", "renamed.txt", target, t)
+	downloaded, _ := ioutil.ReadFile(directory + "sftp_downloaded.txt")
+	checkValueBoolean("'downloaded file identical'", true, string(downloaded) == content, t)
+
+	// interrupted download resumed: only the missing part is transferred
+	writeFile(directory+"sftp_partial.txt", content[:250000])
+	conf, status = launchSFTPClient(port, "get -a "+remote+"/dir/renamed.txt "+directory+"sftp_partial.txt\n")
+	checkValueInt("exit status", 0, status, t)
+	checkValueBoolean("'transfer resumed'", true, strings.Contains(conf.testOutput(), "at byte 250000"), t)
+	downloaded, _ = ioutil.ReadFile(directory + "sftp_partial.txt")
+	checkValueBoolean("'resumed file identical'", true, string(downloaded) == content, t)
+
+	// a partial file that differs from the remote file is transferred again
+	writeFile(remote+"/dir/partial.txt", "not the beginning of the file")
+	conf, status = launchSFTPClient(port, "put -a "+directory+"sftp_local.txt "+remote+"/dir/partial.txt\n")
+	checkValueInt("exit status", 0, status, t)
+	checkValueBoolean("'transfer not resumed'", false, strings.Contains(conf.testOutput(), "Resuming"), t)
+	uploaded, _ := ioutil.ReadFile(remote + "/dir/partial.txt")
+	checkValueBoolean("'uploaded file identical'", true, string(uploaded) == content, t)
+
+	// errors are reported and the exit status is 1
+	conf, status = launchSFTPClient(port, "cd "+remote+"\nrm dir\nstat missing\nrm dir/partial.txt\nunknown\n")
+	checkValueInt("exit status", 1, status, t)
+	checkValueBoolean("'directory not empty'", true, strings.Contains(conf.testErrOutput(), "rm: failure"), t)
+	checkValueBoolean("'missing file'", true, strings.Contains(conf.testErrOutput(), "stat: no such file or directory"), t)
+	checkValueBoolean("'invalid command'", true, strings.Contains(conf.testErrOutput(), "unknown: invalid command"), t)
+	_, err := os.Stat(remote + "/dir/partial.txt")
+	checkValueBoolean("'file removed'", true, os.IsNotExist(err), t)
+
+	// unknown subsystems are refused
+	conf = &SSHConfig{bufSize: 100000, printLevel: PRINT_LEVEL_QUIET, hostname: "127.0.0.1", port: port, privKeyFile: directory + "pr_client", pubKeyFile: directory + "pk_client", subsystem: "unknown"}
+	sshClient := newTestClient(conf)
+	sshClient.Run(context.Background())
+	checkValueInt("exit status", 1, sshClient.exitStatus, t)
+}
+
+func TestSFTPAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the server must be run by root to access files for another user")
+	}
+	port := 41146
+	authorizedKeys := directory + "authorized_hosts_server_sftp"
+	writeFile(authorizedKeys, `user="nobody" `+dummyClientPublicKeyInline+"\n")
+	go launchServerWithResult(port, &SSHConfig{authorizedPublicKeysFile: authorizedKeys})
+
+	userDir, rootDir := directory+"sftp_nobody/", directory+"sftp_root_only/"
+	os.RemoveAll(userDir)
+	os.RemoveAll(rootDir)
+	os.MkdirAll(userDir, 0755)
+	os.Chown(userDir, 65534, 65534)
+	os.MkdirAll(rootDir, 0700)
+	writeFile(rootDir+"secret", "secret\n")
+	os.Chmod(rootDir+"secret", 0666) // only protected by its directory
+	writeFile(directory+"sftp_user_local.txt", "local\n")
+
+	// the files created in the directory of the user belong to the user
+	conf, status := launchSFTPClientAs(port, "nobody", "put "+directory+"sftp_user_local.txt "+userDir+"file.txt\nmkdir "+userDir+"dir\n")
+	checkValueString("errors", "", conf.testErrOutput(), t)
+	checkValueInt("exit status", 0, status, t)
+	for _, p := range []string{userDir + "file.txt", userDir + "dir"} {
+		if info, err := os.Stat(p); err == nil {
+			checkValueInt("owner of "+p, 65534, int(info.Sys().(*syscall.Stat_t).Uid), t)
+		} else {
+			t.Errorf("%s not created", p)
+		}
+	}
+
+	// the search permission of the directories is checked, even for stat
+	for _, command := range []string{"stat " + rootDir + "secret", "get " + rootDir + "secret " + directory + "sftp_secret",
+		"put " + directory + "sftp_user_local.txt " + rootDir + "secret", "mkdir " + rootDir + "dir",
+		"rename " + rootDir + "secret " + userDir + "secret", "ln -s /etc/shadow " + rootDir + "link"} {
+		conf, status = launchSFTPClientAs(port, "nobody", command+"\n")
+		checkValueBoolean("'"+command+" refused'", true, status != 0 && strings.Contains(conf.testErrOutput(), "permission denied"), t)
+	}
+	read, _ := ioutil.ReadFile(rootDir + "secret")
+	checkValueString("protected file", "secret\n", string(read), t)
+	entries, _ := ioutil.ReadDir(rootDir)
+	checkValueInt("files of the protected directory", 1, len(entries), t)
+}
+
+func TestSFTPPackets(t *testing.T) {
+	buf := &bytes.Buffer{}
+	files := []sftpAttrs{{name: "a", kind: SFTP_KIND_REGULAR, mode: 0644, size: 12}, {name: "dir", kind: SFTP_KIND_DIRECTORY, mode: 0755}}
+	writeSFTPPacket(buf, sftpPacket{SFTP_NAMES, 42, encodeSFTPNames(files)})
+	err, packet := readSFTPPacket(buf)
+	checkValueBoolean("'packet read'", true, err == nil, t)
+	checkValueInt("type", SFTP_NAMES, int(packet.msgType), t)
+	checkValueInt("id", 42, int(packet.id), t)
+	err, decoded := decodeSFTPNames(packet.payload)
+	checkValueBoolean("'names decoded'", true, err == nil, t)
+	checkValueInt("number of files", 2, len(decoded), t)
+	if len(decoded) == 2 {
+		checkValueString("name", "dir", decoded[1].name, t)
+		checkValueInt("kind", SFTP_KIND_DIRECTORY, int(decoded[1].kind), t)
+		checkValueInt("size", 12, int(decoded[0].size), t)
+	}
+
+	// truncated payloads are refused
+	err, _ = decodeSFTPNames(packet.payload[:len(packet.payload)-1])
+	checkValueBoolean("'truncated names refused'", true, err != nil, t)
+	err, _, _ = decodeSFTPString([]byte{0, 5, 'a'})
+	checkValueBoolean("'truncated string refused'", true, err != nil, t)
+	checkValueBoolean("'error status decoded'", true, decodeSFTPStatus(encodeSFTPStatus(SFTP_NO_SUCH_FILE, "missing")).Error() == "missing", t)
+	checkValueBoolean("'success status decoded'", true, decodeSFTPStatus(encodeSFTPStatus(SFTP_OK, "")) == nil, t)
+
+	// malformed requests are answered with a status
+	server := &sftpServer{handles: make(map[uint32]*os.File)}
+	msgType, payload := server.handle(sftpPacket{SFTP_READ, 1, []byte{1, 2}})
+	checkValueInt("response type", SFTP_STATUS, int(msgType), t)
+	checkValueInt("status", SFTP_BAD_MESSAGE, int(payload[0]), t)
+	msgType, payload = server.handle(sftpPacket{SFTP_CLOSE, 2, []byte{0, 0, 0, 9}})
+	checkValueInt("status", SFTP_FAILURE, int(payload[0]), t)
+}
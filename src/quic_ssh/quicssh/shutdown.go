@@ -0,0 +1,204 @@
+package quicssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	Graceful shutdown:
+	------------------
+
+	When the server receives SIGTERM or SIGINT, Server.Run does not stop at once:
+	> no session is accepted anymore: every address is retired as on a reload (see Server.reload), the
+	  sessions arriving in the meantime are closed with the reason "server shutting down",
+	> the remote logins are warned by a "server going away" message on their terminal control stream (see
+	  terminal_control.go), which the client prints with the time left. The other services are not warned,
+	> the established sessions are given ShutdownGraceTime (30 seconds by default) to end. A second signal
+	  ends the grace period at once,
+	> the listeners of the remote port forwardings and the sessions still established are then closed (the
+	  clients get the reason "server shutting down"), as the shells of the persistent sessions.
+
+	quic_ssh then exits with status 0 if every session ended during the grace period, 1 otherwise. A listener
+	failing (its socket cannot be read anymore) shuts the server down the same way, with status 1.
+*/
+
+var errServerShutdown = errors.New("server shutting down")
+
+// sessions being served, shared by all the sessions of the server (as the shells)
+type activeSessions struct {
+	mutex    sync.Mutex
+	clients  map[*clientServed]*activeClient
+	deadline time.Time // end of the grace period once the server shuts down (zero before)
+}
+
+type activeClient struct {
+	channel bool // channel of a shared session (the session itself is counted once)
+	login   bool // remote login started: its terminal control stream can be warned
+}
+
+func newActiveSessions() *activeSessions {
+	return &activeSessions{clients: make(map[*clientServed]*activeClient)}
+}
+
+func (active *activeSessions) register(client *clientServed, channel bool) {
+	active.mutex.Lock()
+	defer active.mutex.Unlock()
+	active.clients[client] = &activeClient{channel: channel}
+}
+
+func (active *activeSessions) unregister(client *clientServed) {
+	active.mutex.Lock()
+	defer active.mutex.Unlock()
+	delete(active.clients, client)
+}
+
+// the terminal control stream of client is accepted: it is warned if the server already shuts down
+func (active *activeSessions) loginStarted(client *clientServed) {
+	active.mutex.Lock()
+	if state := active.clients[client]; state != nil {
+		state.login = true
+	}
+	deadline := active.deadline
+	active.mutex.Unlock()
+	if !deadline.IsZero() {
+		go writeGoingAway(client.controlStream, time.Until(deadline))
+	}
+}
+
+// warn the remote logins that their session is closed at deadline
+func (active *activeSessions) goingAway(deadline time.Time) {
+	active.mutex.Lock()
+	active.deadline = deadline
+	logins := []*clientServed{}
+	for client, state := range active.clients {
+		if state.login {
+			logins = append(logins, client)
+		}
+	}
+	active.mutex.Unlock()
+	for _, client := range logins {
+		go writeGoingAway(client.controlStream, time.Until(deadline)) // (a stream without flow credit must not block the others)
+	}
+}
+
+// close the remote port forwardings and the sessions still established. Returns the number of sessions closed.
+func (active *activeSessions) closeAll() (closed int) {
+	active.mutex.Lock()
+	clients := active.clients
+	active.clients = make(map[*clientServed]*activeClient)
+	active.mutex.Unlock()
+	for client, state := range clients {
+		stopListener(client)
+		client.audit.closed(errServerShutdown.Error())
+		client.session.Close(errServerShutdown)
+		if !state.channel {
+			closed++
+		}
+	}
+	return closed
+}
+
+// the server shuts down when ctx is done, or on SIGTERM or SIGINT if launched from the command line
+func (s *Server) shutdownSignals(ctx context.Context) chan bool {
+	stop := make(chan bool, 2)
+	go func() {
+		<-ctx.Done()
+		select {
+		case stop <- true:
+		default:
+		}
+	}()
+	if !s.conf.handleSignals {
+		return stop
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for range signals {
+			select {
+			case stop <- true:
+			default:
+			}
+		}
+	}()
+	return stop
+}
+
+// a listener cannot accept sessions anymore: the server shuts down
+func (s *Server) listenerFailed(err error) {
+	select {
+	case s.failures <- err:
+	default:
+	}
+}
+
+/*
+ * stop the server as described above. failure is the error of the listener that failed (nil if the
+ * server received a signal) and stop signals the end of the grace period before its time.
+ * Returns an error if sessions had to be closed, or failure.
+ */
+func (s *Server) shutdown(stop chan bool, failure error) error {
+	// Step 1) retire all the addresses: the new sessions are refused, the listeners are closed after their last session
+	s.mutex.Lock()
+	conf := s.conf
+	s.shuttingDown = true
+	s.drained = make(chan bool)
+	drained := s.drained
+	for _, l := range s.listeners {
+		l.retired = true
+		if l.sessions == 0 {
+			s.closeListener(l)
+		}
+	}
+	s.checkDrained()
+	s.mutex.Unlock()
+
+	// Step 2) warn the remote logins, and wait for the end of the sessions during the grace period
+	graceTime := conf.shutdownGraceTime
+	if graceTime == 0 {
+		graceTime = defaultShutdownGraceTime
+	} else if graceTime < 0 {
+		graceTime = 0
+	}
+	conf.printMsg(fmt.Sprintf("Shutting down, the established sessions are closed in %s", graceTime))
+	s.active.goingAway(time.Now().Add(graceTime))
+	timer := time.NewTimer(graceTime)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	case <-stop:
+	}
+
+	// Step 3) close what remains
+	closed := s.active.closeAll()
+	s.mutex.Lock()
+	for _, l := range s.listeners {
+		s.closeListener(l)
+	}
+	s.mutex.Unlock()
+	s.shells.stopAll()
+	if failure != nil {
+		return failure
+	}
+	if closed > 0 {
+		return errors.New(fmt.Sprintf("Server stopped, %d session(s) closed at the end of the grace period", closed))
+	}
+	conf.printMsg("Server stopped, all the sessions ended")
+	return nil
+}
+
+// once the server shuts down, drained is closed after the last listener (called with the mutex)
+func (s *Server) checkDrained() {
+	if s.drained != nil && len(s.listeners) == 0 {
+		close(s.drained)
+		s.drained = nil
+	}
+}
@@ -0,0 +1,96 @@
+package quicssh
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func init() {
+	logTmp("17")
+}
+
+// launch a server which shuts down when the returned function is called, Run returns on result
+func launchStoppableServer(port int, conf *SSHConfig) (context.CancelFunc, chan error) {
+	ctx, stop := context.WithCancel(context.Background())
+	conf.bufSize = 100000
+	conf.port = port
+	conf.printLevel = PRINT_LEVEL_QUIET
+	conf.privKeyFile = directory + "pr_server"
+	conf.pubKeyFile = directory + "pk_server"
+	sshServer := newTestServer(conf)
+	result := make(chan error, 1)
+	go func() {
+		result <- sshServer.Run(ctx)
+	}()
+	return stop, result
+}
+
+func TestGoingAwayEncoding(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writeGoingAway(buffer, 2500*time.Millisecond)
+	err, msgType, value := readTerminalControlMessage(buffer)
+	checkValueBoolean("'message read'", true, err == nil, t)
+	checkValueInt("type", SERVER_GOING_AWAY, int(msgType), t)
+	err, gracePeriod := parseGoingAway(value)
+	checkValueBoolean("'message parsed'", true, err == nil, t)
+	checkValueInt("grace period (rounded up)", 3, int(gracePeriod.Seconds()), t)
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	port := 41137
+	stop, result := launchStoppableServer(port, &SSHConfig{shutdownGraceTime: 5 * time.Second})
+
+	// a command still running when the server shuts down ends normally
+	done := make(chan *SSHConfig, 1)
+	go func() {
+		conf, _ := launchRemoteExecClient(port, []string{"sleep 1; echo drained"}, "")
+		done <- conf
+	}()
+	time.Sleep(500 * time.Millisecond)
+	stop()
+
+	// no new session is accepted
+	time.Sleep(100 * time.Millisecond)
+	conf, status := launchRemoteExecClient(port, []string{"echo", "refused"}, "")
+	checkValueInt("exit status of a new session", 1, status, t)
+	checkValueString("standard output of a new session", "", conf.testOutput(), t)
+
+	conf = <-done
+	checkValueString("standard output", "drained\n", conf.testOutput(), t)
+	select {
+	case err := <-result:
+		checkValueBoolean("'all the sessions ended'", true, err == nil, t)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server not stopped after its last session")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	port := 41138
+	stop, result := launchStoppableServer(port, &SSHConfig{shutdownGraceTime: 500 * time.Millisecond})
+
+	// a command running after the grace period is closed, and Run returns an error
+	done := make(chan int, 1)
+	go func() {
+		_, status := launchRemoteExecClient(port, []string{"sleep", "5"}, "")
+		done <- status
+	}()
+	time.Sleep(500 * time.Millisecond)
+	start := time.Now()
+	stop()
+	select {
+	case err := <-result:
+		checkValueBoolean("'sessions closed reported'", true, err != nil, t)
+	case <-time.After(4 * time.Second):
+		t.Fatalf("server not stopped at the end of the grace period")
+	}
+	checkValueBoolean("'grace period given'", true, time.Since(start) >= 500*time.Millisecond, t)
+	select {
+	case status := <-done:
+		checkValueInt("exit status", 255, status, t)
+	case <-time.After(4 * time.Second):
+		t.Fatalf("session not closed at the end of the grace period")
+	}
+}
@@ -0,0 +1,484 @@
+package quicssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+    Format for terminal control messages:
+    -------------------------------------
+
+	Terminal control messages use the same TLV encoding as the port forwarding control messages:
+
+	0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |length | value
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Possible types are:
+    > 0x01 for "terminal request",
+    > 0x02 for "command request",
+    > 0x03 for "exit status",
+    > 0x04 for "window change",
+    > 0x05 for "signal",
+    > 0x06 for "agent forwarding",
+    > 0x07 for "persistent session",
+    > 0x08 for "session token",
+    > 0x09 for "server going away".
+
+	Messages 1, 4, 5, 7, 8 and 9 are sent on the terminal control stream: a dedicated stream opened by the client
+	just after the first stream when remote login is requested (thus before any port forwarding stream).
+	Messages 2 and 3 are sent on the first stream. Message 6 is sent just before message 1 or 2, on the same stream.
+	Message 7 is sent just before message 1 (after message 6 if any).
+
+	1) terminal request:
+
+	First message sent by the client on the terminal control stream.
+	The server answers by spawning the login shell of the requested user on a new pseudo-terminal.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x01 |length |     rows      |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |    columns    |term l.|       |
+    +-+-+-+-+-+-+-+-+-+-+-+-+       +
+    .    terminal type (term l.)    .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |user l.|                       |
+    +-+-+-+-+                       +
+    .       username (user l.)      .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+	fields:
+	-------
+    rows, columns : Size of the client terminal. Encoded on 2 bytes each.
+	term l.       : Length of the terminal type (i.e. the TERM variable of the client, such as "xterm").
+	user l.       : Length of the username. An empty username means the user running the server.
+
+
+	2) command request:
+
+	Sent by the client on the first stream (just after the server mode) when remote command execution is requested.
+	As a command line can be longer than 255 bytes, the length of this message is encoded on 2 bytes.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x02 |    length     |user l.|
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .       username (user l.)      .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    .            command            .
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	The command is run by the login shell of the user ("shell -c command").
+	The server then opens two streams, each one beginning with a single byte telling what it carries:
+	0x01 for the standard output, 0x02 for the standard error. The standard input is read on the first stream.
+
+
+	3) exit status:
+
+	Sent by the server on the first stream once the command exited and its outputs were sent.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x03 |l=0x04 |               |
+    +-+-+-+-+-+-+-+-+               +
+    |          exit status          |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+    exit status : Exit code of the command (128 + signal number if the command was killed by a signal). Encoded on 4 bytes.
+
+
+	4) window change:
+
+	Sent by the client each time its terminal is resized (SIGWINCH). The server applies the new size to the
+	pseudo-terminal, which notifies the processes running on it.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x04 |l=0x04 |     rows      |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |    columns    |
+    +-+-+-+-+-+-+-+-+
+
+
+	5) signal:
+
+	Sent by the client when it receives SIGINT, SIGQUIT or SIGTERM. The server delivers the signal to the
+	foreground process group of the pseudo-terminal.
+
+    0       8       16      24
+    +-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x05 |l=0x01 |signal |
+    +-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+    signal : POSIX number of the signal (2 for SIGINT, 3 for SIGQUIT, 15 for SIGTERM). Other values are ignored.
+
+
+	6) agent forwarding:
+
+	Sent by the client launched with -A, just before the terminal request (or the command request). The server
+	listens on a Unix socket given to the shell (or the command) in QUIC_SSH_AUTH_SOCK. For each connection
+	accepted on this socket, the server opens a stream beginning with an agent stream control message (see
+	port_forwarding_control.go) and the client forwards it to its own agent.
+
+    0       8       16
+    +-+-+-+-+-+-+-+-+
+    |t=0x06 |l=0x00 |
+    +-+-+-+-+-+-+-+-+
+
+
+	7) persistent session:
+
+	Sent by the client launched with --persist or --attach, just before the terminal request. The shell is kept
+	running by the server when the client disconnects (see persistent_session.go).
+
+    0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    |t=0x07 |length | token
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	fields:
+	-------
+    token : Token of the detached session to reattach (given by message 8). Empty for a new session.
+
+
+	8) session token:
+
+	Sent by the server once the shell of a persistent session is started (or reattached). The client presents
+	this token to reattach the session after a disconnection.
+
+    0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    |t=0x08 |length | token
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+
+	9) server going away:
+
+	Sent by the server when it shuts down (see shutdown.go). The client tells the user that the session will be
+	closed, unless it ends before.
+
+    0       8       16             31
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+    |t=0x09 |l=0x04 |               |
+    +-+-+-+-+-+-+-+-+               +
+    |         grace period          |
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	fields:
+	-------
+    grace period : Seconds left before the server closes the session. Encoded on 4 bytes.
+
+*/
+
+const TERMINAL_REQUEST = 0x01
+const COMMAND_REQUEST = 0x02
+const EXIT_STATUS = 0x03
+const WINDOW_CHANGE = 0x04
+const SIGNAL = 0x05
+const AGENT_FORWARDING = 0x06
+const PERSISTENT_SESSION = 0x07
+const SESSION_TOKEN = 0x08
+const SERVER_GOING_AWAY = 0x09
+
+// first byte of the streams opened by the server for the outputs of a command
+const STDOUT_STREAM = 0x01
+const STDERR_STREAM = 0x02
+
+// signals that can be forwarded, indexed by their number in the signal message
+var forwardedSignals = map[byte]syscall.Signal{
+	2:  syscall.SIGINT,
+	3:  syscall.SIGQUIT,
+	15: syscall.SIGTERM,
+}
+
+type commandRequest struct {
+	username     string
+	command      string
+	forwardAgent bool // preceded by an agent forwarding message ?
+}
+
+type terminalRequest struct {
+	rows         uint16
+	cols         uint16
+	term         string
+	username     string
+	forwardAgent bool   // preceded by an agent forwarding message ?
+	persistent   bool   // preceded by a persistent session message ?
+	token        string // token of the persistent session to reattach ("" for a new session)
+}
+
+/*
+ * read one TLV message on stream and return its type and value.
+ */
+func readTerminalControlMessage(stream readable) (err error, msgType byte, value []byte) {
+	headerBuffer := make([]byte, 2, 2)
+	n, err := io.ReadFull(stream, headerBuffer)
+	if err != nil || n != 2 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	msgType = headerBuffer[0]
+	value = make([]byte, headerBuffer[1], headerBuffer[1])
+	n, err = io.ReadFull(stream, value)
+	if err != nil || n != len(value) {
+		err = errors.New("error when reading stream")
+		return
+	}
+	err = nil
+	return
+}
+
+/*
+ * write one TLV message on stream.
+ */
+func writeTerminalControlMessage(stream writable, msgType byte, value []byte) error {
+	if len(value) > 255 {
+		return errors.New("error with the values passed in argument (value too long)")
+	}
+	buf := append([]byte{msgType, byte(len(value))}, value...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+/*
+ * read terminal request on stream following schema depicted above.
+ */
+func readTerminalRequest(stream readable) (err error, request terminalRequest) {
+	err, msgType, valueBuffer := readTerminalControlMessage(stream)
+	if err == nil && msgType == AGENT_FORWARDING && len(valueBuffer) == 0 {
+		request.forwardAgent = true
+		err, msgType, valueBuffer = readTerminalControlMessage(stream)
+	}
+	if err == nil && msgType == PERSISTENT_SESSION {
+		request.persistent, request.token = true, string(valueBuffer)
+		err, msgType, valueBuffer = readTerminalControlMessage(stream)
+	}
+	if err != nil {
+		return
+	}
+	if msgType != TERMINAL_REQUEST {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+
+	// rows, columns and terminal type length
+	if len(valueBuffer) < 6 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	request.rows = binary.BigEndian.Uint16(valueBuffer[0:2])
+	request.cols = binary.BigEndian.Uint16(valueBuffer[2:4])
+	termLength := int(valueBuffer[4])
+	if len(valueBuffer) < 5+termLength+1 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	request.term = string(valueBuffer[5 : 5+termLength])
+
+	// username
+	userLength := int(valueBuffer[5+termLength])
+	if len(valueBuffer) != 5+termLength+1+userLength {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	request.username = string(valueBuffer[6+termLength:])
+	err = nil
+	return
+}
+
+/*
+ * write terminal request on stream following schema depicted above.
+ */
+func writeTerminalRequest(stream writable, request terminalRequest) error {
+	if len(request.term) > 100 || len(request.username) > 100 {
+		return errors.New("error with the values passed in argument (terminal type or username too long)")
+	}
+	sizeBuffer := make([]byte, 4, 4)
+	binary.BigEndian.PutUint16(sizeBuffer[0:2], request.rows)
+	binary.BigEndian.PutUint16(sizeBuffer[2:4], request.cols)
+
+	value := append(sizeBuffer, byte(len(request.term)))
+	value = append(value, []byte(request.term)...)
+	value = append(value, byte(len(request.username)))
+	value = append(value, []byte(request.username)...)
+	if request.forwardAgent {
+		if err := writeTerminalControlMessage(stream, AGENT_FORWARDING, nil); err != nil {
+			return err
+		}
+	}
+	if request.persistent {
+		if err := writeTerminalControlMessage(stream, PERSISTENT_SESSION, []byte(request.token)); err != nil {
+			return err
+		}
+	}
+	return writeTerminalControlMessage(stream, TERMINAL_REQUEST, value)
+}
+
+/*
+ * read command request on stream following schema depicted above.
+ */
+func readCommandRequest(stream readable) (err error, request commandRequest) {
+	headerBuffer := make([]byte, 3, 3)
+	n, err := io.ReadFull(stream, headerBuffer)
+	if err != nil || n != 3 {
+		err = errors.New("error when reading stream")
+		return
+	}
+	if headerBuffer[0] == AGENT_FORWARDING && headerBuffer[1] == 0 {
+		// the agent forwarding message (2 bytes) precedes the header of the command request
+		request.forwardAgent = true
+		headerBuffer = append(headerBuffer[2:], 0, 0)
+		n, err = io.ReadFull(stream, headerBuffer[1:3])
+		if err != nil || n != 2 {
+			err = errors.New("error when reading stream")
+			return
+		}
+	}
+	if headerBuffer[0] != COMMAND_REQUEST {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+
+	valueBuffer := make([]byte, binary.BigEndian.Uint16(headerBuffer[1:3]))
+	n, err = io.ReadFull(stream, valueBuffer)
+	if err != nil || n != len(valueBuffer) {
+		err = errors.New("error when reading stream")
+		return
+	}
+	if len(valueBuffer) < 1 || len(valueBuffer) < 1+int(valueBuffer[0]) {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	userLength := int(valueBuffer[0])
+	request.username = string(valueBuffer[1 : 1+userLength])
+	request.command = string(valueBuffer[1+userLength:])
+	err = nil
+	return
+}
+
+/*
+ * write command request on stream following schema depicted above.
+ */
+func writeCommandRequest(stream writable, request commandRequest) error {
+	if len(request.username) > 100 || 1+len(request.username)+len(request.command) > 65535 {
+		return errors.New("error with the values passed in argument (username or command too long)")
+	}
+	value := append([]byte{byte(len(request.username))}, []byte(request.username)...)
+	value = append(value, []byte(request.command)...)
+
+	buf := []byte{COMMAND_REQUEST, 0, 0}
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(value)))
+	buf = append(buf, value...)
+	if request.forwardAgent {
+		buf = append([]byte{AGENT_FORWARDING, 0}, buf...)
+	}
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+/*
+ * read exit status on stream following schema depicted above.
+ */
+func readExitStatus(stream readable) (err error, status int) {
+	err, msgType, value := readTerminalControlMessage(stream)
+	if err != nil {
+		return
+	}
+	if msgType != EXIT_STATUS || len(value) != 4 {
+		err = errors.New("error with the values read on the stream")
+		return
+	}
+	return nil, int(int32(binary.BigEndian.Uint32(value)))
+}
+
+/*
+ * write exit status on stream following schema depicted above.
+ */
+func writeExitStatus(stream writable, status int) error {
+	value := make([]byte, 4, 4)
+	binary.BigEndian.PutUint32(value, uint32(int32(status)))
+	return writeTerminalControlMessage(stream, EXIT_STATUS, value)
+}
+
+/*
+ * parse the value of a window change message following schema depicted above.
+ */
+func parseWindowChange(value []byte) (err error, rows uint16, cols uint16) {
+	if len(value) != 4 {
+		return errors.New("error with the values read on the stream"), 0, 0
+	}
+	return nil, binary.BigEndian.Uint16(value[0:2]), binary.BigEndian.Uint16(value[2:4])
+}
+
+/*
+ * write window change on stream following schema depicted above.
+ */
+func writeWindowChange(stream writable, rows uint16, cols uint16) error {
+	value := make([]byte, 4, 4)
+	binary.BigEndian.PutUint16(value[0:2], rows)
+	binary.BigEndian.PutUint16(value[2:4], cols)
+	return writeTerminalControlMessage(stream, WINDOW_CHANGE, value)
+}
+
+/*
+ * parse the value of a signal message following schema depicted above.
+ */
+func parseSignal(value []byte) (err error, sig syscall.Signal) {
+	if len(value) != 1 {
+		return errors.New("error with the values read on the stream"), 0
+	}
+	sig, found := forwardedSignals[value[0]]
+	if !found {
+		return errors.New("signal cannot be forwarded"), 0
+	}
+	return nil, sig
+}
+
+/*
+ * write signal on stream following schema depicted above.
+ */
+func writeSignal(stream writable, sig os.Signal) error {
+	for number, forwarded := range forwardedSignals {
+		if forwarded == sig {
+			return writeTerminalControlMessage(stream, SIGNAL, []byte{number})
+		}
+	}
+	return errors.New("error with the values passed in argument (signal cannot be forwarded)")
+}
+
+/*
+ * parse the value of a server going away message following schema depicted above.
+ */
+func parseGoingAway(value []byte) (err error, gracePeriod time.Duration) {
+	if len(value) != 4 {
+		return errors.New("error with the values read on the stream"), 0
+	}
+	return nil, time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+}
+
+/*
+ * write server going away on stream following schema depicted above.
+ */
+func writeGoingAway(stream writable, gracePeriod time.Duration) error {
+	value := make([]byte, 4, 4)
+	binary.BigEndian.PutUint32(value, uint32((gracePeriod+time.Second-1)/time.Second))
+	return writeTerminalControlMessage(stream, SERVER_GOING_AWAY, value)
+}
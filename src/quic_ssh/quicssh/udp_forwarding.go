@@ -0,0 +1,312 @@
+package quicssh
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	UDP port forwarding:
+	--------------------
+
+	The source listens on a UDP socket. Each source address (ip:port of the application sending datagrams)
+	is a flow: the first datagram of a flow opens a new stream beginning with a port forwarding control
+	message whose protocol is 0x11. The destination then sends the datagrams of this flow from a dedicated
+	UDP socket, so that the answers can be sent back to the right source address.
+
+	As a stream is a byte stream, each datagram is framed on it:
+
+    0       8       16
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+    |    length     | datagram
+    +-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	fields:
+	-------
+	length     : Length of the datagram. Encoded on 2 bytes (an UDP payload cannot be larger than 65507 bytes)
+
+	A flow without any datagram (in both directions) during udpFlowIdleTimeout is expired by the source,
+	which closes its stream. The destination then closes its UDP socket.
+*/
+
+// time after which a flow without any datagram is expired
+const udpFlowIdleTimeout = 60 * time.Second
+
+const maxDatagramSize = 65535
+
+// one UDP flow (one source address) of a port forwarding
+type udpFlow struct {
+	sourceAddr   *net.UDPAddr
+	stream       quic.Stream
+	lastActivity time.Time
+}
+
+// flows of a UDP port forwarding, indexed by source address
+type udpFlowTable struct {
+	flows map[string]*udpFlow
+	mutex sync.Mutex
+}
+
+func newUDPFlowTable() *udpFlowTable {
+	return &udpFlowTable{flows: make(map[string]*udpFlow)}
+}
+
+// get the flow of a source address (nil if unknown) and mark it as active
+func (table *udpFlowTable) get(addr *net.UDPAddr) *udpFlow {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	flow := table.flows[addr.String()]
+	if flow != nil {
+		flow.lastActivity = time.Now()
+	}
+	return flow
+}
+
+func (table *udpFlowTable) add(flow *udpFlow) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	flow.lastActivity = time.Now()
+	table.flows[flow.sourceAddr.String()] = flow
+}
+
+// mark a flow as active (datagram received from the destination)
+func (table *udpFlowTable) touch(flow *udpFlow) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	flow.lastActivity = time.Now()
+}
+
+// remove a flow (if still present)
+func (table *udpFlowTable) remove(flow *udpFlow) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if table.flows[flow.sourceAddr.String()] == flow {
+		delete(table.flows, flow.sourceAddr.String())
+	}
+}
+
+// remove and return the flows without any activity since udpFlowIdleTimeout
+func (table *udpFlowTable) removeIdleFlows(now time.Time) []*udpFlow {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	expired := make([]*udpFlow, 0)
+	for key, flow := range table.flows {
+		if now.Sub(flow.lastActivity) >= udpFlowIdleTimeout {
+			expired = append(expired, flow)
+			delete(table.flows, key)
+		}
+	}
+	return expired
+}
+
+// close all the flows
+func (table *udpFlowTable) closeAll() {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for key, flow := range table.flows {
+		flow.stream.Close()
+		delete(table.flows, key)
+	}
+}
+
+/*
+ * read one datagram framed on stream following schema depicted above.
+ */
+func readDatagram(stream readable, buffer []byte) (err error, datagram []byte) {
+	lengthBuffer := make([]byte, 2, 2)
+	n, err := io.ReadFull(stream, lengthBuffer)
+	if err != nil || n != 2 {
+		return errors.New("error when reading stream"), nil
+	}
+	length := int(binary.BigEndian.Uint16(lengthBuffer))
+	if length > len(buffer) {
+		return errors.New("error with the values read on the stream (datagram too large)"), nil
+	}
+	n, err = io.ReadFull(stream, buffer[:length])
+	if err != nil || n != length {
+		return errors.New("error when reading stream"), nil
+	}
+	return nil, buffer[:length]
+}
+
+/*
+ * write one datagram on stream following schema depicted above.
+ */
+func writeDatagram(stream writable, datagram []byte) error {
+	if len(datagram) > maxDatagramSize {
+		return errors.New("error with the values passed in argument (datagram too large)")
+	}
+	buf := make([]byte, 2, 2+len(datagram))
+	binary.BigEndian.PutUint16(buf, uint16(len(datagram)))
+	buf = append(buf, datagram...)
+	n, err := stream.Write(buf)
+	if err != nil || n != len(buf) {
+		return errors.New("error when writing on the stream")
+	}
+	return nil
+}
+
+// runAsUDPSource listens for datagrams and forwards each flow on its own stream. (As runAsSource for TCP)
+func (pFSession *portForwardingSession) runAsUDPSource(request portForwardingRequest) {
+
+	// step 1) open local UDP socket
+	forward := pFSession.forwards.add(request)
+	defer pFSession.forwards.remove(forward)
+	UDPConn := pFSession.acceptLocalDatagrams(request, forward)
+	if UDPConn == nil {
+		writeError(pFSession, &request, nil, "Maybe chosen port is already used")
+		return
+	}
+	flows := newUDPFlowTable()
+	stopExpiry := make(chan bool)
+	go expireUDPFlows(flows, stopExpiry)
+	defer func() {
+		close(stopExpiry)
+		flows.closeAll()
+	}()
+
+	readBuffer := make([]byte, maxDatagramSize, maxDatagramSize)
+	for {
+		// step 2) receive a datagram
+		n, sourceAddr, err := UDPConn.ReadFromUDP(readBuffer)
+		if err != nil {
+			// if err != nil , stop listening. This can be because QUICSession was closed (or the port forwarding cancelled) and thus we closed the UDP socket.
+			return
+		}
+
+		// step 3) find its flow or open a new stream for this source address
+		flow := flows.get(sourceAddr)
+		if flow == nil {
+			flow, err = pFSession.openUDPFlow(request, sourceAddr)
+			if err != nil {
+				writeError(pFSession, &request, nil, "Cannot open stream")
+				continue
+			}
+			flows.add(flow)
+			go sendDatagramsToSource(UDPConn, flows, flow, forward)
+		}
+
+		// step 4) forward the datagram on the stream of the flow
+		if writeDatagram(flow.stream, readBuffer[:n]) != nil {
+			flows.remove(flow)
+			flow.stream.Close()
+		} else {
+			forward.countSent(n)
+		}
+	}
+}
+
+// open the stream of a new flow and tell destination which address and port it must contact
+func (pFSession *portForwardingSession) openUDPFlow(request portForwardingRequest, sourceAddr *net.UDPAddr) (*udpFlow, error) {
+	stream, err := pFSession.QUICSession.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	localRequest := request
+	localRequest.local = true
+	if err = writeControlMessage(stream, localRequest); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return &udpFlow{sourceAddr: sourceAddr, stream: stream}, nil
+}
+
+// datagrams received on the stream of a flow -> source address of the flow (the flow is a connection of forward)
+func sendDatagramsToSource(UDPConn *net.UDPConn, flows *udpFlowTable, flow *udpFlow, forward *activeForward) {
+	forward.connectionOpened()
+	defer forward.connectionClosed()
+	readBuffer := make([]byte, maxDatagramSize, maxDatagramSize)
+	for {
+		err, datagram := readDatagram(flow.stream, readBuffer)
+		if err != nil {
+			flows.remove(flow)
+			flow.stream.Close()
+			return
+		}
+		flows.touch(flow)
+		UDPConn.WriteToUDP(datagram, flow.sourceAddr)
+		forward.countReceived(len(datagram))
+	}
+}
+
+// periodically close the flows without activity
+func expireUDPFlows(flows *udpFlowTable, stop chan bool) {
+	ticker := time.NewTicker(udpFlowIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, flow := range flows.removeIdleFlows(now) {
+				flow.stream.Close()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (pFSession *portForwardingSession) acceptLocalDatagrams(request portForwardingRequest, forward *activeForward) *net.UDPConn {
+	addr := &net.UDPAddr{IP: request.bindIP, Port: int(request.localPort)}
+	UDPConn, err := net.ListenUDP("udp", addr)
+	if err != nil { // do not crash because of one bad port forwarding request, the other ones can still work
+		return nil
+	}
+	pFSession.registerListener(UDPConn)
+	pFSession.forwards.setListener(forward, UDPConn)
+	return UDPConn
+}
+
+// runAsUDPDestination sends the datagrams of one flow to the final destination and forwards the answers. (As runAsDestination for TCP)
+// The destination of a dynamic request is a hostname, resolved here: it relays the session of a client through a jump host (see jump_hosts.go).
+func (pFSession *portForwardingSession) runAsUDPDestination(QUICStream quic.Stream, request portForwardingRequest, forward *activeForward) {
+	var UDPConn net.Conn
+	var err error
+	if request.dynamic {
+		if UDPConn, err = dialDynamicDestination(QUICStream, request); err != nil {
+			QUICStream.Close()
+			return
+		}
+	} else if UDPConn, err = net.Dial("udp", ipToString(request.remoteIP)+":"+strconv.Itoa(int(request.remotePort))); err != nil {
+		writeError(pFSession, &request, QUICStream, "Cannot contact destination")
+		return
+	}
+	forward.connectionOpened()
+	defer forward.connectionClosed()
+
+	// answers of the destination -> stream. Stops when the UDP socket is closed.
+	go func() {
+		readBuffer := make([]byte, maxDatagramSize, maxDatagramSize)
+		for {
+			n, err := UDPConn.Read(readBuffer)
+			if err != nil {
+				if getDynamicStatus(err) == DYNAMIC_CONNECTION_REFUSED {
+					continue // ICMP port unreachable received for a previous datagram: the flow is still usable
+				}
+				QUICStream.Close()
+				return
+			}
+			if writeDatagram(QUICStream, readBuffer[:n]) != nil {
+				return
+			}
+			forward.countSent(n)
+		}
+	}()
+
+	// stream -> destination. Stops when the source closes the stream (flow expired).
+	readBuffer := make([]byte, maxDatagramSize, maxDatagramSize)
+	for {
+		err, datagram := readDatagram(QUICStream, readBuffer)
+		if err != nil {
+			UDPConn.Close()
+			return
+		}
+		UDPConn.Write(datagram)
+		forward.countReceived(len(datagram))
+	}
+}
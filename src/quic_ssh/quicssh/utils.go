@@ -0,0 +1,220 @@
+package quicssh
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"errors"
+	"time"
+	"encoding/binary"
+)
+
+type SSHConfig struct {
+	bufSize                  int
+	pubKeyFile               string
+	privKeyFile              string
+	publicKey                crypto.PublicKey
+	privateKey               crypto.Signer
+	authorizedPublicKeysFile string // file with multiple allowed remote public keys
+	username                 string //username and password can be set directly in arguments (useful to make time measurements)
+	password                 string
+	listen                   bool   // is server ?
+	hostname                 string // if client, hostname to contact
+	port                     int    // if client, port to contact
+	localPortForwarding      bool   // if client, launched with -L or -D ?
+	remotePortForwarding     bool   // if client, launched with -R ?
+	onlyForwardPort          bool   // if client, launched with -N ?
+	remoteCommand            []string // if client, command given after "--" (executed instead of the remote login)
+	agentSocket              string   // if client, Unix socket of the agent (QUIC_SSH_AUTH_SOCK), used if no private key is given
+	forwardAgent             bool     // if client, launched with -A ?
+	hashKnownHosts           bool     // if client, hostnames added to the known hosts file are hashed (--hash-known-hosts)
+	controlMaster            bool     // if client, launched with -M ? (the session is shared on controlPath)
+	controlPath              string   // if client, control socket of the shared session (-S)
+	persistent               bool     // if client, remote login kept by the server after a disconnection (--persist or --attach) ?
+	attachToken              string   // if client, token of the persistent session to reattach (--attach)
+	escapeChar               byte     // if client, escape character of the remote login (-e, 0 if none, see escape_sequences.go)
+	sendEnv                  []string // if client, patterns of the environment variables sent to the server (--send-env, see feature_negotiation.go)
+	printLevel               int      // PRINT_LEVEL_QUIET, PRINT_LEVEL_NORMAL or PRINT_LEVEL_DEBUG (LogLevel)
+	jumpHosts                []jumpHost // if client, servers relaying the session to the hostname, in the order they are contacted (-J, see jump_hosts.go)
+
+	//if server configuration file used (-f, see server_config.go):
+	configFile                 string
+	checkConfig                bool          // launched with -t ?
+	addresses                  []string      // listen addresses "host[:port]" (ListenAddress, the hostname and port if none)
+	idleTimeout                time.Duration // sessions closed after this duration without activity (0 for the default of QUIC)
+	detachTimeout              time.Duration // detached persistent sessions closed after this duration (0 for defaultDetachTimeout)
+	allowedModes               []int         // modes the clients can ask (nil if all)
+	allowTcpForwarding         string        // "yes", "no", "local" or "remote" (AllowTcpForwarding, also UDP forwardings)
+	allowStreamLocalForwarding string        // same for the forwardings of Unix sockets
+	noAgentForwarding          bool
+	permitOpen                 []string // allowed destinations "host:port" of local/dynamic forwardings (nil if any)
+	permitListen               []string // allowed listening addresses "[host:]port" of remote forwardings (nil if any)
+	acceptEnv                  []string // patterns of the environment variables of the clients given to their shell or command (AcceptEnv, none by default)
+	auditLog                   string   // file of the audit records of the sessions (AuditLog, see audit.go)
+	recordSessions             string   // directory of the recordings of the remote logins (RecordSessions, see session_recording.go)
+	maxStartups                int           // sessions not authenticated yet (MaxStartups, 0 if no limit)
+	maxAuthFailures            int           // authentication failures of an address before it is banned (MaxAuthFailures, 0 if never)
+	banTime                    time.Duration // first ban of an address (BanTime), doubled at each new ban up to maxBanTime
+	maxBanTime                 time.Duration
+	loginGraceTime             time.Duration // time given to the clients to authenticate (LoginGraceTime, 0 for defaultLoginGraceTime)
+	shutdownGraceTime          time.Duration // time given to the sessions to end when the server stops (ShutdownGraceTime, 0 for defaultShutdownGraceTime)
+
+	//if file copy used (quic_ssh scp):
+	copyMode      bool
+	copyRecursive bool     // launched with -r ?
+	copyUpload    bool     // files sent to the server (or received from the server) ?
+	copySources   []string // paths of the files to copy (on the server if download)
+	copyTarget    string   // path of the copy (on the server if upload)
+
+	//if a subsystem is used (quic_ssh sftp):
+	subsystem string // name of the subsystem requested to the server
+
+	//if local/remote/dynamic port forwarding used (-L, -R and -D, in the order of the command line):
+	forwards []portForwardingRequest
+
+	// terminal of the client and messages of the server (see WithTerminal): standard input, output and error of the process if nil
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	//if launched from the command line (see Main):
+	handleSignals    bool // Ctrl-C, SIGTERM, SIGWINCH and SIGHUP are handled (a program embedding the package keeps its signals)
+	invalidArguments bool // usage printed: nothing can be run
+
+	//if created by NewClient or NewServer (see api.go):
+	options []Option // applied again after the configuration file when the server reloads it
+}
+
+const PRINT_LEVEL_DEBUG = 1
+const PRINT_LEVEL_NORMAL = 0
+const PRINT_LEVEL_QUIET = -1 // only the errors are printed
+
+func (c *SSHConfig) printDebug(str string){
+	if c.printLevel >= PRINT_LEVEL_DEBUG {
+		fmt.Fprintf(c.output(), "[Debug] %s\n", str)
+	}
+}
+func (c *SSHConfig) printMsg(str string){
+	if c.printLevel >= PRINT_LEVEL_NORMAL {
+		fmt.Fprintf(c.output(), "%s\n", str)
+	}
+}
+
+// print an error on the standard error (whatever the log level)
+func (c *SSHConfig) printErr(str string){
+	fmt.Fprintf(c.errOutput(), "%s\n", str)
+}
+
+// standard input of the client (typed by the user for a remote login)
+func (c *SSHConfig) input() io.Reader {
+	if c.stdin == nil {
+		return os.Stdin
+	}
+	return c.stdin
+}
+
+func (c *SSHConfig) output() io.Writer {
+	if c.stdout == nil {
+		return os.Stdout
+	}
+	return c.stdout
+}
+
+func (c *SSHConfig) errOutput() io.Writer {
+	if c.stderr == nil {
+		return os.Stderr
+	}
+	return c.stderr
+}
+
+// terminal of the standard input, put in raw mode during a remote login (nil if the input is not a file)
+func (c *SSHConfig) terminal() *os.File {
+	if c.stdin == nil {
+		return os.Stdin
+	}
+	file, _ := c.stdin.(*os.File)
+	return file
+}
+
+func (c *SSHConfig) formatAddress() string {
+	return fmt.Sprintf("%v:%v", c.hostname, c.port)
+}
+
+type closable interface {
+	Close() error
+}
+
+type serverInfo struct {
+	hosts     string // names of the server in the known hosts file (hostname and/or IP, comma separated)
+	publicKey crypto.PublicKey
+}
+
+type readable interface {
+	Read(b []byte) (n int, err error)
+}
+
+type writable interface {
+	Write(b []byte) (n int, err error)
+}
+
+/*
+ * this function returns only 1 ip (even if multiple ips were found).
+ */
+func resolveHostname(hostname string) (err error, ip []byte) {
+	ips, err := net.LookupIP(hostname)
+	if err != nil || len(ips) == 0 {
+		return errors.New("error when trying to resolve hostname"), nil
+	}
+
+	var firstV4 net.IP = nil
+	var firstV6 net.IP = nil
+	i := 0
+	for (firstV4 == nil || firstV6 == nil) && i < len(ips) {
+		if net.IP.To4(ips[i]) != nil && firstV4 == nil {
+			firstV4 = net.IP.To4(ips[i])
+		} else if net.IP.To16(ips[i]) != nil && firstV6 == nil {
+			firstV6 = net.IP.To16(ips[i])
+		}
+		i++
+	}
+
+	if firstV6 != nil {
+		return nil, firstV6
+	}
+	return nil, firstV4
+}
+
+/*
+ * convert []byte ip into string for using net.Dial
+ * empty string is returned in case of error
+ */
+func ipToString(ip []byte) string {
+	if len(ip) != 4 && len(ip) != 16 {
+		return ""
+	}
+	if len(ip) == 4 {
+		return strconv.Itoa(int(ip[0])) + "." + strconv.Itoa(int(ip[1])) + "." +
+			strconv.Itoa(int(ip[2])) + "." + strconv.Itoa(int(ip[3]))
+	}
+	result := fmt.Sprintf("%02x", int(ip[0])) + fmt.Sprintf("%02x", int(ip[1]))
+	for i := 2; i < 16; i = i + 2 {
+		result = result + ":" + fmt.Sprintf("%02x", int(ip[i]))
+		result = result + fmt.Sprintf("%02x", int(ip[i+1]))
+	}
+	return "[" + result + "]"
+}
+
+// encode int to []byte
+func encodeInt(val int) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(val))
+	return buf
+}
+
+// decode []byte to int
+func decodeInt(bytes []byte) int {
+	return int(binary.LittleEndian.Uint32(bytes))
+}
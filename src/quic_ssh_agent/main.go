@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/alexflint/go-arg"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"quic_utils"
+	"syscall"
+)
+
+// ================== configuration, parsing from command line ==================
+
+type cli_config struct {
+	Socket string   `arg:"-a" help:"path of the Unix socket to listen (default=quic_ssh-agent.<pid> in a new temporary directory)"`
+	Keys   []string `arg:"positional, required" help:"private key files to load"`
+}
+
+func main() {
+	conf := cli_config{}
+	p := arg.MustParse(&conf)
+
+	// load the keys once, they are never written anywhere else
+	keys := make([]crypto.Signer, 0, len(conf.Keys))
+	for _, keyFile := range conf.Keys {
+		key, err := quic_utils.ExtractPrivateKey(keyFile)
+		if err != nil {
+			p.Fail(fmt.Sprintf("cannot load the private key '%s': %s", keyFile, err))
+		}
+		keys = append(keys, key)
+	}
+
+	listener, socketPath, err := listen(conf.Socket)
+	quic_utils.Check(err)
+
+	// remove the socket when stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+		cleanup(conf.Socket, socketPath)
+		os.Exit(0)
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", quic_utils.AgentSocketEnv, socketPath, quic_utils.AgentSocketEnv)
+	fmt.Printf("echo Agent pid %d;\n", os.Getpid())
+	quic_utils.NewAgent(keys).Serve(listener)
+}
+
+// listen the Unix socket of the agent, only reachable by its owner
+func listen(socketPath string) (net.Listener, string, error) {
+	if socketPath == "" {
+		dir, err := ioutil.TempDir("", "quic_ssh-agent-")
+		if err != nil {
+			return nil, "", err
+		}
+		socketPath = filepath.Join(dir, fmt.Sprintf("quic_ssh-agent.%d", os.Getpid()))
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	return listener, socketPath, nil
+}
+
+// remove the socket (and its temporary directory if the path was not given)
+func cleanup(givenPath string, socketPath string) {
+	os.Remove(socketPath)
+	if givenPath == "" {
+		os.Remove(filepath.Dir(socketPath))
+	}
+}
@@ -0,0 +1,189 @@
+package quic_utils
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// =========================== admission of the sessions (servers) ===============================
+//
+// A server asks the admission of each session it accepts, before the authentication of the client:
+// - the sessions not authenticated yet are limited (MaxUnauthenticated), the next ones are refused,
+// - each source address (IP) counts its authentication failures. After MaxFailures failures, the address
+//   is banned for BanTime, doubled at each new ban of the address up to MaxBanTime (exponential back-off).
+//   The sessions of a banned address are refused at once, without verifying any signature,
+// - a session not authenticated after AuthTimeout is a failure, and is closed.
+// A successful authentication forgets the failures and the bans of its address.
+
+var ErrTooManyUnauthenticated = errors.New("too many sessions waiting for authentication, retry later")
+var ErrSourceBanned = errors.New("too many authentication failures, retry later")
+
+// limits of the admission (0 for no limit)
+type AdmissionConfig struct {
+	MaxUnauthenticated int           // sessions accepted and not authenticated yet
+	MaxFailures        int           // authentication failures of an address before it is banned
+	BanTime            time.Duration // first ban of an address (one minute if not given)
+	MaxBanTime         time.Duration // longest ban of an address (one day if not given)
+	AuthTimeout        time.Duration // time given to a session to authenticate
+}
+
+// admission of the sessions of a server
+type AdmissionControl struct {
+	config          AdmissionConfig
+	mutex           sync.Mutex
+	unauthenticated int
+	sources         map[string]*admissionSource
+	now             func() time.Time // (replaced by tests)
+}
+
+// failures and bans of a source address
+type admissionSource struct {
+	failures    int
+	bans        uint
+	bannedUntil time.Time
+	lastFailure time.Time
+}
+
+// one session admitted, until it is authenticated, fails or ends
+type Admission struct {
+	control *AdmissionControl
+	source  string
+	timer   *time.Timer
+	done    bool
+}
+
+func NewAdmissionControl(config AdmissionConfig) *AdmissionControl {
+	control := &AdmissionControl{sources: make(map[string]*admissionSource), now: time.Now}
+	control.Configure(config)
+	return control
+}
+
+// change the limits (the failures and bans of the addresses are kept)
+func (control *AdmissionControl) Configure(config AdmissionConfig) {
+	if config.BanTime <= 0 {
+		config.BanTime = time.Minute
+	}
+	if config.MaxBanTime <= 0 {
+		config.MaxBanTime = 24 * time.Hour
+	}
+	if config.MaxBanTime < config.BanTime {
+		config.MaxBanTime = config.BanTime
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	control.config = config
+}
+
+// source address of a session: its IP (the port changes at each session)
+func admissionSourceOf(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// admit a new session from addr, or tell why it is refused. If the session is not authenticated after
+// AuthTimeout, expire is called (it must close the session).
+func (control *AdmissionControl) Admit(addr net.Addr, expire func()) (*Admission, error) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	now := control.now()
+	control.forgetSources(now)
+	source := admissionSourceOf(addr)
+	if state := control.sources[source]; state != nil && now.Before(state.bannedUntil) {
+		return nil, ErrSourceBanned
+	}
+	if control.config.MaxUnauthenticated > 0 && control.unauthenticated >= control.config.MaxUnauthenticated {
+		return nil, ErrTooManyUnauthenticated
+	}
+	control.unauthenticated++
+	admission := &Admission{control: control, source: source}
+	if control.config.AuthTimeout > 0 {
+		admission.timer = time.AfterFunc(control.config.AuthTimeout, func() {
+			if admission.Failed() {
+				expire()
+			}
+		})
+	}
+	return admission, nil
+}
+
+// forget the addresses which are not banned anymore and did not fail since MaxBanTime (called with the mutex)
+func (control *AdmissionControl) forgetSources(now time.Time) {
+	for source, state := range control.sources {
+		if now.After(state.bannedUntil) && now.Sub(state.lastFailure) > control.config.MaxBanTime {
+			delete(control.sources, source)
+		}
+	}
+}
+
+// end of the admission (returns false if it already ended)
+func (admission *Admission) end() bool {
+	if admission.done {
+		return false
+	}
+	admission.done = true
+	admission.control.unauthenticated--
+	if admission.timer != nil {
+		admission.timer.Stop()
+	}
+	return true
+}
+
+// the client of the session is authenticated: the failures and bans of its address are forgotten
+func (admission *Admission) Authenticated() {
+	control := admission.control
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if admission.end() {
+		delete(control.sources, admission.source)
+	}
+}
+
+// the authentication failed (or timed out): the address is banned after MaxFailures failures.
+// Returns false if the admission had already ended.
+func (admission *Admission) Failed() bool {
+	control := admission.control
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if !admission.end() {
+		return false
+	}
+	if control.config.MaxFailures <= 0 {
+		return true
+	}
+	now := control.now()
+	state := control.sources[admission.source]
+	if state == nil {
+		state = &admissionSource{}
+		control.sources[admission.source] = state
+	}
+	state.failures++
+	state.lastFailure = now
+	if state.failures >= control.config.MaxFailures {
+		banTime := control.config.BanTime
+		for i := uint(0); i < state.bans && banTime < control.config.MaxBanTime; i++ {
+			banTime *= 2
+		}
+		if banTime > control.config.MaxBanTime {
+			banTime = control.config.MaxBanTime
+		}
+		state.bans++
+		state.failures = 0
+		state.bannedUntil = now.Add(banTime)
+		Logf("%s banned for %s after %d authentication failures", admission.source, banTime, control.config.MaxFailures)
+	}
+	return true
+}
+
+// the session ended before its authentication (not a failure)
+func (admission *Admission) Release() {
+	admission.control.mutex.Lock()
+	defer admission.control.mutex.Unlock()
+	admission.end()
+}
@@ -0,0 +1,78 @@
+package quic_utils
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmissionBans(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	control := NewAdmissionControl(AdmissionConfig{MaxFailures: 2, BanTime: time.Minute, MaxBanTime: 3 * time.Minute})
+	control.now = func() time.Time { return now }
+	attacker := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4000}
+
+	// banned after 2 failures, whatever the port
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		for i := 0; i < 2; i++ {
+			admission, err := control.Admit(&net.UDPAddr{IP: attacker.IP, Port: 4000 + i}, func() {})
+			if err != nil {
+				t.Fatalf("session refused before the ban: %s", err)
+			}
+			admission.Failed()
+		}
+		if _, err := control.Admit(attacker, func() {}); err != ErrSourceBanned {
+			t.Errorf("address not banned: %v", err)
+		}
+		if _, err := control.Admit(other, func() {}); err != nil {
+			t.Errorf("other address banned: %s", err)
+		}
+		now = now.Add(expected - time.Second)
+		if _, err := control.Admit(attacker, func() {}); err != ErrSourceBanned {
+			t.Errorf("ban shorter than %s", expected)
+		}
+		now = now.Add(2 * time.Second)
+	}
+
+	// an authentication forgets the failures
+	admission, _ := control.Admit(attacker, func() {})
+	admission.Failed()
+	admission, _ = control.Admit(attacker, func() {})
+	admission.Authenticated()
+	admission, _ = control.Admit(attacker, func() {})
+	admission.Failed()
+	if _, err := control.Admit(attacker, func() {}); err != nil {
+		t.Errorf("failures not forgotten after an authentication: %s", err)
+	}
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	control := NewAdmissionControl(AdmissionConfig{MaxUnauthenticated: 2, MaxFailures: 1, AuthTimeout: 50 * time.Millisecond})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	first, _ := control.Admit(addr, func() {})
+	expired := make(chan bool, 1)
+	if _, err := control.Admit(addr, func() { expired <- true }); err != nil {
+		t.Fatalf("second session refused: %s", err)
+	}
+	if _, err := control.Admit(addr, func() {}); err != ErrTooManyUnauthenticated {
+		t.Errorf("third unauthenticated session admitted: %v", err)
+	}
+	first.Authenticated()
+	first.Failed() // already ended, ignored
+
+	// the second session does not authenticate in time: it fails and the address is banned
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatalf("session not expired")
+	}
+	if _, err := control.Admit(addr, func() {}); err != ErrSourceBanned {
+		t.Errorf("address not banned after the timeout: %v", err)
+	}
+	other, err := control.Admit(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4000}, func() {})
+	if err != nil {
+		t.Fatalf("slot not released: %s", err)
+	}
+	other.Release()
+}
@@ -0,0 +1,219 @@
+package quic_utils
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// environment variable giving the Unix socket of the agent to the clients
+const AgentSocketEnv = "QUIC_SSH_AUTH_SOCK"
+
+/*
+    Format for agent messages:
+    --------------------------
+
+	The agent holds decrypted private keys and signs the nonce challenges of the client authentication
+	(see ServeClientPublicKey) on behalf of the clients connected to its Unix socket. Private keys never
+	leave the agent.
+
+	0       8                               40
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+    | type  |       length (4 bytes)        | payload
+    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+---
+
+	Requests (client -> agent):
+	> 0x01 "list keys"  : no payload.
+	> 0x02 "sign"       : key l. (4 bytes), public key (ASN.1, as EncodePublicKey), content to sign.
+
+	Responses (agent -> client):
+	> 0x80 "failure"    : no payload (unknown request, or key not held by the agent).
+	> 0x81 "keys"       : count (4 bytes), then for each key: key l. (4 bytes), public key (ASN.1).
+	> 0x82 "signature"  : signature of the content (see SignContent).
+*/
+
+const (
+	AGENT_LIST_KEYS = 0x01
+	AGENT_SIGN      = 0x02
+	AGENT_FAILURE   = 0x80
+	AGENT_KEYS      = 0x81
+	AGENT_SIGNATURE = 0x82
+
+	agentMaxMessageSize = 256 * 1024
+)
+
+// read one agent message following schema depicted above
+func ReadAgentMessage(conn io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > agentMaxMessageSize {
+		return 0, nil, errors.New("agent message too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// write one agent message following schema depicted above
+func WriteAgentMessage(conn io.Writer, msgType byte, payload []byte) error {
+	buf := append([]byte{msgType}, encodeInt(len(payload))...)
+	_, err := conn.Write(append(buf, payload...))
+	return err
+}
+
+// =========================== agent side =======================================
+
+// agent holding decrypted private keys
+type Agent struct {
+	keys []crypto.Signer
+}
+
+func NewAgent(keys []crypto.Signer) *Agent {
+	return &Agent{keys: keys}
+}
+
+// answer the clients accepted on listener (until listener is closed)
+func (agent *Agent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go agent.ServeConn(conn)
+	}
+}
+
+// answer the requests of one client until it leaves
+func (agent *Agent) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	for {
+		msgType, payload, err := ReadAgentMessage(conn)
+		if err != nil {
+			return
+		}
+		responseType, response := agent.answer(msgType, payload)
+		if WriteAgentMessage(conn, responseType, response) != nil {
+			return
+		}
+	}
+}
+
+func (agent *Agent) answer(msgType byte, payload []byte) (byte, []byte) {
+	switch msgType {
+	case AGENT_LIST_KEYS:
+		response := encodeInt(len(agent.keys))
+		for _, key := range agent.keys {
+			encodedKey, err := EncodePublicKey(key.Public())
+			if err != nil {
+				return AGENT_FAILURE, nil
+			}
+			response = append(append(response, encodeInt(len(encodedKey))...), encodedKey...)
+		}
+		return AGENT_KEYS, response
+	case AGENT_SIGN:
+		if len(payload) < 4 || len(payload) < 4+decodeInt(payload[0:4]) {
+			return AGENT_FAILURE, nil
+		}
+		keyLength := decodeInt(payload[0:4])
+		publicKey, err := DecodePublicKey(payload[4 : 4+keyLength])
+		if err != nil {
+			return AGENT_FAILURE, nil
+		}
+		for _, key := range agent.keys {
+			if ComparePublicKeys(key.Public(), publicKey) {
+				signature, err := SignContent(key, payload[4+keyLength:])
+				if err != nil {
+					return AGENT_FAILURE, nil
+				}
+				return AGENT_SIGNATURE, signature
+			}
+		}
+	}
+	return AGENT_FAILURE, nil
+}
+
+// =========================== client side =======================================
+
+// connection to an agent. It is a Signer for the keys held by the agent.
+type AgentClient struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+// connect to the agent listening on socketPath (usually given by AgentSocketEnv)
+func DialAgent(socketPath string) (*AgentClient, error) {
+	if socketPath == "" {
+		return nil, errors.New("no agent available (" + AgentSocketEnv + " is not set)")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, errors.New("cannot connect to the agent at '" + socketPath + "'")
+	}
+	return &AgentClient{conn: conn}, nil
+}
+
+// send a request and wait for its response
+func (client *AgentClient) request(msgType byte, payload []byte) (byte, []byte, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := WriteAgentMessage(client.conn, msgType, payload); err != nil {
+		return 0, nil, err
+	}
+	return ReadAgentMessage(client.conn)
+}
+
+// public keys of the private keys held by the agent
+func (client *AgentClient) ListKeys() ([]crypto.PublicKey, error) {
+	responseType, response, err := client.request(AGENT_LIST_KEYS, nil)
+	if err != nil {
+		return nil, err
+	}
+	if responseType != AGENT_KEYS || len(response) < 4 {
+		return nil, errors.New("unexpected answer of the agent")
+	}
+	keys := make([]crypto.PublicKey, 0)
+	count := decodeInt(response[0:4])
+	response = response[4:]
+	for i := 0; i < count; i++ {
+		if len(response) < 4 || len(response) < 4+decodeInt(response[0:4]) {
+			return nil, errors.New("unexpected answer of the agent")
+		}
+		keyLength := decodeInt(response[0:4])
+		key, err := DecodePublicKey(response[4 : 4+keyLength])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		response = response[4+keyLength:]
+	}
+	return keys, nil
+}
+
+// ask the agent to sign content with the private key of publicKey
+func (client *AgentClient) SignChallenge(publicKey crypto.PublicKey, content []byte) ([]byte, error) {
+	encodedKey, err := EncodePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	payload := append(append(encodeInt(len(encodedKey)), encodedKey...), content...)
+	responseType, response, err := client.request(AGENT_SIGN, payload)
+	if err != nil {
+		return nil, err
+	}
+	if responseType != AGENT_SIGNATURE {
+		return nil, errors.New("the agent refused to sign (key not held by the agent ?)")
+	}
+	return response, nil
+}
+
+func (client *AgentClient) Close() error {
+	return client.conn.Close()
+}
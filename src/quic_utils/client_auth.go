@@ -2,8 +2,8 @@ package quic_utils
 
 import (
 	"github.com/lucas-clemente/quic-go"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"encoding/binary"
 	"errors"
 )
@@ -117,14 +117,28 @@ func (ans *nonceAnswer) write(session quic.Session, stream quic.Stream) (error)
 	return nil
 }
 
-func sign(connectionId uint64, ra []byte, rb[]byte, key *rsa.PrivateKey) ([]byte, error) {
+// signs the nonce challenge of the client authentication for a public key (with its private key, or through an agent)
+type Signer interface {
+	SignChallenge(publicKey crypto.PublicKey, content []byte) ([]byte, error)
+}
+
+// signer holding the private key itself
+type PrivateKeySigner struct {
+	Key crypto.Signer
+}
+
+func (signer PrivateKeySigner) SignChallenge(publicKey crypto.PublicKey, content []byte) ([]byte, error) {
+	return SignContent(signer.Key, content)
+}
+
+func sign(connectionId uint64, ra []byte, rb[]byte, signer Signer, publicKey crypto.PublicKey) ([]byte, error) {
 	connectionIdBytes := make([]byte, 8,8)
 	binary.BigEndian.PutUint64(connectionIdBytes, connectionId)
 
 	signedContent := merge(ra, rb)
 	signedContent = merge(signedContent, connectionIdBytes)
 
-	if signature, err := rsa.SignPKCS1v15(rand.Reader, key, 0, signedContent); err == nil {
+	if signature, err := signer.SignChallenge(publicKey, signedContent); err == nil {
 		return signature, nil
 	} else {
 		return nil, errors.New("failed to sign content")
@@ -138,11 +152,16 @@ func (ans *nonceAnswer) verify(ra []byte) (error) {
 		return err
 	}
 
-	return rsa.VerifyPKCS1v15(key, 0, signedContent, ans.signature)
+	return VerifySignature(key, signedContent, ans.signature)
 }
 
 // (client side) accept nonce, answer other nonce, public key + signature
-func ServeClientPublicKey(session quic.Session, stream quic.Stream, privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) error {
+func ServeClientPublicKey(session quic.Session, stream quic.Stream, privateKey crypto.Signer, publicKey crypto.PublicKey) error {
+	return ServeClientPublicKeyWithSigner(session, stream, PrivateKeySigner{privateKey}, publicKey)
+}
+
+// (client side) same as ServeClientPublicKey, the nonces being signed by signer (such as an agent)
+func ServeClientPublicKeyWithSigner(session quic.Session, stream quic.Stream, signer Signer, publicKey crypto.PublicKey) error {
 	Logf("[client authentication] serve client key ..")
 
 	stream.Write([] byte{0}) // FIXME: dummy data to unlock stream
@@ -167,7 +186,7 @@ func ServeClientPublicKey(session quic.Session, stream quic.Stream, privateKey *
 		return err
 	}
 	answer.keySize = encodeInt(len(answer.key))
-	answer.signature, err = sign(session.AddedForThesis_getConnectionId(), ra, answer.rb, privateKey)
+	answer.signature, err = sign(session.AddedForThesis_getConnectionId(), ra, answer.rb, signer, publicKey)
 	if err != nil {
 		return err
 	}
@@ -182,7 +201,7 @@ func ServeClientPublicKey(session quic.Session, stream quic.Stream, privateKey *
 }
 
 // (server side): send nonce, accept answer and check signature
-func AskClientPublicKey(session quic.Session, stream quic.Stream) (*rsa.PublicKey, error) {
+func AskClientPublicKey(session quic.Session, stream quic.Stream) (crypto.PublicKey, error) {
 	Logf("[client authentication] ask client key ..")
 	readN(stream, 1) // FIXME: dummy read to avoid blocking
 
@@ -214,5 +233,5 @@ func AskClientPublicKey(session quic.Session, stream quic.Stream) (*rsa.PublicKe
 	signedContent := merge(ra, answer.rb)
 	signedContent = merge(signedContent, connectionIDBytes)
 
-	return key, rsa.VerifyPKCS1v15(key, 0, signedContent, answer.signature)
+	return key, VerifySignature(key, signedContent, answer.signature)
 }
\ No newline at end of file
@@ -0,0 +1,267 @@
+package quic_utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// ==================== KEY GENERATION ====================
+
+// size of the RSA keys generated when no size is given
+const DefaultRSABits = 2048
+
+/*
+ * generate a private key of the given type ("rsa", "ecdsa" or "ed25519", as accepted by KeyType).
+ * bits is only used for RSA keys (DefaultRSABits if 0).
+ */
+func GenerateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		if bits < 1024 {
+			return nil, errors.New("RSA keys must have at least 1024 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa", "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, errors.New(fmt.Sprintf("unknown key type '%s' (rsa, ecdsa or ed25519)", keyType))
+}
+
+// size of a key in bits (as shown with its fingerprint)
+func KeyBits(key crypto.PublicKey) int {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+// ==================== KEY FORMATS ====================
+
+/*
+ * Formats of public keys:
+ * > "pem": PEM file read by ExtractPublicKey and written by WritePublicKey ("RSA PUBLIC KEY" for RSA keys),
+ * > "pkix": PEM "PUBLIC KEY" for any key (as written by openssl),
+ * > "openssh": OpenSSH line ("ssh-ed25519 AAAA...", as the .pub files of ssh-keygen),
+ * > "line": single-line form of the "pem" format (base64 without markers), as written in the
+ *   authorized keys file of the server and the known hosts file of the client.
+ * Formats of private keys:
+ * > "pem": PEM file written by WritePrivateKey (PKCS #1 for RSA, PKCS #8 otherwise, encrypted PKCS #8 with a passphrase),
+ * > "pkcs8": PEM "PRIVATE KEY" (or "ENCRYPTED PRIVATE KEY" with a passphrase) for any key,
+ * > "openssh": PEM "OPENSSH PRIVATE KEY" (as written by ssh-keygen).
+ */
+var PublicKeyFormats = []string{"pem", "pkix", "openssh", "line"}
+var PrivateKeyFormats = []string{"pem", "pkcs8", "openssh"}
+
+// encode a public key in one of the PublicKeyFormats (content of the file, ending with a newline)
+func FormatPublicKey(key crypto.PublicKey, format string) ([]byte, error) {
+	if _, err := checkPublicKey(key); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "pem":
+		der, err := EncodePublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: PublicKeyPEMType(key), Bytes: der}), nil
+	case "pkix":
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case "openssh":
+		sshKey, err := ssh.NewPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.MarshalAuthorizedKey(sshKey), nil
+	case "line":
+		line, err := InlinePublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(line + "\n"), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown public key format '%s' (%s)", format, strings.Join(PublicKeyFormats, ", ")))
+}
+
+// encode a private key in a PEM block of one of the PrivateKeyFormats (encrypted if passphrase is not empty)
+func FormatPrivateKey(key crypto.Signer, format string, passphrase []byte) (*pem.Block, error) {
+	if _, err := checkPrivateKey(key); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "pem", "pkcs8":
+		if format == "pem" && len(passphrase) == 0 {
+			der, err := EncodePrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			return &pem.Block{Type: privateKeyPEMType(key), Bytes: der}, nil
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+		}
+		encrypted, err := encryptPKCS8(der, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}, nil
+	case "openssh":
+		if len(passphrase) == 0 {
+			return ssh.MarshalPrivateKey(key, "")
+		}
+		return ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown private key format '%s' (%s)", format, strings.Join(PrivateKeyFormats, ", ")))
+}
+
+// single-line form of a public key (as written in the authorized keys and known hosts files)
+func InlinePublicKey(key crypto.PublicKey) (string, error) {
+	der, err := EncodePublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// decode the single-line form of a public key
+func ParseInlinePublicKey(line string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, errors.New("invalid single-line public key")
+	}
+	return DecodePublicKey(der)
+}
+
+// ==================== FINGERPRINTS ====================
+
+/*
+ * SHA-256 fingerprint of a public key ("SHA256:" followed by the unpadded base64 of the hash).
+ * The hash is computed over the OpenSSH encoding of the key, so that the fingerprint of a key is
+ * the same as the one shown by ssh-keygen -l.
+ */
+func Fingerprint(key crypto.PublicKey) (string, error) {
+	sshKey, err := sshPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(sshKey), nil
+}
+
+func sshPublicKey(key crypto.PublicKey) (ssh.PublicKey, error) {
+	if _, err := checkPublicKey(key); err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(key)
+}
+
+// size of the randomart field, and symbols by number of visits (the two last ones mark the start and the end)
+const (
+	randomartWidth   = 17
+	randomartHeight  = 9
+	randomartSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+/*
+ * visual representation of the fingerprint of a public key (the "drunken bishop" of OpenSSH, same
+ * drawing as ssh-keygen -lv). Starting from the center of the field, each pair of bits of the hash
+ * (low bits first) moves the bishop diagonally: bit 0 gives left/right, bit 1 gives up/down.
+ *
+ *   +--[ED25519 256]--+
+ *   |o o=*o=o.o.o.    |
+ *   | o.. = o. o..E   |
+ *   |  . . + . .o.    |
+ *   | o o = B  =.     |
+ *   |  + O O S+ o     |
+ *   |   + B o+   o    |
+ *   |  + +  . . . .   |
+ *   | . o      o      |
+ *   |         .       |
+ *   +----[SHA256]-----+
+ */
+func Randomart(key crypto.PublicKey) (string, error) {
+	sshKey, err := sshPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(sshKey.Marshal())
+
+	start, end := len(randomartSymbols)-2, len(randomartSymbols)-1
+	field := [randomartWidth][randomartHeight]int{}
+	x, y := randomartWidth/2, randomartHeight/2
+	for _, b := range hash {
+		for i := 0; i < 4; i++ {
+			x = moveBishop(x, b&0x1 != 0, randomartWidth)
+			y = moveBishop(y, b&0x2 != 0, randomartHeight)
+			if field[x][y] < start-1 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomartWidth/2][randomartHeight/2] = start
+	field[x][y] = end
+
+	keyName := strings.ToUpper(strings.TrimSuffix(KeyType(key), "-p256"))
+	art := randomartBorder(fmt.Sprintf("[%s %d]", keyName, KeyBits(key))) + "\n"
+	for y := 0; y < randomartHeight; y++ {
+		art += "|"
+		for x := 0; x < randomartWidth; x++ {
+			art += string(randomartSymbols[field[x][y]])
+		}
+		art += "|\n"
+	}
+	return art + randomartBorder("[SHA256]"), nil
+}
+
+// move one step forward or backward, staying inside the field
+func moveBishop(position int, forward bool, size int) int {
+	if forward && position < size-1 {
+		return position + 1
+	} else if !forward && position > 0 {
+		return position - 1
+	}
+	return position
+}
+
+// top or bottom border of the randomart with the centered title
+func randomartBorder(title string) string {
+	left := (randomartWidth - len(title)) / 2
+	if left < 0 {
+		left = 0
+	}
+	right := randomartWidth - left - len(title)
+	if right < 0 {
+		right = 0
+	}
+	return "+" + strings.Repeat("-", left) + title + strings.Repeat("-", right) + "+"
+}
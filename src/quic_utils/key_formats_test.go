@@ -0,0 +1,124 @@
+package quic_utils
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// key generated by ssh-keygen, with its fingerprint and randomart shown by ssh-keygen -lv
+const (
+	testOpenSSHKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPMUsRijOXQFqmSzs5jrc8mq0hiwaY8yhBCdHPtL+Cuh\n"
+	testFingerprint = "SHA256:MANYAQtcxZWYeiLzXoxlj4rVsVZLFnSvWulbDUxQk14"
+	testRandomart   = "+--[ED25519 256]--+\n" +
+		"|o o=*o=o.o.o.    |\n" +
+		"| o.. = o. o..E   |\n" +
+		"|  . . + . .o.    |\n" +
+		"| o o = B  =.     |\n" +
+		"|  + O O S+ o     |\n" +
+		"|   + B o+   o    |\n" +
+		"|  + +  . . . .   |\n" +
+		"| . o      o      |\n" +
+		"|         .       |\n" +
+		"+----[SHA256]-----+"
+)
+
+// Test fingerprint and randomart against the ones of ssh-keygen
+func TestFingerprint(t *testing.T) {
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testOpenSSHKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sshKey.(ssh.CryptoPublicKey).CryptoPublicKey()
+
+	if fingerprint, err := Fingerprint(key); err != nil || fingerprint != testFingerprint {
+		t.Errorf("Invalid fingerprint %s (expected %s)", fingerprint, testFingerprint)
+	}
+	if art, err := Randomart(key); err != nil || art != testRandomart {
+		t.Errorf("Invalid randomart:\n%s\nexpected:\n%s", art, testRandomart)
+	}
+	if formatted, err := FormatPublicKey(key, "openssh"); err != nil || string(formatted) != testOpenSSHKey {
+		t.Errorf("Invalid OpenSSH public key %s", formatted)
+	}
+}
+
+// Test that every format written is read back by ExtractPublicKey, ExtractPrivateKey and ParseInlinePublicKey
+func TestKeyFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic_utils_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		key, err := GenerateKey(keyType, 1024)
+		if err != nil {
+			t.Fatalf("Unable to generate %s key: %v", keyType, err)
+		}
+
+		for _, format := range PublicKeyFormats {
+			data, err := FormatPublicKey(key.Public(), format)
+			if err != nil {
+				t.Errorf("Unable to format %s public key as %s: %v", keyType, format, err)
+				continue
+			}
+			var extracted interface{}
+			if format == "line" {
+				extracted, err = ParseInlinePublicKey(string(data))
+			} else {
+				file := filepath.Join(dir, keyType+"."+format)
+				ioutil.WriteFile(file, data, 0644)
+				extracted, err = ExtractPublicKey(file)
+			}
+			if err != nil || !ComparePublicKeys(extracted, key.Public()) {
+				t.Errorf("Unable to read %s public key written as %s: %v", keyType, format, err)
+			}
+		}
+
+		for _, format := range PrivateKeyFormats {
+			for _, passphrase := range []string{"", "secret"} {
+				block, err := FormatPrivateKey(key, format, []byte(passphrase))
+				if err != nil {
+					t.Errorf("Unable to format %s private key as %s: %v", keyType, format, err)
+					continue
+				}
+				file := filepath.Join(dir, keyType+"_"+format)
+				os.Remove(file)
+				if err := WritePrivateKeyBlock(file, block); err != nil {
+					t.Fatal(err)
+				}
+				if info, _ := os.Stat(file); info.Mode().Perm() != 0600 {
+					t.Errorf("Private key written with mode %v", info.Mode().Perm())
+				}
+				calls := 0
+				extracted, err := ExtractPrivateKeyWithPassphrase(file, testPassphrase(passphrase, &calls))
+				if err != nil || !ComparePublicKeys(extracted.Public(), key.Public()) {
+					t.Errorf("Unable to read %s private key written as %s: %v", keyType, format, err)
+				}
+				if (calls == 1) != (passphrase != "") {
+					t.Errorf("Passphrase asked %d times for %s private key written as %s", calls, keyType, format)
+				}
+			}
+		}
+	}
+
+	// "line" is the content of the "pem" format without markers
+	key, _ := GenerateKey("rsa", 1024)
+	line, _ := InlinePublicKey(key.Public())
+	data, _ := FormatPublicKey(key.Public(), "pem")
+	block, _ := pem.Decode(data)
+	if block == nil || base64.StdEncoding.EncodeToString(block.Bytes) != line {
+		t.Errorf("Invalid single-line public key %s", line)
+	}
+
+	if _, err := GenerateKey("dsa", 0); err == nil {
+		t.Errorf("Unknown key type accepted")
+	}
+	if _, err := GenerateKey("rsa", 512); err == nil {
+		t.Errorf("Short RSA key accepted")
+	}
+}
@@ -1,110 +1,389 @@
 package quic_utils
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/asn1"
 	"crypto/x509"
 	"crypto/tls"
 	"math/big"
 	"encoding/pem"
 	"bytes"
+	"hash"
 	"os"
 	"io/ioutil"
 	"errors"
 	"crypto/rand"
 	"fmt"
+	"golang.org/x/crypto/ssh"
 )
 
 // ==================== KEY ENCODING-DECODING ====================
 
-// asn1 encode a public key file
-func EncodePublicKey(key *rsa.PublicKey) ([]byte, error) {
-	b, err := asn1.Marshal(*key)
-	return b, err
+/*
+ * Supported keys are RSA, ECDSA on the P-256 curve and Ed25519. Public keys are handled as
+ * crypto.PublicKey (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey) and private keys as
+ * crypto.Signer (*rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey).
+ */
+
+// name of the type of a key ("rsa", "ecdsa-p256" or "ed25519"), empty if not supported
+func KeyType(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return "ecdsa-p256"
+		}
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return ""
+}
+
+// check that a public key is supported
+func checkPublicKey(key crypto.PublicKey) (crypto.PublicKey, error) {
+	if KeyType(key) == "" {
+		return nil, errors.New("unsupported public key (RSA, ECDSA P-256 and Ed25519 keys are supported)")
+	}
+	return key, nil
 }
 
-// asn1 decode a public key file
-func DecodePublicKey(b []byte) (*rsa.PublicKey, error) {
+// check that a private key is supported
+func checkPrivateKey(key interface{}) (crypto.Signer, error) {
+	if ed25519Key, ok := key.(*ed25519.PrivateKey); ok { // as returned by golang.org/x/crypto/ssh
+		key = *ed25519Key
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || KeyType(signer.Public()) == "" {
+		return nil, errors.New("unsupported private key (RSA, ECDSA P-256 and Ed25519 keys are supported)")
+	}
+	return signer, nil
+}
+
+// encode a public key: asn1 for RSA (as in "RSA PUBLIC KEY" files), PKIX DER otherwise
+func EncodePublicKey(key crypto.PublicKey) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		return asn1.Marshal(*rsaKey)
+	}
+	if _, err := checkPublicKey(key); err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// decode a public key encoded by EncodePublicKey (or any PKIX DER public key)
+func DecodePublicKey(b []byte) (crypto.PublicKey, error) {
+	if key, err := x509.ParsePKIXPublicKey(b); err == nil {
+		return checkPublicKey(key)
+	}
 	res := rsa.PublicKey{}
-	_, err := asn1.Unmarshal(b, &res)
-	return &res, err
+	rest, err := asn1.Unmarshal(b, &res)
+	if err != nil || len(rest) != 0 || res.N == nil {
+		return nil, errors.New("invalid public key")
+	}
+	return &res, nil
+}
+
+// DER encode a private key: PKCS #1 for RSA, PKCS #8 otherwise
+func EncodePrivateKey(key crypto.Signer) ([]byte, error){
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return x509.MarshalPKCS1PrivateKey(rsaKey), nil
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
 }
 
-// DER encode a private key
-func EncodePrivateKey(key *rsa.PrivateKey) ([]byte){
-	return x509.MarshalPKCS1PrivateKey(key)
+// DER decode a private key (PKCS #1, PKCS #8 or SEC 1)
+func DecodePrivateKey(der[] byte) (crypto.Signer, error){
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return checkPrivateKey(key)
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return checkPrivateKey(key)
+	}
+	return nil, errors.New("invalid private key")
+}
+
+// type of the PEM block of a private key encoded by EncodePrivateKey
+func privateKeyPEMType(key crypto.Signer) string {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return "RSA PRIVATE KEY"
+	}
+	return "PRIVATE KEY"
 }
 
-// DER decode a private key
-func DecodePrivateKey(der[] byte) (*rsa.PrivateKey, error){
-	return x509.ParsePKCS1PrivateKey(der)
+// type of the PEM block of a public key encoded by EncodePublicKey
+func PublicKeyPEMType(key crypto.PublicKey) string {
+	if _, ok := key.(*rsa.PublicKey); ok {
+		return "RSA PUBLIC KEY"
+	}
+	return "PUBLIC KEY"
 }
 
 // compare two keys (return true if equals)
-func ComparePublicKeys(key1 *rsa.PublicKey, key2 *rsa.PublicKey) bool {
-	return key1.E == key2.E && bytes.Compare(key1.N.Bytes(),key2.N.Bytes()) == 0
+func ComparePublicKeys(key1 crypto.PublicKey, key2 crypto.PublicKey) bool {
+	comparable, ok := key1.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key2 != nil && comparable.Equal(key2)
 }
 
+// ==================== SIGNATURES ====================
+
+/*
+ * sign content with a private key:
+ * > RSA: PKCS #1 v1.5 signature of the content itself (no hash, the content is short),
+ * > ECDSA: ASN.1 signature of the SHA-256 of the content,
+ * > Ed25519: signature of the content.
+ */
+func SignContent(key crypto.Signer, content []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, 0, content)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, k, hashContent(sha256.New(), content))
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, content), nil
+	}
+	return nil, errors.New("unsupported private key")
+}
+
+// verify a signature made by SignContent
+func VerifySignature(key crypto.PublicKey, content []byte, signature []byte) error {
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, 0, content, signature)
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, hashContent(sha256.New(), content), signature)
+	case ed25519.PublicKey:
+		valid = len(k) == ed25519.PublicKeySize && ed25519.Verify(k, content, signature)
+	default:
+		return errors.New("unsupported public key")
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func hashContent(h hash.Hash, content []byte) []byte {
+	h.Write(content)
+	return h.Sum(nil)
+}
 
 // ==================== KEY FILE ENCODING-DECODING ====================
 
 // extract content (DER or ASN1) from a PEM file
 func ReadPEM(pemFilename string) ([]byte, error){
-	f, _ := os.Open(pemFilename)
-	certPEM, err := ioutil.ReadAll(f)
+	block, err := ReadPEMBlock(pemFilename)
+	if err != nil {
+		return nil, err
+	}
+	return block.Bytes, nil
+}
+
+// extract the first PEM block (with its type and headers) from a PEM file
+func ReadPEMBlock(pemFilename string) (*pem.Block, error){
+	certPEM, err := ioutil.ReadFile(pemFilename)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("failed to read file '%s'", pemFilename))
 	}
-	f.Close()
 
 	pemData, _ := pem.Decode(certPEM)
-	derData := pemData.Bytes
-	return derData, nil
+	if pemData == nil {
+		return nil, errors.New(fmt.Sprintf("no PEM data found in file '%s'", pemFilename))
+	}
+	return pemData, nil
 }
 
-// write byte data in a PEM file
+// write byte data in a PEM file (readable by all, the private keys are written by WritePrivateKeyBlock)
 func WritePEM(pemFilename string, dataDescription string, rawdata []byte) error {
 	f, err := os.Create(pemFilename)
 	if err != nil {
 		return errors.New(fmt.Sprintf("failed to open PEM file '%s'", pemFilename))
 	}
 
-	if pem.Encode(f, &pem.Block{Type: dataDescription, Bytes: rawdata}); err != nil {
+	if err = pem.Encode(f, &pem.Block{Type: dataDescription, Bytes: rawdata}); err != nil {
+		f.Close()
 		return errors.New(fmt.Sprintf("failed to write data in PEM file '%s'", pemFilename))
 	}
 
-	f.Close()
-	return nil
+	return f.Close()
 }
 
-// extract public key from a asn1 .pub file
-func ExtractPublicKey(publicKeyFile string) (*rsa.PublicKey, error) {
-	asnData, err := ReadPEM(publicKeyFile)
+/*
+ * extract public key from a file. Accepted formats:
+ * > PEM "RSA PUBLIC KEY" (asn1, as written by EncodePublicKey for RSA keys),
+ * > PEM "PUBLIC KEY" (PKIX, as written by openssl, and by EncodePublicKey for ECDSA and Ed25519 keys),
+ * > OpenSSH public key ("ssh-ed25519 AAAA... comment", as the .pub files of ssh-keygen).
+ */
+func ExtractPublicKey(publicKeyFile string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read file '%s'", publicKeyFile))
+	}
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("ssh-")) || bytes.HasPrefix(trimmed, []byte("ecdsa-")) {
+		sshKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid OpenSSH public key in file '%s'", publicKeyFile))
+		}
+		cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unsupported OpenSSH public key in file '%s'", publicKeyFile))
+		}
+		return checkPublicKey(cryptoKey.CryptoPublicKey())
+	}
 
-	if  err == nil {
-		return DecodePublicKey(asnData)
-	} else {
+	block, err := ReadPEMBlock(publicKeyFile)
+	if err != nil {
 		return nil, err
 	}
+	if block.Type == "PUBLIC KEY" {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return checkPublicKey(key)
+	}
+	return DecodePublicKey(block.Bytes)
+}
+
+// extract private key from a pem file (asking the passphrase with DefaultPassphrase if the key is encrypted)
+func ExtractPrivateKey(privateKeyFile string) (crypto.Signer, error) {
+	return ExtractPrivateKeyWithPassphrase(privateKeyFile, DefaultPassphrase)
+}
+
+/*
+ * extract private key from a file. Accepted formats (the passphrase is only asked for encrypted keys):
+ * > PEM "RSA PRIVATE KEY" (PKCS #1) and "EC PRIVATE KEY" (SEC 1), possibly encrypted with a "Proc-Type: 4,ENCRYPTED" header,
+ * > PEM "PRIVATE KEY" (PKCS #8) and "ENCRYPTED PRIVATE KEY" (PKCS #8 with PBES2),
+ * > PEM "OPENSSH PRIVATE KEY" (as written by ssh-keygen), possibly encrypted.
+ */
+func ExtractPrivateKeyWithPassphrase(privateKeyFile string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	block, err := ReadPEMBlock(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	askPassphrase := func() ([]byte, error) {
+		if passphrase == nil {
+			return nil, errors.New(fmt.Sprintf("key '%s' is encrypted and no passphrase is available", privateKeyFile))
+		}
+		return passphrase(privateKeyFile)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			secret, err := askPassphrase()
+			if err != nil {
+				return nil, err
+			}
+			if der, err = x509.DecryptPEMBlock(block, secret); err != nil {
+				return nil, errors.New("incorrect passphrase")
+			}
+		}
+		if block.Type == "EC PRIVATE KEY" {
+			key, err := x509.ParseECPrivateKey(der)
+			if err != nil {
+				return nil, err
+			}
+			return checkPrivateKey(key)
+		}
+		return x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY":
+		return parsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		secret, err := askPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		der, err := decryptPKCS8(block.Bytes, secret)
+		if err != nil {
+			return nil, err
+		}
+		return parsePKCS8PrivateKey(der)
+	case "OPENSSH PRIVATE KEY":
+		pemData := pem.EncodeToMemory(block)
+		key, err := ssh.ParseRawPrivateKey(pemData)
+		if _, encrypted := err.(*ssh.PassphraseMissingError); encrypted {
+			secret, err := askPassphrase()
+			if err != nil {
+				return nil, err
+			}
+			if key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemData, secret); err != nil {
+				return nil, errors.New("incorrect passphrase")
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		return checkPrivateKey(key)
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported private key type '%s' in file '%s'", block.Type, privateKeyFile))
+}
+
+/*
+ * write a private key in a PEM file (only readable by its owner): as EncodePrivateKey if passphrase
+ * is empty, otherwise PKCS #8 encrypted with PBES2 (PBKDF2-HMAC-SHA256, AES-256-CBC).
+ */
+func WritePrivateKey(privateKeyFile string, key crypto.Signer, passphrase []byte) error {
+	block, err := FormatPrivateKey(key, "pem", passphrase)
+	if err != nil {
+		return err
+	}
+	return WritePrivateKeyBlock(privateKeyFile, block)
 }
 
-// extract private key from a pem file
-func ExtractPrivateKey(privateKeyFile string) (*rsa.PrivateKey, error) {
-	if derData, err := ReadPEM(privateKeyFile); err == nil {
-		return DecodePrivateKey(derData)
-	} else {
+/*
+ * write the PEM block of a private key in a file only readable by its owner. An existing file is made
+ * only readable by its owner before the key is written (its mode is kept by O_TRUNC).
+ */
+func WritePrivateKeyBlock(privateKeyFile string, block *pem.Block) error {
+	f, err := os.OpenFile(privateKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to open PEM file '%s'", privateKeyFile))
+	}
+	if err = f.Chmod(0600); err != nil {
+		f.Close()
+		return errors.New(fmt.Sprintf("failed to restrict the permissions of PEM file '%s'", privateKeyFile))
+	}
+	if err = pem.Encode(f, block); err != nil {
+		f.Close()
+		return errors.New(fmt.Sprintf("failed to write data in PEM file '%s'", privateKeyFile))
+	}
+	return f.Close()
+}
+
+// write a public key in a PEM file (as EncodePublicKey)
+func WritePublicKey(publicKeyFile string, key crypto.PublicKey) error {
+	der, err := EncodePublicKey(key)
+	if err != nil {
+		return err
+	}
+	return WritePEM(publicKeyFile, PublicKeyPEMType(key), der)
+}
+
+func parsePKCS8PrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
 		return nil, err
 	}
+	return checkPrivateKey(key)
 }
 
 // make a certificate from a pair (public, private) keys
-func MakeCertificate(publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (tls.Certificate, error){
+func MakeCertificate(publicKey crypto.PublicKey, privateKey crypto.Signer) (tls.Certificate, error){
 	template := x509.Certificate{SerialNumber: big.NewInt(1)}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
-	Check(err)
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: EncodePrivateKey(privateKey)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	return tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: privateKey}, nil
 }
@@ -0,0 +1,238 @@
+package quic_utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// passphrase function for the tests (counts the calls)
+func testPassphrase(secret string, calls *int) PassphraseFunc {
+	return func(keyFile string) ([]byte, error) {
+		*calls++
+		return []byte(secret), nil
+	}
+}
+
+func writeTestPEM(t *testing.T, file string, block *pem.Block) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test the formats of private keys read by ExtractPrivateKeyWithPassphrase
+func TestExtractPrivateKey_Formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic_utils_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	openssh, _ := ssh.MarshalPrivateKey(key, "test")
+	encryptedOpenssh, _ := ssh.MarshalPrivateKeyWithPassphrase(key, "test", []byte("secret"))
+
+	testData := []struct {
+		name      string
+		write     func(file string)
+		encrypted bool
+	}{
+		{"pkcs1", func(file string) { WritePrivateKey(file, key, nil) }, false},
+		{"pkcs1_encrypted", func(file string) {
+			block, _ := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+			writeTestPEM(t, file, block)
+		}, true},
+		{"pkcs8", func(file string) { writeTestPEM(t, file, &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}) }, false},
+		{"pkcs8_encrypted", func(file string) { WritePrivateKey(file, key, []byte("secret")) }, true},
+		{"openssh", func(file string) { writeTestPEM(t, file, openssh) }, false},
+		{"openssh_encrypted", func(file string) { writeTestPEM(t, file, encryptedOpenssh) }, true},
+	}
+
+	for _, data := range testData {
+		file := filepath.Join(dir, data.name)
+		data.write(file)
+
+		calls := 0
+		extracted, err := ExtractPrivateKeyWithPassphrase(file, testPassphrase("secret", &calls))
+		if err != nil {
+			t.Errorf("Unable to extract %s key: %v", data.name, err)
+			continue
+		}
+		if !ComparePublicKeys(extracted.Public(), &key.PublicKey) {
+			t.Errorf("Invalid %s key extracted", data.name)
+		}
+		if (calls == 1) != data.encrypted || calls > 1 {
+			t.Errorf("Passphrase asked %d times for %s key", calls, data.name)
+		}
+
+		if data.encrypted {
+			if _, err := ExtractPrivateKeyWithPassphrase(file, testPassphrase("wrong", &calls)); err == nil {
+				t.Errorf("Wrong passphrase accepted for %s key", data.name)
+			}
+			if _, err := ExtractPrivateKeyWithPassphrase(file, nil); err == nil {
+				t.Errorf("Encrypted %s key extracted without passphrase", data.name)
+			}
+			failing := func(keyFile string) ([]byte, error) { return nil, errors.New("cancelled") }
+			if _, err := ExtractPrivateKeyWithPassphrase(file, failing); err == nil || err.Error() != "cancelled" {
+				t.Errorf("Error of passphrase function not returned for %s key", data.name)
+			}
+		}
+	}
+
+	// the private keys are only readable by their owner, even when their file already existed
+	file := filepath.Join(dir, "readable")
+	ioutil.WriteFile(file, []byte("readable by all"), 0644)
+	WritePrivateKey(file, key, nil)
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("The private key file must only be readable by its owner")
+	}
+}
+
+// Test the formats of public keys read by ExtractPublicKey
+func TestExtractPublicKey_Formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic_utils_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asn, _ := EncodePublicKey(&key.PublicKey)
+	WritePEM(filepath.Join(dir, "asn1"), "RSA PUBLIC KEY", asn)
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	WritePEM(filepath.Join(dir, "pkix"), "PUBLIC KEY", pkix)
+	sshKey, _ := ssh.NewPublicKey(&key.PublicKey)
+	ioutil.WriteFile(filepath.Join(dir, "openssh"), ssh.MarshalAuthorizedKey(sshKey), 0644)
+
+	for _, name := range []string{"asn1", "pkix", "openssh"} {
+		extracted, err := ExtractPublicKey(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Unable to extract %s key: %v", name, err)
+		} else if !ComparePublicKeys(extracted, &key.PublicKey) {
+			t.Errorf("Invalid %s key extracted", name)
+		}
+	}
+}
+
+// Test that invalid files are reported as errors
+func TestReadPEM_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic_utils_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "invalid"), []byte("not a PEM file"), 0600)
+
+	if _, err := ReadPEM(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Missing file accepted")
+	}
+	if _, err := ReadPEM(filepath.Join(dir, "invalid")); err == nil {
+		t.Errorf("File without PEM data accepted")
+	}
+	if _, err := ExtractPrivateKey(filepath.Join(dir, "invalid")); err == nil {
+		t.Errorf("Invalid private key accepted")
+	}
+	if _, err := ExtractPublicKey(filepath.Join(dir, "invalid")); err == nil {
+		t.Errorf("Invalid public key accepted")
+	}
+}
+
+// generate one key of each supported type
+func testKeys(t *testing.T) []crypto.Signer {
+	rsaKey, err1 := rsa.GenerateKey(rand.Reader, 1024)
+	ecdsaKey, err2 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, ed25519Key, err3 := ed25519.GenerateKey(rand.Reader)
+	if err1 != nil || err2 != nil || err3 != nil {
+		t.Fatal("Unable to generate keys")
+	}
+	return []crypto.Signer{rsaKey, ecdsaKey, ed25519Key}
+}
+
+// Test files, encodings and signatures of each type of key
+func TestKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quic_utils_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := testKeys(t)
+	for _, key := range keys {
+		keyType := KeyType(key.Public())
+		if keyType == "" {
+			t.Errorf("Unknown key type %T", key)
+			continue
+		}
+
+		// files (unencrypted and encrypted private keys)
+		WritePublicKey(filepath.Join(dir, keyType+".pub"), key.Public())
+		ioutil.WriteFile(filepath.Join(dir, keyType), []byte("readable by all"), 0644)
+		WritePrivateKey(filepath.Join(dir, keyType), key, nil)
+		WritePrivateKey(filepath.Join(dir, keyType+"_encrypted"), key, []byte("secret"))
+		for _, file := range []string{keyType, keyType + "_encrypted"} {
+			if info, err := os.Stat(filepath.Join(dir, file)); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("The %s private key file must only be readable by its owner", file)
+			}
+		}
+		publicKey, err := ExtractPublicKey(filepath.Join(dir, keyType+".pub"))
+		if err != nil || !ComparePublicKeys(publicKey, key.Public()) {
+			t.Errorf("Unable to extract %s public key: %v", keyType, err)
+		}
+		for _, file := range []string{keyType, keyType + "_encrypted"} {
+			calls := 0
+			privateKey, err := ExtractPrivateKeyWithPassphrase(filepath.Join(dir, file), testPassphrase("secret", &calls))
+			if err != nil || !ComparePublicKeys(privateKey.Public(), key.Public()) {
+				t.Errorf("Unable to extract %s private key: %v", file, err)
+			}
+		}
+
+		// encoding used on the wire
+		encoded, err := EncodePublicKey(key.Public())
+		decoded, err2 := DecodePublicKey(encoded)
+		if err != nil || err2 != nil || !ComparePublicKeys(decoded, key.Public()) {
+			t.Errorf("Unable to encode-decode %s public key", keyType)
+		}
+
+		// signatures
+		signature, err := SignContent(key, []byte("content"))
+		if err != nil || VerifySignature(key.Public(), []byte("content"), signature) != nil {
+			t.Errorf("Invalid %s signature: %v", keyType, err)
+		}
+		if VerifySignature(key.Public(), []byte("other content"), signature) == nil {
+			t.Errorf("Invalid %s signature accepted", keyType)
+		}
+
+		// certificates
+		if _, err := MakeCertificate(key.Public(), key); err != nil {
+			t.Errorf("Unable to make %s certificate: %v", keyType, err)
+		}
+	}
+
+	// keys of different types are different
+	if ComparePublicKeys(keys[0].Public(), keys[1].Public()) || ComparePublicKeys(keys[1].Public(), keys[2].Public()) {
+		t.Errorf("Keys of different types compared as equal")
+	}
+
+	// other curves are not supported
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if _, err := EncodePublicKey(p384Key.Public()); err == nil {
+		t.Errorf("ECDSA P-384 key accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package quic_utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// environment variable giving the passphrase of the encrypted private keys (instead of the prompt)
+const PassphraseEnv = "QUIC_SSH_PASSPHRASE"
+
+// gives the passphrase of an encrypted private key file (only called if the key is encrypted)
+type PassphraseFunc func(keyFile string) ([]byte, error)
+
+// passphrase given by PassphraseEnv if set, otherwise asked on the terminal
+func DefaultPassphrase(keyFile string) ([]byte, error) {
+	if passphrase, found := os.LookupEnv(PassphraseEnv); found {
+		return []byte(passphrase), nil
+	}
+	return PromptPassphrase(fmt.Sprintf("Enter passphrase for key '%s': ", keyFile))
+}
+
+// ask a passphrase on the terminal of the process (without echo)
+func PromptPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("passphrase required but no terminal available (set " + PassphraseEnv + ")")
+	}
+	defer tty.Close()
+
+	tty.WriteString(prompt)
+	setTerminalEcho(tty, false)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	setTerminalEcho(tty, true)
+	tty.WriteString("\n")
+	if err != nil {
+		return nil, errors.New("failed to read passphrase")
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func setTerminalEcho(tty *os.File, echo bool) {
+	mode := "-echo"
+	if echo {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = tty
+	cmd.Run()
+}
@@ -5,11 +5,11 @@
 package main
 
 import (
-	"crypto/rsa"
 	"crypto/tls"
 	"errors"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/songgao/water"
+	"os"
 	"quic_utils"
 	. "quic_vpn/internal"
 	"strconv"
@@ -64,20 +64,24 @@ func (c *ClientInstance) dial() error {
 
 	dialedAddress := c.vpnConfig.Server.Addr + ":" + strconv.Itoa(c.vpnConfig.Server.Port)
 
-	// extract keys
-	publicKey, err := quic_utils.ExtractPublicKey(c.vpnConfig.Client.Public)
-	if err != nil {
-		return err
-	}
+	// extract keys (no client certificate when the private key is held by an agent)
+	certificates := []tls.Certificate{}
+	if c.vpnConfig.Client.Private != "" {
+		publicKey, err := quic_utils.ExtractPublicKey(c.vpnConfig.Client.Public)
+		if err != nil {
+			return err
+		}
 
-	privateKey, err := quic_utils.ExtractPrivateKey(c.vpnConfig.Client.Private)
-	if err != nil {
-		return err
-	}
+		privateKey, err := quic_utils.ExtractPrivateKey(c.vpnConfig.Client.Private)
+		if err != nil {
+			return err
+		}
 
-	cert, err := quic_utils.MakeCertificate(publicKey, privateKey)
-	if err != nil {
-		return err
+		cert, err := quic_utils.MakeCertificate(publicKey, privateKey)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, cert)
 	}
 
 	// dial
@@ -85,7 +89,7 @@ func (c *ClientInstance) dial() error {
 		dialedAddress,
 		&tls.Config{
 			InsecureSkipVerify: true,
-			Certificates: []tls.Certificate{cert},
+			Certificates: certificates,
 		},
 		&quic.Config{
 			KeepAlive: true,
@@ -108,7 +112,7 @@ func (c *ClientInstance) authenticateServer() error {
 			return err
 		}
 
-		serverKey := c.session.ConnectionState().PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+		serverKey := c.session.ConnectionState().PeerCertificates[0].PublicKey
 
 		if !quic_utils.ComparePublicKeys(expectedKey, serverKey) {
 			err := errors.New("key verification failed")
@@ -119,16 +123,29 @@ func (c *ClientInstance) authenticateServer() error {
 		// serve client public key
 		clientPublicKey, err := quic_utils.ExtractPublicKey(c.vpnConfig.Client.Public)
 		quic_utils.Check(err)
-		clientPrivateKey, err := quic_utils.ExtractPrivateKey(c.vpnConfig.Client.Private)
-		quic_utils.Check(err)
-
-		quic_utils.ServeClientPublicKey(c.session, c.controlStream, clientPrivateKey, clientPublicKey)
+		signer, err := c.clientSigner()
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return quic_utils.ServeClientPublicKeyWithSigner(c.session, c.controlStream, signer, clientPublicKey)
 	}
 	return nil
 }
 
+// Signer of the client authentication: the private key of the configuration,
+// or the agent given by QUIC_SSH_AUTH_SOCK if no private key is configured
+func (c *ClientInstance) clientSigner() (quic_utils.Signer, error) {
+	if c.vpnConfig.Client.Private != "" {
+		clientPrivateKey, err := quic_utils.ExtractPrivateKey(c.vpnConfig.Client.Private)
+		if err != nil {
+			return nil, err
+		}
+		return quic_utils.PrivateKeySigner{Key: clientPrivateKey}, nil
+	}
+	return quic_utils.DialAgent(os.Getenv(quic_utils.AgentSocketEnv))
+}
+
 // Open a new control stream (to serve client key)
 func (c *ClientInstance) openControlStream() error {
 	if c.lastError != nil {
@@ -9,6 +9,7 @@ import (
 	"github.com/go-yaml/yaml"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 type VpnConfig struct {
@@ -30,6 +31,13 @@ type VpnConfig struct {
 		Check_key bool
 		Addr      string
 		Port      int
+
+		// admission of the clients (see quic_utils/admission.go), 0 for no limit
+		Max_startups      int           // clients not authenticated yet
+		Max_auth_failures int           // authentication failures of an address before it is banned
+		Ban_time          time.Duration // first ban of an address (1m by default), doubled at each new ban
+		Max_ban_time      time.Duration // longest ban of an address (24h by default)
+		Login_grace_time  time.Duration // time given to a client to authenticate
 	}
 }
 
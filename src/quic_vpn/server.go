@@ -19,6 +19,7 @@ type ServerInstance struct {
 	tunnelInterface *water.Interface
 	tlsConfig       *tls.Config
 	listener        quic.Listener
+	admission       *quic_utils.AdmissionControl
 }
 
 // Start a new program in server mode
@@ -31,6 +32,13 @@ func NewServerInstance(config *VpnConfig) (*ServerInstance, error) {
 	return &ServerInstance{
 		vpnConfig:       config,
 		tunnelInterface: iface,
+		admission: quic_utils.NewAdmissionControl(quic_utils.AdmissionConfig{
+			MaxUnauthenticated: config.Server.Max_startups,
+			MaxFailures:        config.Server.Max_auth_failures,
+			BanTime:            config.Server.Ban_time,
+			MaxBanTime:         config.Server.Max_ban_time,
+			AuthTimeout:        config.Server.Login_grace_time,
+		}),
 	}, nil
 }
 
@@ -53,8 +61,18 @@ func (s *ServerInstance) Run() error {
 			return err
 		}
 
+		// refuse the banned addresses and the clients over Max_startups before checking their key
+		admission, err := s.admission.Admit(session.RemoteAddr(), func() {
+			session.Close(errors.New("authentication timeout"))
+		})
+		if err != nil {
+			println("    client " + session.RemoteAddr().String() + " refused: " + err.Error())
+			session.Close(err)
+			continue
+		}
+
 		println("    new client")
-		cli := connectedClient{server: s, session: session, vpnConfig: s.vpnConfig}
+		cli := connectedClient{server: s, session: session, vpnConfig: s.vpnConfig, admission: admission}
 		go cli.Handle()
 	}
 
@@ -99,18 +117,22 @@ type connectedClient struct {
 	session       quic.Session
 	controlStream quic.Stream
 	vpnConfig     *VpnConfig
+	admission     *quic_utils.Admission
 }
 
 // Handle a new connected client (wait & serve)
 func (t *connectedClient) Handle() error {
 
 	if err := t.waitControlStream(); err != nil {
+		t.admission.Release()
 		return err
 	}
 
 	if err := t.checkAuthenticity(); err != nil {
+		t.admission.Failed()
 		return err
 	}
+	t.admission.Authenticated()
 
 	tr := NewTransmitter(t.vpnConfig, t.session, t.server.tunnelInterface)
 	return tr.WaitOutput()
@@ -134,7 +156,7 @@ func (t *connectedClient) checkAuthenticity() error {
 
 		clientKey, err := quic_utils.AskClientPublicKey(t.session, t.controlStream)
 
-		if err != nil && !quic_utils.ComparePublicKeys(expectedKey, clientKey) {
+		if err != nil || !quic_utils.ComparePublicKeys(expectedKey, clientKey) {
 			err := errors.New("server thread: expected key != received key")
 			t.session.Close(err)
 			return err